@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Version is the current version of the backup archive format.
+const Version byte = 1
+
+// magic identifies a backup archive.
+var magic = []byte("SIGNALBK")
+
+const saltLength = 16
+const noncePrefixLength = chacha20poly1305.NonceSizeX - 8
+
+// headerLength is the size of the magic, version, argon2 parameters, salt and
+// nonce prefix that start every archive. The header is authenticated with
+// every frame.
+//
+// Format: magic(8) | version(1) | time(4) | memory(4) | threads(1) | salt(16) | nonce prefix(16)
+var headerLength = len(magic) + 1 + 4 + 4 + 1 + saltLength + noncePrefixLength
+
+// maxFrameLength limits the size of a single encrypted frame, so a corrupted
+// length can't make us allocate an unbounded amount of memory.
+const maxFrameLength = 16 * 1024 * 1024
+
+// Entry types stored in the archive. The identity and registration ID always
+// come first and the archive always ends with an end entry, so truncation
+// can be detected.
+const (
+	entryIdentityKeyPair byte = 1
+	entryRegistrationID  byte = 2
+	entryPreKey          byte = 3
+	entrySignedPreKey    byte = 4
+	entrySession         byte = 5
+	entrySenderKey       byte = 6
+	entryTrustedIdentity byte = 7
+	entryEnd             byte = 0xFF
+)
+
+// Backup errors.
+var (
+	// ErrNotBackup indicates the data does not start with a backup archive header.
+	ErrNotBackup = errors.New("not a backup archive")
+
+	// ErrUnsupportedVersion indicates the archive was made with an unknown format version.
+	ErrUnsupportedVersion = errors.New("unsupported backup archive version")
+
+	// ErrBadPassphrase indicates the archive could not be decrypted with the given
+	// passphrase, or that it has been tampered with.
+	ErrBadPassphrase = errors.New("bad passphrase or corrupted backup archive")
+
+	// ErrTruncated indicates the archive ended before its end entry.
+	ErrTruncated = errors.New("backup archive is truncated")
+
+	// ErrTrailingData indicates the archive has data after its end entry.
+	ErrTrailingData = errors.New("backup archive has data after its end entry")
+
+	// ErrMalformedEntry indicates a decrypted entry could not be decoded.
+	ErrMalformedEntry = errors.New("malformed backup archive entry")
+)
+
+// newCipher derives the archive key from the given passphrase and returns the
+// authenticated cipher used to seal every frame.
+func newCipher(passphrase, salt []byte, params kdf.PassphraseParams) (cipher.AEAD, error) {
+	key, err := kdf.DerivePassphraseKey(passphrase, salt, params, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// frameCipher seals and opens the sequence of frames in an archive. Each frame
+// uses the archive's nonce prefix followed by its frame counter, so frames
+// can't be reordered, dropped or replayed without detection.
+type frameCipher struct {
+	aead        cipher.AEAD
+	header      []byte
+	noncePrefix []byte
+	counter     uint64
+}
+
+// nonce returns the nonce for the next frame and advances the counter.
+func (f *frameCipher) nonce() []byte {
+	nonce := make([]byte, 0, chacha20poly1305.NonceSizeX)
+	nonce = append(nonce, f.noncePrefix...)
+	nonce = binary.BigEndian.AppendUint64(nonce, f.counter)
+	f.counter++
+
+	return nonce
+}
+
+// writeFrame seals the given entry and writes it as a length-prefixed frame.
+func (f *frameCipher) writeFrame(w io.Writer, entry []byte) error {
+	sealed := f.aead.Seal(nil, f.nonce(), entry, f.header)
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	frame = append(frame, sealed...)
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readFrame reads the next length-prefixed frame and opens it.
+func (f *frameCipher) readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, ErrTruncated
+	}
+	frameLength := binary.BigEndian.Uint32(length[:])
+	if frameLength < chacha20poly1305.Overhead || frameLength > maxFrameLength {
+		return nil, ErrBadPassphrase
+	}
+
+	sealed := make([]byte, frameLength)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, ErrTruncated
+	}
+	entry, err := f.aead.Open(nil, f.nonce(), sealed, f.header)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return entry, nil
+}
+
+// newEntry builds an entry of the given type from the given fields. Every field
+// is prefixed with its length.
+func newEntry(entryType byte, fields ...[]byte) []byte {
+	entry := []byte{entryType}
+	for _, field := range fields {
+		entry = binary.BigEndian.AppendUint32(entry, uint32(len(field)))
+		entry = append(entry, field...)
+	}
+
+	return entry
+}
+
+// readEntry splits an entry into its type and its fields.
+func readEntry(entry []byte) (byte, [][]byte, error) {
+	if len(entry) < 1 {
+		return 0, nil, ErrMalformedEntry
+	}
+	entryType := entry[0]
+	entry = entry[1:]
+
+	var fields [][]byte
+	for len(entry) > 0 {
+		if len(entry) < 4 {
+			return 0, nil, ErrMalformedEntry
+		}
+		length := binary.BigEndian.Uint32(entry[:4])
+		entry = entry[4:]
+		if uint64(length) > uint64(len(entry)) {
+			return 0, nil, ErrMalformedEntry
+		}
+		fields = append(fields, entry[:length])
+		entry = entry[length:]
+	}
+
+	return entryType, fields, nil
+}
+
+// uint32Field encodes the given value as an entry field.
+func uint32Field(value uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, value)
+}
+
+// readUint32Field decodes an entry field written with uint32Field.
+func readUint32Field(field []byte) (uint32, error) {
+	if len(field) != 4 {
+		return 0, ErrMalformedEntry
+	}
+	return binary.BigEndian.Uint32(field), nil
+}
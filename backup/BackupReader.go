@@ -0,0 +1,299 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// NewReader reads the header, identity key pair and registration ID from the
+// given archive using the given passphrase and serializer. The identity and
+// registration ID are available before restoring, so that the destination
+// store can be built with them.
+func NewReader(r io.Reader, passphrase []byte, serializer *serialize.Serializer) (*Reader, error) {
+	return NewReaderWithLimit(r, passphrase, serializer, kdf.PassphraseParams{})
+}
+
+// NewReaderWithLimit reads the start of an archive like NewReader, but rejects
+// archives whose Argon2id parameters exceed the given limit. Use it to bound
+// the time and memory an untrusted archive can make us spend.
+func NewReaderWithLimit(r io.Reader, passphrase []byte, serializer *serialize.Serializer,
+	limit kdf.PassphraseParams) (*Reader, error) {
+
+	// Read and check our header.
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrNotBackup
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, ErrNotBackup
+	}
+	offset := len(magic)
+	if header[offset] != Version {
+		return nil, ErrUnsupportedVersion
+	}
+	offset++
+
+	// Read our KDF parameters, salt and nonce prefix from the header.
+	params := kdf.PassphraseParams{
+		Time:    binary.BigEndian.Uint32(header[offset : offset+4]),
+		Memory:  binary.BigEndian.Uint32(header[offset+4 : offset+8]),
+		Threads: header[offset+8],
+	}
+	offset += 9
+	if !params.Within(limit) {
+		return nil, kdf.ErrInvalidPassphraseParams
+	}
+	salt := header[offset : offset+saltLength]
+	noncePrefix := header[offset+saltLength:]
+
+	aead, err := newCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{
+		reader:     r,
+		serializer: serializer,
+		frames: &frameCipher{
+			aead:        aead,
+			header:      header,
+			noncePrefix: noncePrefix,
+		},
+	}
+
+	// Read our identity key pair and registration ID.
+	fields, err := reader.next(entryIdentityKeyPair, 1)
+	if err != nil {
+		return nil, err
+	}
+	reader.identityKeyPair, err = identity.NewKeyPairFromBytes(fields[0], serializer.IdentityKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	fields, err = reader.next(entryRegistrationID, 1)
+	if err != nil {
+		return nil, err
+	}
+	reader.registrationID, err = readUint32Field(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Reader is a structure for reading a backup archive and restoring it into
+// a store.
+type Reader struct {
+	reader     io.Reader
+	serializer *serialize.Serializer
+	frames     *frameCipher
+
+	identityKeyPair *identity.KeyPair
+	registrationID  uint32
+}
+
+// IdentityKeyPair returns the identity key pair stored in the archive.
+func (r *Reader) IdentityKeyPair() *identity.KeyPair {
+	return r.identityKeyPair
+}
+
+// RegistrationID returns the local registration ID stored in the archive.
+func (r *Reader) RegistrationID() uint32 {
+	return r.registrationID
+}
+
+// RestoreInto reads the remaining records in the archive and stores them in
+// the given store. The store should already use the archive's identity key
+// pair and registration ID. Records are only stored once the whole archive
+// has been read and verified. An error is returned if the archive is
+// truncated, has data after its end entry or has been tampered with, in
+// which case the store is left untouched.
+func (r *Reader) RestoreInto(signalStore store.SignalProtocol) error {
+	var staged []restoreFunc
+	for {
+		entry, err := r.frames.readFrame(r.reader)
+		if err != nil {
+			return err
+		}
+		entryType, fields, err := readEntry(entry)
+		if err != nil {
+			return err
+		}
+
+		var restore restoreFunc
+		switch entryType {
+		case entryPreKey:
+			restore, err = r.restorePreKey(fields)
+		case entrySignedPreKey:
+			restore, err = r.restoreSignedPreKey(fields)
+		case entrySession:
+			restore, err = r.restoreSession(fields)
+		case entrySenderKey:
+			restore, err = r.restoreSenderKey(fields)
+		case entryTrustedIdentity:
+			restore, err = r.restoreTrustedIdentity(fields)
+		case entryEnd:
+			if len(fields) != 0 {
+				return ErrMalformedEntry
+			}
+			if err := r.checkEnd(); err != nil {
+				return err
+			}
+			for _, restore := range staged {
+				restore(signalStore)
+			}
+			logger.Debug("Finished restoring backup archive.")
+			return nil
+		default:
+			err = ErrMalformedEntry
+		}
+		if err != nil {
+			return err
+		}
+		staged = append(staged, restore)
+	}
+}
+
+// restoreFunc stores a record that was read from an archive.
+type restoreFunc func(signalStore store.SignalProtocol)
+
+// checkEnd returns an error if any data follows the end entry.
+func (r *Reader) checkEnd() error {
+	_, err := io.ReadFull(r.reader, make([]byte, 1))
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return ErrTrailingData
+	default:
+		return err
+	}
+}
+
+// next reads the next entry, which must be of the given type and have the
+// given number of fields.
+func (r *Reader) next(entryType byte, count int) ([][]byte, error) {
+	entry, err := r.frames.readFrame(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	readType, fields, err := readEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if readType != entryType || len(fields) != count {
+		return nil, ErrMalformedEntry
+	}
+
+	return fields, nil
+}
+
+// restorePreKey returns a function that stores the prekey in the given
+// entry fields.
+func (r *Reader) restorePreKey(fields [][]byte) (restoreFunc, error) {
+	if len(fields) != 1 {
+		return nil, ErrMalformedEntry
+	}
+	preKey, err := record.NewPreKeyFromBytes(fields[0], r.serializer.PreKeyRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(signalStore store.SignalProtocol) {
+		signalStore.StorePreKey(preKey.ID().Value, preKey)
+	}, nil
+}
+
+// restoreSignedPreKey returns a function that stores the signed prekey in
+// the given entry fields.
+func (r *Reader) restoreSignedPreKey(fields [][]byte) (restoreFunc, error) {
+	if len(fields) != 1 {
+		return nil, ErrMalformedEntry
+	}
+	signedPreKey, err := record.NewSignedPreKeyFromBytes(fields[0], r.serializer.SignedPreKeyRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(signalStore store.SignalProtocol) {
+		signalStore.StoreSignedPreKey(signedPreKey.ID(), signedPreKey)
+	}, nil
+}
+
+// restoreSession returns a function that stores the session in the given
+// entry fields.
+func (r *Reader) restoreSession(fields [][]byte) (restoreFunc, error) {
+	if len(fields) != 3 {
+		return nil, ErrMalformedEntry
+	}
+	deviceID, err := readUint32Field(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	sessionRecord, err := record.NewSessionFromBytes(fields[2], r.serializer.Session, r.serializer.State)
+	if err != nil {
+		return nil, err
+	}
+	address := protocol.NewSignalAddress(string(fields[0]), deviceID)
+
+	return func(signalStore store.SignalProtocol) {
+		signalStore.StoreSession(address, sessionRecord)
+	}, nil
+}
+
+// restoreSenderKey returns a function that stores the sender key in the
+// given entry fields.
+func (r *Reader) restoreSenderKey(fields [][]byte) (restoreFunc, error) {
+	if len(fields) != 4 {
+		return nil, ErrMalformedEntry
+	}
+	deviceID, err := readUint32Field(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	senderKeyRecord, err := groupRecord.NewSenderKeyFromBytes(fields[3], r.serializer.SenderKeyRecord, r.serializer.SenderKeyState)
+	if err != nil {
+		return nil, err
+	}
+	sender := protocol.NewSignalAddress(string(fields[1]), deviceID)
+	senderKeyName := protocol.NewSenderKeyName(string(fields[0]), sender)
+
+	return func(signalStore store.SignalProtocol) {
+		signalStore.StoreSenderKey(senderKeyName, senderKeyRecord)
+	}, nil
+}
+
+// restoreTrustedIdentity returns a function that saves the remote identity
+// in the given entry fields.
+func (r *Reader) restoreTrustedIdentity(fields [][]byte) (restoreFunc, error) {
+	if len(fields) != 3 {
+		return nil, ErrMalformedEntry
+	}
+	deviceID, err := readUint32Field(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields[2]) != ecc.KeySize {
+		return nil, ErrMalformedEntry
+	}
+	identityKey, err := ecc.DecodePoint(fields[2], 0)
+	if err != nil {
+		return nil, err
+	}
+	address := protocol.NewSignalAddress(string(fields[0]), deviceID)
+
+	return func(signalStore store.SignalProtocol) {
+		signalStore.SaveIdentity(address, identity.NewKey(identityKey))
+	}, nil
+}
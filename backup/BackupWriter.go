@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// DefaultParams are the Argon2id parameters used by Write.
+var DefaultParams = kdf.DefaultPassphraseParams
+
+// Write streams every record in the given store into an encrypted archive,
+// using a key derived from the given passphrase. Records are encoded with the
+// given serializer, which must also be used to read the archive.
+func Write(w io.Writer, signalStore store.EnumerableSignalProtocol, passphrase []byte,
+	serializer *serialize.Serializer) error {
+
+	return WriteWithParams(w, signalStore, passphrase, serializer, DefaultParams)
+}
+
+// WriteWithParams streams every record in the given store into an encrypted
+// archive using the given Argon2id parameters. The parameters are stored in
+// the archive header.
+func WriteWithParams(w io.Writer, signalStore store.EnumerableSignalProtocol, passphrase []byte,
+	serializer *serialize.Serializer, params kdf.PassphraseParams) error {
+
+	if !params.Valid() {
+		return kdf.ErrInvalidPassphraseParams
+	}
+
+	// Build our header with random salt and nonce prefix.
+	header := make([]byte, 0, headerLength)
+	header = append(header, magic...)
+	header = append(header, Version)
+	header = binary.BigEndian.AppendUint32(header, params.Time)
+	header = binary.BigEndian.AppendUint32(header, params.Memory)
+	header = append(header, params.Threads)
+	random := make([]byte, saltLength+noncePrefixLength)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return err
+	}
+	header = append(header, random...)
+
+	aead, err := newCipher(passphrase, random[:saltLength], params)
+	if err != nil {
+		return err
+	}
+	frames := &frameCipher{
+		aead:        aead,
+		header:      header,
+		noncePrefix: random[saltLength:],
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Every entry is sealed and written as soon as it is built.
+	write := func(entry []byte) error {
+		return frames.writeFrame(w, entry)
+	}
+
+	// Write our local identity first, so it can be read before restoring.
+	logger.Debug("Writing identity to backup archive...")
+	identityKeyPair := signalStore.GetIdentityKeyPair()
+	if err := write(newEntry(entryIdentityKeyPair, identityKeyPair.Serialize(serializer.IdentityKeyPair))); err != nil {
+		return err
+	}
+	if err := write(newEntry(entryRegistrationID, uint32Field(signalStore.GetLocalRegistrationId()))); err != nil {
+		return err
+	}
+
+	// Write all of our prekeys and signed prekeys.
+	logger.Debug("Writing prekeys to backup archive...")
+	for _, preKey := range signalStore.LoadPreKeys() {
+		if err := write(newEntry(entryPreKey, preKey.Serialize())); err != nil {
+			return err
+		}
+	}
+	for _, signedPreKey := range signalStore.LoadSignedPreKeys() {
+		if err := write(newEntry(entrySignedPreKey, signedPreKey.Serialize())); err != nil {
+			return err
+		}
+	}
+
+	// Write all of our sessions along with their addresses.
+	logger.Debug("Writing sessions to backup archive...")
+	for _, address := range signalStore.LoadSessionAddresses() {
+		sessionRecord := signalStore.LoadSession(address)
+		entry := newEntry(entrySession, []byte(address.Name()), uint32Field(address.DeviceID()), sessionRecord.Serialize())
+		if err := write(entry); err != nil {
+			return err
+		}
+	}
+
+	// Write all of our sender keys along with their names.
+	logger.Debug("Writing sender keys to backup archive...")
+	for _, senderKeyName := range signalStore.LoadSenderKeyNames() {
+		senderKeyRecord := signalStore.LoadSenderKey(senderKeyName)
+		if senderKeyRecord == nil {
+			continue
+		}
+		sender := senderKeyName.Sender()
+		entry := newEntry(entrySenderKey, []byte(senderKeyName.GroupID()), []byte(sender.Name()),
+			uint32Field(sender.DeviceID()), senderKeyRecord.Serialize())
+		if err := write(entry); err != nil {
+			return err
+		}
+	}
+
+	// Write all of our trusted remote identities.
+	logger.Debug("Writing trusted identities to backup archive...")
+	for _, address := range signalStore.LoadIdentityAddresses() {
+		identityKey := signalStore.LoadIdentity(address)
+		if identityKey == nil {
+			continue
+		}
+		entry := newEntry(entryTrustedIdentity, []byte(address.Name()), uint32Field(address.DeviceID()), identityKey.Serialize())
+		if err := write(entry); err != nil {
+			return err
+		}
+	}
+
+	// Mark the end of the archive, so truncation can be detected on restore.
+	return write(newEntry(entryEnd))
+}
@@ -0,0 +1,9 @@
+// Package backup provides an encrypted, integrity-protected archive of a
+// complete Signal Protocol store, so that an account can be restored after a
+// device is reinstalled.
+//
+// The archive holds the identity key pair, registration ID, prekeys, signed
+// prekeys, sessions, sender keys and trusted identities. It is encrypted with
+// a key derived from a passphrase and is written and read as a stream, so the
+// whole store never has to be held in memory at once.
+package backup
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"errors"
 )
 
@@ -47,6 +48,71 @@ func Encrypt(iv, key, plaintext []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
+// EncryptCTR will use the given iv, key, and plaintext bytes and return
+// ciphertext bytes using AES in counter mode. Counter mode needs no padding,
+// and decryption is the same operation as encryption.
+func EncryptCTR(iv, key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid iv length")
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	return ciphertext, nil
+}
+
+// DecryptCTR will use the given key, iv, and ciphertext and return the
+// plaintext bytes using AES in counter mode.
+func DecryptCTR(iv, key, ciphertext []byte) ([]byte, error) {
+	return EncryptCTR(iv, key, ciphertext)
+}
+
+// EncryptGCM will use the given key and plaintext bytes and return the
+// ciphertext sealed with AES in GCM mode. A random nonce is generated and
+// prepended to the ciphertext.
+func EncryptGCM(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// DecryptGCM will use the given key to open ciphertext created by EncryptGCM.
+// An error is returned if the ciphertext was not sealed with the given key.
+func DecryptGCM(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// GCMOverhead is the number of bytes EncryptGCM adds to the plaintext.
+const GCMOverhead = 12 + 16
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // PKCS7 padding.
 
 // PKCS7 errors.
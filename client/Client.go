@@ -0,0 +1,240 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+const unsupportedMessageError string = "Unsupported message type: "
+const noGroupError string = "Envelope has no group ID."
+
+// New returns a new client with the given local address, which keeps its
+// keys, sessions and sender keys in the given store.
+func New(signalStore store.SignalProtocol, address *protocol.SignalAddress, options Options) *Client {
+	if options.Serializer == nil {
+		options.Serializer = serialize.NewJSONSerializer()
+	}
+
+	groupBuilder := groups.NewGroupSessionBuilder(signalStore, options.Serializer)
+	groupBuilder.SetPendingBuffer(options.PendingBuffer)
+	if options.Observer != nil {
+		groupBuilder.SetObserver(options.Observer)
+	}
+
+	return &Client{
+		signalStore:  signalStore,
+		address:      address,
+		options:      options,
+		groupBuilder: groupBuilder,
+		builders:     make(map[protocol.SignalAddress]*session.Builder),
+		ciphers:      make(map[protocol.SignalAddress]*session.Cipher),
+		groupCiphers: make(map[groupSender]*groups.GroupCipher),
+	}
+}
+
+// Client encrypts and decrypts messages for a local Signal client. Calls for
+// the same remote address or group must not run concurrently, just like the
+// cipher calls they make.
+type Client struct {
+	signalStore  store.SignalProtocol
+	address      *protocol.SignalAddress
+	options      Options
+	groupBuilder *groups.SessionBuilder
+
+	mutex        sync.Mutex
+	builders     map[protocol.SignalAddress]*session.Builder
+	ciphers      map[protocol.SignalAddress]*session.Cipher
+	groupCiphers map[groupSender]*groups.GroupCipher
+}
+
+// groupSender identifies the sender key of a sender in a group.
+type groupSender struct {
+	groupID string
+	sender  protocol.SignalAddress
+}
+
+// Address returns the client's local address.
+func (c *Client) Address() *protocol.SignalAddress {
+	return c.address
+}
+
+// Serializer returns the serializer the client uses.
+func (c *Client) Serializer() *serialize.Serializer {
+	return c.options.Serializer
+}
+
+// HasSession returns true if the client has a session with the given
+// address.
+func (c *Client) HasSession(address *protocol.SignalAddress) bool {
+	return c.signalStore.ContainsSession(address)
+}
+
+// StartSession builds a session with the device of the given user from the
+// device's prekey bundle.
+func (c *Client) StartSession(name string, bundle *prekey.Bundle) error {
+	builder, _ := c.session(protocol.NewSignalAddress(name, bundle.DeviceID()))
+
+	return builder.ProcessBundle(bundle)
+}
+
+// Encrypt encrypts the given plaintext for the given address. A session
+// must have been started, or built from a message of the remote client.
+func (c *Client) Encrypt(address *protocol.SignalAddress, plaintext []byte) (*Envelope, error) {
+	_, cipher := c.session(address)
+	message, err := cipher.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEnvelope(c.address, "", message), nil
+}
+
+// Decrypt decrypts the given envelope. A PreKeySignalMessage builds the
+// session with its sender first. Group messages are decrypted with
+// GroupDecrypt.
+func (c *Client) Decrypt(envelope *Envelope) ([]byte, error) {
+	if envelope.GroupID != "" || envelope.Type == protocol.SENDERKEY_TYPE {
+		return c.GroupDecrypt(envelope)
+	}
+
+	serializer := c.options.Serializer
+	builder, cipher := c.session(envelope.Sender)
+	switch envelope.Type {
+	case protocol.PREKEY_TYPE:
+		message, err := protocol.NewPreKeySignalMessageFromBytes(envelope.Content,
+			serializer.PreKeySignalMessage, serializer.SignalMessage)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := builder.Process(message); err != nil {
+			return nil, err
+		}
+		if !message.IsHeaderEncrypted() {
+			return cipher.Decrypt(message.WhisperMessage())
+		}
+		headerEncrypted, err := protocol.NewHeaderEncryptedMessageFromBytes(message.HeaderEncryptedMessage(),
+			serializer.HeaderEncryptedMessage)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.DecryptHeaderEncrypted(headerEncrypted)
+
+	case protocol.WHISPER_TYPE:
+		message, err := protocol.NewSignalMessageFromBytes(envelope.Content, serializer.SignalMessage)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.Decrypt(message)
+
+	case protocol.HEADER_ENCRYPTED_TYPE:
+		message, err := protocol.NewHeaderEncryptedMessageFromBytes(envelope.Content, serializer.HeaderEncryptedMessage)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.DecryptHeaderEncrypted(message)
+	}
+
+	return nil, errors.New(unsupportedMessageError + strconv.FormatUint(uint64(envelope.Type), 10))
+}
+
+// CreateGroupSession creates our sender key for the given group, if it
+// doesn't exist yet, and returns the serialized SenderKeyDistributionMessage.
+// Send it to every group member with Encrypt, so they can decrypt our group
+// messages.
+func (c *Client) CreateGroupSession(groupID string) ([]byte, error) {
+	distribution, err := c.groupBuilder.Create(protocol.NewSenderKeyName(groupID, c.address))
+	if err != nil {
+		return nil, err
+	}
+
+	return distribution.Serialize(), nil
+}
+
+// ProcessGroupSession processes a serialized SenderKeyDistributionMessage
+// that the given sender sent for the given group.
+func (c *Client) ProcessGroupSession(groupID string, sender *protocol.SignalAddress, distribution []byte) error {
+	message, err := protocol.NewSenderKeyDistributionMessageFromBytes(distribution,
+		c.options.Serializer.SenderKeyDistributionMessage)
+	if err != nil {
+		return err
+	}
+	c.groupBuilder.Process(protocol.NewSenderKeyName(groupID, sender), message)
+
+	return nil
+}
+
+// GroupEncrypt encrypts the given plaintext for the given group with our
+// sender key. The group session must have been created first.
+func (c *Client) GroupEncrypt(groupID string, plaintext []byte) (*Envelope, error) {
+	message, err := c.groupCipher(groupID, c.address).Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEnvelope(c.address, groupID, message), nil
+}
+
+// GroupDecrypt decrypts the given group message envelope with the sender's
+// sender key.
+func (c *Client) GroupDecrypt(envelope *Envelope) ([]byte, error) {
+	if envelope.GroupID == "" {
+		return nil, errors.New(noGroupError)
+	}
+	message, err := protocol.NewSenderKeyMessageFromBytes(envelope.Content, c.options.Serializer.SenderKeyMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.groupCipher(envelope.GroupID, envelope.Sender).Decrypt(message)
+}
+
+// session returns the cached session builder and cipher for the given
+// address, creating them if needed.
+func (c *Client) session(address *protocol.SignalAddress) (*session.Builder, *session.Cipher) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if builder, ok := c.builders[*address]; ok {
+		return builder, c.ciphers[*address]
+	}
+
+	// Copy the address, so the cached builder doesn't share the caller's.
+	remoteAddress := protocol.NewSignalAddress(address.Name(), address.DeviceID())
+	builder := session.NewBuilderFromSignal(c.signalStore, remoteAddress, c.options.Serializer)
+	builder.SetHeaderEncryption(c.options.HeaderEncryption)
+	builder.SetPendingBuffer(c.options.PendingBuffer)
+	builder.SetEventBus(c.options.EventBus)
+	if c.options.Observer != nil {
+		builder.SetObserver(c.options.Observer)
+	}
+	cipher := session.NewCipher(builder, remoteAddress)
+
+	c.builders[*address] = builder
+	c.ciphers[*address] = cipher
+	return builder, cipher
+}
+
+// groupCipher returns the cached group cipher for the given sender in the
+// given group, creating it if needed.
+func (c *Client) groupCipher(groupID string, sender *protocol.SignalAddress) *groups.GroupCipher {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := groupSender{groupID: groupID, sender: *sender}
+	if cipher, ok := c.groupCiphers[key]; ok {
+		return cipher
+	}
+
+	senderKeyName := protocol.NewSenderKeyName(groupID, protocol.NewSignalAddress(sender.Name(), sender.DeviceID()))
+	cipher := groups.NewGroupCipher(c.groupBuilder, senderKeyName, c.signalStore)
+	c.groupCiphers[key] = cipher
+	return cipher
+}
@@ -0,0 +1,9 @@
+// Package client provides a high level Client that bundles the stores,
+// builders and ciphers needed to talk to other Signal clients.
+//
+// A Client is created from a single store.SignalProtocol. It builds sessions
+// from prekey bundles, encrypts and decrypts one-to-one and group messages
+// as Envelopes, and caches a session builder and cipher per remote address
+// and a group cipher per group sender, so they don't have to be wired by
+// hand.
+package client
@@ -0,0 +1,37 @@
+package client
+
+import "github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+
+// Envelope is an encrypted message with the information needed to decrypt
+// it. Its fields are sent to the recipient along with the content.
+type Envelope struct {
+	// Sender is the address of the client that encrypted the message.
+	Sender *protocol.SignalAddress
+
+	// GroupID is the group of a group message, or empty for a one-to-one
+	// message.
+	GroupID string
+
+	// Type is the type of the encrypted message, such as
+	// protocol.PREKEY_TYPE or protocol.SENDERKEY_TYPE.
+	Type uint32
+
+	// Content is the serialized encrypted message.
+	Content []byte
+}
+
+// newEnvelope returns an envelope holding the given message. Sender key
+// messages are serialized with their signature.
+func newEnvelope(sender *protocol.SignalAddress, groupID string, message protocol.CiphertextMessage) *Envelope {
+	content := message.Serialize()
+	if senderKeyMessage, ok := message.(*protocol.SenderKeyMessage); ok {
+		content = senderKeyMessage.SignedSerialize()
+	}
+
+	return &Envelope{
+		Sender:  sender,
+		GroupID: groupID,
+		Type:    message.Type(),
+		Content: content,
+	}
+}
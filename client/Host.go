@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+const noAccountError string = "No such account: "
+const accountAddressError string = "Account is open with another address: "
+
+// NewHost returns a new host for the accounts of the given backend. The
+// options function returns the options of each account's client, and may be
+// nil to use the defaults. Give each account its own pending buffer and
+// event bus, since they are keyed by remote address only.
+func NewHost(accounts store.Accounts, options func(accountID string) Options) *Host {
+	return &Host{
+		accounts: accounts,
+		options:  options,
+		clients:  make(map[string]*Client),
+	}
+}
+
+// Host keeps a Client for every open local account of a store.Accounts
+// backend, so one process can send and receive as many identities. It is
+// safe for concurrent use.
+type Host struct {
+	accounts store.Accounts
+	options  func(accountID string) Options
+
+	mutex   sync.Mutex
+	clients map[string]*Client
+}
+
+// Open returns the client of the given local account, which has the given
+// local address. The client is created the first time the account is
+// opened.
+func (h *Host) Open(accountID string, address *protocol.SignalAddress) (*Client, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if client, ok := h.clients[accountID]; ok {
+		if !client.Address().Equal(address) {
+			return nil, errors.New(accountAddressError + accountID)
+		}
+		return client, nil
+	}
+
+	signalStore := h.accounts.Account(accountID)
+	if signalStore == nil {
+		return nil, errors.New(noAccountError + accountID)
+	}
+	var options Options
+	if h.options != nil {
+		options = h.options(accountID)
+	}
+	client := New(signalStore, address, options)
+	h.clients[accountID] = client
+
+	return client, nil
+}
+
+// Client returns the client of the given account, or nil if the account is
+// not open.
+func (h *Host) Client(accountID string) *Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.clients[accountID]
+}
+
+// Close forgets the client of the given account. Everything stored for the
+// account stays in the backend, and it can be opened again.
+func (h *Host) Close(accountID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.clients, accountID)
+}
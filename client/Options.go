@@ -0,0 +1,31 @@
+package client
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/events"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+)
+
+// Options configure a Client. The zero value uses the JSON serializer and
+// the library defaults.
+type Options struct {
+	// Serializer encodes messages and records. It defaults to
+	// serialize.NewJSONSerializer and must match the remote clients'.
+	Serializer *serialize.Serializer
+
+	// HeaderEncryption builds header encrypted sessions from bundles, and
+	// accepts header encrypted sessions from remote clients.
+	HeaderEncryption bool
+
+	// PendingBuffer holds messages that arrive before their session or
+	// sender key, see session.Builder.SetPendingBuffer.
+	PendingBuffer *pending.Buffer
+
+	// Observer receives metrics and traces. It defaults to the shared
+	// observer.
+	Observer observer.Observer
+
+	// EventBus receives session lifecycle events.
+	EventBus *events.Bus
+}
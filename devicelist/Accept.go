@@ -0,0 +1,52 @@
+package devicelist
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+)
+
+// ErrRollback is returned when a device list is older than the user's
+// accepted list, or has the same version with different contents.
+var ErrRollback = errors.New("Device list version is not newer than the accepted list!")
+
+// ErrRevokedDevice is returned when a device list doesn't keep a revocation
+// of the user's accepted list.
+var ErrRevokedDevice = errors.New("Device list restores a revoked device!")
+
+// Store is an interface for storing the accepted device lists of remote
+// users. LoadDeviceList must return nil if there is no list for the user.
+type Store interface {
+	LoadDeviceList(name string) *List
+	StoreDeviceList(name string, list *List)
+}
+
+// Accept verifies the given device list of the given user with the user's
+// identity key, and stores it as the user's accepted list. The list must be
+// newer than the accepted list and keep all of its revocations. Lists signed
+// by an earlier identity key of the user, from before they reinstalled, don't
+// constrain the lists of the new identity.
+func Accept(listStore Store, name string, identityKey *identity.Key, list *List) error {
+	if err := list.Verify(identityKey); err != nil {
+		return err
+	}
+
+	accepted := listStore.LoadDeviceList(name)
+	if accepted != nil && accepted.Verify(identityKey) == nil {
+		if list.version == accepted.version && bytes.Equal(list.signedBytes(), accepted.signedBytes()) {
+			return nil
+		}
+		if list.version <= accepted.version {
+			return ErrRollback
+		}
+		for _, deviceID := range accepted.revoked {
+			if !list.IsRevoked(deviceID) {
+				return ErrRevokedDevice
+			}
+		}
+	}
+
+	listStore.StoreDeviceList(name, list)
+	return nil
+}
@@ -0,0 +1,239 @@
+package devicelist
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// signaturePrefix separates device list signatures from every other
+// signature made with the identity key.
+var signaturePrefix = []byte("Signal_DeviceList")
+
+const duplicateDeviceError string = "Device is listed twice: "
+const listedRevokedDeviceError string = "Device is both listed and revoked: "
+
+// ErrInvalidSignature is returned when a device list is not signed by the
+// identity key it is verified with.
+var ErrInvalidSignature = errors.New("Invalid device list signature!")
+
+// ListSerializer is an interface for serializing and deserializing device
+// lists into bytes. An implementation of this interface should be used to
+// encode/decode the object into JSON, Protobuffers, etc.
+type ListSerializer interface {
+	Serialize(list *ListStructure) []byte
+	Deserialize(serialized []byte) (*ListStructure, error)
+}
+
+// Device is a device of a user, identified by its device ID and the
+// registration ID it was installed with.
+type Device struct {
+	DeviceID       uint32
+	RegistrationID uint32
+}
+
+// NewList returns a new device list with the given version, devices and
+// revoked device IDs, signed with the given identity key pair.
+func NewList(identityKeyPair *identity.KeyPair, version uint32, devices []Device, revoked []uint32) (*List, error) {
+	list := &List{
+		version: version,
+		devices: append([]Device{}, devices...),
+		revoked: append([]uint32{}, revoked...),
+	}
+	if err := list.normalize(); err != nil {
+		return nil, err
+	}
+	list.signature = ecc.CalculateSignature(identityKeyPair.PrivateKey(), list.signedBytes())
+
+	return list, nil
+}
+
+// NewListFromBytes returns a device list from the given bytes using the
+// given serializer. The list's signature is not verified.
+func NewListFromBytes(serialized []byte, serializer ListSerializer) (*List, error) {
+	structure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListFromStruct(structure)
+}
+
+// NewListFromStruct returns a device list from the given structure. The
+// list's signature is not verified.
+func NewListFromStruct(structure *ListStructure) (*List, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("DeviceList", "Structure", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckLength("DeviceList", "Signature", structure.Signature, 64); err != nil {
+		return nil, err
+	}
+
+	list := &List{
+		version:   structure.Version,
+		devices:   make([]Device, len(structure.Devices)),
+		revoked:   append([]uint32{}, structure.Revoked...),
+		signature: bytehelper.SliceToArray64(structure.Signature),
+	}
+	for i, device := range structure.Devices {
+		list.devices[i] = Device{DeviceID: device.DeviceID, RegistrationID: device.RegistrationID}
+	}
+	if err := list.normalize(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ListStructure is a serializable structure for device lists.
+type ListStructure struct {
+	Version   uint32
+	Devices   []DeviceStructure
+	Revoked   []uint32
+	Signature []byte
+}
+
+// DeviceStructure is a serializable structure for a device in a list.
+type DeviceStructure struct {
+	DeviceID       uint32
+	RegistrationID uint32
+}
+
+// List is a signed, versioned list of a user's devices.
+type List struct {
+	version   uint32
+	devices   []Device
+	revoked   []uint32
+	signature [64]byte
+}
+
+// Version returns the list's version. Every new list of a user must have a
+// higher version than the last.
+func (l *List) Version() uint32 {
+	return l.version
+}
+
+// Devices returns the listed devices, ordered by device ID.
+func (l *List) Devices() []Device {
+	return append([]Device{}, l.devices...)
+}
+
+// DeviceIDs returns the IDs of the listed devices, in order.
+func (l *List) DeviceIDs() []uint32 {
+	deviceIDs := make([]uint32, len(l.devices))
+	for i, device := range l.devices {
+		deviceIDs[i] = device.DeviceID
+	}
+	return deviceIDs
+}
+
+// Revoked returns the IDs of revoked devices, in order.
+func (l *List) Revoked() []uint32 {
+	return append([]uint32{}, l.revoked...)
+}
+
+// Signature returns the list's signature.
+func (l *List) Signature() [64]byte {
+	return l.signature
+}
+
+// Contains returns true if the given device is listed with the given
+// registration ID.
+func (l *List) Contains(deviceID, registrationID uint32) bool {
+	for _, device := range l.devices {
+		if device.DeviceID == deviceID {
+			return device.RegistrationID == registrationID
+		}
+	}
+	return false
+}
+
+// IsRevoked returns true if the given device ID has been revoked.
+func (l *List) IsRevoked(deviceID uint32) bool {
+	index := sort.Search(len(l.revoked), func(i int) bool { return l.revoked[i] >= deviceID })
+	return index < len(l.revoked) && l.revoked[index] == deviceID
+}
+
+// Next returns the next version of the list with the given devices, signed
+// with the given identity key pair. Devices revoked in this list stay
+// revoked, and the given device IDs are revoked as well.
+func (l *List) Next(identityKeyPair *identity.KeyPair, devices []Device, revoked ...uint32) (*List, error) {
+	return NewList(identityKeyPair, l.version+1, devices, append(l.Revoked(), revoked...))
+}
+
+// Verify returns an error if the list is not signed by the given identity
+// key.
+func (l *List) Verify(identityKey *identity.Key) error {
+	if !ecc.VerifySignature(identityKey.PublicKey(), l.signedBytes(), l.signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Serialize returns the list as bytes using the given serializer.
+func (l *List) Serialize(serializer ListSerializer) []byte {
+	structure := &ListStructure{
+		Version:   l.version,
+		Devices:   make([]DeviceStructure, len(l.devices)),
+		Revoked:   l.Revoked(),
+		Signature: bytehelper.ArrayToSlice64(l.signature),
+	}
+	for i, device := range l.devices {
+		structure.Devices[i] = DeviceStructure{DeviceID: device.DeviceID, RegistrationID: device.RegistrationID}
+	}
+
+	return serializer.Serialize(structure)
+}
+
+// normalize sorts the devices and revoked device IDs, so the signed bytes
+// don't depend on their order, and checks that no device is listed twice or
+// both listed and revoked.
+func (l *List) normalize() error {
+	sort.Slice(l.devices, func(i, j int) bool { return l.devices[i].DeviceID < l.devices[j].DeviceID })
+	sort.Slice(l.revoked, func(i, j int) bool { return l.revoked[i] < l.revoked[j] })
+
+	// Revoking a device twice is harmless, so duplicates are dropped.
+	revoked := l.revoked[:0]
+	for i, deviceID := range l.revoked {
+		if i == 0 || deviceID != l.revoked[i-1] {
+			revoked = append(revoked, deviceID)
+		}
+	}
+	l.revoked = revoked
+
+	for i, device := range l.devices {
+		if i > 0 && device.DeviceID == l.devices[i-1].DeviceID {
+			return errors.New(duplicateDeviceError + strconv.FormatUint(uint64(device.DeviceID), 10))
+		}
+		if l.IsRevoked(device.DeviceID) {
+			return errors.New(listedRevokedDeviceError + strconv.FormatUint(uint64(device.DeviceID), 10))
+		}
+	}
+
+	return nil
+}
+
+// signedBytes returns the canonical encoding of the list that is signed.
+//
+// Format: prefix | version(4) | count(4) | (device ID(4) | registration ID(4))... | count(4) | revoked ID(4)...
+func (l *List) signedBytes() []byte {
+	signed := append([]byte{}, signaturePrefix...)
+	signed = binary.BigEndian.AppendUint32(signed, l.version)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(len(l.devices)))
+	for _, device := range l.devices {
+		signed = binary.BigEndian.AppendUint32(signed, device.DeviceID)
+		signed = binary.BigEndian.AppendUint32(signed, device.RegistrationID)
+	}
+	signed = binary.BigEndian.AppendUint32(signed, uint32(len(l.revoked)))
+	for _, deviceID := range l.revoked {
+		signed = binary.BigEndian.AppendUint32(signed, deviceID)
+	}
+
+	return signed
+}
@@ -0,0 +1,10 @@
+// Package devicelist provides device lists signed with a user's identity key,
+// so peers can tell which devices really belong to the user.
+//
+// A List holds the device and registration IDs of every device of a user,
+// the IDs of revoked devices, and a version. The user signs each new version
+// with their identity key pair. Accept verifies a list against the user's
+// identity key, and only stores it if its version is newer than the stored
+// list's and it keeps every earlier revocation, so a server can't roll a
+// user back to an older list or bring a revoked device back.
+package devicelist
@@ -2,11 +2,11 @@ package ecc
 
 import (
 	"crypto/rand"
-	"errors"
 	"io"
 
 	"github.com/RadicalApp/complete"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -16,16 +16,23 @@ const DjbType = 0x05
 // DecodePoint will take the given bytes and offset and return an ECPublicKeyable object.
 // This is used to check the byte at the given offset in the byte array for a special
 // "type" byte that will determine the key type. Currently only DJB EC keys are supported.
+// A DecodeError is returned if the bytes are too short or the key type is unknown.
 func DecodePoint(bytes []byte, offset int) (ECPublicKeyable, error) {
+	if offset < 0 || len(bytes) <= offset {
+		return nil, errorhelper.NewDecodeError("ECPublicKey", "Type", errorhelper.ErrMissingField)
+	}
 	keyType := bytes[offset] & 0xFF
 
 	switch keyType {
 	case DjbType:
+		if len(bytes)-offset-1 < 32 {
+			return nil, errorhelper.NewDecodeError("ECPublicKey", "Key", errorhelper.ErrInvalidLength)
+		}
 		keyBytes := [32]byte{}
-		copy(keyBytes[:], bytes[offset+1:])
+		copy(keyBytes[:], bytes[offset+1:offset+33])
 		return NewDjbECPublicKey(keyBytes), nil
 	default:
-		return nil, errors.New("Bad key type: " + string(keyType))
+		return nil, errorhelper.NewDecodeError("ECPublicKey", "Type", errorhelper.ErrInvalidKeyType)
 	}
 }
 
@@ -4,9 +4,11 @@ package ecc
 // See https://moderncrypto.org/mail-archive/curves/2014/000205.html for details.
 
 import (
+	"crypto/ed25519"
 	"crypto/sha512"
 
 	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
 )
 
 // sign signs the message with privateKey and returns a signature as a byte slice.
@@ -67,40 +69,35 @@ func sign(privateKey *[32]byte, message []byte, random [64]byte) *[64]byte {
 func verify(publicKey [32]byte, message []byte, signature *[64]byte) bool {
 	publicKey[31] &= 0x7F
 
-	// Load the public key into a Point object
-	A, err := new(edwards25519.Point).SetBytes(publicKey[:])
-	if err != nil {
-		return false
-	}
+	/* Convert the Curve25519 public key into an Ed25519 public key. In
+	particular, convert Curve25519's "montgomery" x-coordinate into an
+	Ed25519 "edwards" y-coordinate:
 
-	// Split the signature into R and S
-	R := new(edwards25519.Point)
-	_, err = R.SetBytes(signature[:32])
-	if err != nil {
-		return false
-	}
+	ed_y = (mont_x - 1) / (mont_x + 1)
+
+	NOTE: mont_x=-1 is converted to ed_y=0 since Invert is mod-exp
 
-	// Create a scalar from the last 32 bytes of the signature
-	s := new(edwards25519.Scalar)
-	_, err = s.SetCanonicalBytes(signature[32:])
+	Then move the sign bit into the pubkey from the signature.
+	*/
+	montX, err := new(field.Element).SetBytes(publicKey[:])
 	if err != nil {
 		return false
 	}
+	one := new(field.Element).One()
+	montXMinusOne := new(field.Element).Subtract(montX, one)
+	montXPlusOne := new(field.Element).Add(montX, one)
+	montXPlusOne.Invert(montXPlusOne)
+	edY := new(field.Element).Multiply(montXMinusOne, montXPlusOne)
 
-	// s := new(edwards25519.Scalar).SetBytes(signature[32:])
+	var aEd [32]byte
+	copy(aEd[:], edY.Bytes())
+	aEd[31] |= signature[63] & 0x80
 
-	// Calculate h = SHA512(R || A_ed || msg)
-	hash := sha512.New()
-	hash.Write(signature[:32])
-	hash.Write(publicKey[:])
-	hash.Write(message)
-	var hramDigest [64]byte
-	hash.Sum(hramDigest[:0])
-	hramScalar, _ := edwards25519.NewScalar().SetUniformBytes(hramDigest[:])
+	var sig [64]byte
+	copy(sig[:], signature[:])
+	sig[63] &= 0x7F
 
-	// Check if S * B == R + h * A
-	check := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(hramScalar, A, s)
-	return check.Equal(R) == 1
+	return ed25519.Verify(aEd[:], message, sig[:])
 }
 
 // func main() {
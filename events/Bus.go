@@ -0,0 +1,153 @@
+package events
+
+import "sync"
+
+// Handler is called with every event published to the bus.
+type Handler func(event Event)
+
+// NewBus returns a new event bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Bus passes published events to its subscribers. It is safe for
+// concurrent use.
+type Bus struct {
+	mutex       sync.RWMutex
+	nextID      int
+	subscribers []*subscriber
+}
+
+// subscriber is a handler subscribed to the bus. Asynchronous subscribers
+// have a queue.
+type subscriber struct {
+	id      int
+	handler Handler
+	queue   *queue
+}
+
+// Subscribe calls the given handler with every event, in the goroutine that
+// publishes it. The handler must not block. The returned function
+// unsubscribes the handler.
+func (b *Bus) Subscribe(handler Handler) (unsubscribe func()) {
+	return b.subscribe(&subscriber{handler: handler})
+}
+
+// SubscribeAsync calls the given handler with every event on a goroutine of
+// its own, in the order the events were published. Publishing never waits
+// for the handler. The returned function unsubscribes the handler; events
+// published before are still delivered.
+func (b *Bus) SubscribeAsync(handler Handler) (unsubscribe func()) {
+	q := newQueue()
+	go q.run(handler)
+	return b.subscribe(&subscriber{handler: handler, queue: q})
+}
+
+// subscribe adds the given subscriber and returns its unsubscribe function.
+func (b *Bus) subscribe(s *subscriber) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.nextID++
+	s.id = b.nextID
+	b.subscribers = append(b.subscribers, s)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { b.unsubscribe(s) })
+	}
+}
+
+// unsubscribe removes the given subscriber and stops its queue.
+func (b *Bus) unsubscribe(s *subscriber) {
+	b.mutex.Lock()
+	subscribers := make([]*subscriber, 0, len(b.subscribers))
+	for _, subscriber := range b.subscribers {
+		if subscriber.id != s.id {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	b.subscribers = subscribers
+	b.mutex.Unlock()
+
+	if s.queue != nil {
+		s.queue.close()
+	}
+}
+
+// Publish passes the given event to every subscriber. A nil bus ignores
+// the event.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.RLock()
+	subscribers := b.subscribers
+	b.mutex.RUnlock()
+
+	for _, subscriber := range subscribers {
+		if subscriber.queue != nil {
+			subscriber.queue.push(event)
+		} else {
+			subscriber.handler(event)
+		}
+	}
+}
+
+// queue holds the events of an asynchronous subscriber until its goroutine
+// handles them.
+type queue struct {
+	mutex  sync.Mutex
+	ready  *sync.Cond
+	events []Event
+	closed bool
+}
+
+// newQueue returns a new empty queue.
+func newQueue() *queue {
+	q := &queue{}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds the given event to the queue.
+func (q *queue) push(event Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.events = append(q.events, event)
+	q.ready.Signal()
+}
+
+// close stops the queue once the queued events are handled.
+func (q *queue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.ready.Signal()
+}
+
+// run passes the queued events to the given handler until the queue is
+// closed and empty.
+func (q *queue) run(handler Handler) {
+	for {
+		q.mutex.Lock()
+		for len(q.events) == 0 && !q.closed {
+			q.ready.Wait()
+		}
+		if len(q.events) == 0 {
+			q.mutex.Unlock()
+			return
+		}
+		event := q.events[0]
+		q.events = q.events[1:]
+		q.mutex.Unlock()
+
+		handler(event)
+	}
+}
@@ -0,0 +1,9 @@
+// Package events provides a bus for session lifecycle events, so apps can
+// react when sessions are created, archived, promoted or reset, when a
+// remote identity changes, and when a prekey is consumed.
+//
+// Set a Bus on a session.Builder to receive the events of the builder and of
+// the ciphers created from it. Synchronous subscribers are called in the
+// publishing goroutine, before the operation returns. Asynchronous
+// subscribers each receive the events in order on their own goroutine.
+package events
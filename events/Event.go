@@ -0,0 +1,80 @@
+package events
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// Event is a session lifecycle event. Use a type switch to handle the
+// event types.
+type Event interface {
+	// Address returns the remote address of the session.
+	Address() *protocol.SignalAddress
+}
+
+// SessionCreated is published when a new session is built, either from a
+// prekey bundle or from a PreKeySignalMessage.
+type SessionCreated struct {
+	RemoteAddress *protocol.SignalAddress
+	Version       int
+
+	// Initiator is true if we built the session from the remote side's
+	// prekey bundle.
+	Initiator bool
+}
+
+// Address returns the remote address of the session.
+func (e *SessionCreated) Address() *protocol.SignalAddress { return e.RemoteAddress }
+
+// SessionArchived is published when the current session state is archived
+// to make room for a new session.
+type SessionArchived struct {
+	RemoteAddress *protocol.SignalAddress
+}
+
+// Address returns the remote address of the session.
+func (e *SessionArchived) Address() *protocol.SignalAddress { return e.RemoteAddress }
+
+// SessionReset is published when the remote client's registration ID has
+// changed, meaning it has reinstalled and the session is rebuilt.
+type SessionReset struct {
+	RemoteAddress     *protocol.SignalAddress
+	OldRegistrationID uint32
+	NewRegistrationID uint32
+}
+
+// Address returns the remote address of the session.
+func (e *SessionReset) Address() *protocol.SignalAddress { return e.RemoteAddress }
+
+// StatePromoted is published when an archived session state decrypts a
+// message and becomes the current state again.
+type StatePromoted struct {
+	RemoteAddress *protocol.SignalAddress
+}
+
+// Address returns the remote address of the session.
+func (e *StatePromoted) Address() *protocol.SignalAddress { return e.RemoteAddress }
+
+// IdentityChanged is published when a session is built with a remote
+// identity that differs from the saved one. It can only be detected with an
+// identity store that implements store.EnumerableIdentityKey.
+type IdentityChanged struct {
+	RemoteAddress *protocol.SignalAddress
+	OldIdentity   *identity.Key
+	NewIdentity   *identity.Key
+}
+
+// Address returns the remote address of the session.
+func (e *IdentityChanged) Address() *protocol.SignalAddress { return e.RemoteAddress }
+
+// PreKeyConsumed is published when one of our prekeys is used to build a
+// session. One time prekeys are removed from the store, the last resort
+// prekey is kept.
+type PreKeyConsumed struct {
+	RemoteAddress *protocol.SignalAddress
+	PreKeyID      uint32
+	LastResort    bool
+}
+
+// Address returns the remote address of the session.
+func (e *PreKeyConsumed) Address() *protocol.SignalAddress { return e.RemoteAddress }
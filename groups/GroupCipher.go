@@ -7,10 +7,23 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/ratchet"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"strconv"
 )
 
+// Errors returned by group ciphers. Errors with details, such as the group ID
+// or message iteration, wrap one of these, so callers can check the cause with
+// errors.Is.
+var (
+	ErrNoSenderKey      = errors.New("No sender key!")
+	ErrInvalidSignature = errors.New("Sender Key State failed verification with given pub key!")
+	ErrOldCounter       = errors.New("Received message with old counter!")
+	ErrTooFarInFuture   = errors.New("Over 2000 messages into the future!")
+)
+
 // NewGroupCipher will return a new group message cipher that can be used for
 // encrypt/decrypt operations.
 func NewGroupCipher(builder *SessionBuilder, senderKeyID *protocol.SenderKeyName,
@@ -20,6 +33,8 @@ func NewGroupCipher(builder *SessionBuilder, senderKeyID *protocol.SenderKeyName
 		senderKeyID:    senderKeyID,
 		senderKeyStore: senderKeyStore,
 		sessionBuilder: builder,
+		pendingBuffer:  builder.pendingBuffer,
+		observer:       builder.observer,
 	}
 }
 
@@ -30,10 +45,35 @@ type GroupCipher struct {
 	senderKeyID    *protocol.SenderKeyName
 	senderKeyStore store.SenderKey
 	sessionBuilder *SessionBuilder
+	pendingBuffer  *pending.Buffer
+	observer       observer.Observer
+}
+
+// SetObserver sets the observer for this cipher. By default the builder's
+// observer is used.
+func (c *GroupCipher) SetObserver(o observer.Observer) {
+	c.observer = o
+}
+
+// observe returns the cipher's observer, or the shared observer if none was
+// set.
+func (c *GroupCipher) observe() observer.Observer {
+	if c.observer != nil {
+		return c.observer
+	}
+	return observer.Get()
 }
 
 // Encrypt will take the given message in bytes and return encrypted bytes.
-func (c *GroupCipher) Encrypt(plaintext []byte) (protocol.CiphertextMessage, error) {
+func (c *GroupCipher) Encrypt(plaintext []byte) (encrypted protocol.CiphertextMessage, err error) {
+	span := c.observe().StartSpan(observer.OperationGroupEncrypt)
+	defer func() {
+		if err == nil {
+			c.observe().MessageEncrypted(encrypted.Type())
+		}
+		observer.Finish(c.observe(), span, observer.OperationGroupEncrypt, err, failureReason(err))
+	}()
+
 	// Load the sender key based on id from our store.
 	keyRecord := c.senderKeyStore.LoadSenderKey(c.senderKeyID)
 	senderKeyState, err := keyRecord.SenderKeyState()
@@ -69,23 +109,45 @@ func (c *GroupCipher) Encrypt(plaintext []byte) (protocol.CiphertextMessage, err
 
 // Decrypt decrypts the given message using an existing session that
 // is stored in the senderKey store.
-func (c *GroupCipher) Decrypt(senderKeyMessage *protocol.SenderKeyMessage) ([]byte, error) {
+func (c *GroupCipher) Decrypt(senderKeyMessage *protocol.SenderKeyMessage) (plaintext []byte, err error) {
+	span := c.observe().StartSpan(observer.OperationGroupDecrypt)
+	defer func() {
+		if errors.Is(err, pending.ErrBuffered) {
+			span.SetAttribute("buffered", "true")
+			span.End(nil)
+			return
+		}
+		if err == nil {
+			c.observe().MessageDecrypted(senderKeyMessage.Type())
+		}
+		observer.Finish(c.observe(), span, observer.OperationGroupDecrypt, err, failureReason(err))
+	}()
+
 	keyRecord := c.senderKeyStore.LoadSenderKey(c.senderKeyID)
 
 	if keyRecord.IsEmpty() {
-		return nil, errors.New("No sender key for: " + c.senderKeyID.GroupID())
+		if c.pendingBuffer != nil {
+			c.pendingBuffer.AddGroupMessage(c.senderKeyID, senderKeyMessage)
+			return nil, pending.ErrBuffered
+		}
+		return nil, errorhelper.WithDetail(ErrNoSenderKey, c.senderKeyID.GroupID())
 	}
 
-	// Get the senderkey state by id.
+	// Get the senderkey state by id. If the sender has a new sender key we
+	// haven't received yet, the message can be buffered as well.
 	senderKeyState, err := keyRecord.GetSenderKeyStateByID(senderKeyMessage.KeyID())
 	if err != nil {
+		if c.pendingBuffer != nil {
+			c.pendingBuffer.AddGroupMessage(c.senderKeyID, senderKeyMessage)
+			return nil, pending.ErrBuffered
+		}
 		return nil, err
 	}
 
 	// Verify the signature of the senderkey message.
 	verified := c.verifySignature(senderKeyState.SigningKey().PublicKey(), senderKeyMessage)
 	if !verified {
-		return nil, errors.New("Sender Key State failed verification with given pub key!")
+		return nil, ErrInvalidSignature
 	}
 
 	senderKey, err := c.getSenderKey(senderKeyState, senderKeyMessage.Iteration())
@@ -94,7 +156,7 @@ func (c *GroupCipher) Decrypt(senderKeyMessage *protocol.SenderKeyMessage) ([]by
 	}
 
 	// Decrypt the message ciphertext.
-	plaintext, err := cipher.Decrypt(senderKey.Iv(), senderKey.CipherKey(), senderKeyMessage.Ciphertext())
+	plaintext, err = cipher.Decrypt(senderKey.Iv(), senderKey.CipherKey(), senderKeyMessage.Ciphertext())
 	if err != nil {
 		return nil, err
 	}
@@ -121,22 +183,52 @@ func (c *GroupCipher) getSenderKey(senderKeyState *record.SenderKeyState, iterat
 		}
 		i1 := strconv.Itoa(int(senderChainKey.Iteration()))
 		i2 := strconv.Itoa(int(iteration))
-		return nil, errors.New("Received message with old counter: " + i1 + ", " + i2)
+		return nil, errorhelper.WithDetail(ErrOldCounter, "chain iteration "+i1+", iteration "+i2)
 	}
 
 	if iteration-senderChainKey.Iteration() > 2000 {
-		return nil, errors.New("Over 2000 messages into the future!")
+		return nil, ErrTooFarInFuture
 	}
 
+	stored, evicted := 0, 0
 	for senderChainKey.Iteration() < iteration {
 		senderMessageKey, err := senderChainKey.SenderMessageKey()
 		if err != nil {
 			return nil, err
 		}
-		senderKeyState.AddSenderMessageKey(senderMessageKey)
+		if senderKeyState.AddSenderMessageKey(senderMessageKey) {
+			evicted++
+		}
+		stored++
 		senderChainKey = senderChainKey.Next()
 	}
+	if stored > 0 {
+		c.observe().SkippedKeysStored(stored)
+	}
+	if evicted > 0 {
+		c.observe().SkippedKeysEvicted(evicted)
+	}
 
 	senderKeyState.SetSenderChainKey(senderChainKey.Next())
 	return senderChainKey.SenderMessageKey()
 }
+
+// failureReason returns the observer's failure reason for the given error.
+func failureReason(err error) observer.Reason {
+	switch {
+	case err == nil:
+		return observer.ReasonOther
+	case errors.Is(err, cipher.ErrInvalidPKCS7Data), errors.Is(err, cipher.ErrInvalidPKCS7Padding),
+		errors.Is(err, cipher.ErrInvalidBlockSize):
+		return observer.ReasonInvalidMessage
+	case errors.Is(err, ErrNoSenderKey), errors.Is(err, record.ErrNoSenderKeyState):
+		return observer.ReasonNoSenderKey
+	case errors.Is(err, ErrInvalidSignature):
+		return observer.ReasonInvalidSignature
+	case errors.Is(err, ErrOldCounter):
+		return observer.ReasonDuplicateMessage
+	case errors.Is(err, ErrTooFarInFuture):
+		return observer.ReasonTooFarInFuture
+	}
+	return observer.ReasonOther
+}
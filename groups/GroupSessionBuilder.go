@@ -11,6 +11,8 @@ package groups
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
@@ -30,6 +32,22 @@ func NewGroupSessionBuilder(senderKeyStore store.SenderKey,
 type SessionBuilder struct {
 	senderKeyStore store.SenderKey
 	serializer     *serialize.Serializer
+	pendingBuffer  *pending.Buffer
+	observer       observer.Observer
+}
+
+// SetObserver sets the observer for this builder and the group ciphers
+// created from it. By default the shared observer from observer.Setup is
+// used.
+func (b *SessionBuilder) SetObserver(o observer.Observer) {
+	b.observer = o
+}
+
+// SetPendingBuffer sets the buffer for messages that arrive before their
+// sender key. Group ciphers created from this builder buffer such messages,
+// and Process decrypts them once it has added their sender key.
+func (b *SessionBuilder) SetPendingBuffer(buffer *pending.Buffer) {
+	b.pendingBuffer = buffer
 }
 
 // Process will process an incoming group message and set up the corresponding
@@ -37,12 +55,38 @@ type SessionBuilder struct {
 func (b *SessionBuilder) Process(senderKeyName *protocol.SenderKeyName,
 	msg *protocol.SenderKeyDistributionMessage) {
 
+	o := b.observer
+	if o == nil {
+		o = observer.Get()
+	}
+	span := o.StartSpan(observer.OperationGroupProcess)
+	defer span.End(nil)
+
 	senderKeyRecord := b.senderKeyStore.LoadSenderKey(senderKeyName)
 	if senderKeyRecord == nil {
 		senderKeyRecord = record.NewSenderKey(b.serializer.SenderKeyRecord, b.serializer.SenderKeyState)
 	}
 	senderKeyRecord.AddSenderKeyState(msg.ID(), msg.Iteration(), msg.ChainKey(), msg.SignatureKey())
 	b.senderKeyStore.StoreSenderKey(senderKeyName, senderKeyRecord)
+	b.retryPending(senderKeyName)
+}
+
+// retryPending decrypts the buffered messages for the given sender key now
+// that it has been added, and passes the results to the buffer's handler.
+func (b *SessionBuilder) retryPending(senderKeyName *protocol.SenderKeyName) {
+	if b.pendingBuffer == nil {
+		return
+	}
+	messages := b.pendingBuffer.TakeGroupMessages(senderKeyName)
+	if len(messages) == 0 {
+		return
+	}
+
+	cipher := NewGroupCipher(b, senderKeyName, b.senderKeyStore)
+	for _, message := range messages {
+		plaintext, err := cipher.Decrypt(message.Ciphertext.(*protocol.SenderKeyMessage))
+		b.pendingBuffer.Deliver(message, plaintext, err)
+	}
 }
 
 // Create will create a new group session for the given name.
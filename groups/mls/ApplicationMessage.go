@@ -0,0 +1,101 @@
+package mls
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// reuseGuardLength is the length of the random bytes mixed into the nonce
+// of every application message, so state restored from a backup can't
+// reuse a nonce.
+const reuseGuardLength = 4
+
+// NewApplicationMessageFromBytes returns an application message from the
+// given bytes.
+func NewApplicationMessageFromBytes(serialized []byte) (*ApplicationMessage, error) {
+	d := newDecoder("ApplicationMessage", serialized)
+	message := &ApplicationMessage{
+		groupID:             d.readBytes("GroupID"),
+		epoch:               d.readUint64("Epoch"),
+		encryptedSenderData: d.readBytes("EncryptedSenderData"),
+		ciphertext:          d.readBytes("Ciphertext"),
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// ApplicationMessage is a message encrypted to a group in an epoch. Its
+// sender and generation are encrypted as well, with a key derived from the
+// ciphertext.
+type ApplicationMessage struct {
+	groupID             []byte
+	epoch               uint64
+	encryptedSenderData []byte
+	ciphertext          []byte
+}
+
+// GroupID returns the ID of the message's group.
+func (m *ApplicationMessage) GroupID() []byte {
+	return m.groupID
+}
+
+// Epoch returns the epoch the message was encrypted in.
+func (m *ApplicationMessage) Epoch() uint64 {
+	return m.epoch
+}
+
+// Serialize returns the message as bytes.
+func (m *ApplicationMessage) Serialize() []byte {
+	e := &encoder{}
+	e.writeBytes(m.groupID)
+	e.writeUint64(m.epoch)
+	e.writeBytes(m.encryptedSenderData)
+	e.writeBytes(m.ciphertext)
+	return e.buf
+}
+
+// Type returns the message's type, protocol.MLS_TYPE.
+func (m *ApplicationMessage) Type() uint32 {
+	return protocol.MLS_TYPE
+}
+
+// senderData is the encrypted header of an application message.
+type senderData struct {
+	sender     uint32
+	generation uint32
+	reuseGuard []byte
+}
+
+func (s *senderData) bytes() []byte {
+	e := &encoder{}
+	e.writeUint32(s.sender)
+	e.writeUint32(s.generation)
+	e.buf = append(e.buf, s.reuseGuard...)
+	return e.buf
+}
+
+func decodeSenderData(serialized []byte) (*senderData, error) {
+	d := newDecoder("SenderData", serialized)
+	data := &senderData{
+		sender:     d.readUint32("Sender"),
+		generation: d.readUint32("Generation"),
+		reuseGuard: d.read("ReuseGuard", reuseGuardLength),
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// guardNonce returns the nonce with the reuse guard XORed into its first
+// bytes.
+func guardNonce(nonce, reuseGuard []byte) []byte {
+	guarded := append([]byte{}, nonce...)
+	for i := range reuseGuard {
+		guarded[i] ^= reuseGuard[i]
+	}
+	return guarded
+}
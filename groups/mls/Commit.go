@@ -0,0 +1,164 @@
+package mls
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+)
+
+// maxPathLength is the length of the longest direct path in a tree of
+// MaxMembers leaves.
+const maxPathLength = 16
+
+// NewCommitFromBytes returns a commit from the given bytes. It is verified
+// when it is processed.
+func NewCommitFromBytes(serialized []byte) (*Commit, error) {
+	d := newDecoder("Commit", serialized)
+	commit := &Commit{
+		groupID: d.readBytes("GroupID"),
+		epoch:   d.readUint64("Epoch"),
+		sender:  d.readUint32("Sender"),
+	}
+	proposals := d.readCount("Proposals", MaxMembers)
+	for i := 0; i < proposals; i++ {
+		commit.proposals = append(commit.proposals, decodeProposal(d))
+	}
+	commit.path = decodeUpdatePath(d)
+	commit.signature = d.readSignature("Signature")
+	commit.confirmationTag = d.readSecret("ConfirmationTag", secretLength)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return commit, nil
+}
+
+// Commit applies proposals to a group and replaces the committer's path,
+// which starts the group's next epoch.
+type Commit struct {
+	groupID         []byte
+	epoch           uint64
+	sender          uint32
+	proposals       []*Proposal
+	path            *updatePath
+	signature       [64]byte
+	confirmationTag []byte
+}
+
+// GroupID returns the ID of the commit's group.
+func (c *Commit) GroupID() []byte {
+	return c.groupID
+}
+
+// Epoch returns the epoch the commit ends.
+func (c *Commit) Epoch() uint64 {
+	return c.epoch
+}
+
+// Sender returns the leaf index of the committer.
+func (c *Commit) Sender() uint32 {
+	return c.sender
+}
+
+// Proposals returns the proposals the commit applies.
+func (c *Commit) Proposals() []*Proposal {
+	return append([]*Proposal{}, c.proposals...)
+}
+
+// Serialize returns the commit as bytes.
+func (c *Commit) Serialize() []byte {
+	e := &encoder{}
+	e.buf = append(e.buf, c.content()...)
+	e.writeSignature(c.signature)
+	e.writeBytes(c.confirmationTag)
+	return e.buf
+}
+
+// tbs returns the content the committer signs in the given group context.
+func (c *Commit) tbs(context *groupContext) []byte {
+	return framedContent(context, c.sender, contentCommit, c.body())
+}
+
+// transcript returns the signed commit, which is added to the group's
+// transcript hash.
+func (c *Commit) transcript() []byte {
+	e := &encoder{}
+	e.buf = append(e.buf, c.content()...)
+	e.writeSignature(c.signature)
+	return e.buf
+}
+
+func (c *Commit) content() []byte {
+	e := &encoder{}
+	e.writeBytes(c.groupID)
+	e.writeUint64(c.epoch)
+	e.writeUint32(c.sender)
+	e.buf = append(e.buf, c.body()...)
+	return e.buf
+}
+
+// body returns the encoding of the proposals and path.
+func (c *Commit) body() []byte {
+	e := &encoder{}
+	e.writeUint32(uint32(len(c.proposals)))
+	for _, proposal := range c.proposals {
+		proposal.encode(e)
+	}
+	c.path.encode(e)
+	return e.buf
+}
+
+// updatePath is the committer's new leaf, and for each node of its filtered
+// direct path the new public key and the path secret encrypted to each
+// node of the copath child's resolution.
+type updatePath struct {
+	leaf  *leafNode
+	nodes []*updatePathNode
+}
+
+type updatePathNode struct {
+	publicKey            ecc.ECPublicKeyable
+	encryptedPathSecrets []*hpkeCiphertext
+}
+
+func (p *updatePath) encode(e *encoder) {
+	p.leaf.encode(e)
+	e.writeUint32(uint32(len(p.nodes)))
+	for _, node := range p.nodes {
+		e.writePublicKey(node.publicKey)
+		e.writeUint32(uint32(len(node.encryptedPathSecrets)))
+		for _, ciphertext := range node.encryptedPathSecrets {
+			ciphertext.encode(e)
+		}
+	}
+}
+
+func decodeUpdatePath(d *decoder) *updatePath {
+	path := &updatePath{leaf: decodeLeafNode(d)}
+	nodes := d.readCount("UpdatePath.Nodes", maxPathLength)
+	for i := 0; i < nodes; i++ {
+		node := &updatePathNode{publicKey: d.readPublicKey("UpdatePath.PublicKey", false)}
+		ciphertexts := d.readCount("UpdatePath.EncryptedPathSecrets", MaxMembers)
+		for j := 0; j < ciphertexts; j++ {
+			node.encryptedPathSecrets = append(node.encryptedPathSecrets, decodeHPKECiphertext(d))
+		}
+		path.nodes = append(path.nodes, node)
+	}
+	return path
+}
+
+// hpkeCiphertext is a secret encrypted to a node's key.
+type hpkeCiphertext struct {
+	enc        []byte
+	ciphertext []byte
+}
+
+func (c *hpkeCiphertext) encode(e *encoder) {
+	e.writeBytes(c.enc)
+	e.writeBytes(c.ciphertext)
+}
+
+func decodeHPKECiphertext(d *decoder) *hpkeCiphertext {
+	return &hpkeCiphertext{
+		enc:        d.readBytes("HPKECiphertext.Enc"),
+		ciphertext: d.readBytes("HPKECiphertext.Ciphertext"),
+	}
+}
@@ -0,0 +1,40 @@
+// Package mls implements an MLS-style group mode (RFC 9420) as an
+// alternative to sender keys, for large and long-lived groups.
+//
+// Members share a ratchet tree of X25519 keys. A commit applies add,
+// remove and update proposals and replaces the committer's path to the
+// root, encrypting each new path secret to the subtree that needs it with
+// HPKE, so a membership change or key update costs O(log n) ciphertexts
+// rather than a sender key distribution to every member. Each commit starts
+// a new epoch with fresh epoch secrets, which gives post-compromise
+// security once a compromised member has updated. New members join from a
+// Welcome, which carries the group's tree and the secrets of the new epoch.
+//
+// Application messages are encrypted with per-sender ratchets derived from
+// the epoch's secret tree, hide their sender, are signed with the sender's
+// identity key and implement protocol.CiphertextMessage.
+//
+// The key schedule, TreeKEM and secret tree follow RFC 9420 with the
+// cipher suite's primitives (X25519 HPKE, HKDF-SHA256, AES-128-GCM), but
+// members sign with their XEdDSA identity keys and messages use this
+// package's own encoding, so it doesn't interoperate with other MLS
+// implementations. Parent hashes follow RFC 9420 section 7.9: each commit
+// links the nodes of its path to the committer's signed leaf, commits with
+// a wrong leaf parent hash are rejected, and new members check that every
+// parent node of a Welcome's tree is parent-hash valid.
+//
+// Some parts of RFC 9420 are left out, as they serve deployments this
+// package doesn't target:
+//   - Pre-shared keys and ReInit proposals, used to link groups and resume
+//     them across versions. A group here lives in one store and is never
+//     resumed elsewhere.
+//   - External commits and external proposals, which let non-members join
+//     or change a group. Every change here comes from a member, and members
+//     join from a Welcome.
+//   - Group context extensions, leaf capabilities and credentials other
+//     than identity keys. Members are authenticated by their Signal identity
+//     keys, so there are no other credential types or extensions to
+//     negotiate.
+//   - PublicMessage framing and the MLS wire format. Commits, proposals and
+//     messages use this package's own signed encoding.
+package mls
@@ -0,0 +1,201 @@
+package mls
+
+import (
+	"encoding/binary"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// encoder writes the canonical encoding of MLS structures, which is what
+// is signed, hashed and sent: big-endian integers, and byte strings and
+// lists prefixed with their 32 bit length or count.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeUint8(value uint8) {
+	e.buf = append(e.buf, value)
+}
+
+func (e *encoder) writeUint32(value uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, value)
+}
+
+func (e *encoder) writeUint64(value uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, value)
+}
+
+func (e *encoder) writeBytes(value []byte) {
+	e.writeUint32(uint32(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+// writePublicKey writes the serialized key, or an empty string for nil.
+func (e *encoder) writePublicKey(key ecc.ECPublicKeyable) {
+	if key == nil {
+		e.writeBytes(nil)
+		return
+	}
+	e.writeBytes(key.Serialize())
+}
+
+func (e *encoder) writePrivateKey(key ecc.ECPrivateKeyable) {
+	privateKey := key.Serialize()
+	e.writeBytes(privateKey[:])
+}
+
+func (e *encoder) writeSignature(signature [64]byte) {
+	e.buf = append(e.buf, signature[:]...)
+}
+
+// decoder reads what an encoder wrote. The first error is kept and every
+// later read returns zero values, so callers check err once at the end.
+type decoder struct {
+	structType string
+	buf        []byte
+	err        error
+}
+
+func newDecoder(structType string, serialized []byte) *decoder {
+	return &decoder{structType: structType, buf: serialized}
+}
+
+// fail records a decode error for the given field.
+func (d *decoder) fail(field string, err error) {
+	if d.err == nil {
+		d.err = errorhelper.NewDecodeError(d.structType, field, err)
+	}
+	d.buf = nil
+}
+
+func (d *decoder) read(field string, length uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if length > uint64(len(d.buf)) {
+		d.fail(field, errorhelper.WithDetail(errorhelper.ErrInvalidLength, "truncated"))
+		return nil
+	}
+	value := d.buf[:length]
+	d.buf = d.buf[length:]
+
+	return value
+}
+
+func (d *decoder) readUint8(field string) uint8 {
+	value := d.read(field, 1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (d *decoder) readUint32(field string) uint32 {
+	value := d.read(field, 4)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(value)
+}
+
+func (d *decoder) readUint64(field string) uint64 {
+	value := d.read(field, 8)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+// readBytes returns a copy of the next byte string.
+func (d *decoder) readBytes(field string) []byte {
+	length := d.readUint32(field)
+	value := d.read(field, uint64(length))
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+// readSecret reads a byte string of exactly the given length.
+func (d *decoder) readSecret(field string, length int) []byte {
+	value := d.readBytes(field)
+	if d.err != nil {
+		return nil
+	}
+	if err := errorhelper.CheckLength(d.structType, field, value, length); err != nil {
+		d.err = err
+		return nil
+	}
+	return value
+}
+
+// readPublicKey reads a serialized public key. An empty string is only
+// accepted, as nil, if the key is optional.
+func (d *decoder) readPublicKey(field string, optional bool) ecc.ECPublicKeyable {
+	value := d.readBytes(field)
+	if d.err != nil || (optional && len(value) == 0) {
+		return nil
+	}
+	if err := errorhelper.CheckLength(d.structType, field, value, ecc.KeySize); err != nil {
+		d.err = err
+		return nil
+	}
+	key, err := ecc.DecodePoint(value, 0)
+	if err != nil {
+		d.fail(field, err)
+		return nil
+	}
+	return key
+}
+
+func (d *decoder) readIdentityKey(field string) *identity.Key {
+	key := d.readPublicKey(field, false)
+	if key == nil {
+		return nil
+	}
+	return identity.NewKey(key)
+}
+
+// readKeyPair reads a private key and pairs it with the given public key.
+func (d *decoder) readKeyPair(field string, publicKey ecc.ECPublicKeyable) *ecc.ECKeyPair {
+	value := d.readSecret(field, 32)
+	if value == nil {
+		return nil
+	}
+	var privateKey [32]byte
+	copy(privateKey[:], value)
+
+	return ecc.NewECKeyPair(publicKey, ecc.NewDjbECPrivateKey(privateKey))
+}
+
+func (d *decoder) readSignature(field string) [64]byte {
+	var signature [64]byte
+	copy(signature[:], d.read(field, 64))
+	return signature
+}
+
+// readCount reads the number of entries of a list, which must be at most
+// max.
+func (d *decoder) readCount(field string, max int) int {
+	count := d.readUint32(field)
+	if d.err != nil {
+		return 0
+	}
+	if err := errorhelper.CheckMaxCount(d.structType, field, int(count), max); err != nil {
+		d.err = err
+		d.buf = nil
+		return 0
+	}
+	return int(count)
+}
+
+// finish returns the first decode error, or an error if bytes are left
+// over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("Trailing", errorhelper.ErrUnexpectedField)
+	}
+	return d.err
+}
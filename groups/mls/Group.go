@@ -0,0 +1,938 @@
+package mls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"sort"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// maxPendingProposals bounds the pending proposals of a decoded group.
+const maxPendingProposals = 1000
+
+// Errors returned when processing group messages.
+var (
+	ErrWrongGroup             = errors.New("MLS message is for another group!")
+	ErrWrongEpoch             = errors.New("MLS message is for another epoch!")
+	ErrUnknownMember          = errors.New("Unknown MLS group member!")
+	ErrInvalidProposal        = errors.New("Invalid MLS proposal!")
+	ErrInvalidCommit          = errors.New("Invalid MLS commit!")
+	ErrInvalidConfirmationTag = errors.New("Invalid MLS confirmation tag!")
+	ErrPathKeyMismatch        = errors.New("MLS path secret doesn't match the committed public key!")
+	ErrInvalidMessage         = errors.New("Invalid MLS message!")
+	ErrInvalidWelcome         = errors.New("Invalid MLS welcome!")
+	ErrNoMatchingKeyPackage   = errors.New("MLS welcome is not for this key package!")
+	ErrRemoved                = errors.New("Removed from the MLS group!")
+	ErrGroupFull              = errors.New("MLS group is full!")
+	ErrWrongIdentity          = errors.New("MLS group state is for another identity key!")
+	ErrInvalidExportLength    = errors.New("Invalid MLS export length!")
+)
+
+// Member is a member of a group: the leaf it sits at and its identity key.
+type Member struct {
+	LeafIndex   uint32
+	IdentityKey *identity.Key
+}
+
+// NewGroup returns a new group with the given ID, with us as its only
+// member.
+func NewGroup(groupID []byte, identityKeyPair *identity.KeyPair) (*Group, error) {
+	leafKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	initSecret, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{
+		identityKeyPair: identityKeyPair,
+		tree:            newRatchetTree(newLeafNode(leafKeyPair.PublicKey(), identityKeyPair)),
+		privateKeys:     map[uint32]*ecc.ECKeyPair{0: leafKeyPair},
+	}
+	context := groupContext{
+		groupID:  append([]byte{}, groupID...),
+		treeHash: g.tree.hash(),
+	}
+	secrets := newEpochSecrets(joinerSecret(initSecret, make([]byte, secretLength), context.bytes()), context.bytes())
+	g.startEpoch(context, secrets, secrets.confirmationTag(nil))
+
+	return g, nil
+}
+
+// NewGroupFromWelcome joins a group from a Welcome to the given key
+// package. Use KeyPackageRefs to find the key package record.
+func NewGroupFromWelcome(welcome *Welcome, keyPackage *KeyPackageRecord, identityKeyPair *identity.KeyPair) (*Group, error) {
+	ref := keyPackage.keyPackage.Ref()
+	var encrypted *encryptedGroupSecrets
+	for _, secrets := range welcome.secrets {
+		if bytes.Equal(secrets.keyPackageRef, ref) {
+			encrypted = secrets
+		}
+	}
+	if encrypted == nil {
+		return nil, ErrNoMatchingKeyPackage
+	}
+	if !keyPackage.keyPackage.leaf.hasIdentity(identityKeyPair.PublicKey()) {
+		return nil, ErrWrongIdentity
+	}
+
+	plaintext, err := decryptWithLabel(keyPackage.initKeyPair, "Welcome", welcome.encryptedGroupInfo, encrypted.ciphertext)
+	if err != nil {
+		return nil, errorhelper.WithDetail(ErrInvalidWelcome, err.Error())
+	}
+	secrets, err := decodeGroupSecrets(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	key, nonce := welcomeKey(secrets.joinerSecret)
+	plaintext, err = openAEAD(key, nonce, nil, welcome.encryptedGroupInfo)
+	if err != nil {
+		return nil, errorhelper.WithDetail(ErrInvalidWelcome, err.Error())
+	}
+	info, err := decodeGroupInfo(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the tree and group info before trusting any of it.
+	tree := info.tree
+	signer := tree.leaf(info.signer)
+	if signer == nil {
+		return nil, ErrUnknownMember
+	}
+	if !verifyWithLabel(signer.identityKey.PublicKey(), "GroupInfoTBS", info.content(), info.signature) {
+		return nil, ErrInvalidSignature
+	}
+	if !bytes.Equal(tree.hash(), info.context.treeHash) {
+		return nil, errorhelper.WithDetail(ErrInvalidWelcome, "tree hash")
+	}
+	if !tree.verifyParentHashes() {
+		return nil, errorhelper.WithDetail(ErrInvalidWelcome, "parent hash")
+	}
+	leafIndex, found := uint32(0), false
+	for i, leaf := range tree.leaves {
+		if leaf == nil {
+			continue
+		}
+		if !leaf.verify() {
+			return nil, ErrInvalidSignature
+		}
+		if sameKey(leaf.encryptionKey, keyPackage.leafKeyPair.PublicKey()) && leaf.hasIdentity(identityKeyPair.PublicKey()) {
+			leafIndex, found = uint32(i), true
+		}
+	}
+	if !found {
+		return nil, errorhelper.WithDetail(ErrInvalidWelcome, "not in tree")
+	}
+
+	epochSecrets := newEpochSecrets(secrets.joinerSecret, info.context.bytes())
+	tag := epochSecrets.confirmationTag(info.context.confirmedTranscriptHash)
+	if !hmac.Equal(tag, info.confirmationTag) {
+		return nil, ErrInvalidConfirmationTag
+	}
+
+	g := &Group{
+		identityKeyPair: identityKeyPair,
+		tree:            tree,
+		leafIndex:       leafIndex,
+		privateKeys:     map[uint32]*ecc.ECKeyPair{2 * leafIndex: keyPackage.leafKeyPair},
+	}
+
+	// The path secret gives us the keys from the lowest node we share with
+	// the committer up to the root.
+	if len(secrets.pathSecret) > 0 {
+		path, _ := tree.filteredDirectPath(info.signer)
+		ancestor := commonAncestor(2*info.signer, 2*leafIndex)
+		start := indexOf(path, ancestor)
+		if start < 0 {
+			return nil, errorhelper.WithDetail(ErrInvalidWelcome, "path secret")
+		}
+		publicKeys := make([]ecc.ECPublicKeyable, 0, len(path)-start)
+		for _, node := range path[start:] {
+			publicKeys = append(publicKeys, tree.publicKey(node))
+		}
+		keyPairs, _, err := derivePath(secrets.pathSecret, len(publicKeys), publicKeys)
+		if err != nil {
+			return nil, err
+		}
+		for i, keyPair := range keyPairs {
+			g.privateKeys[path[start+i]] = keyPair
+		}
+	}
+	g.startEpoch(info.context, epochSecrets, tag)
+
+	return g, nil
+}
+
+// NewGroupFromBytes returns a group from the state serialized with
+// Serialize. The identity key pair must be the one the group was created
+// or joined with.
+func NewGroupFromBytes(serialized []byte, identityKeyPair *identity.KeyPair) (*Group, error) {
+	d := newDecoder("Group", serialized)
+	g := &Group{
+		identityKeyPair: identityKeyPair,
+		context:         decodeGroupContext(d),
+		tree:            decodeRatchetTree(d),
+		leafIndex:       d.readUint32("LeafIndex"),
+		privateKeys:     make(map[uint32]*ecc.ECKeyPair),
+		pendingUpdates:  make(map[string]*ecc.ECKeyPair),
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	leaf := g.tree.leaf(g.leafIndex)
+	if leaf == nil {
+		return nil, errorhelper.NewDecodeError("Group", "LeafIndex", errorhelper.ErrInvalidCounter)
+	}
+	if !leaf.hasIdentity(identityKeyPair.PublicKey()) {
+		return nil, ErrWrongIdentity
+	}
+
+	privateKeys := d.readCount("PrivateKeys", 2*MaxMembers)
+	for i := 0; i < privateKeys; i++ {
+		node := d.readUint32("PrivateKeyNode")
+		publicKey := g.tree.publicKey(node)
+		if publicKey == nil && d.err == nil {
+			d.fail("PrivateKeyNode", errorhelper.ErrInvalidCounter)
+		}
+		g.privateKeys[node] = d.readKeyPair("PrivateKey", publicKey)
+	}
+	g.interimTranscriptHash = d.readSecret("InterimTranscriptHash", secretLength)
+	g.secrets = &epochSecrets{
+		senderDataSecret:   d.readSecret("SenderDataSecret", secretLength),
+		exporterSecret:     d.readSecret("ExporterSecret", secretLength),
+		initSecret:         d.readSecret("InitSecret", secretLength),
+		epochAuthenticator: d.readSecret("EpochAuthenticator", secretLength),
+	}
+	g.secretTree = decodeSecretTree(d, g.tree.leafCount())
+
+	proposals := d.readCount("PendingProposals", maxPendingProposals)
+	for i := 0; i < proposals; i++ {
+		g.pendingProposals = append(g.pendingProposals, decodeProposal(d))
+	}
+	updates := d.readCount("PendingUpdates", maxPendingProposals)
+	for i := 0; i < updates; i++ {
+		ref := d.readSecret("PendingUpdateRef", secretLength)
+		publicKey := d.readPublicKey("PendingUpdateKey", false)
+		g.pendingUpdates[string(ref)] = d.readKeyPair("PendingUpdatePrivateKey", publicKey)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Group is our state of an MLS group in its current epoch. A group must
+// not be used concurrently; store it after every change.
+type Group struct {
+	identityKeyPair       *identity.KeyPair
+	context               groupContext
+	tree                  *ratchetTree
+	leafIndex             uint32
+	privateKeys           map[uint32]*ecc.ECKeyPair
+	interimTranscriptHash []byte
+	secrets               *epochSecrets
+	secretTree            *secretTree
+	pendingProposals      []*Proposal
+	pendingUpdates        map[string]*ecc.ECKeyPair
+}
+
+// GroupID returns the group's ID.
+func (g *Group) GroupID() []byte {
+	return g.context.groupID
+}
+
+// Epoch returns the group's current epoch. Every commit starts a new one.
+func (g *Group) Epoch() uint64 {
+	return g.context.epoch
+}
+
+// LeafIndex returns our leaf index in the group.
+func (g *Group) LeafIndex() uint32 {
+	return g.leafIndex
+}
+
+// Members returns the group's members, ordered by leaf index.
+func (g *Group) Members() []Member {
+	var members []Member
+	for i, leaf := range g.tree.leaves {
+		if leaf != nil {
+			members = append(members, Member{LeafIndex: uint32(i), IdentityKey: leaf.identityKey})
+		}
+	}
+	return members
+}
+
+// EpochAuthenticator returns a secret of the current epoch that members can
+// compare out of band to check that they are in the same group state.
+func (g *Group) EpochAuthenticator() []byte {
+	return append([]byte{}, g.secrets.epochAuthenticator...)
+}
+
+// Export returns a secret of the given length for the given label and
+// context, derived from the current epoch. Every member exports the same
+// secrets.
+func (g *Group) Export(label string, context []byte, length int) ([]byte, error) {
+	if length <= 0 || length > maxExpandLength {
+		return nil, ErrInvalidExportLength
+	}
+	return expandWithLabel(deriveSecret(g.secrets.exporterSecret, label), "exported", hash(context), length)
+}
+
+// ProposeAdd proposes adding the owner of the given key package.
+func (g *Group) ProposeAdd(keyPackage *KeyPackage) (*Proposal, error) {
+	if err := keyPackage.Verify(); err != nil {
+		return nil, err
+	}
+	return g.propose(&Proposal{proposalType: ProposalAdd, keyPackage: keyPackage}), nil
+}
+
+// ProposeRemove proposes removing the member at the given leaf. Members
+// leave a group by proposing their own removal.
+func (g *Group) ProposeRemove(leafIndex uint32) (*Proposal, error) {
+	if g.tree.leaf(leafIndex) == nil {
+		return nil, ErrUnknownMember
+	}
+	return g.propose(&Proposal{proposalType: ProposalRemove, removed: leafIndex}), nil
+}
+
+// ProposeUpdate proposes a new key for our leaf.
+func (g *Group) ProposeUpdate() (*Proposal, error) {
+	keyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	proposal := g.propose(&Proposal{proposalType: ProposalUpdate, leaf: newLeafNode(keyPair.PublicKey(), g.identityKeyPair)})
+	g.pendingUpdates[string(proposal.ref())] = keyPair
+
+	return proposal, nil
+}
+
+// propose signs the given proposal as ours and adds it to the pending
+// proposals.
+func (g *Group) propose(proposal *Proposal) *Proposal {
+	proposal.groupID = g.context.groupID
+	proposal.epoch = g.context.epoch
+	proposal.sender = g.leafIndex
+	proposal.signature = signWithLabel(g.identityKeyPair.PrivateKey(), "FramedContentTBS", proposal.tbs(&g.context))
+	g.pendingProposals = append(g.pendingProposals, proposal)
+
+	return proposal
+}
+
+// ReceiveProposal verifies a proposal from another member and adds it to
+// the pending proposals, which our next commit applies. Pending proposals
+// are dropped when the epoch ends.
+func (g *Group) ReceiveProposal(proposal *Proposal) error {
+	if err := g.verifyProposal(proposal); err != nil {
+		return err
+	}
+	ref := proposal.ref()
+	for _, pending := range g.pendingProposals {
+		if bytes.Equal(pending.ref(), ref) {
+			return nil
+		}
+	}
+	g.pendingProposals = append(g.pendingProposals, proposal)
+
+	return nil
+}
+
+// verifyProposal returns an error if the given proposal isn't for the
+// current epoch or isn't signed by its sender.
+func (g *Group) verifyProposal(proposal *Proposal) error {
+	if !bytes.Equal(proposal.groupID, g.context.groupID) {
+		return ErrWrongGroup
+	}
+	if proposal.epoch != g.context.epoch {
+		return ErrWrongEpoch
+	}
+	sender := g.tree.leaf(proposal.sender)
+	if sender == nil {
+		return ErrUnknownMember
+	}
+	if !verifyWithLabel(sender.identityKey.PublicKey(), "FramedContentTBS", proposal.tbs(&g.context), proposal.signature) {
+		return ErrInvalidSignature
+	}
+
+	switch proposal.proposalType {
+	case ProposalAdd:
+		return proposal.keyPackage.Verify()
+	case ProposalUpdate:
+		if !proposal.leaf.verify() || !proposal.leaf.hasIdentity(sender.identityKey) {
+			return errorhelper.WithDetail(ErrInvalidProposal, "update changes identity")
+		}
+	case ProposalRemove:
+		if g.tree.leaf(proposal.removed) == nil {
+			return ErrUnknownMember
+		}
+	}
+	return nil
+}
+
+// proposalsToCommit returns the pending proposals that can be committed
+// together: removes first, then updates of members that stay, then adds.
+// Our own updates are left out, since the commit updates our leaf anyway,
+// and so is our own removal, which another member has to commit.
+func (g *Group) proposalsToCommit() []*Proposal {
+	var proposals []*Proposal
+	affected := make(map[uint32]bool)
+	for _, proposal := range g.pendingProposals {
+		if proposal.proposalType == ProposalRemove && proposal.removed != g.leafIndex && !affected[proposal.removed] {
+			affected[proposal.removed] = true
+			proposals = append(proposals, proposal)
+		}
+	}
+	for _, proposal := range g.pendingProposals {
+		if proposal.proposalType == ProposalUpdate && proposal.sender != g.leafIndex && !affected[proposal.sender] {
+			affected[proposal.sender] = true
+			proposals = append(proposals, proposal)
+		}
+	}
+	added := make(map[string]bool)
+	for _, proposal := range g.pendingProposals {
+		if proposal.proposalType == ProposalAdd && !added[string(proposal.keyPackage.Ref())] {
+			added[string(proposal.keyPackage.Ref())] = true
+			proposals = append(proposals, proposal)
+		}
+	}
+	return proposals
+}
+
+// applyProposals applies the given proposals of a commit from the given
+// committer to the tree, and returns the leaf indexes of added members.
+// Proposals must be ordered removes, updates, then adds, and touch every
+// leaf at most once.
+func applyProposals(tree *ratchetTree, proposals []*Proposal, committer uint32) ([]uint32, error) {
+	var added []uint32
+	affected := make(map[uint32]bool)
+	last := ProposalRemove
+	for _, proposal := range proposals {
+		if proposalOrder(proposal.proposalType) < proposalOrder(last) {
+			return nil, errorhelper.WithDetail(ErrInvalidCommit, "proposal order")
+		}
+		last = proposal.proposalType
+
+		switch proposal.proposalType {
+		case ProposalRemove:
+			if proposal.removed == committer || affected[proposal.removed] || tree.leaf(proposal.removed) == nil {
+				return nil, errorhelper.WithDetail(ErrInvalidCommit, "invalid remove")
+			}
+			affected[proposal.removed] = true
+			tree.removeLeaf(proposal.removed)
+		case ProposalUpdate:
+			if proposal.sender == committer || affected[proposal.sender] || tree.leaf(proposal.sender) == nil {
+				return nil, errorhelper.WithDetail(ErrInvalidCommit, "invalid update")
+			}
+			affected[proposal.sender] = true
+			tree.updateLeaf(proposal.sender, proposal.leaf)
+		case ProposalAdd:
+			for _, leaf := range tree.leaves {
+				if leaf != nil && sameKey(leaf.encryptionKey, proposal.keyPackage.leaf.encryptionKey) {
+					return nil, errorhelper.WithDetail(ErrInvalidCommit, "duplicate leaf")
+				}
+			}
+			if tree.leafCount() == MaxMembers && len(tree.resolution(2*(MaxMembers-1))) > 0 {
+				return nil, ErrGroupFull
+			}
+			added = append(added, tree.addLeaf(proposal.keyPackage.leaf))
+		}
+	}
+
+	return added, nil
+}
+
+// proposalOrder returns the position of proposals of the given type in a
+// commit.
+func proposalOrder(proposalType ProposalType) int {
+	switch proposalType {
+	case ProposalRemove:
+		return 0
+	case ProposalUpdate:
+		return 1
+	}
+	return 2
+}
+
+// Commit applies the pending proposals, updates our leaf and path, and
+// starts the next epoch. Send the commit to the group, and the Welcome, if
+// the commit adds members, to the new members.
+//
+// The group moves to the new epoch right away. If the delivery service
+// rejects the commit because another member's commit came first, restore
+// the group from before the commit and process theirs instead.
+func (g *Group) Commit() (*Commit, *Welcome, error) {
+	proposals := g.proposalsToCommit()
+	tree := g.tree.clone()
+	added, err := applyProposals(tree, proposals, g.leafIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Derive a fresh key pair for our leaf and every node of our filtered
+	// direct path.
+	leafSecret, err := randomSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+	leafKeyPair, err := nodeKeyPair(leafSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, copath := tree.filteredDirectPath(g.leafIndex)
+	pathSecrets := make([][]byte, len(path))
+	pathSecrets0 := deriveSecret(leafSecret, "path")
+	keyPairs, commitSecret, err := derivePath(pathSecrets0, len(path), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeys := map[uint32]*ecc.ECKeyPair{2 * g.leafIndex: leafKeyPair}
+	publicKeys := make([]ecc.ECPublicKeyable, len(path))
+	for i, node := range path {
+		if i == 0 {
+			pathSecrets[i] = pathSecrets0
+		} else {
+			pathSecrets[i] = deriveSecret(pathSecrets[i-1], "path")
+		}
+		privateKeys[node] = keyPairs[i]
+		publicKeys[i] = keyPairs[i].PublicKey()
+	}
+
+	parentHash := tree.setPath(g.leafIndex, path, copath, publicKeys)
+	leaf := newPathLeafNode(leafKeyPair.PublicKey(), parentHash, g.identityKeyPair)
+	tree.leaves[g.leafIndex] = leaf
+	provisional := groupContext{
+		groupID:                 g.context.groupID,
+		epoch:                   g.context.epoch + 1,
+		treeHash:                tree.hash(),
+		confirmedTranscriptHash: g.context.confirmedTranscriptHash,
+	}
+
+	// Encrypt each path secret to the copath child's resolution. New members
+	// get theirs from the Welcome.
+	isAdded := make(map[uint32]bool)
+	for _, index := range added {
+		isAdded[2*index] = true
+	}
+	updatePath := &updatePath{leaf: leaf}
+	for i, child := range copath {
+		node := &updatePathNode{publicKey: publicKeys[i]}
+		for _, member := range tree.resolution(child) {
+			if isAdded[member] {
+				continue
+			}
+			ciphertext, err := encryptWithLabel(tree.publicKey(member), "UpdatePathNode", provisional.bytes(), pathSecrets[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			node.encryptedPathSecrets = append(node.encryptedPathSecrets, ciphertext)
+		}
+		updatePath.nodes = append(updatePath.nodes, node)
+	}
+
+	commit := &Commit{
+		groupID:   g.context.groupID,
+		epoch:     g.context.epoch,
+		sender:    g.leafIndex,
+		proposals: proposals,
+		path:      updatePath,
+	}
+	commit.signature = signWithLabel(g.identityKeyPair.PrivateKey(), "FramedContentTBS", commit.tbs(&g.context))
+
+	context := provisional
+	context.confirmedTranscriptHash = hash(g.interimTranscriptHash, commit.transcript())
+	joiner := joinerSecret(g.secrets.initSecret, commitSecret, context.bytes())
+	secrets := newEpochSecrets(joiner, context.bytes())
+	commit.confirmationTag = secrets.confirmationTag(context.confirmedTranscriptHash)
+
+	var welcome *Welcome
+	if len(added) > 0 {
+		welcome, err = g.welcome(tree, context, commit.confirmationTag, joiner, added, path, pathSecrets)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	g.tree = tree
+	g.privateKeys = privateKeys
+	g.startEpoch(context, secrets, commit.confirmationTag)
+
+	return commit, welcome, nil
+}
+
+// welcome returns the Welcome for the given added leaves of a commit of
+// ours.
+func (g *Group) welcome(tree *ratchetTree, context groupContext, confirmationTag, joiner []byte,
+	added []uint32, path []uint32, pathSecrets [][]byte) (*Welcome, error) {
+
+	info := &groupInfo{
+		context:         context,
+		tree:            tree,
+		confirmationTag: confirmationTag,
+		signer:          g.leafIndex,
+	}
+	info.signature = signWithLabel(g.identityKeyPair.PrivateKey(), "GroupInfoTBS", info.content())
+	key, nonce := welcomeKey(joiner)
+	encryptedGroupInfo, err := sealAEAD(key, nonce, nil, info.bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	welcome := &Welcome{encryptedGroupInfo: encryptedGroupInfo}
+	for _, index := range added {
+		secrets := &groupSecrets{joinerSecret: joiner}
+		if i := indexOf(path, commonAncestor(2*g.leafIndex, 2*index)); i >= 0 {
+			secrets.pathSecret = pathSecrets[i]
+		}
+		keyPackage := g.addedKeyPackage(tree.leaf(index))
+		ciphertext, err := encryptWithLabel(keyPackage.initKey, "Welcome", encryptedGroupInfo, secrets.bytes())
+		if err != nil {
+			return nil, err
+		}
+		welcome.secrets = append(welcome.secrets, &encryptedGroupSecrets{keyPackageRef: keyPackage.Ref(), ciphertext: ciphertext})
+	}
+
+	return welcome, nil
+}
+
+// addedKeyPackage returns the pending key package of the given added leaf.
+func (g *Group) addedKeyPackage(leaf *leafNode) *KeyPackage {
+	for _, proposal := range g.pendingProposals {
+		if proposal.proposalType == ProposalAdd && proposal.keyPackage.leaf == leaf {
+			return proposal.keyPackage
+		}
+	}
+	return nil
+}
+
+// ProcessCommit verifies a commit from another member and moves the group
+// to the epoch it starts. ErrRemoved is returned if the commit removes us;
+// the group can't be used after that.
+func (g *Group) ProcessCommit(commit *Commit) error {
+	if !bytes.Equal(commit.groupID, g.context.groupID) {
+		return ErrWrongGroup
+	}
+	if commit.epoch != g.context.epoch {
+		return ErrWrongEpoch
+	}
+	committer := g.tree.leaf(commit.sender)
+	if committer == nil || commit.sender == g.leafIndex {
+		return ErrUnknownMember
+	}
+	if !verifyWithLabel(committer.identityKey.PublicKey(), "FramedContentTBS", commit.tbs(&g.context), commit.signature) {
+		return ErrInvalidSignature
+	}
+	for _, proposal := range commit.proposals {
+		if err := g.verifyProposal(proposal); err != nil {
+			return err
+		}
+	}
+
+	tree := g.tree.clone()
+	added, err := applyProposals(tree, commit.proposals, commit.sender)
+	if err != nil {
+		return err
+	}
+	if tree.leaf(g.leafIndex) == nil {
+		return ErrRemoved
+	}
+
+	// Our leaf has a new key if the commit includes our update.
+	privateKeys := make(map[uint32]*ecc.ECKeyPair, len(g.privateKeys))
+	for node, keyPair := range g.privateKeys {
+		privateKeys[node] = keyPair
+	}
+	for _, proposal := range commit.proposals {
+		if proposal.proposalType == ProposalUpdate && proposal.sender == g.leafIndex {
+			keyPair := g.pendingUpdates[string(proposal.ref())]
+			if keyPair == nil {
+				return errorhelper.WithDetail(ErrInvalidCommit, "unknown update")
+			}
+			privateKeys[2*g.leafIndex] = keyPair
+		}
+	}
+
+	path, copath := tree.filteredDirectPath(commit.sender)
+	if len(path) != len(commit.path.nodes) {
+		return errorhelper.WithDetail(ErrInvalidCommit, "path length")
+	}
+	leaf := commit.path.leaf
+	if !leaf.verify() || !leaf.hasIdentity(committer.identityKey) {
+		return errorhelper.WithDetail(ErrInvalidCommit, "path leaf")
+	}
+	publicKeys := make([]ecc.ECPublicKeyable, len(path))
+	for i, node := range commit.path.nodes {
+		publicKeys[i] = node.publicKey
+	}
+	if !bytes.Equal(leaf.parentHash, tree.setPath(commit.sender, path, copath, publicKeys)) {
+		return errorhelper.WithDetail(ErrInvalidCommit, "parent hash")
+	}
+	tree.leaves[commit.sender] = leaf
+	for node, keyPair := range privateKeys {
+		if !sameKey(tree.publicKey(node), keyPair.PublicKey()) {
+			delete(privateKeys, node)
+		}
+	}
+	provisional := groupContext{
+		groupID:                 g.context.groupID,
+		epoch:                   g.context.epoch + 1,
+		treeHash:                tree.hash(),
+		confirmedTranscriptHash: g.context.confirmedTranscriptHash,
+	}
+
+	// Decrypt the path secret of the lowest node we share with the
+	// committer, with the key of whichever node of the copath child's
+	// resolution we have.
+	start := indexOf(path, commonAncestor(2*commit.sender, 2*g.leafIndex))
+	if start < 0 {
+		return errorhelper.WithDetail(ErrInvalidCommit, "path")
+	}
+	isAdded := make(map[uint32]bool)
+	for _, index := range added {
+		isAdded[2*index] = true
+	}
+	var resolution []uint32
+	for _, member := range tree.resolution(copath[start]) {
+		if !isAdded[member] {
+			resolution = append(resolution, member)
+		}
+	}
+	ciphertexts := commit.path.nodes[start].encryptedPathSecrets
+	if len(ciphertexts) != len(resolution) {
+		return errorhelper.WithDetail(ErrInvalidCommit, "path secrets")
+	}
+	var pathSecret []byte
+	for i, member := range resolution {
+		if keyPair := privateKeys[member]; keyPair != nil {
+			pathSecret, err = decryptWithLabel(keyPair, "UpdatePathNode", provisional.bytes(), ciphertexts[i])
+			if err != nil {
+				return errorhelper.WithDetail(ErrInvalidCommit, err.Error())
+			}
+			break
+		}
+	}
+	if pathSecret == nil {
+		return errorhelper.WithDetail(ErrInvalidCommit, "no key for path secret")
+	}
+	keyPairs, commitSecret, err := derivePath(pathSecret, len(path)-start, publicKeys[start:])
+	if err != nil {
+		return err
+	}
+	for i, keyPair := range keyPairs {
+		privateKeys[path[start+i]] = keyPair
+	}
+
+	context := provisional
+	context.confirmedTranscriptHash = hash(g.interimTranscriptHash, commit.transcript())
+	secrets := newEpochSecrets(joinerSecret(g.secrets.initSecret, commitSecret, context.bytes()), context.bytes())
+	tag := secrets.confirmationTag(context.confirmedTranscriptHash)
+	if !hmac.Equal(tag, commit.confirmationTag) {
+		return ErrInvalidConfirmationTag
+	}
+
+	g.tree = tree
+	g.privateKeys = privateKeys
+	g.startEpoch(context, secrets, tag)
+
+	return nil
+}
+
+// startEpoch moves the group to the epoch of the given context and
+// secrets.
+func (g *Group) startEpoch(context groupContext, secrets *epochSecrets, confirmationTag []byte) {
+	g.context = context
+	g.interimTranscriptHash = hash(context.confirmedTranscriptHash, confirmationTag)
+	g.secretTree = newSecretTree(secrets.encryptionSecret, g.tree.leafCount())
+	secrets.encryptionSecret = nil
+	secrets.confirmationKey = nil
+	g.secrets = secrets
+	g.pendingProposals = nil
+	g.pendingUpdates = make(map[string]*ecc.ECKeyPair)
+}
+
+// Encrypt encrypts the given plaintext to the group's members in the
+// current epoch.
+func (g *Group) Encrypt(plaintext []byte) (protocol.CiphertextMessage, error) {
+	ratchet := g.secretTree.ratchet(g.leafIndex)
+	if ratchet == nil {
+		return nil, errorhelper.WithDetail(ErrInvalidMessage, "no sender ratchet")
+	}
+	generation, key := ratchet.next()
+
+	content := &encoder{}
+	content.writeBytes(plaintext)
+	content.writeSignature(signWithLabel(g.identityKeyPair.PrivateKey(), "FramedContentTBS",
+		framedContent(&g.context, g.leafIndex, contentApplication, plaintext)))
+
+	reuseGuard := make([]byte, reuseGuardLength)
+	if _, err := rand.Read(reuseGuard); err != nil {
+		return nil, err
+	}
+	aad := g.messageAAD()
+	ciphertext, err := sealAEAD(key.key, guardNonce(key.nonce, reuseGuard), aad, content.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &senderData{sender: g.leafIndex, generation: generation, reuseGuard: reuseGuard}
+	senderDataKey, senderDataNonce := g.senderDataKey(ciphertext)
+	encryptedSenderData, err := sealAEAD(senderDataKey, senderDataNonce, aad, header.bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApplicationMessage{
+		groupID:             g.context.groupID,
+		epoch:               g.context.epoch,
+		encryptedSenderData: encryptedSenderData,
+		ciphertext:          ciphertext,
+	}, nil
+}
+
+// Decrypt decrypts an application message of the current epoch and returns
+// it with its sender.
+func (g *Group) Decrypt(message *ApplicationMessage) ([]byte, *Member, error) {
+	if !bytes.Equal(message.groupID, g.context.groupID) {
+		return nil, nil, ErrWrongGroup
+	}
+	if message.epoch != g.context.epoch {
+		return nil, nil, ErrWrongEpoch
+	}
+
+	aad := g.messageAAD()
+	senderDataKey, senderDataNonce := g.senderDataKey(message.ciphertext)
+	plaintext, err := openAEAD(senderDataKey, senderDataNonce, aad, message.encryptedSenderData)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	header, err := decodeSenderData(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	sender := g.tree.leaf(header.sender)
+	if sender == nil {
+		return nil, nil, ErrUnknownMember
+	}
+
+	// Only advance the sender's ratchet once the message is authentic.
+	ratchet := g.secretTree.ratchet(header.sender)
+	if ratchet == nil {
+		return nil, nil, errorhelper.WithDetail(ErrInvalidMessage, "no sender ratchet")
+	}
+	ratchet = ratchet.clone()
+	key, err := ratchet.key(header.generation)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err = openAEAD(key.key, guardNonce(key.nonce, header.reuseGuard), aad, message.ciphertext)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+
+	d := newDecoder("ApplicationContent", plaintext)
+	content := d.readBytes("Content")
+	signature := d.readSignature("Signature")
+	if err := d.finish(); err != nil {
+		return nil, nil, err
+	}
+	tbs := framedContent(&g.context, header.sender, contentApplication, content)
+	if !verifyWithLabel(sender.identityKey.PublicKey(), "FramedContentTBS", tbs, signature) {
+		return nil, nil, ErrInvalidSignature
+	}
+	g.secretTree.ratchets[header.sender] = ratchet
+
+	return content, &Member{LeafIndex: header.sender, IdentityKey: sender.identityKey}, nil
+}
+
+// messageAAD returns the additional data of application messages in the
+// current epoch.
+func (g *Group) messageAAD() []byte {
+	e := &encoder{}
+	e.writeBytes(g.context.groupID)
+	e.writeUint64(g.context.epoch)
+	e.writeUint8(contentApplication)
+	return e.buf
+}
+
+// senderDataKey returns the key and nonce of the sender data of the given
+// ciphertext.
+func (g *Group) senderDataKey(ciphertext []byte) (key, nonce []byte) {
+	sample := ciphertext
+	if len(sample) > secretLength {
+		sample = sample[:secretLength]
+	}
+	return expandSecretWithLabel(g.secrets.senderDataSecret, "key", sample, keyLength),
+		expandSecretWithLabel(g.secrets.senderDataSecret, "nonce", sample, nonceLength)
+}
+
+// Serialize returns the group's state as bytes. The identity key pair is
+// not included.
+func (g *Group) Serialize() []byte {
+	e := &encoder{}
+	g.context.encode(e)
+	g.tree.encode(e)
+	e.writeUint32(g.leafIndex)
+
+	nodes := make([]uint32, 0, len(g.privateKeys))
+	for node := range g.privateKeys {
+		nodes = append(nodes, node)
+	}
+	e.writeUint32(uint32(len(nodes)))
+	for _, node := range sortUint32s(nodes) {
+		e.writeUint32(node)
+		e.writePrivateKey(g.privateKeys[node].PrivateKey())
+	}
+
+	e.writeBytes(g.interimTranscriptHash)
+	e.writeBytes(g.secrets.senderDataSecret)
+	e.writeBytes(g.secrets.exporterSecret)
+	e.writeBytes(g.secrets.initSecret)
+	e.writeBytes(g.secrets.epochAuthenticator)
+	g.secretTree.encode(e)
+
+	e.writeUint32(uint32(len(g.pendingProposals)))
+	for _, proposal := range g.pendingProposals {
+		proposal.encode(e)
+	}
+	refs := make([]string, 0, len(g.pendingUpdates))
+	for ref := range g.pendingUpdates {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	e.writeUint32(uint32(len(refs)))
+	for _, ref := range refs {
+		e.writeBytes([]byte(ref))
+		e.writePublicKey(g.pendingUpdates[ref].PublicKey())
+		e.writePrivateKey(g.pendingUpdates[ref].PrivateKey())
+	}
+
+	return e.buf
+}
+
+// randomSecret returns a new random secret.
+func randomSecret() ([]byte, error) {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// indexOf returns the position of the given node in the path, or -1.
+func indexOf(path []uint32, node uint32) int {
+	for i, pathNode := range path {
+		if pathNode == node {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,142 @@
+package mls
+
+import (
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+)
+
+// ErrInvalidSignature is returned when a key package, proposal, commit or
+// group info is not signed by the identity key it claims.
+var ErrInvalidSignature = errors.New("Invalid MLS signature!")
+
+// NewKeyPackageRecord returns a new key package for the given identity key
+// pair, along with the private keys that join a group from a Welcome to
+// it. Publish the key package and keep the record until it is used.
+func NewKeyPackageRecord(identityKeyPair *identity.KeyPair) (*KeyPackageRecord, error) {
+	initKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	leafKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPackage := &KeyPackage{
+		initKey: initKeyPair.PublicKey(),
+		leaf:    newLeafNode(leafKeyPair.PublicKey(), identityKeyPair),
+	}
+	keyPackage.signature = signWithLabel(identityKeyPair.PrivateKey(), "KeyPackageTBS", keyPackage.content())
+
+	return &KeyPackageRecord{
+		keyPackage:  keyPackage,
+		initKeyPair: initKeyPair,
+		leafKeyPair: leafKeyPair,
+	}, nil
+}
+
+// NewKeyPackageRecordFromBytes returns a key package record from the given
+// bytes.
+func NewKeyPackageRecordFromBytes(serialized []byte) (*KeyPackageRecord, error) {
+	d := newDecoder("KeyPackageRecord", serialized)
+	record := &KeyPackageRecord{keyPackage: decodeKeyPackage(d)}
+	if d.err == nil {
+		record.initKeyPair = d.readKeyPair("InitPrivateKey", record.keyPackage.initKey)
+		record.leafKeyPair = d.readKeyPair("LeafPrivateKey", record.keyPackage.leaf.encryptionKey)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// KeyPackageRecord is a key package with its private keys.
+type KeyPackageRecord struct {
+	keyPackage  *KeyPackage
+	initKeyPair *ecc.ECKeyPair
+	leafKeyPair *ecc.ECKeyPair
+}
+
+// KeyPackage returns the record's public key package.
+func (r *KeyPackageRecord) KeyPackage() *KeyPackage {
+	return r.keyPackage
+}
+
+// Serialize returns the record as bytes.
+func (r *KeyPackageRecord) Serialize() []byte {
+	e := &encoder{}
+	r.keyPackage.encode(e)
+	e.writePrivateKey(r.initKeyPair.PrivateKey())
+	e.writePrivateKey(r.leafKeyPair.PrivateKey())
+	return e.buf
+}
+
+// NewKeyPackageFromBytes returns a key package from the given bytes. Its
+// signatures are not verified.
+func NewKeyPackageFromBytes(serialized []byte) (*KeyPackage, error) {
+	d := newDecoder("KeyPackage", serialized)
+	keyPackage := decodeKeyPackage(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return keyPackage, nil
+}
+
+// KeyPackage is a member's offer to be added to groups: the key that the
+// secrets of a Welcome are encrypted to, and the member's leaf.
+type KeyPackage struct {
+	initKey   ecc.ECPublicKeyable
+	leaf      *leafNode
+	signature [64]byte
+}
+
+// IdentityKey returns the identity key of the key package's owner.
+func (k *KeyPackage) IdentityKey() *identity.Key {
+	return k.leaf.identityKey
+}
+
+// Ref returns the hash that identifies the key package in a Welcome.
+func (k *KeyPackage) Ref() []byte {
+	return hash([]byte(labelPrefix+"KeyPackage Reference"), k.Serialize())
+}
+
+// Verify returns an error if the key package or its leaf is not signed by
+// its identity key.
+func (k *KeyPackage) Verify() error {
+	if !k.leaf.verify() || !verifyWithLabel(k.leaf.identityKey.PublicKey(), "KeyPackageTBS", k.content(), k.signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Serialize returns the key package as bytes.
+func (k *KeyPackage) Serialize() []byte {
+	e := &encoder{}
+	k.encode(e)
+	return e.buf
+}
+
+// content returns the signed part of the key package.
+func (k *KeyPackage) content() []byte {
+	e := &encoder{}
+	e.writePublicKey(k.initKey)
+	k.leaf.encode(e)
+	return e.buf
+}
+
+func (k *KeyPackage) encode(e *encoder) {
+	e.buf = append(e.buf, k.content()...)
+	e.writeSignature(k.signature)
+}
+
+func decodeKeyPackage(d *decoder) *KeyPackage {
+	return &KeyPackage{
+		initKey:   d.readPublicKey("KeyPackage.InitKey", false),
+		leaf:      decodeLeafNode(d),
+		signature: d.readSignature("KeyPackage.Signature"),
+	}
+}
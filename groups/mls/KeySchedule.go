@@ -0,0 +1,214 @@
+package mls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"golang.org/x/crypto/hkdf"
+)
+
+// labelPrefix prefixes every label of a key derivation, signature or
+// encryption.
+const labelPrefix = "MLS 1.0 "
+
+// secretLength is the length of every secret, the output length of
+// SHA-256.
+const secretLength = sha256.Size
+
+// AES-128-GCM key and nonce lengths.
+const (
+	keyLength   = 16
+	nonceLength = 12
+)
+
+// maxExpandLength is the longest output of HKDF-Expand with SHA-256.
+const maxExpandLength = 255 * secretLength
+
+// errExpandLength is returned for HKDF-Expand outputs above maxExpandLength.
+var errExpandLength = errors.New("HKDF output is longer than 255 hashes!")
+
+// expandWithLabel is HKDF-Expand with the length, label and context
+// encoded into the info.
+func expandWithLabel(secret []byte, label string, context []byte, length int) ([]byte, error) {
+	if length < 0 || length > maxExpandLength {
+		return nil, errExpandLength
+	}
+
+	output := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, labeledInfo(label, context, length)), output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// expandSecretWithLabel is expandWithLabel for outputs of at most one hash,
+// which every key, nonce and secret of the key schedule is. HKDF-Expand is
+// then a single HMAC, so it can't fail.
+func expandSecretWithLabel(secret []byte, label string, context []byte, length int) []byte {
+	return mac(secret, append(labeledInfo(label, context, length), 1))[:length]
+}
+
+// labeledInfo returns the HKDF info of expandWithLabel.
+func labeledInfo(label string, context []byte, length int) []byte {
+	info := &encoder{}
+	info.buf = append(info.buf, byte(length>>8), byte(length))
+	info.writeBytes([]byte(labelPrefix + label))
+	info.writeBytes(context)
+	return info.buf
+}
+
+// deriveSecret derives a secret with the given label and no context.
+func deriveSecret(secret []byte, label string) []byte {
+	return expandSecretWithLabel(secret, label, nil, secretLength)
+}
+
+// extract is HKDF-Extract.
+func extract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+// hash returns the SHA-256 hash of the concatenated values.
+func hash(values ...[]byte) []byte {
+	digest := sha256.New()
+	for _, value := range values {
+		digest.Write(value)
+	}
+	return digest.Sum(nil)
+}
+
+// mac returns the HMAC-SHA256 of the given message.
+func mac(key, message []byte) []byte {
+	digest := hmac.New(sha256.New, key)
+	digest.Write(message)
+	return digest.Sum(nil)
+}
+
+// signedContent returns the labeled content that is signed.
+func signedContent(label string, content []byte) []byte {
+	signed := &encoder{}
+	signed.writeBytes([]byte(labelPrefix + label))
+	signed.writeBytes(content)
+	return signed.buf
+}
+
+// signWithLabel signs the given content with the given label.
+func signWithLabel(signingKey ecc.ECPrivateKeyable, label string, content []byte) [64]byte {
+	return ecc.CalculateSignature(signingKey, signedContent(label, content))
+}
+
+// verifyWithLabel verifies a signature made with signWithLabel.
+func verifyWithLabel(verifyingKey ecc.ECPublicKeyable, label string, content []byte, signature [64]byte) bool {
+	return ecc.VerifySignature(verifyingKey, signedContent(label, content), signature)
+}
+
+// groupContext is the summary of a group's state in an epoch that every
+// key derivation of the epoch is bound to.
+type groupContext struct {
+	groupID                 []byte
+	epoch                   uint64
+	treeHash                []byte
+	confirmedTranscriptHash []byte
+}
+
+func (c *groupContext) encode(e *encoder) {
+	e.writeBytes(c.groupID)
+	e.writeUint64(c.epoch)
+	e.writeBytes(c.treeHash)
+	e.writeBytes(c.confirmedTranscriptHash)
+}
+
+func (c *groupContext) bytes() []byte {
+	e := &encoder{}
+	c.encode(e)
+	return e.buf
+}
+
+func decodeGroupContext(d *decoder) groupContext {
+	return groupContext{
+		groupID:                 d.readBytes("GroupContext.GroupID"),
+		epoch:                   d.readUint64("GroupContext.Epoch"),
+		treeHash:                d.readSecret("GroupContext.TreeHash", secretLength),
+		confirmedTranscriptHash: d.readBytes("GroupContext.ConfirmedTranscriptHash"),
+	}
+}
+
+// epochSecrets are the secrets of an epoch that are kept after it starts.
+type epochSecrets struct {
+	senderDataSecret   []byte
+	encryptionSecret   []byte
+	exporterSecret     []byte
+	confirmationKey    []byte
+	initSecret         []byte
+	epochAuthenticator []byte
+}
+
+// joinerSecret returns the joiner secret of the next epoch, from the
+// previous epoch's init secret and the commit secret.
+func joinerSecret(initSecret, commitSecret, context []byte) []byte {
+	return expandSecretWithLabel(extract(initSecret, commitSecret), "joiner", context, secretLength)
+}
+
+// memberSecret mixes the (empty) pre-shared key secret into the joiner
+// secret.
+func memberSecret(joinerSecret []byte) []byte {
+	return extract(joinerSecret, make([]byte, secretLength))
+}
+
+// welcomeKey returns the key and nonce that encrypt the group info of a
+// Welcome.
+func welcomeKey(joinerSecret []byte) (key, nonce []byte) {
+	welcomeSecret := deriveSecret(memberSecret(joinerSecret), "welcome")
+	return expandSecretWithLabel(welcomeSecret, "key", nil, keyLength), expandSecretWithLabel(welcomeSecret, "nonce", nil, nonceLength)
+}
+
+// newEpochSecrets derives the secrets of an epoch from its joiner secret
+// and group context.
+func newEpochSecrets(joinerSecret, context []byte) *epochSecrets {
+	epochSecret := expandSecretWithLabel(memberSecret(joinerSecret), "epoch", context, secretLength)
+
+	return &epochSecrets{
+		senderDataSecret:   deriveSecret(epochSecret, "sender data"),
+		encryptionSecret:   deriveSecret(epochSecret, "encryption"),
+		exporterSecret:     deriveSecret(epochSecret, "exporter"),
+		confirmationKey:    deriveSecret(epochSecret, "confirm"),
+		initSecret:         deriveSecret(epochSecret, "init"),
+		epochAuthenticator: deriveSecret(epochSecret, "authentication"),
+	}
+}
+
+// confirmationTag returns the tag that proves knowledge of the epoch's
+// secrets and agreement on its transcript.
+func (s *epochSecrets) confirmationTag(confirmedTranscriptHash []byte) []byte {
+	return mac(s.confirmationKey, confirmedTranscriptHash)
+}
+
+// sealAEAD encrypts with AES-128-GCM.
+func sealAEAD(key, nonce, aad, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// openAEAD decrypts with AES-128-GCM.
+func openAEAD(key, nonce, aad, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,71 @@
+package mls
+
+import (
+	"bytes"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+)
+
+// newLeafNode returns a leaf with the given encryption key, signed with the
+// given identity key pair.
+func newLeafNode(encryptionKey ecc.ECPublicKeyable, identityKeyPair *identity.KeyPair) *leafNode {
+	return newPathLeafNode(encryptionKey, nil, identityKeyPair)
+}
+
+// newPathLeafNode returns a leaf for a commit's path, which holds the parent
+// hash of the lowest node of the path.
+func newPathLeafNode(encryptionKey ecc.ECPublicKeyable, parentHash []byte, identityKeyPair *identity.KeyPair) *leafNode {
+	leaf := &leafNode{
+		encryptionKey: encryptionKey,
+		identityKey:   identityKeyPair.PublicKey(),
+		parentHash:    parentHash,
+	}
+	leaf.signature = signWithLabel(identityKeyPair.PrivateKey(), "LeafNodeTBS", leaf.content())
+
+	return leaf
+}
+
+// leafNode is a member's leaf of the ratchet tree: the key that path
+// secrets are encrypted to, and the identity key that signs the member's
+// messages. Leaves set by a commit also hold the parent hash of the lowest
+// node of the commit's path, which is empty for other leaves.
+type leafNode struct {
+	encryptionKey ecc.ECPublicKeyable
+	identityKey   *identity.Key
+	parentHash    []byte
+	signature     [64]byte
+}
+
+// content returns the signed part of the leaf.
+func (l *leafNode) content() []byte {
+	e := &encoder{}
+	e.writePublicKey(l.encryptionKey)
+	e.writePublicKey(l.identityKey.PublicKey())
+	e.writeBytes(l.parentHash)
+	return e.buf
+}
+
+// verify returns true if the leaf is signed by its identity key.
+func (l *leafNode) verify() bool {
+	return verifyWithLabel(l.identityKey.PublicKey(), "LeafNodeTBS", l.content(), l.signature)
+}
+
+// hasIdentity returns true if the leaf belongs to the given identity key.
+func (l *leafNode) hasIdentity(identityKey *identity.Key) bool {
+	return bytes.Equal(l.identityKey.Serialize(), identityKey.Serialize())
+}
+
+func (l *leafNode) encode(e *encoder) {
+	e.buf = append(e.buf, l.content()...)
+	e.writeSignature(l.signature)
+}
+
+func decodeLeafNode(d *decoder) *leafNode {
+	return &leafNode{
+		encryptionKey: d.readPublicKey("LeafNode.EncryptionKey", false),
+		identityKey:   d.readIdentityKey("LeafNode.IdentityKey"),
+		parentHash:    d.readBytes("LeafNode.ParentHash"),
+		signature:     d.readSignature("LeafNode.Signature"),
+	}
+}
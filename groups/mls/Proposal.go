@@ -0,0 +1,151 @@
+package mls
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// ProposalType is the kind of change a proposal makes to a group.
+type ProposalType uint8
+
+// Supported proposal types.
+const (
+	ProposalAdd    ProposalType = 1
+	ProposalUpdate ProposalType = 2
+	ProposalRemove ProposalType = 3
+)
+
+// Content types of signed group content.
+const (
+	contentApplication uint8 = 1
+	contentProposal    uint8 = 2
+	contentCommit      uint8 = 3
+)
+
+// framedContent returns the content a member signs: the group context of
+// the current epoch, the sender's leaf index, the content type and the
+// content.
+func framedContent(context *groupContext, sender uint32, contentType uint8, content []byte) []byte {
+	e := &encoder{}
+	context.encode(e)
+	e.writeUint32(sender)
+	e.writeUint8(contentType)
+	e.writeBytes(content)
+	return e.buf
+}
+
+// NewProposalFromBytes returns a proposal from the given bytes. Its
+// signature is verified when it is received or committed.
+func NewProposalFromBytes(serialized []byte) (*Proposal, error) {
+	d := newDecoder("Proposal", serialized)
+	proposal := decodeProposal(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return proposal, nil
+}
+
+// Proposal is a member's signed proposal to add a member, remove one or
+// update its own leaf. Proposals take effect when a commit includes them.
+type Proposal struct {
+	groupID      []byte
+	epoch        uint64
+	sender       uint32
+	proposalType ProposalType
+	keyPackage   *KeyPackage
+	leaf         *leafNode
+	removed      uint32
+	signature    [64]byte
+}
+
+// GroupID returns the ID of the proposal's group.
+func (p *Proposal) GroupID() []byte {
+	return p.groupID
+}
+
+// Epoch returns the epoch the proposal was made in.
+func (p *Proposal) Epoch() uint64 {
+	return p.epoch
+}
+
+// Sender returns the leaf index of the proposal's sender.
+func (p *Proposal) Sender() uint32 {
+	return p.sender
+}
+
+// Type returns the proposal's type.
+func (p *Proposal) Type() ProposalType {
+	return p.proposalType
+}
+
+// KeyPackage returns the key package an add proposal adds, or nil.
+func (p *Proposal) KeyPackage() *KeyPackage {
+	return p.keyPackage
+}
+
+// Removed returns the leaf index a remove proposal removes.
+func (p *Proposal) Removed() uint32 {
+	return p.removed
+}
+
+// Serialize returns the proposal as bytes.
+func (p *Proposal) Serialize() []byte {
+	e := &encoder{}
+	p.encode(e)
+	return e.buf
+}
+
+// ref returns the hash that identifies the proposal.
+func (p *Proposal) ref() []byte {
+	return hash([]byte(labelPrefix+"Proposal Reference"), p.Serialize())
+}
+
+// tbs returns the content the sender signs in the given group context.
+func (p *Proposal) tbs(context *groupContext) []byte {
+	return framedContent(context, p.sender, contentProposal, p.body())
+}
+
+// body returns the encoding of the proposed change.
+func (p *Proposal) body() []byte {
+	e := &encoder{}
+	e.writeUint8(uint8(p.proposalType))
+	switch p.proposalType {
+	case ProposalAdd:
+		p.keyPackage.encode(e)
+	case ProposalUpdate:
+		p.leaf.encode(e)
+	case ProposalRemove:
+		e.writeUint32(p.removed)
+	}
+	return e.buf
+}
+
+func (p *Proposal) encode(e *encoder) {
+	e.writeBytes(p.groupID)
+	e.writeUint64(p.epoch)
+	e.writeUint32(p.sender)
+	e.buf = append(e.buf, p.body()...)
+	e.writeSignature(p.signature)
+}
+
+func decodeProposal(d *decoder) *Proposal {
+	p := &Proposal{
+		groupID:      d.readBytes("Proposal.GroupID"),
+		epoch:        d.readUint64("Proposal.Epoch"),
+		sender:       d.readUint32("Proposal.Sender"),
+		proposalType: ProposalType(d.readUint8("Proposal.Type")),
+	}
+	switch p.proposalType {
+	case ProposalAdd:
+		p.keyPackage = decodeKeyPackage(d)
+	case ProposalUpdate:
+		p.leaf = decodeLeafNode(d)
+	case ProposalRemove:
+		p.removed = d.readUint32("Proposal.Removed")
+	default:
+		d.fail("Proposal.Type", errorhelper.ErrUnexpectedField)
+	}
+	p.signature = d.readSignature("Proposal.Signature")
+
+	return p
+}
@@ -0,0 +1,232 @@
+package mls
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// maxForwardJump is how far ahead of a sender's ratchet a message may be.
+const maxForwardJump = 2000
+
+// maxSkippedKeys is how many keys of skipped messages are kept per sender.
+const maxSkippedKeys = 2000
+
+// ErrDuplicateMessage is returned for messages whose key was already used
+// or discarded.
+var ErrDuplicateMessage = errors.New("MLS message key was already used!")
+
+// ErrTooFarInFuture is returned for messages too far ahead of their
+// sender's ratchet.
+var ErrTooFarInFuture = errors.New("MLS message is over 2000 messages into the future!")
+
+// messageKey is the key and nonce of one application message.
+type messageKey struct {
+	key   []byte
+	nonce []byte
+}
+
+// senderRatchet derives the message keys of one sender in an epoch.
+type senderRatchet struct {
+	generation uint32
+	secret     []byte
+	skipped    map[uint32]messageKey
+}
+
+func (r *senderRatchet) clone() *senderRatchet {
+	clone := &senderRatchet{generation: r.generation, secret: r.secret, skipped: make(map[uint32]messageKey, len(r.skipped))}
+	for generation, key := range r.skipped {
+		clone.skipped[generation] = key
+	}
+	return clone
+}
+
+// next returns the key of the current generation and advances the ratchet.
+func (r *senderRatchet) next() (uint32, messageKey) {
+	generation := r.generation
+	context := &encoder{}
+	context.writeUint32(generation)
+
+	key := messageKey{
+		key:   expandSecretWithLabel(r.secret, "key", context.buf, keyLength),
+		nonce: expandSecretWithLabel(r.secret, "nonce", context.buf, nonceLength),
+	}
+	r.secret = expandSecretWithLabel(r.secret, "secret", context.buf, secretLength)
+	r.generation++
+
+	return generation, key
+}
+
+// key returns the key of the given generation. Keys of skipped generations
+// are kept for messages that arrive out of order.
+func (r *senderRatchet) key(generation uint32) (messageKey, error) {
+	if generation < r.generation {
+		key, ok := r.skipped[generation]
+		if !ok {
+			return messageKey{}, ErrDuplicateMessage
+		}
+		delete(r.skipped, generation)
+		return key, nil
+	}
+	if generation-r.generation > maxForwardJump {
+		return messageKey{}, ErrTooFarInFuture
+	}
+
+	for r.generation < generation {
+		skipped, key := r.next()
+		r.skipped[skipped] = key
+	}
+	for len(r.skipped) > maxSkippedKeys {
+		oldest := generation
+		for skipped := range r.skipped {
+			if skipped < oldest {
+				oldest = skipped
+			}
+		}
+		delete(r.skipped, oldest)
+	}
+	_, key := r.next()
+
+	return key, nil
+}
+
+// newSecretTree returns the secret tree of an epoch, rooted at its
+// encryption secret.
+func newSecretTree(encryptionSecret []byte, leaves uint32) *secretTree {
+	return &secretTree{
+		leaves:   leaves,
+		secrets:  map[uint32][]byte{root(leaves): encryptionSecret},
+		ratchets: make(map[uint32]*senderRatchet),
+	}
+}
+
+// secretTree derives a sender ratchet for every leaf of an epoch. Secrets
+// are deleted as soon as both of their children are derived, so only the
+// frontier of the tree is kept.
+type secretTree struct {
+	leaves   uint32
+	secrets  map[uint32][]byte
+	ratchets map[uint32]*senderRatchet
+}
+
+// ratchet returns the sender ratchet of the given leaf, deriving it on
+// first use. It returns nil if the leaf's secret is gone, which only
+// happens for corrupted state.
+func (t *secretTree) ratchet(index uint32) *senderRatchet {
+	if ratchet, ok := t.ratchets[index]; ok {
+		return ratchet
+	}
+
+	leaf := 2 * index
+	node := leaf
+	for t.secrets[node] == nil {
+		if node == root(t.leaves) {
+			return nil
+		}
+		node = parent(node)
+	}
+	for node != leaf {
+		secret := t.secrets[node]
+		delete(t.secrets, node)
+		t.secrets[left(node)] = expandSecretWithLabel(secret, "tree", []byte("left"), secretLength)
+		t.secrets[right(node)] = expandSecretWithLabel(secret, "tree", []byte("right"), secretLength)
+		if inSubtree(leaf, left(node)) {
+			node = left(node)
+		} else {
+			node = right(node)
+		}
+	}
+
+	ratchet := &senderRatchet{
+		secret:  expandSecretWithLabel(t.secrets[leaf], "application", nil, secretLength),
+		skipped: make(map[uint32]messageKey),
+	}
+	delete(t.secrets, leaf)
+	t.ratchets[index] = ratchet
+
+	return ratchet
+}
+
+func (t *secretTree) encode(e *encoder) {
+	e.writeUint32(t.leaves)
+
+	nodes := make([]uint32, 0, len(t.secrets))
+	for node := range t.secrets {
+		nodes = append(nodes, node)
+	}
+	e.writeUint32(uint32(len(nodes)))
+	for _, node := range sortUint32s(nodes) {
+		e.writeUint32(node)
+		e.writeBytes(t.secrets[node])
+	}
+
+	indexes := make([]uint32, 0, len(t.ratchets))
+	for index := range t.ratchets {
+		indexes = append(indexes, index)
+	}
+	e.writeUint32(uint32(len(indexes)))
+	for _, index := range sortUint32s(indexes) {
+		ratchet := t.ratchets[index]
+		e.writeUint32(index)
+		e.writeUint32(ratchet.generation)
+		e.writeBytes(ratchet.secret)
+		generations := make([]uint32, 0, len(ratchet.skipped))
+		for generation := range ratchet.skipped {
+			generations = append(generations, generation)
+		}
+		e.writeUint32(uint32(len(generations)))
+		for _, generation := range sortUint32s(generations) {
+			e.writeUint32(generation)
+			e.writeBytes(ratchet.skipped[generation].key)
+			e.writeBytes(ratchet.skipped[generation].nonce)
+		}
+	}
+}
+
+func decodeSecretTree(d *decoder, leaves uint32) *secretTree {
+	t := &secretTree{leaves: leaves, secrets: make(map[uint32][]byte), ratchets: make(map[uint32]*senderRatchet)}
+	if d.readUint32("SecretTree.Leaves") != leaves && d.err == nil {
+		d.fail("SecretTree.Leaves", errorhelper.ErrInvalidCounter)
+	}
+
+	secrets := d.readCount("SecretTree.Secrets", 2*int(leaves))
+	for i := 0; i < secrets; i++ {
+		node := d.readUint32("SecretTree.Node")
+		if node >= 2*leaves-1 && d.err == nil {
+			d.fail("SecretTree.Node", errorhelper.ErrInvalidCounter)
+		}
+		t.secrets[node] = d.readSecret("SecretTree.Secret", secretLength)
+	}
+
+	ratchets := d.readCount("SecretTree.Ratchets", int(leaves))
+	for i := 0; i < ratchets; i++ {
+		index := d.readUint32("SenderRatchet.Leaf")
+		if index >= leaves && d.err == nil {
+			d.fail("SenderRatchet.Leaf", errorhelper.ErrInvalidCounter)
+		}
+		ratchet := &senderRatchet{
+			generation: d.readUint32("SenderRatchet.Generation"),
+			secret:     d.readSecret("SenderRatchet.Secret", secretLength),
+			skipped:    make(map[uint32]messageKey),
+		}
+		skipped := d.readCount("SenderRatchet.Skipped", maxSkippedKeys)
+		for j := 0; j < skipped; j++ {
+			generation := d.readUint32("SenderRatchet.SkippedGeneration")
+			ratchet.skipped[generation] = messageKey{
+				key:   d.readSecret("SenderRatchet.SkippedKey", keyLength),
+				nonce: d.readSecret("SenderRatchet.SkippedNonce", nonceLength),
+			}
+		}
+		t.ratchets[index] = ratchet
+	}
+
+	return t
+}
+
+// sortUint32s sorts the given values in ascending order and returns them,
+// so encodings don't depend on map order.
+func sortUint32s(values []uint32) []uint32 {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
@@ -0,0 +1,425 @@
+package mls
+
+import (
+	"bytes"
+	"math/bits"
+	"sort"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// MaxMembers is the largest number of leaves a group's tree can have.
+const MaxMembers = 1 << 16
+
+// The tree is stored as an array of nodes, where leaf i is node 2i and each
+// parent sits between its subtrees. The number of leaves is always a power
+// of two.
+
+// level returns the height of the given node above the leaves.
+func level(node uint32) uint32 {
+	k := uint32(0)
+	for (node>>k)&1 == 1 {
+		k++
+	}
+	return k
+}
+
+// root returns the root node of a tree with the given number of leaves.
+func root(leaves uint32) uint32 {
+	width := 2*(leaves-1) + 1
+	return 1<<(bits.Len32(width)-1) - 1
+}
+
+func left(node uint32) uint32 {
+	return node ^ (1 << (level(node) - 1))
+}
+
+func right(node uint32) uint32 {
+	return node ^ (3 << (level(node) - 1))
+}
+
+func parent(node uint32) uint32 {
+	k := level(node)
+	b := (node >> (k + 1)) & 1
+	return (node | (1 << k)) ^ (b << (k + 1))
+}
+
+func sibling(node uint32) uint32 {
+	p := parent(node)
+	if node < p {
+		return right(p)
+	}
+	return left(p)
+}
+
+// directPath returns the ancestors of the given node, up to the root.
+func directPath(node, leaves uint32) []uint32 {
+	var path []uint32
+	for r := root(leaves); node != r; {
+		node = parent(node)
+		path = append(path, node)
+	}
+	return path
+}
+
+// inSubtree returns true if the given node is in the subtree of ancestor.
+func inSubtree(node, ancestor uint32) bool {
+	k := level(ancestor)
+	return node+(1<<k) > ancestor && node < ancestor+(1<<k)
+}
+
+// parentNode is an inner node of the ratchet tree. Unmerged leaves were
+// added below it after its key was set, so they don't know its private
+// key. The parent hash is that of the next node up the path of the commit
+// that set the key, or empty for the top node.
+type parentNode struct {
+	publicKey      ecc.ECPublicKeyable
+	parentHash     []byte
+	unmergedLeaves []uint32
+}
+
+// newRatchetTree returns a tree with the given leaf only.
+func newRatchetTree(leaf *leafNode) *ratchetTree {
+	return &ratchetTree{leaves: []*leafNode{leaf}}
+}
+
+// ratchetTree is a group's tree of public keys. Blank nodes are nil. Nodes
+// are never modified, only replaced, so clones can share them.
+type ratchetTree struct {
+	leaves  []*leafNode
+	parents []*parentNode
+}
+
+func (t *ratchetTree) clone() *ratchetTree {
+	return &ratchetTree{
+		leaves:  append([]*leafNode{}, t.leaves...),
+		parents: append([]*parentNode{}, t.parents...),
+	}
+}
+
+func (t *ratchetTree) leafCount() uint32 {
+	return uint32(len(t.leaves))
+}
+
+// leaf returns the given leaf, or nil if it is blank or outside the tree.
+func (t *ratchetTree) leaf(index uint32) *leafNode {
+	if index >= t.leafCount() {
+		return nil
+	}
+	return t.leaves[index]
+}
+
+// publicKey returns the public key of the given node, or nil if it is
+// blank or outside the tree.
+func (t *ratchetTree) publicKey(node uint32) ecc.ECPublicKeyable {
+	if node%2 == 0 {
+		if leaf := t.leaf(node / 2); leaf != nil {
+			return leaf.encryptionKey
+		}
+		return nil
+	}
+	if node/2 < uint32(len(t.parents)) && t.parents[node/2] != nil {
+		return t.parents[node/2].publicKey
+	}
+	return nil
+}
+
+// resolution returns the nodes whose keys cover the subtree of the given
+// node: the node itself and its unmerged leaves, or if it is blank, the
+// resolutions of its children.
+func (t *ratchetTree) resolution(node uint32) []uint32 {
+	if node%2 == 0 {
+		if t.leaves[node/2] == nil {
+			return nil
+		}
+		return []uint32{node}
+	}
+	if p := t.parents[node/2]; p != nil {
+		resolution := []uint32{node}
+		for _, leaf := range p.unmergedLeaves {
+			resolution = append(resolution, 2*leaf)
+		}
+		return resolution
+	}
+	return append(t.resolution(left(node)), t.resolution(right(node))...)
+}
+
+// filteredDirectPath returns the ancestors of the given leaf whose other
+// child, returned as the copath, has a non-empty resolution. These are the
+// nodes a commit from the leaf sets keys for.
+func (t *ratchetTree) filteredDirectPath(index uint32) (path, copath []uint32) {
+	node := 2 * index
+	for _, ancestor := range directPath(node, t.leafCount()) {
+		if child := sibling(node); len(t.resolution(child)) > 0 {
+			path = append(path, ancestor)
+			copath = append(copath, child)
+		}
+		node = ancestor
+	}
+	return path, copath
+}
+
+// addLeaf puts the given leaf at the leftmost blank leaf, extending the
+// tree if it is full, and returns its index.
+func (t *ratchetTree) addLeaf(leaf *leafNode) uint32 {
+	index := t.leafCount()
+	for i, existing := range t.leaves {
+		if existing == nil {
+			index = uint32(i)
+			break
+		}
+	}
+	if index == t.leafCount() {
+		t.leaves = append(t.leaves, make([]*leafNode, len(t.leaves))...)
+		t.parents = append(t.parents, make([]*parentNode, len(t.leaves)-len(t.parents)-1)...)
+	}
+
+	t.leaves[index] = leaf
+	for _, ancestor := range directPath(2*index, t.leafCount()) {
+		if p := t.parents[ancestor/2]; p != nil {
+			unmerged := append(append([]uint32{}, p.unmergedLeaves...), index)
+			sort.Slice(unmerged, func(i, j int) bool { return unmerged[i] < unmerged[j] })
+			t.parents[ancestor/2] = &parentNode{publicKey: p.publicKey, parentHash: p.parentHash, unmergedLeaves: unmerged}
+		}
+	}
+
+	return index
+}
+
+// removeLeaf blanks the given leaf and its direct path, and shrinks the
+// tree while its right half is blank.
+func (t *ratchetTree) removeLeaf(index uint32) {
+	t.leaves[index] = nil
+	t.blankPath(index)
+
+	for n := len(t.leaves); n > 1; n /= 2 {
+		for _, leaf := range t.leaves[n/2:] {
+			if leaf != nil {
+				return
+			}
+		}
+		t.leaves = t.leaves[:n/2]
+		t.parents = t.parents[:n/2-1]
+	}
+}
+
+// updateLeaf replaces the given leaf and blanks its direct path.
+func (t *ratchetTree) updateLeaf(index uint32, leaf *leafNode) {
+	t.leaves[index] = leaf
+	t.blankPath(index)
+}
+
+// setPath blanks the direct path of the given leaf and sets the keys of its
+// filtered direct path, from the top down so each node holds the parent hash
+// of the node above it. It returns the parent hash the leaf must hold.
+func (t *ratchetTree) setPath(index uint32, path, copath []uint32, keys []ecc.ECPublicKeyable) []byte {
+	t.blankPath(index)
+
+	var parentHash []byte
+	for i := len(path) - 1; i >= 0; i-- {
+		t.parents[path[i]/2] = &parentNode{publicKey: keys[i], parentHash: parentHash}
+		parentHash = t.parentHash(path[i], copath[i])
+	}
+
+	return parentHash
+}
+
+func (t *ratchetTree) blankPath(index uint32) {
+	for _, ancestor := range directPath(2*index, t.leafCount()) {
+		t.parents[ancestor/2] = nil
+	}
+}
+
+// hash returns the hash of the whole tree, which every member must agree
+// on.
+func (t *ratchetTree) hash() []byte {
+	e := &encoder{}
+	t.encode(e)
+	return hash([]byte(labelPrefix+"RatchetTree"), e.buf)
+}
+
+// parentHash returns the parent hash of the given parent node, which the
+// node below it on the other side from the given sibling must hold. The
+// sibling's subtree is hashed as it was when the node's key was set, without
+// the leaves added since.
+func (t *ratchetTree) parentHash(node, sibling uint32) []byte {
+	p := t.parents[node/2]
+	added := make(map[uint32]bool, len(p.unmergedLeaves))
+	for _, leaf := range p.unmergedLeaves {
+		added[leaf] = true
+	}
+
+	e := &encoder{}
+	e.writePublicKey(p.publicKey)
+	e.writeBytes(p.parentHash)
+	e.writeBytes(t.subtreeHash(sibling, added))
+	return hash([]byte(labelPrefix+"ParentHash"), e.buf)
+}
+
+// subtreeHash returns the tree hash of the subtree of the given node, as if
+// the excluded leaves were blank and not unmerged anywhere.
+func (t *ratchetTree) subtreeHash(node uint32, excluded map[uint32]bool) []byte {
+	e := &encoder{}
+	if node%2 == 0 {
+		e.writeUint8(1)
+		e.writeUint32(node / 2)
+		if leaf := t.leaves[node/2]; leaf != nil && !excluded[node/2] {
+			e.writeUint8(1)
+			leaf.encode(e)
+		} else {
+			e.writeUint8(0)
+		}
+		return hash([]byte(labelPrefix+"TreeHash"), e.buf)
+	}
+
+	e.writeUint8(2)
+	if p := t.parents[node/2]; p != nil {
+		var unmerged []uint32
+		for _, leaf := range p.unmergedLeaves {
+			if !excluded[leaf] {
+				unmerged = append(unmerged, leaf)
+			}
+		}
+		e.writeUint8(1)
+		e.writePublicKey(p.publicKey)
+		e.writeBytes(p.parentHash)
+		e.writeUint32(uint32(len(unmerged)))
+		for _, leaf := range unmerged {
+			e.writeUint32(leaf)
+		}
+	} else {
+		e.writeUint8(0)
+	}
+	e.writeBytes(t.subtreeHash(left(node), excluded))
+	e.writeBytes(t.subtreeHash(right(node), excluded))
+	return hash([]byte(labelPrefix+"TreeHash"), e.buf)
+}
+
+// verifyParentHashes returns true if every parent node of the tree is
+// parent-hash valid, so it was set by a commit together with a chain of
+// nodes down to the committer's signed leaf.
+func (t *ratchetTree) verifyParentHashes() bool {
+	for i, p := range t.parents {
+		if p == nil {
+			continue
+		}
+		node := uint32(2*i + 1)
+		if !t.chained(node, left(node), right(node)) && !t.chained(node, right(node), left(node)) {
+			return false
+		}
+	}
+	return true
+}
+
+// chained returns true if the subtree of the given child of a parent node
+// holds the node below it on its commit's path. That is the only node of the
+// child's resolution that isn't one of the parent's unmerged leaves. It must
+// hold the parent's hash with the other child as sibling, and have the
+// parent's unmerged leaves below it as its own.
+func (t *ratchetTree) chained(node, child, sibling uint32) bool {
+	p := t.parents[node/2]
+	added := make(map[uint32]bool, len(p.unmergedLeaves))
+	for _, leaf := range p.unmergedLeaves {
+		added[2*leaf] = true
+	}
+	var below []uint32
+	for _, member := range t.resolution(child) {
+		if !added[member] {
+			below = append(below, member)
+		}
+	}
+	if len(below) != 1 {
+		return false
+	}
+
+	var parentHash []byte
+	var unmerged []uint32
+	if below[0]%2 == 0 {
+		parentHash = t.leaves[below[0]/2].parentHash
+	} else {
+		parentHash = t.parents[below[0]/2].parentHash
+		unmerged = t.parents[below[0]/2].unmergedLeaves
+	}
+	count := 0
+	for _, leaf := range p.unmergedLeaves {
+		if inSubtree(2*leaf, below[0]) {
+			count++
+		}
+	}
+	if count != len(unmerged) {
+		return false
+	}
+	for _, leaf := range unmerged {
+		if !added[2*leaf] {
+			return false
+		}
+	}
+
+	return bytes.Equal(parentHash, t.parentHash(node, sibling))
+}
+
+func (t *ratchetTree) encode(e *encoder) {
+	e.writeUint32(t.leafCount())
+	for _, leaf := range t.leaves {
+		if leaf == nil {
+			e.writeUint8(0)
+			continue
+		}
+		e.writeUint8(1)
+		leaf.encode(e)
+	}
+	for _, p := range t.parents {
+		if p == nil {
+			e.writeUint8(0)
+			continue
+		}
+		e.writeUint8(1)
+		e.writePublicKey(p.publicKey)
+		e.writeBytes(p.parentHash)
+		e.writeUint32(uint32(len(p.unmergedLeaves)))
+		for _, leaf := range p.unmergedLeaves {
+			e.writeUint32(leaf)
+		}
+	}
+}
+
+func decodeRatchetTree(d *decoder) *ratchetTree {
+	count := d.readCount("RatchetTree.Leaves", MaxMembers)
+	if d.err == nil && (count == 0 || count&(count-1) != 0) {
+		d.fail("RatchetTree.Leaves", errorhelper.ErrInvalidLength)
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	t := &ratchetTree{leaves: make([]*leafNode, count), parents: make([]*parentNode, count-1)}
+	for i := range t.leaves {
+		if d.readUint8("RatchetTree.Leaf") == 1 {
+			t.leaves[i] = decodeLeafNode(d)
+		}
+	}
+	for i := range t.parents {
+		if d.readUint8("RatchetTree.Parent") != 1 {
+			continue
+		}
+		p := &parentNode{
+			publicKey:  d.readPublicKey("RatchetTree.ParentKey", false),
+			parentHash: d.readBytes("RatchetTree.ParentHash"),
+		}
+		unmerged := d.readCount("RatchetTree.UnmergedLeaves", count)
+		for j := 0; j < unmerged; j++ {
+			leaf := d.readUint32("RatchetTree.UnmergedLeaf")
+			if leaf >= uint32(count) || !inSubtree(2*leaf, uint32(2*i+1)) {
+				d.fail("RatchetTree.UnmergedLeaf", errorhelper.ErrInvalidCounter)
+			}
+			p.unmergedLeaves = append(p.unmergedLeaves, leaf)
+		}
+		t.parents[i] = p
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	return t
+}
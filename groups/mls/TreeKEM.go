@@ -0,0 +1,81 @@
+package mls
+
+import (
+	"bytes"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/hpke"
+)
+
+// nodeKeyPair derives the key pair of a node from its path secret.
+func nodeKeyPair(pathSecret []byte) (*ecc.ECKeyPair, error) {
+	return hpke.DeriveKeyPair(deriveSecret(pathSecret, "node"))
+}
+
+// derivePath derives the key pairs of the given number of path nodes,
+// starting from the given path secret, and checks them against the given
+// public keys if there are any. It returns the key pairs and the secret
+// after the last node, which is the commit secret.
+func derivePath(pathSecret []byte, length int, publicKeys []ecc.ECPublicKeyable) ([]*ecc.ECKeyPair, []byte, error) {
+	keyPairs := make([]*ecc.ECKeyPair, length)
+	for i := range keyPairs {
+		keyPair, err := nodeKeyPair(pathSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		if publicKeys != nil && !sameKey(keyPair.PublicKey(), publicKeys[i]) {
+			return nil, nil, ErrPathKeyMismatch
+		}
+		keyPairs[i] = keyPair
+		pathSecret = deriveSecret(pathSecret, "path")
+	}
+
+	return keyPairs, pathSecret, nil
+}
+
+// commonAncestor returns the lowest node whose subtree has both given
+// nodes.
+func commonAncestor(x, y uint32) uint32 {
+	ancestor := x
+	for !inSubtree(y, ancestor) {
+		ancestor = parent(ancestor)
+	}
+	return ancestor
+}
+
+// sameKey returns true if the given public keys are equal.
+func sameKey(a, b ecc.ECPublicKeyable) bool {
+	return a != nil && b != nil && bytes.Equal(a.Serialize(), b.Serialize())
+}
+
+// encryptWithLabel encrypts a secret to the given public key with HPKE,
+// bound to the given label and context.
+func encryptWithLabel(publicKey ecc.ECPublicKeyable, label string, context, plaintext []byte) (*hpkeCiphertext, error) {
+	suite, err := hpke.NewSuite(hpke.AES128GCM)
+	if err != nil {
+		return nil, err
+	}
+	enc, ciphertext, err := suite.Seal(publicKey, encryptContext(label, context), nil, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeCiphertext{enc: enc, ciphertext: ciphertext}, nil
+}
+
+// decryptWithLabel decrypts a secret encrypted with encryptWithLabel.
+func decryptWithLabel(keyPair *ecc.ECKeyPair, label string, context []byte, ciphertext *hpkeCiphertext) ([]byte, error) {
+	suite, err := hpke.NewSuite(hpke.AES128GCM)
+	if err != nil {
+		return nil, err
+	}
+
+	return suite.Open(ciphertext.enc, keyPair, encryptContext(label, context), nil, ciphertext.ciphertext)
+}
+
+func encryptContext(label string, context []byte) []byte {
+	e := &encoder{}
+	e.writeBytes([]byte(labelPrefix + label))
+	e.writeBytes(context)
+	return e.buf
+}
@@ -0,0 +1,129 @@
+package mls
+
+// NewWelcomeFromBytes returns a Welcome from the given bytes.
+func NewWelcomeFromBytes(serialized []byte) (*Welcome, error) {
+	d := newDecoder("Welcome", serialized)
+	welcome := &Welcome{}
+	secrets := d.readCount("Secrets", MaxMembers)
+	for i := 0; i < secrets; i++ {
+		welcome.secrets = append(welcome.secrets, &encryptedGroupSecrets{
+			keyPackageRef: d.readSecret("KeyPackageRef", secretLength),
+			ciphertext:    decodeHPKECiphertext(d),
+		})
+	}
+	welcome.encryptedGroupInfo = d.readBytes("EncryptedGroupInfo")
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return welcome, nil
+}
+
+// Welcome lets the members added by a commit join the group in the epoch
+// the commit starts. It carries the group's tree and context, encrypted
+// with a key derived from the epoch's joiner secret, which is encrypted to
+// each new member's key package.
+type Welcome struct {
+	secrets            []*encryptedGroupSecrets
+	encryptedGroupInfo []byte
+}
+
+// KeyPackageRefs returns the references of the key packages the Welcome is
+// for, so new members can find their key package record.
+func (w *Welcome) KeyPackageRefs() [][]byte {
+	refs := make([][]byte, len(w.secrets))
+	for i, secrets := range w.secrets {
+		refs[i] = secrets.keyPackageRef
+	}
+	return refs
+}
+
+// Serialize returns the Welcome as bytes.
+func (w *Welcome) Serialize() []byte {
+	e := &encoder{}
+	e.writeUint32(uint32(len(w.secrets)))
+	for _, secrets := range w.secrets {
+		e.writeBytes(secrets.keyPackageRef)
+		secrets.ciphertext.encode(e)
+	}
+	e.writeBytes(w.encryptedGroupInfo)
+	return e.buf
+}
+
+// encryptedGroupSecrets are the group secrets encrypted to one key
+// package.
+type encryptedGroupSecrets struct {
+	keyPackageRef []byte
+	ciphertext    *hpkeCiphertext
+}
+
+// groupSecrets are the secrets a new member needs: the joiner secret of the
+// epoch, and the path secret of the lowest node the new member shares with
+// the committer, if any.
+type groupSecrets struct {
+	joinerSecret []byte
+	pathSecret   []byte
+}
+
+func (s *groupSecrets) bytes() []byte {
+	e := &encoder{}
+	e.writeBytes(s.joinerSecret)
+	e.writeBytes(s.pathSecret)
+	return e.buf
+}
+
+func decodeGroupSecrets(serialized []byte) (*groupSecrets, error) {
+	d := newDecoder("GroupSecrets", serialized)
+	secrets := &groupSecrets{
+		joinerSecret: d.readSecret("JoinerSecret", secretLength),
+		pathSecret:   d.readBytes("PathSecret"),
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// groupInfo is the state of the group that a new member joins, signed by
+// the committer.
+type groupInfo struct {
+	context         groupContext
+	tree            *ratchetTree
+	confirmationTag []byte
+	signer          uint32
+	signature       [64]byte
+}
+
+// content returns the signed part of the group info.
+func (i *groupInfo) content() []byte {
+	e := &encoder{}
+	i.context.encode(e)
+	i.tree.encode(e)
+	e.writeBytes(i.confirmationTag)
+	e.writeUint32(i.signer)
+	return e.buf
+}
+
+func (i *groupInfo) bytes() []byte {
+	e := &encoder{}
+	e.buf = append(e.buf, i.content()...)
+	e.writeSignature(i.signature)
+	return e.buf
+}
+
+func decodeGroupInfo(serialized []byte) (*groupInfo, error) {
+	d := newDecoder("GroupInfo", serialized)
+	info := &groupInfo{
+		context:         decodeGroupContext(d),
+		tree:            decodeRatchetTree(d),
+		confirmationTag: d.readSecret("ConfirmationTag", secretLength),
+		signer:          d.readUint32("Signer"),
+		signature:       d.readSignature("Signature"),
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
@@ -3,6 +3,8 @@ package ratchet
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 var messageKeySeed = []byte{0x01}
@@ -17,12 +19,20 @@ func NewSenderChainKey(iteration uint32, chainKey []byte) *SenderChainKey {
 }
 
 // NewSenderChainKeyFromStruct will return a new chain key object from the
-// given serializeable structure.
-func NewSenderChainKeyFromStruct(structure *SenderChainKeyStructure) *SenderChainKey {
+// given serializeable structure. An error is returned if the chain key is
+// missing or is not 32 bytes.
+func NewSenderChainKeyFromStruct(structure *SenderChainKeyStructure) (*SenderChainKey, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SenderChainKey", "Structure", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckLength("SenderChainKey", "ChainKey", structure.ChainKey, 32); err != nil {
+		return nil, err
+	}
+
 	return &SenderChainKey{
 		iteration: structure.Iteration,
 		chainKey:  structure.ChainKey,
-	}
+	}, nil
 }
 
 // NewStructFromSenderChainKeys returns a serializeable structure of chain keys.
@@ -3,6 +3,7 @@ package ratchet
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // KdfInfo is optional bytes to include in deriving secrets with KDF.
@@ -31,14 +32,25 @@ func NewSenderMessageKey(iteration uint32, seed []byte) (*SenderMessageKey, erro
 }
 
 // NewSenderMessageKeyFromStruct will return a new message key object from the
-// given serializeable structure.
-func NewSenderMessageKeyFromStruct(structure *SenderMessageKeyStructure) *SenderMessageKey {
+// given serializeable structure. An error is returned if the IV or cipher
+// key are missing or have the wrong length.
+func NewSenderMessageKeyFromStruct(structure *SenderMessageKeyStructure) (*SenderMessageKey, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SenderMessageKey", "Structure", errorhelper.ErrMissingField)
+	}
+	errs := errorhelper.NewMultiError()
+	errs.Add(errorhelper.CheckLength("SenderMessageKey", "IV", structure.IV, 16))
+	errs.Add(errorhelper.CheckLength("SenderMessageKey", "CipherKey", structure.CipherKey, 32))
+	if errs.HasErrors() {
+		return nil, errs
+	}
+
 	return &SenderMessageKey{
 		iteration: structure.Iteration,
 		iv:        structure.IV,
 		cipherKey: structure.CipherKey,
 		seed:      structure.Seed,
-	}
+	}, nil
 }
 
 // NewStructFromSenderMessageKey returns a serializeable structure of message keys.
@@ -3,8 +3,17 @@ package record
 import (
 	"errors"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
+// maxSenderKeyStates is the number of sender key states a record keeps, so
+// that messages from a sender's previous chains can still be decrypted.
+const maxSenderKeyStates = 5
+
+// ErrNoSenderKeyState is returned when a record has no sender key state with
+// the requested key ID.
+var ErrNoSenderKeyState = errors.New("No sender key for for ID")
+
 // SenderKeySerializer is an interface for serializing and deserializing
 // SenderKey objects into bytes. An implementation of this interface should be
 // used to encode/decode the object into JSON, Protobuffers, etc.
@@ -30,10 +39,17 @@ func NewSenderKeyFromBytes(serialized []byte, serializer SenderKeySerializer,
 func NewSenderKeyFromStruct(structure *SenderKeyStructure, serializer SenderKeySerializer,
 	stateSerializer SenderKeyStateSerializer) (*SenderKey, error) {
 
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SenderKey", "Structure", errorhelper.ErrMissingField)
+	}
+	err := errorhelper.CheckMaxCount("SenderKey", "SenderKeyStates", len(structure.SenderKeyStates), maxSenderKeyStates)
+	if err != nil {
+		return nil, err
+	}
+
 	// Build our sender key states from structure.
 	senderKeyStates := make([]*SenderKeyState, len(structure.SenderKeyStates))
 	for i := range structure.SenderKeyStates {
-		var err error
 		senderKeyStates[i], err = NewSenderKeyStateFromStructure(structure.SenderKeyStates[i], stateSerializer)
 		if err != nil {
 			return nil, err
@@ -44,6 +60,7 @@ func NewSenderKeyFromStruct(structure *SenderKeyStructure, serializer SenderKeyS
 	senderKey := &SenderKey{
 		senderKeyStates: senderKeyStates,
 		serializer:      serializer,
+		stateSerializer: stateSerializer,
 	}
 
 	return senderKey, nil
@@ -93,7 +110,7 @@ func (k *SenderKey) GetSenderKeyStateByID(keyID uint32) (*SenderKeyState, error)
 		}
 	}
 
-	return nil, errors.New("No sender key for for ID")
+	return nil, ErrNoSenderKeyState
 }
 
 // IsEmpty will return false if there is more than one state in this
@@ -110,7 +127,7 @@ func (k *SenderKey) AddSenderKeyState(id uint32, iteration uint32,
 	newState := NewSenderKeyStateFromPublicKey(id, iteration, chainKey, signatureKey, k.stateSerializer)
 	k.senderKeyStates = append(k.senderKeyStates, newState)
 
-	if len(k.senderKeyStates) > maxMessageKeys {
+	if len(k.senderKeyStates) > maxSenderKeyStates {
 		k.senderKeyStates = k.senderKeyStates[1:]
 	}
 }
@@ -121,7 +138,7 @@ func (k *SenderKey) SetSenderKeyState(id uint32, iteration uint32,
 	chainKey []byte, signatureKey *ecc.ECKeyPair) {
 
 	newState := NewSenderKeyState(id, iteration, chainKey, signatureKey, k.stateSerializer)
-	k.senderKeyStates = make([]*SenderKeyState, 0, maxMessageKeys/2)
+	k.senderKeyStates = make([]*SenderKeyState, 0, maxSenderKeyStates)
 	k.senderKeyStates = append(k.senderKeyStates, newState)
 }
 
@@ -4,6 +4,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/ratchet"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 const maxMessageKeys = 2000
@@ -62,24 +63,52 @@ func NewSenderKeyStateFromPublicKey(keyID uint32, iteration uint32, chainKey []b
 func NewSenderKeyStateFromStructure(structure *SenderKeyStateStructure,
 	serializer SenderKeyStateSerializer) (*SenderKeyState, error) {
 
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SenderKeyState", "Structure", errorhelper.ErrMissingField)
+	}
+	err := errorhelper.CheckMaxCount("SenderKeyState", "Keys", len(structure.Keys), maxMessageKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	// Convert our ecc keys from bytes into object form.
 	signingKeyPublic, err := ecc.DecodePoint(structure.SigningKeyPublic, 0)
 	if err != nil {
 		return nil, err
 	}
-	signingKeyPrivate := ecc.NewDjbECPrivateKey(bytehelper.SliceToArray(structure.SigningKeyPrivate))
+	var signingKeyPrivate ecc.ECPrivateKeyable
+	if structure.SigningKeyPrivate != nil {
+		err = errorhelper.CheckLength("SenderKeyState", "SigningKeyPrivate", structure.SigningKeyPrivate, 32)
+		if err != nil {
+			return nil, err
+		}
+		signingKeyPrivate = ecc.NewDjbECPrivateKey(bytehelper.SliceToArray(structure.SigningKeyPrivate))
+	}
+
+	// Build our sender chain key from structure.
+	senderChainKey, err := ratchet.NewSenderChainKeyFromStruct(structure.SenderChainKey)
+	if err != nil {
+		return nil, err
+	}
 
-	// Build our sender message keys from structure
+	// Build our sender message keys from structure. Stored message keys are
+	// for skipped messages, so they must be behind the chain key.
 	senderMessageKeys := make([]*ratchet.SenderMessageKey, len(structure.Keys))
 	for i := range structure.Keys {
-		senderMessageKeys[i] = ratchet.NewSenderMessageKeyFromStruct(structure.Keys[i])
+		senderMessageKeys[i], err = ratchet.NewSenderMessageKeyFromStruct(structure.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if senderMessageKeys[i].Iteration() >= senderChainKey.Iteration() {
+			return nil, errorhelper.NewDecodeError("SenderKeyState", "Keys", errorhelper.ErrInvalidCounter)
+		}
 	}
 
 	// Build our state object.
 	state := &SenderKeyState{
 		keys:           senderMessageKeys,
 		keyID:          structure.KeyID,
-		senderChainKey: ratchet.NewSenderChainKeyFromStruct(structure.SenderChainKey),
+		senderChainKey: senderChainKey,
 		signingKeyPair: ecc.NewECKeyPair(signingKeyPublic, signingKeyPrivate),
 		serializer:     serializer,
 	}
@@ -132,12 +161,15 @@ func (k *SenderKeyState) HasSenderMessageKey(iteration uint32) bool {
 }
 
 // AddSenderMessageKey will add the given sender message key to the state.
-func (k *SenderKeyState) AddSenderMessageKey(senderMsgKey *ratchet.SenderMessageKey) {
+// It returns true if the oldest key was dropped to make room.
+func (k *SenderKeyState) AddSenderMessageKey(senderMsgKey *ratchet.SenderMessageKey) bool {
 	k.keys = append(k.keys, senderMsgKey)
 
 	if len(k.keys) > maxMessageKeys {
 		k.keys = k.keys[1:]
+		return true
 	}
+	return false
 }
 
 // SetSenderChainKey will set the state's sender chain key with the given key.
@@ -172,12 +204,18 @@ func (k *SenderKeyState) structure() *SenderKeyStateStructure {
 		keys[i] = ratchet.NewStructFromSenderMessageKey(k.keys[i])
 	}
 
+	// Convert our signing private key. Receiving states only hold the public key.
+	var signingKeyPrivate []byte
+	if k.signingKeyPair.PrivateKey() != nil {
+		signingKeyPrivate = bytehelper.ArrayToSlice(k.signingKeyPair.PrivateKey().Serialize())
+	}
+
 	// Build and return our state structure.
 	return &SenderKeyStateStructure{
 		Keys:              keys,
 		KeyID:             k.keyID,
 		SenderChainKey:    ratchet.NewStructFromSenderChainKey(k.senderChainKey),
-		SigningKeyPrivate: bytehelper.ArrayToSlice(k.signingKeyPair.PrivateKey().Serialize()),
+		SigningKeyPrivate: signingKeyPrivate,
 		SigningKeyPublic:  k.signingKeyPair.PublicKey().Serialize(),
 	}
 }
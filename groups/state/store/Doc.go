@@ -1,3 +1,3 @@
 // Package store provides the storage interfaces for storing group sender
-// key records.
+// key records and MLS group state.
 package store
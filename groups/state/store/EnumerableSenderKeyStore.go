@@ -0,0 +1,14 @@
+package store
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// EnumerableSenderKey is a SenderKey store that can list every stored
+// sender key.
+type EnumerableSenderKey interface {
+	SenderKey
+
+	// Load the names of every sender key record in the store.
+	LoadSenderKeyNames() []*protocol.SenderKeyName
+}
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+)
+
+// MLSGroup store is an interface for the persistent storage of MLS group
+// state.
+//
+// LoadMLSGroup must return nil when there is no group with the ID. Groups
+// change with every message, commit and proposal, so they must be stored
+// after each of them.
+type MLSGroup interface {
+	StoreMLSGroup(groupID []byte, group *mls.Group)
+	LoadMLSGroup(groupID []byte) *mls.Group
+	DeleteMLSGroup(groupID []byte)
+}
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+)
+
+// MLSKeyPackage store is an interface for the persistent storage of the
+// private parts of published MLS key packages, keyed by key package
+// reference.
+//
+// LoadMLSKeyPackage must return nil when there is no record for the
+// reference. Records should be removed once a Welcome to them is used.
+type MLSKeyPackage interface {
+	StoreMLSKeyPackage(ref []byte, keyPackage *mls.KeyPackageRecord)
+	LoadMLSKeyPackage(ref []byte) *mls.KeyPackageRecord
+	RemoveMLSKeyPackage(ref []byte)
+}
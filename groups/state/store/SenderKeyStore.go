@@ -5,6 +5,11 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
 )
 
+// SenderKey store is an interface for the persistent storage of group
+// sender keys.
+//
+// Sender key names must be compared by value. LoadSenderKey must return an
+// empty record rather than nil when there is no sender key for the name.
 type SenderKey interface {
 	StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *record.SenderKey)
 	LoadSenderKey(senderKeyName *protocol.SenderKeyName) *record.SenderKey
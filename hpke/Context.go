@@ -0,0 +1,75 @@
+package hpke
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// nonceLength is the nonce length of every supported AEAD.
+const nonceLength = 12
+
+// ErrMessageLimitReached is returned when a context has sealed or opened
+// as many messages as its nonces allow.
+var ErrMessageLimitReached = errors.New("HPKE message limit reached!")
+
+// ErrOpen is returned when a ciphertext fails authentication.
+var ErrOpen = errors.New("HPKE ciphertext failed to open!")
+
+// Context encrypts messages from a sender to a recipient after setup. The
+// sender seals and the recipient opens, in the same order. A context must
+// not be used concurrently.
+type Context struct {
+	suiteID        []byte
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	sequence       uint64
+}
+
+// Seal encrypts the given plaintext with the given additional data.
+func (c *Context) Seal(aad, plaintext []byte) ([]byte, error) {
+	if c.sequence == math.MaxUint64 {
+		return nil, ErrMessageLimitReached
+	}
+	ciphertext := c.aead.Seal(nil, c.nonce(), plaintext, aad)
+	c.sequence++
+
+	return ciphertext, nil
+}
+
+// Open decrypts the given ciphertext with the given additional data. The
+// sequence only advances if the ciphertext is authentic.
+func (c *Context) Open(aad, ciphertext []byte) ([]byte, error) {
+	if c.sequence == math.MaxUint64 {
+		return nil, ErrMessageLimitReached
+	}
+	plaintext, err := c.aead.Open(nil, c.nonce(), ciphertext, aad)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	c.sequence++
+
+	return plaintext, nil
+}
+
+// Export returns a secret of the given length derived from the context's
+// shared key and the given exporter context. Both sides export the same
+// secrets.
+func (c *Context) Export(exporterContext []byte, length int) ([]byte, error) {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterContext, length)
+}
+
+// nonce returns the nonce of the current sequence number, the base nonce
+// XORed with the big-endian sequence number.
+func (c *Context) nonce() []byte {
+	nonce := append([]byte{}, c.baseNonce...)
+	var sequence [8]byte
+	binary.BigEndian.PutUint64(sequence[:], c.sequence)
+	for i := range sequence {
+		nonce[nonceLength-8+i] ^= sequence[i]
+	}
+
+	return nonce
+}
@@ -0,0 +1,15 @@
+// Package hpke implements Hybrid Public Key Encryption (RFC 9180) with
+// DHKEM(X25519, HKDF-SHA256) and HKDF-SHA256, for envelope formats that
+// encrypt to a recipient's public key.
+//
+// A Suite picks the AEAD: AES-128-GCM, AES-256-GCM or ChaCha20-Poly1305.
+// The sender sets up a Context to the recipient's public key and sends the
+// returned encapsulated key along with its ciphertexts; the recipient sets
+// up the matching Context from it with their key pair. In auth mode the
+// sender also authenticates with their own key pair. Contexts seal or open
+// any number of messages in order, and export secrets derived from the
+// shared key. Seal and Open on a Suite do all of this for a single message.
+//
+// Keys are ecc key pairs and public keys, such as identity keys. The
+// encapsulated key is a raw 32 byte X25519 public key, as RFC 9180 defines.
+package hpke
@@ -0,0 +1,144 @@
+package hpke
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"golang.org/x/crypto/curve25519"
+)
+
+// KEMID is the ID of DHKEM(X25519, HKDF-SHA256).
+const KEMID uint16 = 0x0020
+
+// EncapsulatedKeyLength is the length of an encapsulated key, a raw X25519
+// public key.
+const EncapsulatedKeyLength = 32
+
+// secretLength is the length of the KEM's shared secret.
+const secretLength = 32
+
+// ErrInvalidEncapsulatedKey is returned for encapsulated keys of the wrong
+// length.
+var ErrInvalidEncapsulatedKey = errors.New("Invalid HPKE encapsulated key!")
+
+// ErrLowOrderPoint is returned when an X25519 agreement results in zero,
+// because a public key is a low order point.
+var ErrLowOrderPoint = errors.New("HPKE key agreement with a low order point!")
+
+// kemSuiteID identifies the KEM in its labeled key derivations.
+var kemSuiteID = []byte{'K', 'E', 'M', byte(KEMID >> 8), byte(KEMID)}
+
+// DeriveKeyPair deterministically derives a key pair from the given input
+// key material, as the KEM's DeriveKeyPair function. The input should have
+// at least 32 bytes of entropy.
+func DeriveKeyPair(ikm []byte) (*ecc.ECKeyPair, error) {
+	prk := labeledExtract(kemSuiteID, nil, "dkp_prk", ikm)
+	sk, err := labeledExpand(kemSuiteID, prk, "sk", nil, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey [32]byte
+	copy(privateKey[:], sk)
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+
+	return ecc.NewECKeyPair(ecc.NewDjbECPublicKey(publicKey), ecc.NewDjbECPrivateKey(privateKey)), nil
+}
+
+// generateKeyPair returns a new ephemeral key pair, derived from 32 bytes of
+// the given random source.
+func generateKeyPair(random io.Reader) (*ecc.ECKeyPair, error) {
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(random, ikm); err != nil {
+		return nil, err
+	}
+
+	return DeriveKeyPair(ikm)
+}
+
+// encap returns a shared secret and its encapsulation for the given
+// recipient. In auth mode, the sender's key pair is mixed in as well.
+func encap(random io.Reader, pkR ecc.ECPublicKeyable, skS *ecc.ECKeyPair) (sharedSecret, enc []byte, err error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	ephemeral, err := generateKeyPair(random)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh, err := agree(ephemeral, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	encKey := ephemeral.PublicKey().PublicKey()
+	recipientKey := pkR.PublicKey()
+	kemContext := append(encKey[:], recipientKey[:]...)
+	if skS != nil {
+		dhS, err := agree(skS, pkR)
+		if err != nil {
+			return nil, nil, err
+		}
+		senderKey := skS.PublicKey().PublicKey()
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, senderKey[:]...)
+	}
+
+	sharedSecret, err = extractAndExpand(dh, kemContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sharedSecret, encKey[:], nil
+}
+
+// decap returns the shared secret of the given encapsulation for the given
+// recipient. In auth mode, the sender's public key is mixed in as well.
+func decap(enc []byte, skR *ecc.ECKeyPair, pkS ecc.ECPublicKeyable) ([]byte, error) {
+	if len(enc) != EncapsulatedKeyLength {
+		return nil, ErrInvalidEncapsulatedKey
+	}
+	var encKey [32]byte
+	copy(encKey[:], enc)
+
+	dh, err := agree(skR, ecc.NewDjbECPublicKey(encKey))
+	if err != nil {
+		return nil, err
+	}
+	recipientKey := skR.PublicKey().PublicKey()
+	kemContext := append(encKey[:], recipientKey[:]...)
+	if pkS != nil {
+		dhS, err := agree(skR, pkS)
+		if err != nil {
+			return nil, err
+		}
+		senderKey := pkS.PublicKey()
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, senderKey[:]...)
+	}
+
+	return extractAndExpand(dh, kemContext)
+}
+
+// agree returns the X25519 agreement of the given key pair and public key.
+func agree(keyPair *ecc.ECKeyPair, publicKey ecc.ECPublicKeyable) ([]byte, error) {
+	sharedSecret := kdf.CalculateSharedSecret(publicKey.PublicKey(), keyPair.PrivateKey().Serialize())
+	if subtle.ConstantTimeCompare(sharedSecret[:], make([]byte, len(sharedSecret))) == 1 {
+		return nil, ErrLowOrderPoint
+	}
+
+	return sharedSecret[:], nil
+}
+
+// extractAndExpand derives the shared secret from the given agreements and
+// KEM context.
+func extractAndExpand(dh, kemContext []byte) ([]byte, error) {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, secretLength)
+}
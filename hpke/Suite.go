@@ -0,0 +1,236 @@
+package hpke
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KDFID is the ID of HKDF-SHA256.
+const KDFID uint16 = 0x0001
+
+// AEAD is the ID of an authenticated encryption algorithm.
+type AEAD uint16
+
+// Supported AEADs.
+const (
+	AES128GCM        AEAD = 0x0001
+	AES256GCM        AEAD = 0x0002
+	ChaCha20Poly1305 AEAD = 0x0003
+)
+
+// Mode is the mode of an HPKE context.
+type Mode byte
+
+// Supported modes. Base mode only encrypts to the recipient, auth mode also
+// authenticates the sender's key pair.
+const (
+	ModeBase Mode = 0x00
+	ModeAuth Mode = 0x02
+)
+
+// versionLabel prefixes every labeled key derivation.
+const versionLabel = "HPKE-v1"
+
+const unsupportedAEADError string = "Unsupported HPKE AEAD: "
+
+// NewSuite returns a new HPKE suite with DHKEM(X25519, HKDF-SHA256),
+// HKDF-SHA256 and the given AEAD.
+func NewSuite(aead AEAD) (*Suite, error) {
+	suite := &Suite{aead: aead}
+	switch aead {
+	case AES128GCM:
+		suite.keyLength = 16
+	case AES256GCM:
+		suite.keyLength = 32
+	case ChaCha20Poly1305:
+		suite.keyLength = chacha20poly1305.KeySize
+	default:
+		return nil, errors.New(unsupportedAEADError + strconv.Itoa(int(aead)))
+	}
+	suite.id = []byte{'H', 'P', 'K', 'E',
+		byte(KEMID >> 8), byte(KEMID), byte(KDFID >> 8), byte(KDFID), byte(aead >> 8), byte(aead)}
+
+	return suite, nil
+}
+
+// Suite is an HPKE cipher suite.
+type Suite struct {
+	aead      AEAD
+	keyLength int
+	id        []byte
+	random    io.Reader
+}
+
+// AEAD returns the suite's AEAD.
+func (s *Suite) AEAD() AEAD {
+	return s.aead
+}
+
+// SetRandom sets the source of the sender's ephemeral keys, which are
+// derived from 32 bytes of it. It is meant for test vectors; by default
+// crypto/rand is used.
+func (s *Suite) SetRandom(random io.Reader) {
+	s.random = random
+}
+
+// SetupBaseS sets up a sender context to the given recipient public key.
+// The info binds the context to the application. Send the returned
+// encapsulated key to the recipient.
+func (s *Suite) SetupBaseS(pkR ecc.ECPublicKeyable, info []byte) (enc []byte, context *Context, err error) {
+	sharedSecret, enc, err := encap(s.random, pkR, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	context, err = s.keySchedule(ModeBase, sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, context, nil
+}
+
+// SetupBaseR sets up the recipient context of the given encapsulated key
+// with the recipient's key pair.
+func (s *Suite) SetupBaseR(enc []byte, skR *ecc.ECKeyPair, info []byte) (*Context, error) {
+	sharedSecret, err := decap(enc, skR, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keySchedule(ModeBase, sharedSecret, info)
+}
+
+// SetupAuthS sets up a sender context to the given recipient public key,
+// authenticated with the sender's key pair.
+func (s *Suite) SetupAuthS(pkR ecc.ECPublicKeyable, info []byte, skS *ecc.ECKeyPair) (enc []byte, context *Context, err error) {
+	sharedSecret, enc, err := encap(s.random, pkR, skS)
+	if err != nil {
+		return nil, nil, err
+	}
+	context, err = s.keySchedule(ModeAuth, sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, context, nil
+}
+
+// SetupAuthR sets up the recipient context of the given encapsulated key
+// with the recipient's key pair. Opening only succeeds if the sender used
+// the key pair of the given public key.
+func (s *Suite) SetupAuthR(enc []byte, skR *ecc.ECKeyPair, info []byte, pkS ecc.ECPublicKeyable) (*Context, error) {
+	sharedSecret, err := decap(enc, skR, pkS)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keySchedule(ModeAuth, sharedSecret, info)
+}
+
+// Seal encrypts a single message to the given recipient public key in base
+// mode.
+func (s *Suite) Seal(pkR ecc.ECPublicKeyable, info, aad, plaintext []byte) (enc, ciphertext []byte, err error) {
+	enc, context, err := s.SetupBaseS(pkR, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err = context.Seal(aad, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, ciphertext, nil
+}
+
+// Open decrypts a single message sealed with Seal.
+func (s *Suite) Open(enc []byte, skR *ecc.ECKeyPair, info, aad, ciphertext []byte) ([]byte, error) {
+	context, err := s.SetupBaseR(enc, skR, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return context.Open(aad, ciphertext)
+}
+
+// keySchedule derives the context's key, base nonce and exporter secret
+// from the shared secret. Only modes without a PSK are supported, so the
+// PSK and its ID are empty.
+func (s *Suite) keySchedule(mode Mode, sharedSecret, info []byte) (*Context, error) {
+	pskIDHash := labeledExtract(s.id, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(s.id, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{byte(mode)}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := labeledExtract(s.id, sharedSecret, "secret", nil)
+	key, err := labeledExpand(s.id, secret, "key", keyScheduleContext, s.keyLength)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce, err := labeledExpand(s.id, secret, "base_nonce", keyScheduleContext, nonceLength)
+	if err != nil {
+		return nil, err
+	}
+	exporterSecret, err := labeledExpand(s.id, secret, "exp", keyScheduleContext, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := s.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Context{
+		suiteID:        s.id,
+		aead:           aead,
+		baseNonce:      baseNonce,
+		exporterSecret: exporterSecret,
+	}, nil
+}
+
+// newAEAD returns the suite's AEAD with the given key.
+func (s *Suite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if s.aead == ChaCha20Poly1305 {
+		return chacha20poly1305.New(key)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// labeledExtract is HKDF-Extract with the suite ID and label prefixed to
+// the input key material.
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte(versionLabel), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+// labeledExpand is HKDF-Expand with the output length, suite ID and label
+// prefixed to the info.
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeledInfo := []byte{byte(length >> 8), byte(length)}
+	labeledInfo = append(labeledInfo, versionLabel...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+
+	output := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
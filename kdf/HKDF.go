@@ -3,7 +3,9 @@
 package kdf
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 	"io"
@@ -44,3 +46,26 @@ type KeyMaterial struct {
 	MacKey    []byte
 	IV        []byte
 }
+
+// DeriveSecretsV2 derives the requested number of bytes using the HKDF
+// variant of protocol version 2 sessions. It is identical to DeriveSecrets
+// except that the expand step counts its iterations from 0 rather than 1.
+func DeriveSecretsV2(inputKeyMaterial, salt, info []byte, outputLength int) ([]byte, error) {
+	if outputLength > 255*sha256.Size {
+		return nil, errors.New("Requested too many HKDF output bytes.")
+	}
+	prk := hkdf.Extract(sha256.New, inputKeyMaterial, salt)
+
+	secrets := make([]byte, 0, outputLength)
+	var previous []byte
+	for i := 0; len(secrets) < outputLength; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(previous)
+		mac.Write(info)
+		mac.Write([]byte{byte(i)})
+		previous = mac.Sum(nil)
+		secrets = append(secrets, previous...)
+	}
+
+	return secrets[:outputLength], nil
+}
@@ -0,0 +1,61 @@
+package kdf
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Limits on the passphrase KDF parameters we are willing to use, so that a
+// crafted archive or export can't make us allocate an unbounded amount of
+// memory. Memory is capped at 1 GiB; callers can pass a stricter limit to
+// PassphraseParams.Within.
+const maxPassphraseTime uint32 = 64
+const maxPassphraseMemory uint32 = 1024 * 1024
+const maxPassphraseThreads uint8 = 64
+
+// ErrInvalidPassphraseParams indicates the passphrase KDF parameters are outside
+// the accepted range.
+var ErrInvalidPassphraseParams = errors.New("invalid passphrase KDF parameters")
+
+// PassphraseParams are the Argon2id parameters used to derive a key from a
+// passphrase. Memory is given in KiB.
+type PassphraseParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultPassphraseParams are the recommended Argon2id parameters for deriving
+// keys from user passphrases.
+var DefaultPassphraseParams = PassphraseParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// Valid returns true if the parameters are within the accepted range.
+func (p PassphraseParams) Valid() bool {
+	return p.Time > 0 && p.Time <= maxPassphraseTime &&
+		p.Threads > 0 && p.Threads <= maxPassphraseThreads &&
+		p.Memory >= 8*uint32(p.Threads) && p.Memory <= maxPassphraseMemory
+}
+
+// Within returns true if the parameters are valid and none of them exceeds the
+// given limit. Zero fields of the limit are not checked.
+func (p PassphraseParams) Within(limit PassphraseParams) bool {
+	return p.Valid() &&
+		(limit.Time == 0 || p.Time <= limit.Time) &&
+		(limit.Memory == 0 || p.Memory <= limit.Memory) &&
+		(limit.Threads == 0 || p.Threads <= limit.Threads)
+}
+
+// DerivePassphraseKey uses the memory-hard Argon2id function to derive a key of
+// the given length from the given passphrase and salt.
+func DerivePassphraseKey(passphrase, salt []byte, params PassphraseParams, keyLength int) ([]byte, error) {
+	if !params.Valid() {
+		return nil, ErrInvalidPassphraseParams
+	}
+
+	return argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, uint32(keyLength)), nil
+}
@@ -4,8 +4,11 @@ package chain
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/message"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 var messageKeySeed = []byte{0x01}
@@ -23,12 +26,20 @@ func NewKey(kdf kdf.HKDF, key []byte, index uint32) *Key {
 }
 
 // NewKeyFromStruct will return a chain key built from the given structure.
-func NewKeyFromStruct(structure *KeyStructure, kdf kdf.HKDF) *Key {
+// An error is returned if the key is missing or is not 32 bytes.
+func NewKeyFromStruct(structure *KeyStructure, kdf kdf.HKDF) (*Key, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("ChainKey", "Structure", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckLength("ChainKey", "Key", structure.Key, 32); err != nil {
+		return nil, err
+	}
+
 	return NewKey(
 		kdf,
 		structure.Key,
 		structure.Index,
-	)
+	), nil
 }
 
 // NewStructFromKey will return a chain key structure for serialization.
@@ -87,9 +98,26 @@ func (c *Key) NextKey() *Key {
 
 // MessageKeys returns message keys, which includes the cipherkey, mac, iv, and index.
 func (c *Key) MessageKeys() *message.Keys {
+	return c.deriveMessageKeys(c.kdf, []byte(message.KdfSalt), false)
+}
+
+// DeriveMessageKeys returns message keys derived with the KDF and info of
+// the given protocol version.
+func (c *Key) DeriveMessageKeys(params *version.Parameters) *message.Keys {
+	return c.deriveMessageKeys(params.KDF, params.MessageKdfInfo, params.CounterIV)
+}
+
+// deriveMessageKeys returns message keys derived with the given KDF and info.
+// If counterIV is set, the IV is the chain key's index instead of derived
+// key material.
+func (c *Key) deriveMessageKeys(kdf kdf.HKDF, info []byte, counterIV bool) *message.Keys {
 	inputKeyMaterial := c.BaseMaterial(messageKeySeed)
-	keyMaterialBytes, _ := c.kdf(inputKeyMaterial, nil, []byte(message.KdfSalt), message.DerivedSecretsSize)
+	keyMaterialBytes, _ := kdf(inputKeyMaterial, nil, info, message.DerivedSecretsSize)
 	keyMaterial := newKeyMaterial(keyMaterialBytes)
+	if counterIV {
+		keyMaterial.IV = make([]byte, message.IVLength)
+		binary.BigEndian.PutUint32(keyMaterial.IV, c.Index())
+	}
 
 	// Use the key material returned from the key derivation function for our cipherkey, mac, and iv.
 	messageKeys := message.NewKeys(
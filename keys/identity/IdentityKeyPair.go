@@ -1,9 +1,22 @@
 package identity
 
 import (
+	"errors"
+
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"golang.org/x/crypto/curve25519"
 )
 
+// KeyPairSerializer is an interface for serializing and deserializing
+// identity KeyPairs into bytes. An implementation of this interface should be
+// used to encode/decode the object into JSON, Protobuffers, etc.
+type KeyPairSerializer interface {
+	Serialize(keyPair *KeyPairStructure) []byte
+	Deserialize(serialized []byte) (*KeyPairStructure, error)
+}
+
 // NewKeyPair returns a new identity key with the given public and private keys.
 func NewKeyPair(publicKey *Key, privateKey ecc.ECPrivateKeyable) *KeyPair {
 	keyPair := KeyPair{
@@ -14,9 +27,56 @@ func NewKeyPair(publicKey *Key, privateKey ecc.ECPrivateKeyable) *KeyPair {
 	return &keyPair
 }
 
-// NewKeyPairFromBytes returns a new identity key from the given serialized bytes.
-//func NewKeyPairFromBytes(serialized []byte) KeyPair {
-//}
+// NewKeyPairFromBytes returns a new identity key from the given serialized bytes
+// using the given serializer.
+func NewKeyPairFromBytes(serialized []byte, serializer KeyPairSerializer) (*KeyPair, error) {
+	// Use the given serializer to decode the identity key pair.
+	keyPairStructure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeyPairFromStruct(keyPairStructure)
+}
+
+// NewKeyPairFromStruct returns a new identity key pair from the given
+// serializable structure. The private key is checked against the public
+// key, so a corrupted or mismatched structure will return an error.
+func NewKeyPairFromStruct(structure *KeyPairStructure) (*KeyPair, error) {
+	// Throw an error if the structure is missing critical fields.
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("IdentityKeyPair", "Structure", errorhelper.ErrMissingField)
+	}
+	errs := errorhelper.NewMultiError()
+	errs.Add(errorhelper.CheckLength("IdentityKeyPair", "PublicKey", structure.PublicKey, ecc.KeySize))
+	errs.Add(errorhelper.CheckLength("IdentityKeyPair", "PrivateKey", structure.PrivateKey, 32))
+	if errs.HasErrors() {
+		return nil, errs
+	}
+
+	// Generate the ECC public key from bytes.
+	publicKey, err := ecc.DecodePoint(structure.PublicKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := ecc.NewDjbECPrivateKey(bytehelper.SliceToArray(structure.PrivateKey))
+
+	// Ensure the private key belongs to the public key.
+	var derived [32]byte
+	private := privateKey.Serialize()
+	curve25519.ScalarBaseMult(&derived, &private)
+	if derived != publicKey.PublicKey() {
+		return nil, errors.New("Identity private key does not match public key.")
+	}
+
+	return NewKeyPair(NewKey(publicKey), privateKey), nil
+}
+
+// KeyPairStructure is a serializable structure for identity key pairs.
+type KeyPairStructure struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
 
 // KeyPair is a holder for public and private identity key pair.
 type KeyPair struct {
@@ -34,6 +94,16 @@ func (k *KeyPair) PrivateKey() ecc.ECPrivateKeyable {
 	return k.privateKey
 }
 
-// Serialize returns a byte array that represents the keypair.
-//func (k *KeyPair) Serialize() []byte {
-//}
+// Serialize returns a byte array that represents the keypair using the
+// given serializer.
+func (k *KeyPair) Serialize(serializer KeyPairSerializer) []byte {
+	return serializer.Serialize(k.structure())
+}
+
+// structure will return a serializable structure of the key pair.
+func (k *KeyPair) structure() *KeyPairStructure {
+	return &KeyPairStructure{
+		PublicKey:  k.publicKey.Serialize(),
+		PrivateKey: bytehelper.ArrayToSlice(k.privateKey.Serialize()),
+	}
+}
@@ -0,0 +1,141 @@
+package identity
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ExportVersion is the current version of the encrypted identity export format.
+const ExportVersion byte = 1
+
+const exportSaltLength = 16
+const exportKeyLength = chacha20poly1305.KeySize
+
+// exportHeaderLength is the size of the version, argon2 parameters, salt and nonce
+// that prefix every export.
+const exportHeaderLength = 1 + 4 + 4 + 1 + exportSaltLength + chacha20poly1305.NonceSizeX
+
+// Export errors.
+var (
+	// ErrExportTooShort indicates the export is too small to contain a header.
+	ErrExportTooShort = errors.New("identity export too short")
+
+	// ErrUnsupportedExportVersion indicates the export was made with an unknown format version.
+	ErrUnsupportedExportVersion = errors.New("unsupported identity export version")
+
+	// ErrInvalidExportParams indicates the export's KDF parameters are outside the accepted range.
+	ErrInvalidExportParams = kdf.ErrInvalidPassphraseParams
+
+	// ErrBadPassphrase indicates the export could not be decrypted with the given passphrase,
+	// or that it has been tampered with.
+	ErrBadPassphrase = errors.New("bad passphrase or corrupted identity export")
+)
+
+// ExportParams are the Argon2id parameters used to derive the export key from
+// a passphrase. They are shared with the other passphrase protected formats.
+type ExportParams = kdf.PassphraseParams
+
+// DefaultExportParams are the Argon2id parameters used by ExportKeyPair.
+var DefaultExportParams = kdf.DefaultPassphraseParams
+
+// ExportKeyPair encrypts the given identity key pair with a key derived from
+// the passphrase so it can be moved to another install. The key pair is encoded
+// with the given serializer, which must also be used to import it again.
+func ExportKeyPair(keyPair *KeyPair, passphrase []byte, serializer KeyPairSerializer) ([]byte, error) {
+	return ExportKeyPairWithParams(keyPair, passphrase, serializer, DefaultExportParams)
+}
+
+// ExportKeyPairWithParams encrypts the given identity key pair using the given
+// Argon2id parameters. The parameters are stored in the export.
+//
+// Format: version(1) | time(4) | memory(4) | threads(1) | salt(16) | nonce(24) | ciphertext
+func ExportKeyPairWithParams(keyPair *KeyPair, passphrase []byte,
+	serializer KeyPairSerializer, params ExportParams) ([]byte, error) {
+
+	if !params.Valid() {
+		return nil, ErrInvalidExportParams
+	}
+
+	// Build our header with random salt and nonce.
+	header := make([]byte, exportHeaderLength)
+	header[0] = ExportVersion
+	binary.BigEndian.PutUint32(header[1:5], params.Time)
+	binary.BigEndian.PutUint32(header[5:9], params.Memory)
+	header[9] = params.Threads
+	if _, err := io.ReadFull(rand.Reader, header[10:]); err != nil {
+		return nil, err
+	}
+	salt := header[10 : 10+exportSaltLength]
+	nonce := header[10+exportSaltLength:]
+
+	// Derive our key and seal the serialized key pair, authenticating the header.
+	aead, err := newExportCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := keyPair.Serialize(serializer)
+
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// ImportKeyPair decrypts an identity key pair that was exported with
+// ExportKeyPair using the given passphrase and serializer.
+func ImportKeyPair(exported, passphrase []byte, serializer KeyPairSerializer) (*KeyPair, error) {
+	return ImportKeyPairWithLimit(exported, passphrase, serializer, ExportParams{})
+}
+
+// ImportKeyPairWithLimit decrypts an exported identity key pair like
+// ImportKeyPair, but rejects exports whose Argon2id parameters exceed the
+// given limit. Use it to bound the time and memory an untrusted export can
+// make us spend.
+func ImportKeyPairWithLimit(exported, passphrase []byte, serializer KeyPairSerializer,
+	limit ExportParams) (*KeyPair, error) {
+
+	if len(exported) < exportHeaderLength+chacha20poly1305.Overhead {
+		return nil, ErrExportTooShort
+	}
+	if exported[0] != ExportVersion {
+		return nil, ErrUnsupportedExportVersion
+	}
+
+	// Read our KDF parameters from the header.
+	header := exported[:exportHeaderLength]
+	params := ExportParams{
+		Time:    binary.BigEndian.Uint32(header[1:5]),
+		Memory:  binary.BigEndian.Uint32(header[5:9]),
+		Threads: header[9],
+	}
+	if !params.Within(limit) {
+		return nil, ErrInvalidExportParams
+	}
+	salt := header[10 : 10+exportSaltLength]
+	nonce := header[10+exportSaltLength:]
+
+	// Derive our key and open the sealed key pair.
+	aead, err := newExportCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, exported[exportHeaderLength:], header)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return NewKeyPairFromBytes(plaintext, serializer)
+}
+
+// newExportCipher derives the export key from the given passphrase and returns
+// the authenticated cipher used to seal the export.
+func newExportCipher(passphrase, salt []byte, params ExportParams) (cipher.AEAD, error) {
+	key, err := kdf.DerivePassphraseKey(passphrase, salt, params, exportKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
@@ -2,6 +2,10 @@
 // keys used for the encryption/decryption of Signal messages.
 package message
 
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
 // DerivedSecretsSize is the size of the derived secrets for message keys.
 const DerivedSecretsSize = 80
 
@@ -30,14 +34,26 @@ func NewKeys(cipherKey, macKey, iv []byte, index uint32) *Keys {
 }
 
 // NewKeysFromStruct will return a new message keys object from the
-// given serializeable structure.
-func NewKeysFromStruct(structure *KeysStructure) *Keys {
+// given serializeable structure. An error is returned if any of the keys
+// are missing or have the wrong length.
+func NewKeysFromStruct(structure *KeysStructure) (*Keys, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("MessageKeys", "Structure", errorhelper.ErrMissingField)
+	}
+	errs := errorhelper.NewMultiError()
+	errs.Add(errorhelper.CheckLength("MessageKeys", "CipherKey", structure.CipherKey, CipherKeyLength))
+	errs.Add(errorhelper.CheckLength("MessageKeys", "MacKey", structure.MacKey, MacKeyLength))
+	errs.Add(errorhelper.CheckLength("MessageKeys", "IV", structure.IV, IVLength))
+	if errs.HasErrors() {
+		return nil, errs
+	}
+
 	return NewKeys(
 		structure.CipherKey,
 		structure.MacKey,
 		structure.IV,
 		structure.Index,
-	)
+	), nil
 }
 
 // NewStructFromKeys returns a serializeable structure of message keys.
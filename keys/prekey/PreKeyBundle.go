@@ -6,6 +6,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 // NewBundle returns a Bundle structure that contains a remote PreKey
@@ -39,6 +40,7 @@ type Bundle struct {
 	signedPreKeyPublic    ecc.ECPublicKeyable
 	signedPreKeySignature [64]byte
 	identityKey           *identity.Key
+	supportedVersions     []int
 }
 
 // DeviceID returns the device ID this PreKey belongs to.
@@ -84,3 +86,20 @@ func (b *Bundle) IdentityKey() *identity.Key {
 func (b *Bundle) RegistrationID() uint32 {
 	return b.registrationID
 }
+
+// SupportedVersions returns the protocol versions the owner of this
+// bundle advertised. A bundle without any advertised versions is assumed
+// to only support the default version.
+func (b *Bundle) SupportedVersions() []int {
+	if len(b.supportedVersions) == 0 {
+		return []int{version.Default}
+	}
+	return b.supportedVersions
+}
+
+// SetSupportedVersions sets the protocol versions the owner of this bundle
+// supports. These are used to choose the version of the session built from
+// the bundle.
+func (b *Bundle) SetSupportedVersions(versions []int) {
+	b.supportedVersions = versions
+}
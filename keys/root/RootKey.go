@@ -7,11 +7,15 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/chain"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 // DerivedSecretsSize is the size of the derived secrets for root keys.
 const DerivedSecretsSize = 64
 
+// HeaderKeySize is the size of the header keys of header encrypted sessions.
+const HeaderKeySize = 32
+
 // KdfInfo is used as the info for message keys to derive secrets using a Key Derivation Function
 const KdfInfo string = "WhisperRatchet"
 
@@ -39,18 +43,54 @@ func (k *Key) Bytes() []byte {
 
 // CreateChain creates a new RootKey and ChainKey from the recipient's ratchet key and our private key.
 func (k *Key) CreateChain(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair) (*session.KeyPair, error) {
-	var keyMaterial []byte
-	theirPublicKey := theirRatchetKey.PublicKey()
-	ourPrivateKey := ourRatchetKey.PrivateKey().Serialize()
+	return k.CreateChainWithParameters(theirRatchetKey, ourRatchetKey, version.V3)
+}
 
-	// Use our key derivation function to calculate a shared secret.
-	sharedSecret := kdf.CalculateSharedSecret(theirPublicKey, ourPrivateKey)
-	copy(keyMaterial[:], sharedSecret[:])
-	derivedSecretBytes, err := kdf.DeriveSecrets(keyMaterial, k.key, []byte(KdfInfo), DerivedSecretsSize)
+// CreateChainWithParameters creates a new RootKey and ChainKey from the recipient's
+// ratchet key and our private key, using the given version's parameters.
+func (k *Key) CreateChainWithParameters(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair,
+	params *version.Parameters) (*session.KeyPair, error) {
+
+	derivedSecretBytes, err := k.deriveSecrets(theirRatchetKey, ourRatchetKey, params, DerivedSecretsSize)
 	if err != nil {
 		return nil, err
 	}
 
+	return k.newKeyPair(derivedSecretBytes), nil
+}
+
+// CreateChainWithHeaderKey creates a new RootKey and ChainKey like
+// CreateChainWithParameters, and also returns the next header key used by
+// header encrypted sessions. The root and chain keys are the same as the
+// ones CreateChainWithParameters returns.
+func (k *Key) CreateChainWithHeaderKey(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair,
+	params *version.Parameters) (*session.KeyPair, []byte, error) {
+
+	derivedSecretBytes, err := k.deriveSecrets(theirRatchetKey, ourRatchetKey, params, DerivedSecretsSize+HeaderKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k.newKeyPair(derivedSecretBytes[:DerivedSecretsSize]), derivedSecretBytes[DerivedSecretsSize:], nil
+}
+
+// deriveSecrets derives the given number of bytes from the root key and the
+// shared secret of the given ratchet keys.
+func (k *Key) deriveSecrets(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair,
+	params *version.Parameters, length int) ([]byte, error) {
+
+	theirPublicKey := theirRatchetKey.PublicKey()
+	ourPrivateKey := ourRatchetKey.PrivateKey().Serialize()
+
+	// Use our key derivation function to calculate a shared secret, which is
+	// the input key material of the next root and chain keys.
+	sharedSecret := kdf.CalculateSharedSecret(theirPublicKey, ourPrivateKey)
+
+	return params.KDF(sharedSecret[:], k.key, params.RootKdfInfo, length)
+}
+
+// newKeyPair returns a session keypair from the given derived secret bytes.
+func (k *Key) newKeyPair(derivedSecretBytes []byte) *session.KeyPair {
 	// Split the derived secret bytes in half, using one half for the root key and the second for the chain key.
 	derivedSecrets := session.NewDerivedSecrets(derivedSecretBytes)
 
@@ -59,10 +99,8 @@ func (k *Key) CreateChain(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ec
 	chainKey := chain.NewKey(k.kdf, derivedSecrets.ChainKey(), 0)
 
 	// Create a session keypair with the generated root and chain keys.
-	keyPair := session.NewKeyPair(
+	return session.NewKeyPair(
 		rootKey,
 		chainKey,
 	)
-
-	return keyPair, nil
 }
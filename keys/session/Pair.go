@@ -6,6 +6,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/chain"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/message"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 // RootKeyable is an interface for all root key implementations that are part of
@@ -13,6 +14,10 @@ import (
 type RootKeyable interface {
 	Bytes() []byte
 	CreateChain(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair) (*KeyPair, error)
+	CreateChainWithParameters(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair,
+		params *version.Parameters) (*KeyPair, error)
+	CreateChainWithHeaderKey(theirRatchetKey ecc.ECPublicKeyable, ourRatchetKey *ecc.ECKeyPair,
+		params *version.Parameters) (*KeyPair, []byte, error)
 }
 
 // ChainKeyable is an interface for all chain key implementations that are part of
@@ -22,6 +27,7 @@ type ChainKeyable interface {
 	Index() uint32
 	NextKey() *chain.Key
 	MessageKeys() *message.Keys
+	DeriveMessageKeys(params *version.Parameters) *message.Keys
 	Current() *chain.Key
 }
 
@@ -0,0 +1,156 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// MaxMessageLength is the largest Noise message, in bytes.
+const MaxMessageLength = 65535
+
+// KeyLength is the length of cipher keys.
+const KeyLength = chacha20poly1305.KeySize
+
+// TagLength is the length of the authentication tag added to every
+// encrypted message.
+const TagLength = chacha20poly1305.Overhead
+
+// ErrNonceExhausted is returned when a cipher state has encrypted or
+// decrypted 2^64-1 messages and must not be used anymore.
+var ErrNonceExhausted = errors.New("Noise cipher nonce exhausted!")
+
+// ErrInvalidKey is returned for cipher keys that are not KeyLength bytes.
+var ErrInvalidKey = errors.New("Invalid Noise cipher key length!")
+
+// ErrDecrypt is returned when a message fails authentication.
+var ErrDecrypt = errors.New("Noise message failed to decrypt!")
+
+// NewCipherState returns a new cipher state with the given key. A nil key
+// returns a cipher state without a key, which passes messages through
+// unencrypted, as during the start of a handshake.
+func NewCipherState(key []byte) (*CipherState, error) {
+	cipherState := &CipherState{}
+	if key != nil {
+		if err := cipherState.initializeKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return cipherState, nil
+}
+
+// CipherState encrypts or decrypts the messages of one direction, with a
+// key and a counter used as the nonce. Messages must be decrypted in the
+// order they were encrypted.
+type CipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+// HasKey returns true if the cipher state has a key.
+func (c *CipherState) HasKey() bool {
+	return c.key != nil
+}
+
+// Nonce returns the nonce of the next message.
+func (c *CipherState) Nonce() uint64 {
+	return c.nonce
+}
+
+// SetNonce sets the nonce of the next message, for transports that deliver
+// messages out of order and send their nonces along with them.
+func (c *CipherState) SetNonce(nonce uint64) {
+	c.nonce = nonce
+}
+
+// Encrypt encrypts the given plaintext with the given associated data and
+// the next nonce. Without a key the plaintext is returned as is.
+func (c *CipherState) Encrypt(ad, plaintext []byte) ([]byte, error) {
+	if !c.HasKey() {
+		return append([]byte{}, plaintext...), nil
+	}
+	if c.nonce == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+
+	ciphertext, err := seal(c.key, c.nonce, ad, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	c.nonce++
+
+	return ciphertext, nil
+}
+
+// Decrypt decrypts the given ciphertext with the given associated data and
+// the next nonce. Without a key the ciphertext is returned as is. The nonce
+// only advances if the ciphertext is authentic.
+func (c *CipherState) Decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if !c.HasKey() {
+		return append([]byte{}, ciphertext...), nil
+	}
+	if c.nonce == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonceBytes(c.nonce), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.nonce++
+
+	return plaintext, nil
+}
+
+// Rekey replaces the key with one derived from it, as defined by the Noise
+// specification. Both sides must rekey after the same message.
+func (c *CipherState) Rekey() error {
+	if !c.HasKey() {
+		return nil
+	}
+
+	newKey, err := seal(c.key, math.MaxUint64, nil, make([]byte, KeyLength))
+	if err != nil {
+		return err
+	}
+	c.key = newKey[:KeyLength]
+
+	return nil
+}
+
+// initializeKey sets the key and resets the nonce.
+func (c *CipherState) initializeKey(key []byte) error {
+	if len(key) != KeyLength {
+		return ErrInvalidKey
+	}
+	c.key = append([]byte{}, key...)
+	c.nonce = 0
+
+	return nil
+}
+
+// seal encrypts the given plaintext with ChaCha20-Poly1305.
+func seal(key []byte, nonce uint64, ad, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonceBytes(nonce), plaintext, ad), nil
+}
+
+// nonceBytes encodes the given nonce as 32 bits of zeros followed by the
+// little-endian nonce.
+func nonceBytes(nonce uint64) []byte {
+	encoded := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(encoded[4:], nonce)
+
+	return encoded
+}
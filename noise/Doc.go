@@ -0,0 +1,16 @@
+// Package noise implements Noise Protocol Framework handshakes with the
+// 25519, ChaChaPoly and SHA256 functions, so devices can authenticate to a
+// server with their identity keys and get an encrypted transport without
+// TLS client certificates.
+//
+// A HandshakeState runs one of the interactive patterns IK, XX or NK. IK
+// suits devices that already know the server's static key: the device's
+// first message carries its encrypted identity key and a payload, and the
+// handshake finishes after the server's reply. Static keys are ecc key
+// pairs, and NewIdentityHandshakeState uses a Signal identity key pair and
+// identity key instead. Once the handshake is finished, Split returns the
+// CipherStates that encrypt the transport messages in each direction.
+//
+// Noise messages are at most MaxMessageLength bytes. Framing them on the
+// wire is up to the transport.
+package noise
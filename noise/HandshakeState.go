@@ -0,0 +1,321 @@
+package noise
+
+import (
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+)
+
+// dhLength is the length of X25519 public keys on the wire.
+const dhLength = 32
+
+// protocolSuffix names the functions of every supported protocol.
+const protocolSuffix = "_25519_ChaChaPoly_SHA256"
+
+// Errors returned by handshake states.
+var (
+	ErrMissingStaticKey    = errors.New("Noise pattern needs a local static key!")
+	ErrMissingRemoteKey    = errors.New("Noise pattern needs the remote static key!")
+	ErrHandshakeFinished   = errors.New("Noise handshake is already finished!")
+	ErrHandshakeIncomplete = errors.New("Noise handshake is not finished yet!")
+	ErrWrongTurn           = errors.New("Not our turn in the Noise handshake!")
+	ErrMessageTooLong      = errors.New("Noise message is too long!")
+	ErrMessageTooShort     = errors.New("Noise message is too short!")
+)
+
+// NewHandshakeState returns a new handshake state for the given pattern and
+// role. The prologue is any data both sides agree on beforehand, which the
+// handshake authenticates. The static key pair is only needed if the
+// pattern sends or pre-shares our static key, and the remote static key only
+// if it is pre-shared with us.
+func NewHandshakeState(pattern *Pattern, initiator bool, prologue []byte, staticKeyPair *ecc.ECKeyPair,
+	remoteStatic ecc.ECPublicKeyable) (*HandshakeState, error) {
+
+	if staticKeyPair == nil && pattern.usesStatic(initiator) {
+		return nil, ErrMissingStaticKey
+	}
+
+	h := &HandshakeState{
+		pattern:   pattern,
+		initiator: initiator,
+		symmetric: newSymmetricState("Noise_" + pattern.name + protocolSuffix),
+		s:         staticKeyPair,
+		rs:        remoteStatic,
+	}
+	h.symmetric.mixHash(prologue)
+
+	initiatorStatic, responderStatic := h.staticPublicKey(), h.rs
+	if !initiator {
+		initiatorStatic, responderStatic = h.rs, h.staticPublicKey()
+	}
+	for _, preMessage := range []struct {
+		tokens []token
+		key    ecc.ECPublicKeyable
+	}{
+		{pattern.initiatorPreMessages, initiatorStatic},
+		{pattern.responderPreMessages, responderStatic},
+	} {
+		for range preMessage.tokens {
+			if preMessage.key == nil {
+				return nil, ErrMissingRemoteKey
+			}
+			publicKey := preMessage.key.PublicKey()
+			h.symmetric.mixHash(publicKey[:])
+		}
+	}
+
+	return h, nil
+}
+
+// NewIdentityHandshakeState returns a new handshake state that uses the
+// given identity key pair as our static key, and the given identity key as
+// the remote static key. Either may be nil if the pattern doesn't need it.
+func NewIdentityHandshakeState(pattern *Pattern, initiator bool, prologue []byte,
+	identityKeyPair *identity.KeyPair, remoteIdentity *identity.Key) (*HandshakeState, error) {
+
+	var staticKeyPair *ecc.ECKeyPair
+	if identityKeyPair != nil {
+		staticKeyPair = ecc.NewECKeyPair(identityKeyPair.PublicKey().PublicKey(), identityKeyPair.PrivateKey())
+	}
+	var remoteStatic ecc.ECPublicKeyable
+	if remoteIdentity != nil {
+		remoteStatic = remoteIdentity.PublicKey()
+	}
+
+	return NewHandshakeState(pattern, initiator, prologue, staticKeyPair, remoteStatic)
+}
+
+// HandshakeState runs one side of a Noise handshake. The sides take turns
+// writing and reading messages, starting with the initiator, until
+// IsFinished returns true. If reading a message fails, the handshake must be
+// abandoned.
+type HandshakeState struct {
+	pattern   *Pattern
+	initiator bool
+	symmetric *symmetricState
+	s         *ecc.ECKeyPair
+	e         *ecc.ECKeyPair
+	rs        ecc.ECPublicKeyable
+	re        ecc.ECPublicKeyable
+	index     int
+}
+
+// SetEphemeralKeyPair sets the ephemeral key pair to use instead of a
+// generated one. It is meant for test vectors; an ephemeral key pair must
+// never be used twice.
+func (h *HandshakeState) SetEphemeralKeyPair(keyPair *ecc.ECKeyPair) {
+	h.e = keyPair
+}
+
+// ProtocolName returns the full name of the handshake's Noise protocol.
+func (h *HandshakeState) ProtocolName() string {
+	return "Noise_" + h.pattern.name + protocolSuffix
+}
+
+// IsInitiator returns true if we are the initiator of the handshake.
+func (h *HandshakeState) IsInitiator() bool {
+	return h.initiator
+}
+
+// IsFinished returns true once every message of the handshake has been
+// written or read.
+func (h *HandshakeState) IsFinished() bool {
+	return h.index >= len(h.pattern.messages)
+}
+
+// IsOurTurn returns true if the next handshake message is ours to write.
+func (h *HandshakeState) IsOurTurn() bool {
+	return !h.IsFinished() && (h.index%2 == 0) == h.initiator
+}
+
+// RemoteStatic returns the remote static key, or nil if it is not known
+// yet.
+func (h *HandshakeState) RemoteStatic() ecc.ECPublicKeyable {
+	return h.rs
+}
+
+// RemoteIdentity returns the remote static key as an identity key, or nil
+// if it is not known yet. Check it against the identity of the device the
+// remote side claims to be.
+func (h *HandshakeState) RemoteIdentity() *identity.Key {
+	if h.rs == nil {
+		return nil
+	}
+	return identity.NewKey(h.rs)
+}
+
+// HandshakeHash returns the hash of the handshake, which both sides share
+// once it is finished. It can be used to bind the session to later
+// authentication.
+func (h *HandshakeState) HandshakeHash() []byte {
+	return append([]byte{}, h.symmetric.h...)
+}
+
+// WriteMessage returns our next handshake message, with the given payload.
+// The payload is encrypted once the pattern has mixed in a key.
+func (h *HandshakeState) WriteMessage(payload []byte) ([]byte, error) {
+	if h.IsFinished() {
+		return nil, ErrHandshakeFinished
+	}
+	if !h.IsOurTurn() {
+		return nil, ErrWrongTurn
+	}
+
+	var message []byte
+	for _, t := range h.pattern.messages[h.index] {
+		switch t {
+		case tokenE:
+			if h.e == nil {
+				keyPair, err := ecc.GenerateKeyPair()
+				if err != nil {
+					return nil, err
+				}
+				h.e = keyPair
+			}
+			publicKey := h.e.PublicKey().PublicKey()
+			message = append(message, publicKey[:]...)
+			h.symmetric.mixHash(publicKey[:])
+
+		case tokenS:
+			publicKey := h.s.PublicKey().PublicKey()
+			encrypted, err := h.symmetric.encryptAndHash(publicKey[:])
+			if err != nil {
+				return nil, err
+			}
+			message = append(message, encrypted...)
+
+		default:
+			if err := h.mixDH(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	encrypted, err := h.symmetric.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	message = append(message, encrypted...)
+	if len(message) > MaxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+	h.index++
+
+	return message, nil
+}
+
+// ReadMessage reads the remote side's next handshake message, and returns
+// its payload.
+func (h *HandshakeState) ReadMessage(message []byte) ([]byte, error) {
+	if h.IsFinished() {
+		return nil, ErrHandshakeFinished
+	}
+	if h.IsOurTurn() {
+		return nil, ErrWrongTurn
+	}
+	if len(message) > MaxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+
+	for _, t := range h.pattern.messages[h.index] {
+		switch t {
+		case tokenE:
+			if len(message) < dhLength {
+				return nil, ErrMessageTooShort
+			}
+			h.re = newPublicKey(message[:dhLength])
+			h.symmetric.mixHash(message[:dhLength])
+			message = message[dhLength:]
+
+		case tokenS:
+			length := dhLength
+			if h.symmetric.cipherState.HasKey() {
+				length += TagLength
+			}
+			if len(message) < length {
+				return nil, ErrMessageTooShort
+			}
+			publicKey, err := h.symmetric.decryptAndHash(message[:length])
+			if err != nil {
+				return nil, err
+			}
+			h.rs = newPublicKey(publicKey)
+			message = message[length:]
+
+		default:
+			if err := h.mixDH(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := h.symmetric.decryptAndHash(message)
+	if err != nil {
+		return nil, err
+	}
+	h.index++
+
+	return payload, nil
+}
+
+// Split returns the cipher states for the transport messages we send and
+// receive. The handshake must be finished.
+func (h *HandshakeState) Split() (send, receive *CipherState, err error) {
+	if !h.IsFinished() {
+		return nil, nil, ErrHandshakeIncomplete
+	}
+
+	initiator, responder, err := h.symmetric.split()
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.initiator {
+		return initiator, responder, nil
+	}
+	return responder, initiator, nil
+}
+
+// mixDH mixes the DH output of the given token into the chaining key. The
+// first letter of the token names the initiator's key, the second the
+// responder's.
+func (h *HandshakeState) mixDH(t token) error {
+	var keyPair *ecc.ECKeyPair
+	var publicKey ecc.ECPublicKeyable
+	switch {
+	case t == tokenEE:
+		keyPair, publicKey = h.e, h.re
+	case t == tokenSS:
+		keyPair, publicKey = h.s, h.rs
+	case (t == tokenES) == h.initiator:
+		keyPair, publicKey = h.e, h.rs
+	default:
+		keyPair, publicKey = h.s, h.re
+	}
+	if keyPair == nil {
+		return ErrMissingStaticKey
+	}
+	if publicKey == nil {
+		return ErrMissingRemoteKey
+	}
+
+	sharedSecret := kdf.CalculateSharedSecret(publicKey.PublicKey(), keyPair.PrivateKey().Serialize())
+	return h.symmetric.mixKey(sharedSecret[:])
+}
+
+// staticPublicKey returns our static public key, or nil if we have none.
+func (h *HandshakeState) staticPublicKey() ecc.ECPublicKeyable {
+	if h.s == nil {
+		return nil
+	}
+	return h.s.PublicKey()
+}
+
+// newPublicKey returns the public key of the given raw X25519 bytes.
+func newPublicKey(publicKey []byte) ecc.ECPublicKeyable {
+	var key [32]byte
+	copy(key[:], publicKey)
+
+	return ecc.NewDjbECPublicKey(key)
+}
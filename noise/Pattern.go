@@ -0,0 +1,99 @@
+package noise
+
+// token is a step of a handshake message.
+type token int
+
+const (
+	tokenE token = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+// Pattern is an interactive Noise handshake pattern.
+type Pattern struct {
+	name                 string
+	initiatorPreMessages []token
+	responderPreMessages []token
+	messages             [][]token
+}
+
+// Name returns the pattern's name, such as "IK".
+func (p *Pattern) Name() string {
+	return p.name
+}
+
+// PatternIK is the IK pattern. The initiator knows the responder's static
+// key beforehand, and sends its own static key in the first message:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+var PatternIK = &Pattern{
+	name:                 "IK",
+	responderPreMessages: []token{tokenS},
+	messages: [][]token{
+		{tokenE, tokenES, tokenS, tokenSS},
+		{tokenE, tokenEE, tokenSE},
+	},
+}
+
+// PatternXX is the XX pattern. Both sides send their static keys during the
+// handshake:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+var PatternXX = &Pattern{
+	name: "XX",
+	messages: [][]token{
+		{tokenE},
+		{tokenE, tokenEE, tokenS, tokenES},
+		{tokenS, tokenSE},
+	},
+}
+
+// PatternNK is the NK pattern. The initiator is anonymous and knows the
+// responder's static key beforehand:
+//
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
+var PatternNK = &Pattern{
+	name:                 "NK",
+	responderPreMessages: []token{tokenS},
+	messages: [][]token{
+		{tokenE, tokenES},
+		{tokenE, tokenEE},
+	},
+}
+
+// usesStatic returns true if the pattern sends or pre-shares the static key
+// of the initiator, or of the responder if initiator is false.
+func (p *Pattern) usesStatic(initiator bool) bool {
+	preMessages := p.responderPreMessages
+	if initiator {
+		preMessages = p.initiatorPreMessages
+	}
+	for _, t := range preMessages {
+		if t == tokenS {
+			return true
+		}
+	}
+	for i, message := range p.messages {
+		if (i%2 == 0) != initiator {
+			continue
+		}
+		for _, t := range message {
+			if t == tokenS {
+				return true
+			}
+		}
+	}
+
+	return false
+}
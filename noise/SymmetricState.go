@@ -0,0 +1,97 @@
+package noise
+
+import (
+	"crypto/sha256"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+)
+
+// hashLength is the output length of SHA256.
+const hashLength = sha256.Size
+
+// newSymmetricState returns a new symmetric state for the given protocol
+// name.
+func newSymmetricState(protocolName string) *symmetricState {
+	s := &symmetricState{cipherState: &CipherState{}}
+	if len(protocolName) <= hashLength {
+		s.h = make([]byte, hashLength)
+		copy(s.h, protocolName)
+	} else {
+		hash := sha256.Sum256([]byte(protocolName))
+		s.h = hash[:]
+	}
+	s.ck = append([]byte{}, s.h...)
+
+	return s
+}
+
+// symmetricState holds the chaining key and handshake hash during a
+// handshake, and the cipher state that encrypts the handshake payloads.
+type symmetricState struct {
+	cipherState *CipherState
+	ck          []byte
+	h           []byte
+}
+
+// mixKey mixes the given key material into the chaining key, and uses the
+// derived key to encrypt.
+func (s *symmetricState) mixKey(inputKeyMaterial []byte) error {
+	outputs, err := kdf.DeriveSecrets(inputKeyMaterial, s.ck, nil, 2*hashLength)
+	if err != nil {
+		return err
+	}
+	s.ck = outputs[:hashLength]
+
+	return s.cipherState.initializeKey(outputs[hashLength : hashLength+KeyLength])
+}
+
+// mixHash mixes the given data into the handshake hash.
+func (s *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h)
+	hash.Write(data)
+	s.h = hash.Sum(nil)
+}
+
+// encryptAndHash encrypts the given plaintext with the handshake hash as
+// associated data, and mixes the ciphertext into the hash.
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipherState.Encrypt(s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+
+	return ciphertext, nil
+}
+
+// decryptAndHash decrypts the given ciphertext with the handshake hash as
+// associated data, and mixes the ciphertext into the hash.
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipherState.Decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns the cipher states for the initiator's and the responder's
+// transport messages.
+func (s *symmetricState) split() (*CipherState, *CipherState, error) {
+	outputs, err := kdf.DeriveSecrets(nil, s.ck, nil, 2*hashLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	initiator, err := NewCipherState(outputs[:KeyLength])
+	if err != nil {
+		return nil, nil, err
+	}
+	responder, err := NewCipherState(outputs[hashLength : hashLength+KeyLength])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return initiator, responder, nil
+}
@@ -0,0 +1,8 @@
+// Package observer provides optional metrics and tracing of the Signal
+// library's protocol operations.
+//
+// Session builders, session ciphers, group ciphers and the key helpers report
+// their operations to an Observer. By default the shared observer set up
+// with Setup is used, which does nothing until one is configured. Builders
+// and ciphers can be given their own observer with SetObserver.
+package observer
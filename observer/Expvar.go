@@ -0,0 +1,115 @@
+package observer
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// messageTypeNames are the names the expvar observer uses for message types.
+var messageTypeNames = map[uint32]string{
+	protocol.WHISPER_TYPE:                "signal",
+	protocol.PREKEY_TYPE:                 "prekey",
+	protocol.SENDERKEY_TYPE:              "sender_key",
+	protocol.SENDERKEY_DISTRIBUTION_TYPE: "sender_key_distribution",
+	protocol.HEADER_ENCRYPTED_TYPE:       "header_encrypted",
+	protocol.MLS_TYPE:                    "mls",
+}
+
+// NewExpvar returns an Observer that counts events in the given expvar map.
+// Publish the map with expvar.NewMap to export it:
+//
+//	observer.Setup(observer.NewExpvar(expvar.NewMap("signal")))
+//
+// Counters are named after the event, such as "encrypt.prekey",
+// "failure.decrypt.no_session" or "skipped_keys.stored". Every operation
+// also counts its calls and total duration in "<operation>.calls" and
+// "<operation>.nanoseconds".
+func NewExpvar(counters *expvar.Map) *Expvar {
+	return &Expvar{counters: counters}
+}
+
+// Expvar is an Observer that counts events in an expvar map.
+type Expvar struct {
+	Nop
+	counters *expvar.Map
+}
+
+// Map returns the map the observer counts events in.
+func (e *Expvar) Map() *expvar.Map {
+	return e.counters
+}
+
+// StartSpan returns a span that counts the operation's calls and duration.
+func (e *Expvar) StartSpan(operation Operation) Span {
+	return &expvarSpan{counters: e.counters, operation: operation, start: time.Now()}
+}
+
+// MessageEncrypted counts an encrypted message by its type.
+func (e *Expvar) MessageEncrypted(messageType uint32) {
+	e.counters.Add("encrypt."+messageTypeName(messageType), 1)
+}
+
+// MessageDecrypted counts a decrypted message by its type.
+func (e *Expvar) MessageDecrypted(messageType uint32) {
+	e.counters.Add("decrypt."+messageTypeName(messageType), 1)
+}
+
+// Failed counts a failed operation by its reason.
+func (e *Expvar) Failed(operation Operation, reason Reason) {
+	e.counters.Add("failure."+string(operation)+"."+string(reason), 1)
+}
+
+// SkippedKeysStored counts the stored skipped message keys.
+func (e *Expvar) SkippedKeysStored(count int) {
+	e.counters.Add("skipped_keys.stored", int64(count))
+}
+
+// SkippedKeysEvicted counts the evicted skipped message keys.
+func (e *Expvar) SkippedKeysEvicted(count int) {
+	e.counters.Add("skipped_keys.evicted", int64(count))
+}
+
+// SessionArchived counts an archived session state.
+func (e *Expvar) SessionArchived() {
+	e.counters.Add("session.archived", 1)
+}
+
+// SessionPromoted counts a promoted session state.
+func (e *Expvar) SessionPromoted() {
+	e.counters.Add("session.promoted", 1)
+}
+
+// KeysGenerated counts generated keys by their kind.
+func (e *Expvar) KeysGenerated(key Key, count int) {
+	e.counters.Add("generated."+string(key), int64(count))
+}
+
+// PreKeyConsumed counts a consumed prekey by its kind.
+func (e *Expvar) PreKeyConsumed(key Key) {
+	e.counters.Add("consumed."+string(key), 1)
+}
+
+// messageTypeName returns the counter name of the given message type.
+func messageTypeName(messageType uint32) string {
+	if name, ok := messageTypeNames[messageType]; ok {
+		return name
+	}
+	return "type_" + strconv.FormatUint(uint64(messageType), 10)
+}
+
+// expvarSpan counts an operation's calls and duration when it ends.
+type expvarSpan struct {
+	counters  *expvar.Map
+	operation Operation
+	start     time.Time
+}
+
+func (s *expvarSpan) SetAttribute(key, value string) {}
+
+func (s *expvarSpan) End(err error) {
+	s.counters.Add(string(s.operation)+".calls", 1)
+	s.counters.Add(string(s.operation)+".nanoseconds", int64(time.Since(s.start)))
+}
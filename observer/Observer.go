@@ -0,0 +1,229 @@
+package observer
+
+// Operation names a protocol operation that is timed and can fail.
+type Operation string
+
+// The operations reported to an Observer.
+const (
+	OperationEncrypt       Operation = "encrypt"
+	OperationDecrypt       Operation = "decrypt"
+	OperationProcess       Operation = "process"
+	OperationProcessBundle Operation = "process_bundle"
+	OperationGroupEncrypt  Operation = "group_encrypt"
+	OperationGroupDecrypt  Operation = "group_decrypt"
+	OperationGroupProcess  Operation = "group_process"
+)
+
+// Reason describes why an operation failed.
+type Reason string
+
+// The failure reasons reported to an Observer.
+const (
+	ReasonNoSession             Reason = "no_session"
+	ReasonNoSenderKey           Reason = "no_sender_key"
+	ReasonUntrustedIdentity     Reason = "untrusted_identity"
+	ReasonInvalidSignature      Reason = "invalid_signature"
+	ReasonInvalidRegistrationID Reason = "invalid_registration_id"
+	ReasonUnsupportedVersion    Reason = "unsupported_version"
+	ReasonMissingPreKey         Reason = "missing_prekey"
+	ReasonInvalidMessage        Reason = "invalid_message"
+	ReasonDuplicateMessage      Reason = "duplicate_message"
+	ReasonTooFarInFuture        Reason = "too_far_in_future"
+	ReasonOther                 Reason = "other"
+)
+
+// Key names a kind of key that is generated or consumed.
+type Key string
+
+// The kinds of keys reported to an Observer.
+const (
+	KeyIdentity     Key = "identity"
+	KeyPreKey       Key = "prekey"
+	KeyLastResort   Key = "last_resort_prekey"
+	KeySignedPreKey Key = "signed_prekey"
+	KeySenderKey    Key = "sender_key"
+)
+
+// Observer receives the protocol operations of the library. Implementations
+// must be safe for concurrent use. Embed Nop to only handle some events.
+type Observer interface {
+	// StartSpan is called when an operation starts. The returned span is
+	// ended when the operation finishes.
+	StartSpan(operation Operation) Span
+
+	// MessageEncrypted is called for every message encrypted, with the
+	// type of the resulting message.
+	MessageEncrypted(messageType uint32)
+
+	// MessageDecrypted is called for every message decrypted, with the
+	// type of the decrypted message.
+	MessageDecrypted(messageType uint32)
+
+	// Failed is called when an operation fails.
+	Failed(operation Operation, reason Reason)
+
+	// SkippedKeysStored is called with the number of message keys stored
+	// for messages that have not arrived yet.
+	SkippedKeysStored(count int)
+
+	// SkippedKeysEvicted is called with the number of stored message keys
+	// that were dropped to make room for newer ones.
+	SkippedKeysEvicted(count int)
+
+	// SessionArchived is called when a session state is archived to make
+	// room for a new one.
+	SessionArchived()
+
+	// SessionPromoted is called when an archived session state decrypts a
+	// message and becomes the current state again.
+	SessionPromoted()
+
+	// KeysGenerated is called with the number of keys of the given kind
+	// that were generated.
+	KeysGenerated(key Key, count int)
+
+	// PreKeyConsumed is called when a one time or last resort prekey is
+	// used to build a session.
+	PreKeyConsumed(key Key)
+}
+
+// Span is a timed operation. End is called once, with the error the
+// operation failed with or nil. A failed operation sets the "failure"
+// attribute to the failure reason before the span is ended.
+type Span interface {
+	SetAttribute(key, value string)
+	End(err error)
+}
+
+// Finish ends the given span of the given operation. If err is not nil, the
+// failure is reported to the observer with the given reason first.
+func Finish(observer Observer, span Span, operation Operation, err error, reason Reason) {
+	if err != nil {
+		observer.Failed(operation, reason)
+		span.SetAttribute("failure", string(reason))
+	}
+	span.End(err)
+}
+
+// current is the shared observer used when none was set.
+var current Observer = Nop{}
+
+// Setup will configure the shared observer to use the provided observer.
+// It should be called before the library is used.
+func Setup(observer Observer) {
+	if observer == nil {
+		observer = Nop{}
+	}
+	current = observer
+}
+
+// Get returns the shared observer.
+func Get() Observer {
+	return current
+}
+
+// Nop is an Observer that ignores every event.
+type Nop struct{}
+
+func (Nop) StartSpan(operation Operation) Span        { return nopSpan{} }
+func (Nop) MessageEncrypted(messageType uint32)       {}
+func (Nop) MessageDecrypted(messageType uint32)       {}
+func (Nop) Failed(operation Operation, reason Reason) {}
+func (Nop) SkippedKeysStored(count int)               {}
+func (Nop) SkippedKeysEvicted(count int)              {}
+func (Nop) SessionArchived()                          {}
+func (Nop) SessionPromoted()                          {}
+func (Nop) KeysGenerated(key Key, count int)          {}
+func (Nop) PreKeyConsumed(key Key)                    {}
+
+// nopSpan is a span that records nothing.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key, value string) {}
+func (nopSpan) End(err error)                  {}
+
+// Multi returns an Observer that passes every event to each of the given
+// observers, for example to both collect metrics and trace.
+func Multi(observers ...Observer) Observer {
+	return multi(observers)
+}
+
+// multi is an Observer that passes events to several observers.
+type multi []Observer
+
+func (m multi) StartSpan(operation Operation) Span {
+	spans := make(multiSpan, len(m))
+	for i, observer := range m {
+		spans[i] = observer.StartSpan(operation)
+	}
+	return spans
+}
+
+func (m multi) MessageEncrypted(messageType uint32) {
+	for _, observer := range m {
+		observer.MessageEncrypted(messageType)
+	}
+}
+
+func (m multi) MessageDecrypted(messageType uint32) {
+	for _, observer := range m {
+		observer.MessageDecrypted(messageType)
+	}
+}
+
+func (m multi) Failed(operation Operation, reason Reason) {
+	for _, observer := range m {
+		observer.Failed(operation, reason)
+	}
+}
+
+func (m multi) SkippedKeysStored(count int) {
+	for _, observer := range m {
+		observer.SkippedKeysStored(count)
+	}
+}
+
+func (m multi) SkippedKeysEvicted(count int) {
+	for _, observer := range m {
+		observer.SkippedKeysEvicted(count)
+	}
+}
+
+func (m multi) SessionArchived() {
+	for _, observer := range m {
+		observer.SessionArchived()
+	}
+}
+
+func (m multi) SessionPromoted() {
+	for _, observer := range m {
+		observer.SessionPromoted()
+	}
+}
+
+func (m multi) KeysGenerated(key Key, count int) {
+	for _, observer := range m {
+		observer.KeysGenerated(key, count)
+	}
+}
+
+func (m multi) PreKeyConsumed(key Key) {
+	for _, observer := range m {
+		observer.PreKeyConsumed(key)
+	}
+}
+
+// multiSpan is a span that passes its events to several spans.
+type multiSpan []Span
+
+func (m multiSpan) SetAttribute(key, value string) {
+	for _, span := range m {
+		span.SetAttribute(key, value)
+	}
+}
+
+func (m multiSpan) End(err error) {
+	for _, span := range m {
+		span.End(err)
+	}
+}
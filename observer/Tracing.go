@@ -0,0 +1,25 @@
+package observer
+
+// Tracer starts spans in a tracing system. Adapt a tracing library to it to
+// trace the library's operations with NewTracing.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// NewTracing returns an Observer that starts a span with the given tracer
+// for every operation. Spans are named "signal.<operation>".
+func NewTracing(tracer Tracer) *Tracing {
+	return &Tracing{tracer: tracer}
+}
+
+// Tracing is an Observer that traces operations. It ignores the other
+// events, so combine it with a metrics observer using Multi.
+type Tracing struct {
+	Nop
+	tracer Tracer
+}
+
+// StartSpan starts a span for the given operation.
+func (t *Tracing) StartSpan(operation Operation) Span {
+	return t.tracer.StartSpan("signal." + string(operation))
+}
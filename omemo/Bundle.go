@@ -0,0 +1,215 @@
+package omemo
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"math/big"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
+)
+
+// Namespace is the XML namespace of OMEMO bundles and encrypted elements.
+const Namespace = "eu.siacs.conversations.axolotl"
+
+// maxPreKeys is the largest number of prekeys accepted in a bundle.
+const maxPreKeys = 1000
+
+// ErrInvalidDeviceID is returned for device IDs outside of the range of
+// registration IDs.
+var ErrInvalidDeviceID = errors.New("Invalid OMEMO device ID!")
+
+// PreKey is a one-time prekey published in a bundle.
+type PreKey struct {
+	ID        uint32
+	PublicKey ecc.ECPublicKeyable
+}
+
+// NewBundle returns a new bundle to publish for the local device, with the
+// given identity key, signed prekey and one-time prekeys.
+func NewBundle(identityKey *identity.Key, signedPreKey *record.SignedPreKey, preKeys []*record.PreKey) *Bundle {
+	bundle := &Bundle{
+		identityKey:           identityKey,
+		signedPreKeyID:        signedPreKey.ID(),
+		signedPreKey:          signedPreKey.KeyPair().PublicKey(),
+		signedPreKeySignature: signedPreKey.Signature(),
+		preKeys:               make([]PreKey, len(preKeys)),
+	}
+	for i, preKey := range preKeys {
+		bundle.preKeys[i] = PreKey{ID: preKey.ID().Value, PublicKey: preKey.KeyPair().PublicKey()}
+	}
+
+	return bundle
+}
+
+// NewBundleFromXML returns a bundle from the given bundle element.
+func NewBundleFromXML(serialized []byte) (*Bundle, error) {
+	var element bundleElement
+	if err := xml.Unmarshal(serialized, &element); err != nil {
+		return nil, err
+	}
+
+	identityKey, err := decodeKey("IdentityKey", element.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	signedPreKey, err := decodeKey("SignedPreKeyPublic", element.SignedPreKeyPublic.Value)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeBase64("OMEMOBundle", "SignedPreKeySignature", element.SignedPreKeySignature)
+	if err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckLength("OMEMOBundle", "SignedPreKeySignature", signature, 64); err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckMaxCount("OMEMOBundle", "PreKeys", len(element.PreKeys), maxPreKeys); err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		identityKey:           identity.NewKey(identityKey),
+		signedPreKeyID:        element.SignedPreKeyPublic.ID,
+		signedPreKey:          signedPreKey,
+		signedPreKeySignature: bytehelper.SliceToArray64(signature),
+		preKeys:               make([]PreKey, len(element.PreKeys)),
+	}
+	for i, preKey := range element.PreKeys {
+		publicKey, err := decodeKey("PreKeyPublic", preKey.Value)
+		if err != nil {
+			return nil, err
+		}
+		bundle.preKeys[i] = PreKey{ID: preKey.ID, PublicKey: publicKey}
+	}
+
+	return bundle, nil
+}
+
+// Bundle is the set of public keys a device publishes, so others can build
+// sessions with it.
+type Bundle struct {
+	identityKey           *identity.Key
+	signedPreKeyID        uint32
+	signedPreKey          ecc.ECPublicKeyable
+	signedPreKeySignature [64]byte
+	preKeys               []PreKey
+}
+
+// IdentityKey returns the device's identity key.
+func (b *Bundle) IdentityKey() *identity.Key {
+	return b.identityKey
+}
+
+// SignedPreKeyID returns the ID of the device's signed prekey.
+func (b *Bundle) SignedPreKeyID() uint32 {
+	return b.signedPreKeyID
+}
+
+// SignedPreKey returns the device's signed prekey.
+func (b *Bundle) SignedPreKey() ecc.ECPublicKeyable {
+	return b.signedPreKey
+}
+
+// SignedPreKeySignature returns the signature over the signed prekey.
+func (b *Bundle) SignedPreKeySignature() [64]byte {
+	return b.signedPreKeySignature
+}
+
+// PreKeys returns the device's one-time prekeys.
+func (b *Bundle) PreKeys() []PreKey {
+	return append([]PreKey{}, b.preKeys...)
+}
+
+// PreKeyBundle returns a prekey bundle to build a session with the given
+// device. As OMEMO requires, one of the bundle's one-time prekeys is chosen
+// at random. The device ID is used as the registration ID.
+func (b *Bundle) PreKeyBundle(deviceID uint32) (*prekey.Bundle, error) {
+	if !keyhelper.IsValidRegistrationID(deviceID, true) {
+		return nil, ErrInvalidDeviceID
+	}
+
+	preKeyID := optional.NewEmptyUint32()
+	var preKeyPublic ecc.ECPublicKeyable
+	if len(b.preKeys) > 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(b.preKeys))))
+		if err != nil {
+			return nil, err
+		}
+		preKey := b.preKeys[n.Int64()]
+		preKeyID = optional.NewOptionalUint32(preKey.ID)
+		preKeyPublic = preKey.PublicKey
+	}
+
+	return prekey.NewBundle(deviceID, deviceID, preKeyID, b.signedPreKeyID,
+		preKeyPublic, b.signedPreKey, b.signedPreKeySignature, b.identityKey), nil
+}
+
+// XML returns the bundle element to publish.
+func (b *Bundle) XML() ([]byte, error) {
+	signature := b.signedPreKeySignature
+	element := bundleElement{
+		SignedPreKeyPublic: signedPreKeyElement{
+			ID:    b.signedPreKeyID,
+			Value: encodeBase64(b.signedPreKey.Serialize()),
+		},
+		SignedPreKeySignature: encodeBase64(signature[:]),
+		IdentityKey:           encodeBase64(b.identityKey.Serialize()),
+		PreKeys:               make([]preKeyElement, len(b.preKeys)),
+	}
+	for i, preKey := range b.preKeys {
+		element.PreKeys[i] = preKeyElement{ID: preKey.ID, Value: encodeBase64(preKey.PublicKey.Serialize())}
+	}
+
+	return xml.Marshal(&element)
+}
+
+// bundleElement is the XML bundle element:
+//
+//	<bundle xmlns='eu.siacs.conversations.axolotl'>
+//	  <signedPreKeyPublic signedPreKeyId='1'>BASE64</signedPreKeyPublic>
+//	  <signedPreKeySignature>BASE64</signedPreKeySignature>
+//	  <identityKey>BASE64</identityKey>
+//	  <prekeys>
+//	    <preKeyPublic preKeyId='1'>BASE64</preKeyPublic>
+//	  </prekeys>
+//	</bundle>
+type bundleElement struct {
+	XMLName               xml.Name            `xml:"eu.siacs.conversations.axolotl bundle"`
+	SignedPreKeyPublic    signedPreKeyElement `xml:"signedPreKeyPublic"`
+	SignedPreKeySignature string              `xml:"signedPreKeySignature"`
+	IdentityKey           string              `xml:"identityKey"`
+	PreKeys               []preKeyElement     `xml:"prekeys>preKeyPublic"`
+}
+
+// signedPreKeyElement is the signed prekey element of a bundle.
+type signedPreKeyElement struct {
+	ID    uint32 `xml:"signedPreKeyId,attr"`
+	Value string `xml:",chardata"`
+}
+
+// preKeyElement is a one-time prekey element of a bundle.
+type preKeyElement struct {
+	ID    uint32 `xml:"preKeyId,attr"`
+	Value string `xml:",chardata"`
+}
+
+// decodeKey decodes the given base64 encoded public key of a bundle.
+func decodeKey(field, value string) (ecc.ECPublicKeyable, error) {
+	decoded, err := decodeBase64("OMEMOBundle", field, value)
+	if err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckLength("OMEMOBundle", field, decoded, ecc.KeySize); err != nil {
+		return nil, err
+	}
+
+	return ecc.DecodePoint(decoded, 0)
+}
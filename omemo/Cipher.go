@@ -0,0 +1,197 @@
+package omemo
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// keyLength is the length of the AES-128 key of a message's payload.
+const keyLength = 16
+
+// authTagLength is the length of the GCM authentication tag, which is sent
+// along with the key.
+const authTagLength = 16
+
+// ErrNoKeyForDevice is returned when a message isn't encrypted for the local
+// device.
+var ErrNoKeyForDevice = errors.New("OMEMO message has no key for this device!")
+
+// ErrInvalidKey is returned when a decrypted key has the wrong length.
+var ErrInvalidKey = errors.New("Invalid OMEMO message key!")
+
+// ErrNoRecipients is returned when a message is encrypted for no devices.
+var ErrNoRecipients = errors.New("OMEMO message has no recipients!")
+
+// NewCipher returns a new OMEMO cipher for the local device at the given
+// address, with the sessions and keys in the given store. The address is the
+// user's bare JID and OMEMO device ID, and the store's local registration ID
+// must be the same device ID.
+func NewCipher(signalStore store.SignalProtocol, address *protocol.SignalAddress,
+	serializer *serialize.Serializer) *Cipher {
+
+	return &Cipher{
+		signalStore: signalStore,
+		address:     address,
+		serializer:  serializer,
+	}
+}
+
+// Cipher encrypts and decrypts OMEMO messages for the local device. Calls
+// for the same remote device must not run concurrently, just like the
+// session.Cipher calls they make.
+type Cipher struct {
+	signalStore store.SignalProtocol
+	address     *protocol.SignalAddress
+	serializer  *serialize.Serializer
+}
+
+// Address returns the address of the local device.
+func (c *Cipher) Address() *protocol.SignalAddress {
+	return c.address
+}
+
+// ProcessBundle builds a session with the given device of the given user
+// from the device's published bundle.
+func (c *Cipher) ProcessBundle(jid string, deviceID uint32, bundle *Bundle) error {
+	preKeyBundle, err := bundle.PreKeyBundle(deviceID)
+	if err != nil {
+		return err
+	}
+
+	builder := session.NewBuilderFromSignal(c.signalStore, protocol.NewSignalAddress(jid, deviceID), c.serializer)
+	return builder.ProcessBundle(preKeyBundle)
+}
+
+// Encrypt encrypts the given plaintext for the given devices, which must all
+// have a session. Include the user's own other devices, so they can read
+// the message too.
+func (c *Cipher) Encrypt(plaintext []byte, recipients ...*protocol.SignalAddress) (*Message, error) {
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	// EncryptGCM returns the IV, the ciphertext and the tag. OMEMO sends the
+	// tag with the key, so it's encrypted for every device.
+	sealed, err := cipher.EncryptGCM(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	iv := sealed[:ivLength]
+	payload := sealed[ivLength : len(sealed)-authTagLength]
+	authTag := sealed[len(sealed)-authTagLength:]
+
+	keys, err := c.encryptKey(append(key, authTag...), recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMessage(c.address.DeviceID(), keys, iv, payload), nil
+}
+
+// KeyTransport returns a key transport element for the given devices, which
+// must all have a session. It carries a random key without a payload, and is
+// used to complete a session built from a bundle, or to advance the ratchet
+// of a session.
+func (c *Cipher) KeyTransport(recipients ...*protocol.SignalAddress) (*Message, error) {
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, ivLength)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	keys, err := c.encryptKey(key, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMessage(c.address.DeviceID(), keys, iv, nil), nil
+}
+
+// Decrypt decrypts the given message from the given user. A key in a
+// PreKeySignalMessage builds the session with the sender first. Key
+// transport elements only update the session, and return a nil plaintext.
+func (c *Cipher) Decrypt(jid string, message *Message) ([]byte, error) {
+	key := message.Key(c.address.DeviceID())
+	if key == nil {
+		return nil, ErrNoKeyForDevice
+	}
+
+	keyMaterial, err := c.decryptKey(protocol.NewSignalAddress(jid, message.SenderDeviceID()), key)
+	if err != nil {
+		return nil, err
+	}
+	if message.IsKeyTransport() {
+		return nil, nil
+	}
+
+	// Older clients appended the tag to the payload instead of the key.
+	sealed := append(append([]byte{}, message.IV()...), message.Payload()...)
+	switch len(keyMaterial) {
+	case keyLength + authTagLength:
+		sealed = append(sealed, keyMaterial[keyLength:]...)
+	case keyLength:
+	default:
+		return nil, ErrInvalidKey
+	}
+
+	return cipher.DecryptGCM(keyMaterial[:keyLength], sealed)
+}
+
+// encryptKey encrypts the given key material with the session of every
+// given device.
+func (c *Cipher) encryptKey(keyMaterial []byte, recipients []*protocol.SignalAddress) ([]*Key, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	keys := make([]*Key, len(recipients))
+	for i, recipient := range recipients {
+		builder := session.NewBuilderFromSignal(c.signalStore, recipient, c.serializer)
+		encrypted, err := session.NewCipher(builder, recipient).Encrypt(keyMaterial)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = &Key{
+			DeviceID: recipient.DeviceID(),
+			PreKey:   encrypted.Type() == protocol.PREKEY_TYPE,
+			Data:     encrypted.Serialize(),
+		}
+	}
+
+	return keys, nil
+}
+
+// decryptKey decrypts the given key from the given device with the
+// device's session.
+func (c *Cipher) decryptKey(sender *protocol.SignalAddress, key *Key) ([]byte, error) {
+	builder := session.NewBuilderFromSignal(c.signalStore, sender, c.serializer)
+	sessionCipher := session.NewCipher(builder, sender)
+
+	if key.PreKey {
+		message, err := protocol.NewPreKeySignalMessageFromBytes(key.Data,
+			c.serializer.PreKeySignalMessage, c.serializer.SignalMessage)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := builder.Process(message); err != nil {
+			return nil, err
+		}
+		return sessionCipher.Decrypt(message.WhisperMessage())
+	}
+
+	message, err := protocol.NewSignalMessageFromBytes(key.Data, c.serializer.SignalMessage)
+	if err != nil {
+		return nil, err
+	}
+	return sessionCipher.Decrypt(message)
+}
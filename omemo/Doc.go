@@ -0,0 +1,17 @@
+// Package omemo provides a compatibility layer for OMEMO (XEP-0384)
+// encryption in XMPP, which is built on the same X3DH and double ratchet.
+//
+// It implements the "eu.siacs.conversations.axolotl" namespace used by
+// deployed OMEMO clients. A user's OMEMO device ID is used as both their
+// device ID and registration ID, so an OMEMO device maps to the
+// protocol.SignalAddress of the user's bare JID and device ID. Bundles
+// published over PubSub are parsed into prekey.Bundles to build sessions.
+//
+// Messages are encrypted with a fresh AES-128-GCM key and 12 byte IV. The
+// key and the GCM authentication tag are encrypted for every recipient
+// device with its session.Cipher, and sent in the message's header next to
+// the encrypted payload. Key transport elements carry a key without a
+// payload, and are used to build or advance sessions. Other OMEMO clients
+// expect the Signal messages in the header to be protobuf encoded, so use a
+// serializer that encodes them that way to talk to them.
+package omemo
@@ -0,0 +1,219 @@
+package omemo
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// ivLength is the length of the AES-GCM IV of a message.
+const ivLength = 12
+
+// maxKeys is the largest number of keys accepted in a message header.
+const maxKeys = 1000
+
+// Key is a message's payload key, encrypted for one device with the
+// device's session.
+type Key struct {
+	// DeviceID is the recipient device.
+	DeviceID uint32
+
+	// PreKey is true if Data is a PreKeySignalMessage, which builds the
+	// session, and false if it is a SignalMessage.
+	PreKey bool
+
+	// Data is the serialized Signal message.
+	Data []byte
+}
+
+// NewMessage returns a new message from the given sender device, with the
+// given encrypted keys, IV and encrypted payload. A message without a
+// payload is a key transport element.
+func NewMessage(senderDeviceID uint32, keys []*Key, iv, payload []byte) *Message {
+	return &Message{
+		senderDeviceID: senderDeviceID,
+		keys:           keys,
+		iv:             iv,
+		payload:        payload,
+	}
+}
+
+// NewMessageFromXML returns a message from the given encrypted element.
+func NewMessageFromXML(serialized []byte) (*Message, error) {
+	var element encryptedElement
+	if err := xml.Unmarshal(serialized, &element); err != nil {
+		return nil, err
+	}
+
+	if !keyhelper.IsValidRegistrationID(element.Header.SenderDeviceID, true) {
+		return nil, errorhelper.NewDecodeError("OMEMOMessage", "SenderDeviceID", ErrInvalidDeviceID)
+	}
+	if len(element.Header.Keys) == 0 {
+		return nil, errorhelper.NewDecodeError("OMEMOMessage", "Keys", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckMaxCount("OMEMOMessage", "Keys", len(element.Header.Keys), maxKeys); err != nil {
+		return nil, err
+	}
+	iv, err := decodeBase64("OMEMOMessage", "IV", element.Header.IV)
+	if err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckLength("OMEMOMessage", "IV", iv, ivLength); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, len(element.Header.Keys))
+	for i, key := range element.Header.Keys {
+		data, err := decodeBase64("OMEMOMessage", "Key", key.Value)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = &Key{
+			DeviceID: key.DeviceID,
+			PreKey:   key.PreKey == "true" || key.PreKey == "1",
+			Data:     data,
+		}
+	}
+
+	var payload []byte
+	if element.Payload != nil {
+		// An empty payload is the encryption of an empty plaintext.
+		payload, err = base64.StdEncoding.DecodeString(stripWhitespace(*element.Payload))
+		if err != nil {
+			return nil, errorhelper.NewDecodeError("OMEMOMessage", "Payload", err)
+		}
+		if payload == nil {
+			payload = []byte{}
+		}
+	}
+
+	return NewMessage(element.Header.SenderDeviceID, keys, iv, payload), nil
+}
+
+// Message is an OMEMO encrypted element. It holds a payload encrypted with
+// AES-GCM, and the payload's key encrypted for every recipient device.
+type Message struct {
+	senderDeviceID uint32
+	keys           []*Key
+	iv             []byte
+	payload        []byte
+}
+
+// SenderDeviceID returns the device ID of the sender.
+func (m *Message) SenderDeviceID() uint32 {
+	return m.senderDeviceID
+}
+
+// Keys returns the encrypted keys for every recipient device.
+func (m *Message) Keys() []*Key {
+	return m.keys
+}
+
+// Key returns the encrypted key for the given device, or nil if the message
+// isn't encrypted for it.
+func (m *Message) Key(deviceID uint32) *Key {
+	for _, key := range m.keys {
+		if key.DeviceID == deviceID {
+			return key
+		}
+	}
+	return nil
+}
+
+// IV returns the IV of the encrypted payload.
+func (m *Message) IV() []byte {
+	return m.iv
+}
+
+// Payload returns the encrypted payload, or nil for a key transport
+// element.
+func (m *Message) Payload() []byte {
+	return m.payload
+}
+
+// IsKeyTransport returns true if the message has no payload. Key transport
+// elements only carry keys, to build or advance sessions.
+func (m *Message) IsKeyTransport() bool {
+	return m.payload == nil
+}
+
+// XML returns the message as an encrypted element.
+func (m *Message) XML() ([]byte, error) {
+	element := encryptedElement{
+		Header: headerElement{
+			SenderDeviceID: m.senderDeviceID,
+			Keys:           make([]keyElement, len(m.keys)),
+			IV:             encodeBase64(m.iv),
+		},
+	}
+	for i, key := range m.keys {
+		element.Header.Keys[i] = keyElement{DeviceID: key.DeviceID, Value: encodeBase64(key.Data)}
+		if key.PreKey {
+			element.Header.Keys[i].PreKey = "true"
+		}
+	}
+	if m.payload != nil {
+		payload := encodeBase64(m.payload)
+		element.Payload = &payload
+	}
+
+	return xml.Marshal(&element)
+}
+
+// encryptedElement is the XML encrypted element:
+//
+//	<encrypted xmlns='eu.siacs.conversations.axolotl'>
+//	  <header sid='27183'>
+//	    <key rid='31415'>BASE64</key>
+//	    <key prekey='true' rid='12321'>BASE64</key>
+//	    <iv>BASE64</iv>
+//	  </header>
+//	  <payload>BASE64</payload>
+//	</encrypted>
+type encryptedElement struct {
+	XMLName xml.Name      `xml:"eu.siacs.conversations.axolotl encrypted"`
+	Header  headerElement `xml:"header"`
+	Payload *string       `xml:"payload"`
+}
+
+// headerElement is the header of an encrypted element.
+type headerElement struct {
+	SenderDeviceID uint32       `xml:"sid,attr"`
+	Keys           []keyElement `xml:"key"`
+	IV             string       `xml:"iv"`
+}
+
+// keyElement is an encrypted key in a header.
+type keyElement struct {
+	DeviceID uint32 `xml:"rid,attr"`
+	PreKey   string `xml:"prekey,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+// encodeBase64 returns the given bytes as base64 element text.
+func encodeBase64(value []byte) string {
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+// decodeBase64 returns the bytes of the given base64 element text, which
+// may be wrapped over several lines.
+func decodeBase64(structType, field, value string) ([]byte, error) {
+	value = stripWhitespace(value)
+	if value == "" {
+		return nil, errorhelper.NewDecodeError(structType, field, errorhelper.ErrMissingField)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errorhelper.NewDecodeError(structType, field, err)
+	}
+	return decoded, nil
+}
+
+// stripWhitespace removes all whitespace from the given element text.
+func stripWhitespace(value string) string {
+	return strings.Join(strings.Fields(value), "")
+}
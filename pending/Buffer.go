@@ -0,0 +1,194 @@
+package pending
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// DefaultTTL is how long a message is kept in the buffer by default.
+const DefaultTTL = 5 * time.Minute
+
+// DefaultMaxSize is the number of messages a buffer holds by default.
+const DefaultMaxSize = 1000
+
+// ErrBuffered is returned by a cipher when a message was buffered until its
+// session or sender key is established.
+var ErrBuffered = errors.New("Message buffered until its session is established.")
+
+// ErrExpired is passed to the Handler for a message that was not decrypted
+// before its time to live ran out.
+var ErrExpired = errors.New("Buffered message expired.")
+
+// ErrBufferFull is passed to the Handler for a message that was dropped to
+// make room for a newer one.
+var ErrBufferFull = errors.New("Message buffer is full.")
+
+// Handler is called with the result of decrypting a buffered message, or
+// with ErrExpired or ErrBufferFull if the message was dropped.
+type Handler func(message *Message, plaintext []byte, err error)
+
+// Message is a message held in the buffer. Exactly one of Address and
+// SenderKeyName is set.
+type Message struct {
+	Address       *protocol.SignalAddress
+	SenderKeyName *protocol.SenderKeyName
+	Ciphertext    protocol.CiphertextMessage
+	Received      time.Time
+}
+
+// expired returns true if the message is older than the given TTL.
+func (m *Message) expired(ttl time.Duration) bool {
+	return time.Since(m.Received) >= ttl
+}
+
+// NewBuffer returns a new buffer that keeps messages for the given time to
+// live and holds at most maxSize messages. A ttl or maxSize that isn't
+// positive is replaced by DefaultTTL or DefaultMaxSize, as such a buffer
+// would drop every message. The given handler is called with the results of
+// buffered messages.
+func NewBuffer(ttl time.Duration, maxSize int, handler Handler) *Buffer {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	return &Buffer{
+		ttl:     ttl,
+		maxSize: maxSize,
+		handler: handler,
+	}
+}
+
+// Buffer holds messages that arrived before their session or sender key.
+// It is safe for concurrent use.
+type Buffer struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	maxSize  int
+	handler  Handler
+	messages []*Message
+}
+
+// AddSessionMessage buffers the given message from the given address until
+// a session with the address is established.
+func (b *Buffer) AddSessionMessage(address *protocol.SignalAddress, message protocol.CiphertextMessage) {
+	b.add(&Message{Address: address, Ciphertext: message, Received: time.Now()})
+}
+
+// AddGroupMessage buffers the given message until the sender key with the
+// given name is established.
+func (b *Buffer) AddGroupMessage(senderKeyName *protocol.SenderKeyName, message *protocol.SenderKeyMessage) {
+	b.add(&Message{SenderKeyName: senderKeyName, Ciphertext: message, Received: time.Now()})
+}
+
+// TakeSessionMessages removes and returns the unexpired messages from the
+// given address, oldest first.
+func (b *Buffer) TakeSessionMessages(address *protocol.SignalAddress) []*Message {
+	return b.take(func(message *Message) bool {
+		return message.Address != nil && *message.Address == *address
+	})
+}
+
+// TakeGroupMessages removes and returns the unexpired messages for the
+// sender key with the given name, oldest first.
+func (b *Buffer) TakeGroupMessages(senderKeyName *protocol.SenderKeyName) []*Message {
+	return b.take(func(message *Message) bool {
+		return message.SenderKeyName != nil && message.SenderKeyName.Equal(senderKeyName)
+	})
+}
+
+// Len returns the number of messages in the buffer, including expired
+// messages that have not been pruned yet.
+func (b *Buffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.messages)
+}
+
+// Prune removes the expired messages from the buffer and passes them to the
+// handler with ErrExpired.
+func (b *Buffer) Prune() {
+	b.mutex.Lock()
+	expired := b.removeExpired()
+	b.mutex.Unlock()
+
+	b.dropped(expired, ErrExpired)
+}
+
+// Deliver passes the result of decrypting a buffered message to the handler.
+func (b *Buffer) Deliver(message *Message, plaintext []byte, err error) {
+	if b.handler != nil {
+		b.handler(message, plaintext, err)
+	}
+}
+
+// add appends the given message to the buffer, dropping the oldest messages
+// if the buffer is full.
+func (b *Buffer) add(message *Message) {
+	b.mutex.Lock()
+	expired := b.removeExpired()
+	b.messages = append(b.messages, message)
+	var full []*Message
+	if overflow := len(b.messages) - b.maxSize; overflow > 0 {
+		full = b.messages[:overflow]
+		b.messages = append([]*Message{}, b.messages[overflow:]...)
+	}
+	b.mutex.Unlock()
+
+	logger.Debug("Buffered message until its session is established: ", message.Ciphertext.Type())
+	b.dropped(expired, ErrExpired)
+	b.dropped(full, ErrBufferFull)
+}
+
+// take removes and returns the unexpired messages that match the given
+// function.
+func (b *Buffer) take(matches func(*Message) bool) []*Message {
+	b.mutex.Lock()
+	expired := b.removeExpired()
+	var taken []*Message
+	kept := make([]*Message, 0, len(b.messages))
+	for _, message := range b.messages {
+		if matches(message) {
+			taken = append(taken, message)
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	b.messages = kept
+	b.mutex.Unlock()
+
+	b.dropped(expired, ErrExpired)
+	return taken
+}
+
+// removeExpired removes and returns the expired messages. The caller must
+// hold the mutex.
+func (b *Buffer) removeExpired() []*Message {
+	var expired []*Message
+	kept := make([]*Message, 0, len(b.messages))
+	for _, message := range b.messages {
+		if message.expired(b.ttl) {
+			expired = append(expired, message)
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	b.messages = kept
+
+	return expired
+}
+
+// dropped passes the given dropped messages to the handler with the given
+// error.
+func (b *Buffer) dropped(messages []*Message, err error) {
+	for _, message := range messages {
+		b.Deliver(message, nil, err)
+	}
+}
@@ -0,0 +1,11 @@
+// Package pending provides a buffer for messages that arrive before the
+// session or sender key needed to decrypt them.
+//
+// On unreliable transports a SignalMessage can arrive before the
+// PreKeySignalMessage that builds its session, and a SenderKeyMessage before
+// its SenderKeyDistributionMessage. When a Buffer is set on a session or
+// group builder, ciphers created from that builder hold such messages in it
+// instead of failing, and the builder decrypts them once it has processed
+// the message that establishes the session or sender key. The results are
+// passed to the buffer's Handler.
+package pending
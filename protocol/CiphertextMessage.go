@@ -12,3 +12,5 @@ const WHISPER_TYPE = 2
 const PREKEY_TYPE = 3
 const SENDERKEY_TYPE = 4
 const SENDERKEY_DISTRIBUTION_TYPE = 5
+const HEADER_ENCRYPTED_TYPE = 6
+const MLS_TYPE = 7
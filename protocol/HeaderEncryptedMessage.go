@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+)
+
+// headerLength is the length of an encoded message header: the serialized
+// sender ratchet key, the counter and the previous counter.
+const headerLength = 33 + 4 + 4
+
+// HeaderEncryptedMessageSerializer is an interface for serializing and
+// deserializing HeaderEncryptedMessages into bytes. An implementation of this
+// interface should be used to encode/decode the object into JSON, Protobuffers, etc.
+type HeaderEncryptedMessageSerializer interface {
+	Serialize(message *HeaderEncryptedMessageStructure) []byte
+	Deserialize(serialized []byte) (*HeaderEncryptedMessageStructure, error)
+}
+
+// NewHeaderEncryptedMessageFromBytes will return a header encrypted message
+// from the given bytes using the given serializer.
+func NewHeaderEncryptedMessageFromBytes(serialized []byte, serializer HeaderEncryptedMessageSerializer) (*HeaderEncryptedMessage, error) {
+	structure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHeaderEncryptedMessageFromStruct(structure, serializer)
+}
+
+// NewHeaderEncryptedMessageFromStruct returns a header encrypted message from
+// the given serializable structure.
+func NewHeaderEncryptedMessageFromStruct(structure *HeaderEncryptedMessageStructure,
+	serializer HeaderEncryptedMessageSerializer) (*HeaderEncryptedMessage, error) {
+
+	if structure == nil {
+		return nil, missingField("HeaderEncryptedMessage", "Structure")
+	}
+
+	// Throw an error if the given message structure is an unsupported version.
+	if err := checkVersion("HeaderEncryptedMessage", structure.Version); err != nil {
+		return nil, err
+	}
+
+	// Throw an error if the structure is missing critical fields.
+	err := errorhelper.CheckLength("HeaderEncryptedMessage", "Header", structure.Header, headerLength+cipher.GCMOverhead)
+	if err != nil {
+		return nil, err
+	}
+	if structure.CipherText == nil {
+		return nil, missingField("HeaderEncryptedMessage", "CipherText")
+	}
+	params, err := version.Get(structure.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckLength("HeaderEncryptedMessage", "Mac", structure.Mac, params.MacLength); err != nil {
+		return nil, err
+	}
+
+	return &HeaderEncryptedMessage{structure: *structure, serializer: serializer}, nil
+}
+
+// NewHeaderEncryptedMessage returns a new header encrypted message. The given
+// header is encrypted with the header key, and the whole message is
+// authenticated with the MAC key.
+func NewHeaderEncryptedMessage(messageVersion int, header *MessageHeader, headerKey, macKey []byte,
+	ciphertext []byte, senderIdentityKey, receiverIdentityKey *identity.Key,
+	serializer HeaderEncryptedMessageSerializer) (*HeaderEncryptedMessage, error) {
+
+	encryptedHeader, err := cipher.EncryptGCM(headerKey, header.encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the message structure with the given data.
+	structure := &HeaderEncryptedMessageStructure{
+		Version:    messageVersion,
+		Header:     encryptedHeader,
+		CipherText: ciphertext,
+	}
+
+	// Get the message authentication code from the serialized structure.
+	mac, err := getMac(
+		messageVersion, senderIdentityKey, receiverIdentityKey,
+		macKey, serializer.Serialize(structure),
+	)
+	if err != nil {
+		return nil, err
+	}
+	structure.Mac = mac
+
+	return NewHeaderEncryptedMessageFromStruct(structure, serializer)
+}
+
+// HeaderEncryptedMessageStructure is a serializable structure of a header
+// encrypted message.
+type HeaderEncryptedMessageStructure struct {
+	Header     []byte
+	CipherText []byte
+	Version    int
+	Mac        []byte
+}
+
+// HeaderEncryptedMessage is a cipher message whose sender ratchet key and
+// counters are encrypted, so relays can't see the structure of a
+// conversation.
+type HeaderEncryptedMessage struct {
+	structure  HeaderEncryptedMessageStructure
+	serializer HeaderEncryptedMessageSerializer
+}
+
+// MessageVersion returns the message version of the message.
+func (h *HeaderEncryptedMessage) MessageVersion() int {
+	return h.structure.Version
+}
+
+// Body will return the message's ciphertext in bytes.
+func (h *HeaderEncryptedMessage) Body() []byte {
+	return h.structure.CipherText
+}
+
+// DecryptHeader decrypts the message header with the given header key. An
+// error is returned if the header was not encrypted with the key.
+func (h *HeaderEncryptedMessage) DecryptHeader(headerKey []byte) (*MessageHeader, error) {
+	encoded, err := cipher.DecryptGCM(headerKey, h.structure.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeMessageHeader(encoded)
+}
+
+// VerifyMac will return an error if the message's message authentication code
+// is invalid.
+func (h *HeaderEncryptedMessage) VerifyMac(senderIdentityKey, receiverIdentityKey *identity.Key, macKey []byte) error {
+	// Calculate the message authentication code without the mac.
+	structure := h.structure
+	structure.Mac = nil
+	ourMac, err := getMac(
+		h.structure.Version,
+		senderIdentityKey,
+		receiverIdentityKey,
+		macKey,
+		h.serializer.Serialize(&structure),
+	)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(ourMac, h.structure.Mac) {
+		return ErrBadMac
+	}
+
+	return nil
+}
+
+// Serialize will return the message as bytes.
+func (h *HeaderEncryptedMessage) Serialize() []byte {
+	return h.serializer.Serialize(&h.structure)
+}
+
+// Structure will return a serializeable structure of the message.
+func (h *HeaderEncryptedMessage) Structure() *HeaderEncryptedMessageStructure {
+	structure := h.structure
+	return &structure
+}
+
+// Type will return the type of message this is.
+func (h *HeaderEncryptedMessage) Type() uint32 {
+	return HEADER_ENCRYPTED_TYPE
+}
+
+// NewMessageHeader returns a new message header.
+func NewMessageHeader(senderRatchetKey ecc.ECPublicKeyable, counter, previousCounter uint32) *MessageHeader {
+	return &MessageHeader{
+		senderRatchetKey: senderRatchetKey,
+		counter:          counter,
+		previousCounter:  previousCounter,
+	}
+}
+
+// MessageHeader holds the fields of a message that are encrypted in header
+// encrypted messages.
+type MessageHeader struct {
+	senderRatchetKey ecc.ECPublicKeyable
+	counter          uint32
+	previousCounter  uint32
+}
+
+// SenderRatchetKey returns the sender's ratchet key.
+func (m *MessageHeader) SenderRatchetKey() ecc.ECPublicKeyable {
+	return m.senderRatchetKey
+}
+
+// Counter returns the message counter.
+func (m *MessageHeader) Counter() uint32 {
+	return m.counter
+}
+
+// PreviousCounter returns the length of the sender's previous chain.
+func (m *MessageHeader) PreviousCounter() uint32 {
+	return m.previousCounter
+}
+
+// encode returns the header in its fixed length binary form.
+func (m *MessageHeader) encode() []byte {
+	encoded := make([]byte, 0, headerLength)
+	encoded = append(encoded, m.senderRatchetKey.Serialize()...)
+	encoded = binary.BigEndian.AppendUint32(encoded, m.counter)
+	encoded = binary.BigEndian.AppendUint32(encoded, m.previousCounter)
+
+	return encoded
+}
+
+// decodeMessageHeader returns the header encoded in the given bytes.
+func decodeMessageHeader(encoded []byte) (*MessageHeader, error) {
+	err := errorhelper.CheckLength("MessageHeader", "Header", encoded, headerLength)
+	if err != nil {
+		return nil, err
+	}
+	senderRatchetKey, err := ecc.DecodePoint(encoded[:33], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageHeader{
+		senderRatchetKey: senderRatchetKey,
+		counter:          binary.BigEndian.Uint32(encoded[33:37]),
+		previousCounter:  binary.BigEndian.Uint32(encoded[37:41]),
+	}, nil
+}
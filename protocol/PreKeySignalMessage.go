@@ -1,11 +1,10 @@
 package protocol
 
 import (
-	"errors"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
-	"strconv"
 )
 
 // PreKeySignalMessageSerializer is an interface for serializing and deserializing
@@ -34,22 +33,24 @@ func NewPreKeySignalMessageFromBytes(serialized []byte, serializer PreKeySignalM
 func NewPreKeySignalMessageFromStruct(structure *PreKeySignalMessageStructure,
 	serializer PreKeySignalMessageSerializer, msgSerializer SignalMessageSerializer) (*PreKeySignalMessage, error) {
 
-	// Throw an error if the given message structure is an unsupported version.
-	if structure.Version <= UnsupportedVersion {
-		err := "Legacy message: " + strconv.Itoa(structure.Version)
-		return nil, errors.New(err)
+	if structure == nil {
+		return nil, missingField("PreKeySignalMessage", "Structure")
 	}
 
-	// Throw an error if the given message structure is a future version.
-	if structure.Version > CurrentVersion {
-		err := "Unknown version: " + strconv.Itoa(structure.Version)
-		return nil, errors.New(err)
+	// Throw an error if the given message structure is an unsupported version.
+	if err := checkVersion("PreKeySignalMessage", structure.Version); err != nil {
+		return nil, err
 	}
 
-	// Throw an error if the structure is missing critical fields.
-	if structure.BaseKey == nil || structure.IdentityKey == nil || structure.Message == nil {
-		err := "Incomplete message."
-		return nil, errors.New(err)
+	// Throw an error if the structure is missing critical fields. A message
+	// carries either a signal message or a header encrypted message.
+	if structure.Message == nil && structure.HeaderEncryptedMessage == nil {
+		return nil, missingField("PreKeySignalMessage", "Message")
+	}
+	if structure.Message != nil && structure.HeaderEncryptedMessage != nil {
+		return nil, errorhelper.NewDecodeError(
+			"PreKeySignalMessage", "HeaderEncryptedMessage", errorhelper.ErrUnexpectedField,
+		)
 	}
 
 	// Create the signal message object from the structure.
@@ -70,6 +71,12 @@ func NewPreKeySignalMessageFromStruct(structure *PreKeySignalMessageStructure,
 	}
 	preKeyWhisperMessage.identityKey = identity.NewKey(identityKey)
 
+	// Header encrypted messages are decoded by the session cipher, which
+	// holds the header keys needed to read them.
+	if structure.HeaderEncryptedMessage != nil {
+		return preKeyWhisperMessage, nil
+	}
+
 	// Generate the SignalMessage object from bytes.
 	preKeyWhisperMessage.message, err = NewSignalMessageFromBytes(structure.Message, msgSerializer)
 	if err != nil {
@@ -96,6 +103,24 @@ func NewPreKeySignalMessage(version int, registrationID uint32, preKeyID *option
 	return NewPreKeySignalMessageFromStruct(structure, serializer, msgSerializer)
 }
 
+// NewHeaderEncryptedPreKeySignalMessage will return a new PreKeySignalMessage
+// object that carries a header encrypted message.
+func NewHeaderEncryptedPreKeySignalMessage(version int, registrationID uint32, preKeyID *optional.Uint32,
+	signedPreKeyID uint32, baseKey ecc.ECPublicKeyable, identityKey *identity.Key, message *HeaderEncryptedMessage,
+	serializer PreKeySignalMessageSerializer, msgSerializer SignalMessageSerializer) (*PreKeySignalMessage, error) {
+
+	structure := &PreKeySignalMessageStructure{
+		Version:                version,
+		RegistrationID:         registrationID,
+		PreKeyID:               preKeyID,
+		SignedPreKeyID:         signedPreKeyID,
+		BaseKey:                baseKey.Serialize(),
+		IdentityKey:            identityKey.PublicKey().Serialize(),
+		HeaderEncryptedMessage: message.Serialize(),
+	}
+	return NewPreKeySignalMessageFromStruct(structure, serializer, msgSerializer)
+}
+
 // PreKeySignalMessageStructure is a serializable structure for
 // PreKeySignalMessages.
 type PreKeySignalMessageStructure struct {
@@ -106,6 +131,10 @@ type PreKeySignalMessageStructure struct {
 	IdentityKey    []byte
 	Message        []byte
 	Version        int
+
+	// HeaderEncryptedMessage is set instead of Message for sessions that
+	// use header encryption.
+	HeaderEncryptedMessage []byte
 }
 
 // PreKeySignalMessage is an encrypted Signal message that is designed
@@ -146,6 +175,18 @@ func (p *PreKeySignalMessage) WhisperMessage() *SignalMessage {
 	return p.message
 }
 
+// IsHeaderEncrypted returns true if the message carries a header encrypted
+// message instead of a signal message.
+func (p *PreKeySignalMessage) IsHeaderEncrypted() bool {
+	return p.structure.HeaderEncryptedMessage != nil
+}
+
+// HeaderEncryptedMessage returns the serialized header encrypted message, or
+// nil if the message carries a signal message.
+func (p *PreKeySignalMessage) HeaderEncryptedMessage() []byte {
+	return p.structure.HeaderEncryptedMessage
+}
+
 func (p *PreKeySignalMessage) Serialize() []byte {
 	return p.serializer.Serialize(&p.structure)
 }
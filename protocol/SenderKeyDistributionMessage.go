@@ -1,9 +1,8 @@
 package protocol
 
 import (
-	"errors"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
-	"strconv"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // SenderKeyDistributionMessageSerializer is an interface for serializing and deserializing
@@ -33,22 +32,18 @@ func NewSenderKeyDistributionMessageFromBytes(serialized []byte,
 func NewSenderKeyDistributionMessageFromStruct(structure *SenderKeyDistributionMessageStructure,
 	serializer SenderKeyDistributionMessageSerializer) (*SenderKeyDistributionMessage, error) {
 
-	// Throw an error if the given message structure is an unsupported version.
-	if structure.Version <= UnsupportedVersion {
-		err := "Legacy message: " + strconv.Itoa(int(structure.Version))
-		return nil, errors.New(err)
+	if structure == nil {
+		return nil, missingField("SenderKeyDistributionMessage", "Structure")
 	}
 
-	// Throw an error if the given message structure is a future version.
-	if structure.Version > CurrentVersion {
-		err := "Unknown version: " + strconv.Itoa(int(structure.Version))
-		return nil, errors.New(err)
+	// Throw an error if the given message structure is an unsupported version.
+	if err := checkVersion("SenderKeyDistributionMessage", int(structure.Version)); err != nil {
+		return nil, err
 	}
 
 	// Throw an error if the structure is missing critical fields.
-	if structure.SigningKey == nil || structure.ChainKey == nil {
-		err := "Incomplete message."
-		return nil, errors.New(err)
+	if err := errorhelper.CheckLength("SenderKeyDistributionMessage", "ChainKey", structure.ChainKey, 32); err != nil {
+		return nil, err
 	}
 
 	// Get the signing key object from bytes.
@@ -67,12 +62,6 @@ func NewSenderKeyDistributionMessageFromStruct(structure *SenderKeyDistributionM
 		serializer:   serializer,
 	}
 
-	// Generate the ECC key from bytes.
-	message.signatureKey, err = ecc.DecodePoint(structure.SigningKey, 0)
-	if err != nil {
-		return nil, err
-	}
-
 	return message, nil
 }
 
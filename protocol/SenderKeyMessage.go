@@ -1,10 +1,9 @@
 package protocol
 
 import (
-	"errors"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
-	"strconv"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // SenderKeyMessageSerializer is an interface for serializing and deserializing
@@ -34,22 +33,21 @@ func NewSenderKeyMessageFromBytes(serialized []byte,
 func NewSenderKeyMessageFromStruct(structure *SenderKeyMessageStructure,
 	serializer SenderKeyMessageSerializer) (*SenderKeyMessage, error) {
 
-	// Throw an error if the given message structure is an unsupported version.
-	if structure.Version <= UnsupportedVersion {
-		err := "Legacy message: " + strconv.Itoa(int(structure.Version))
-		return nil, errors.New(err)
+	if structure == nil {
+		return nil, missingField("SenderKeyMessage", "Structure")
 	}
 
-	// Throw an error if the given message structure is a future version.
-	if structure.Version > CurrentVersion {
-		err := "Unknown version: " + strconv.Itoa(int(structure.Version))
-		return nil, errors.New(err)
+	// Throw an error if the given message structure is an unsupported version.
+	if err := checkVersion("SenderKeyMessage", int(structure.Version)); err != nil {
+		return nil, err
 	}
 
 	// Throw an error if the structure is missing critical fields.
 	if structure.CipherText == nil {
-		err := "Incomplete message."
-		return nil, errors.New(err)
+		return nil, missingField("SenderKeyMessage", "CipherText")
+	}
+	if err := errorhelper.CheckLength("SenderKeyMessage", "Signature", structure.Signature, signatureLength); err != nil {
+		return nil, err
 	}
 
 	// Create the signal message object from the structure.
@@ -1,17 +1,40 @@
 package protocol
 
+import (
+	"errors"
+	"strings"
+)
+
 // NewSenderKeyName returns a new SenderKeyName object.
 func NewSenderKeyName(groupID string, sender *SignalAddress) *SenderKeyName {
 	return &SenderKeyName{
 		groupID: groupID,
-		sender:  sender,
+		sender:  *sender,
+	}
+}
+
+// ParseSenderKeyName returns the sender key name from the given string, as
+// returned by SenderKeyName.String. The group ID ends at the first separator,
+// so only the sender's name may contain the separator.
+func ParseSenderKeyName(name string) (*SenderKeyName, error) {
+	separator := strings.Index(name, ADDRESS_SEPARATOR)
+	if separator < 0 {
+		return nil, errors.New("Invalid sender key name: " + name)
+	}
+
+	sender, err := ParseSignalAddress(name[separator+len(ADDRESS_SEPARATOR):])
+	if err != nil {
+		return nil, err
 	}
+
+	return NewSenderKeyName(name[:separator], sender), nil
 }
 
-// SenderKeyName is a structure for a group session address.
+// SenderKeyName is a structure for a group session address. Names are
+// comparable, so a dereferenced name can be used as a map key.
 type SenderKeyName struct {
 	groupID string
-	sender  *SignalAddress
+	sender  SignalAddress
 }
 
 // GroupID returns the sender key group id
@@ -21,5 +44,19 @@ func (n *SenderKeyName) GroupID() string {
 
 // Sender returns the Signal address of sending user in the group.
 func (n *SenderKeyName) Sender() *SignalAddress {
-	return n.sender
+	sender := n.sender
+	return &sender
+}
+
+// Equal returns true if the given name has the same group ID and sender.
+func (n *SenderKeyName) Equal(other *SenderKeyName) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	return *n == *other
+}
+
+// String returns a string of both the group id and the sender's address.
+func (n *SenderKeyName) String() string {
+	return n.groupID + ADDRESS_SEPARATOR + n.sender.String()
 }
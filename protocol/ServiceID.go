@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ServiceIDKind is the kind of identifier a ServiceID is.
+type ServiceIDKind uint8
+
+const (
+	// ACI is the account identifier, which is the same for every device of
+	// an account and never changes.
+	ACI ServiceIDKind = 0
+
+	// PNI is the phone number identifier, which belongs to the account's
+	// phone number and changes when the number does.
+	PNI ServiceIDKind = 1
+)
+
+// pniPrefix precedes the UUID in the string form of a PNI.
+const pniPrefix = "PNI:"
+
+const invalidServiceIDError string = "Invalid service ID: "
+
+// String returns the name of the service ID kind.
+func (k ServiceIDKind) String() string {
+	switch k {
+	case ACI:
+		return "ACI"
+	case PNI:
+		return "PNI"
+	}
+	return "Unknown"
+}
+
+// NewACI returns the ACI service ID with the given UUID.
+func NewACI(uuid [16]byte) ServiceID {
+	return ServiceID{kind: ACI, uuid: uuid}
+}
+
+// NewPNI returns the PNI service ID with the given UUID.
+func NewPNI(uuid [16]byte) ServiceID {
+	return ServiceID{kind: PNI, uuid: uuid}
+}
+
+// ParseServiceID returns the service ID from the given string, as returned
+// by ServiceID.String. An ACI is a bare UUID, and a PNI is a UUID prefixed
+// with "PNI:".
+func ParseServiceID(serviceID string) (ServiceID, error) {
+	kind := ACI
+	uuid := serviceID
+	if strings.HasPrefix(serviceID, pniPrefix) {
+		kind = PNI
+		uuid = serviceID[len(pniPrefix):]
+	}
+
+	parsed, err := parseUUID(uuid)
+	if err != nil {
+		return ServiceID{}, errors.New(invalidServiceIDError + serviceID)
+	}
+
+	return ServiceID{kind: kind, uuid: parsed}, nil
+}
+
+// ServiceIDFromBytes returns the service ID from the given bytes, as
+// returned by ServiceID.Bytes or ServiceID.FixedWidthBytes.
+func ServiceIDFromBytes(serialized []byte) (ServiceID, error) {
+	var serviceID ServiceID
+	switch len(serialized) {
+	case 16:
+		serviceID.kind = ACI
+		copy(serviceID.uuid[:], serialized)
+	case 17:
+		serviceID.kind = ServiceIDKind(serialized[0])
+		if serviceID.kind != ACI && serviceID.kind != PNI {
+			return ServiceID{}, errors.New(invalidServiceIDError + hex.EncodeToString(serialized))
+		}
+		copy(serviceID.uuid[:], serialized[1:])
+	default:
+		return ServiceID{}, errors.New(invalidServiceIDError + hex.EncodeToString(serialized))
+	}
+
+	return serviceID, nil
+}
+
+// ServiceIDFromAddress returns the service ID that is the name of the given
+// address.
+func ServiceIDFromAddress(address *SignalAddress) (ServiceID, error) {
+	return ParseServiceID(address.Name())
+}
+
+// ServiceID identifies an account, or the phone number of an account, by its
+// kind and UUID. Service IDs are comparable, so they can be used as map keys.
+type ServiceID struct {
+	kind ServiceIDKind
+	uuid [16]byte
+}
+
+// Kind returns whether the service ID is an ACI or a PNI.
+func (s ServiceID) Kind() ServiceIDKind {
+	return s.kind
+}
+
+// UUID returns the service ID's UUID.
+func (s ServiceID) UUID() [16]byte {
+	return s.uuid
+}
+
+// String returns the UUID in its canonical form, prefixed with "PNI:" for a
+// PNI.
+func (s ServiceID) String() string {
+	var uuid [36]byte
+	hex.Encode(uuid[0:8], s.uuid[0:4])
+	uuid[8] = '-'
+	hex.Encode(uuid[9:13], s.uuid[4:6])
+	uuid[13] = '-'
+	hex.Encode(uuid[14:18], s.uuid[6:8])
+	uuid[18] = '-'
+	hex.Encode(uuid[19:23], s.uuid[8:10])
+	uuid[23] = '-'
+	hex.Encode(uuid[24:], s.uuid[10:])
+
+	if s.kind == PNI {
+		return pniPrefix + string(uuid[:])
+	}
+	return string(uuid[:])
+}
+
+// Bytes returns the binary form of the service ID: the 16 UUID bytes for an
+// ACI, and the kind followed by the UUID for a PNI.
+func (s ServiceID) Bytes() []byte {
+	if s.kind == ACI {
+		return append([]byte{}, s.uuid[:]...)
+	}
+	return s.FixedWidthBytes()
+}
+
+// FixedWidthBytes returns the kind followed by the UUID, which is 17 bytes
+// for every kind of service ID.
+func (s ServiceID) FixedWidthBytes() []byte {
+	return append([]byte{byte(s.kind)}, s.uuid[:]...)
+}
+
+// Address returns the address of the given device of the service ID.
+func (s ServiceID) Address(deviceID uint32) *SignalAddress {
+	return NewSignalAddress(s.String(), deviceID)
+}
+
+// parseUUID parses a UUID in its canonical, hyphenated form.
+func parseUUID(uuid string) ([16]byte, error) {
+	var parsed [16]byte
+	if len(uuid) != 36 || uuid[8] != '-' || uuid[13] != '-' || uuid[18] != '-' || uuid[23] != '-' {
+		return parsed, errors.New(invalidServiceIDError + uuid)
+	}
+
+	digits := uuid[0:8] + uuid[9:13] + uuid[14:18] + uuid[19:23] + uuid[24:]
+	if _, err := hex.Decode(parsed[:], []byte(digits)); err != nil {
+		return parsed, err
+	}
+
+	return parsed, nil
+}
@@ -8,10 +8,12 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
-	"strconv"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
-const macLength int = 8
+// ErrBadMac is returned when a message's MAC does not verify.
+var ErrBadMac = errors.New("Bad Mac!")
 
 // SignalMessageSerializer is an interface for serializing and deserializing
 // SignalMessages into bytes. An implementation of this interface should be
@@ -36,33 +38,69 @@ func NewSignalMessageFromBytes(serialized []byte, serializer SignalMessageSerial
 // NewSignalMessageFromStruct returns a Signal Ciphertext message from the
 // given serializable structure.
 func NewSignalMessageFromStruct(structure *SignalMessageStructure, serializer SignalMessageSerializer) (*SignalMessage, error) {
-	// Throw an error if the given message structure is an unsupported version.
-	if structure.Version <= UnsupportedVersion {
-		err := "Legacy message: " + strconv.Itoa(structure.Version)
-		return nil, errors.New(err)
+	return newSignalMessageFromStruct(structure, serializer, false)
+}
+
+// NewLegacySignalMessageFromBytes will return a Signal Ciphertext message from
+// the given bytes, also accepting legacy message versions that can only be
+// decrypted. This should only be used to read old archives.
+func NewLegacySignalMessageFromBytes(serialized []byte, serializer SignalMessageSerializer) (*SignalMessage, error) {
+	signalMessageStructure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
 	}
 
-	// Throw an error if the given message structure is a future version.
-	if structure.Version > CurrentVersion {
-		err := "Unknown version: " + strconv.Itoa(structure.Version)
-		return nil, errors.New(err)
+	return NewLegacySignalMessageFromStruct(signalMessageStructure, serializer)
+}
+
+// NewLegacySignalMessageFromStruct returns a Signal Ciphertext message from the
+// given serializable structure, also accepting legacy message versions.
+func NewLegacySignalMessageFromStruct(structure *SignalMessageStructure, serializer SignalMessageSerializer) (*SignalMessage, error) {
+	return newSignalMessageFromStruct(structure, serializer, true)
+}
+
+// newSignalMessageFromStruct returns a Signal Ciphertext message from the
+// given structure. Legacy versions are only accepted if allowLegacy is set.
+func newSignalMessageFromStruct(structure *SignalMessageStructure, serializer SignalMessageSerializer,
+	allowLegacy bool) (*SignalMessage, error) {
+
+	if structure == nil {
+		return nil, missingField("SignalMessage", "Structure")
+	}
+
+	// Throw an error if the given message structure is an unsupported version.
+	if !allowLegacy || !version.IsLegacy(structure.Version) {
+		if err := checkVersion("SignalMessage", structure.Version); err != nil {
+			return nil, err
+		}
 	}
 
 	// Throw an error if the structure is missing critical fields.
-	if structure.CipherText == nil || structure.RatchetKey == nil {
-		err := "Incomplete message."
-		return nil, errors.New(err)
+	if structure.CipherText == nil {
+		return nil, missingField("SignalMessage", "CipherText")
+	}
+	params, err := version.Lookup(structure.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := errorhelper.CheckLength("SignalMessage", "Mac", structure.Mac, params.MacLength); err != nil {
+		return nil, err
 	}
 
 	// Create the signal message object from the structure.
 	whisperMessage := &SignalMessage{structure: *structure, serializer: serializer}
 
 	// Generate the ECC key from bytes.
-	var err error
 	whisperMessage.senderRatchetKey, err = ecc.DecodePoint(structure.RatchetKey, 0)
 	if err != nil {
 		return nil, err
 	}
+	if structure.PreviousRatchetKey != nil {
+		whisperMessage.previousRatchetKey, err = ecc.DecodePoint(structure.PreviousRatchetKey, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return whisperMessage, nil
 }
@@ -72,6 +110,18 @@ func NewSignalMessage(messageVersion int, counter, previousCounter uint32, macKe
 	senderRatchetKey ecc.ECPublicKeyable, ciphertext []byte, senderIdentityKey,
 	receiverIdentityKey *identity.Key, serializer SignalMessageSerializer) (*SignalMessage, error) {
 
+	return NewRefreshedSignalMessage(messageVersion, counter, previousCounter, macKey, senderRatchetKey, nil,
+		ciphertext, senderIdentityKey, receiverIdentityKey, serializer)
+}
+
+// NewRefreshedSignalMessage returns a Signal Ciphertext message sent on a
+// refreshed sender chain. The previous ratchet key names the chain that was
+// refreshed, and the previous counter is the last counter used on it. A nil
+// previous ratchet key returns a message like NewSignalMessage.
+func NewRefreshedSignalMessage(messageVersion int, counter, previousCounter uint32, macKey []byte,
+	senderRatchetKey, previousRatchetKey ecc.ECPublicKeyable, ciphertext []byte, senderIdentityKey,
+	receiverIdentityKey *identity.Key, serializer SignalMessageSerializer) (*SignalMessage, error) {
+
 	// Build the signal message structure with the given data.
 	structure := &SignalMessageStructure{
 		Version:         messageVersion,
@@ -80,6 +130,9 @@ func NewSignalMessage(messageVersion int, counter, previousCounter uint32, macKe
 		RatchetKey:      senderRatchetKey.Serialize(),
 		CipherText:      ciphertext,
 	}
+	if previousRatchetKey != nil {
+		structure.PreviousRatchetKey = previousRatchetKey.Serialize()
+	}
 
 	// Get the message authentication code from the serialized structure.
 	mac, err := getMac(
@@ -109,14 +162,20 @@ type SignalMessageStructure struct {
 	CipherText      []byte
 	Version         int
 	Mac             []byte
+
+	// PreviousRatchetKey is only set on messages of a refreshed sender
+	// chain. It is left out when empty, so other messages serialize and
+	// authenticate the same way as before.
+	PreviousRatchetKey []byte `json:",omitempty"`
 }
 
 // SignalMessage is a cipher message that contains a message encrypted
 // with the Signal protocol.
 type SignalMessage struct {
-	structure        SignalMessageStructure
-	senderRatchetKey ecc.ECPublicKeyable
-	serializer       SignalMessageSerializer
+	structure          SignalMessageStructure
+	senderRatchetKey   ecc.ECPublicKeyable
+	previousRatchetKey ecc.ECPublicKeyable
+	serializer         SignalMessageSerializer
 }
 
 // SenderRatchetKey returns the SignalMessage's sender ratchet key. This
@@ -126,6 +185,18 @@ func (s *SignalMessage) SenderRatchetKey() ecc.ECPublicKeyable {
 	return s.senderRatchetKey
 }
 
+// PreviousRatchetKey returns the ratchet key of the sender chain that this
+// message's chain refreshed, or nil if the chain wasn't created by a refresh.
+func (s *SignalMessage) PreviousRatchetKey() ecc.ECPublicKeyable {
+	return s.previousRatchetKey
+}
+
+// PreviousCounter returns the last counter used on the sender's previous
+// chain.
+func (s *SignalMessage) PreviousCounter() uint32 {
+	return s.structure.PreviousCounter
+}
+
 // MessageVersion returns the message version this SignalMessage supports.
 func (s *SignalMessage) MessageVersion() int {
 	return s.structure.Version
@@ -150,11 +221,7 @@ func (s *SignalMessage) VerifyMac(messageVersion int, senderIdentityKey,
 	// Create a copy of the message without the mac. We'll use this to calculate
 	// the message authentication code.
 	structure := s.structure
-	signalMessage, err := NewSignalMessageFromStruct(&structure, s.serializer)
-	if err != nil {
-		return err
-	}
-	signalMessage.structure.Mac = nil
+	structure.Mac = nil
 
 	// Calculate the message authentication code from the serialized structure.
 	ourMac, err := getMac(
@@ -162,7 +229,7 @@ func (s *SignalMessage) VerifyMac(messageVersion int, senderIdentityKey,
 		senderIdentityKey,
 		receiverIdentityKey,
 		macKey,
-		signalMessage.Serialize(),
+		s.serializer.Serialize(&structure),
 	)
 	if err != nil {
 		logger.Error(err)
@@ -179,7 +246,7 @@ func (s *SignalMessage) VerifyMac(messageVersion int, senderIdentityKey,
 
 	// Return an error if our calculated mac doesn't match the mac sent to us.
 	if !hmac.Equal(ourMac, theirMac) {
-		return errors.New("Bad Mac!")
+		return ErrBadMac
 	}
 
 	return nil
@@ -207,9 +274,16 @@ func (s *SignalMessage) Type() uint32 {
 func getMac(messageVersion int, senderIdentityKey, receiverIdentityKey *identity.Key,
 	macKey, serialized []byte) ([]byte, error) {
 
+	// Get the MAC layout for the message version. Legacy versions are
+	// included so their messages can still be verified.
+	params, err := version.Lookup(messageVersion)
+	if err != nil {
+		return nil, err
+	}
+
 	mac := hmac.New(sha256.New, macKey[:])
 
-	if messageVersion >= 3 {
+	if params.MacIdentityKeys {
 		mac.Write(senderIdentityKey.PublicKey().Serialize())
 		mac.Write(receiverIdentityKey.PublicKey().Serialize())
 	}
@@ -218,5 +292,5 @@ func getMac(messageVersion int, senderIdentityKey, receiverIdentityKey *identity
 
 	fullMac := mac.Sum(nil)
 
-	return bytehelper.Trim(fullMac, macLength), nil
+	return bytehelper.Trim(fullMac, params.MacLength), nil
 }
@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 const ADDRESS_SEPARATOR = "~"
@@ -16,7 +19,25 @@ func NewSignalAddress(name string, deviceID uint32) *SignalAddress {
 	return &addr
 }
 
-// SignalAddress is a combination of a name and a device ID.
+// ParseSignalAddress returns the signal address from the given string, as
+// returned by SignalAddress.String. The device ID follows the last separator,
+// so names may contain the separator themselves.
+func ParseSignalAddress(address string) (*SignalAddress, error) {
+	separator := strings.LastIndex(address, ADDRESS_SEPARATOR)
+	if separator < 0 {
+		return nil, errors.New("Invalid signal address: " + address)
+	}
+
+	deviceID, err := strconv.ParseUint(address[separator+len(ADDRESS_SEPARATOR):], 10, 32)
+	if err != nil {
+		return nil, errors.New("Invalid signal address device ID: " + address)
+	}
+
+	return NewSignalAddress(address[:separator], uint32(deviceID)), nil
+}
+
+// SignalAddress is a combination of a name and a device ID. Addresses are
+// comparable, so a dereferenced address can be used as a map key.
 type SignalAddress struct {
 	name     string
 	deviceID uint32
@@ -32,6 +53,14 @@ func (s *SignalAddress) DeviceID() uint32 {
 	return s.deviceID
 }
 
+// Equal returns true if the given address has the same name and device ID.
+func (s *SignalAddress) Equal(other *SignalAddress) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return *s == *other
+}
+
 // String returns a string of both the address name and device id.
 func (s *SignalAddress) String() string {
 	return s.name + ADDRESS_SEPARATOR + fmt.Sprint(s.deviceID)
@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+	"strconv"
+)
+
+// signatureLength is the length of an XEdDSA signature.
+const signatureLength = 64
+
+// checkVersion returns a DecodeError if the given message version is a legacy
+// version or a version this library has no parameters for.
+func checkVersion(structType string, messageVersion int) error {
+	if messageVersion <= UnsupportedVersion || (messageVersion < version.Latest && !version.IsSupported(messageVersion)) {
+		detail := "Legacy message: " + strconv.Itoa(messageVersion)
+		return errorhelper.NewDecodeError(structType, "Version", errorhelper.WithDetail(errorhelper.ErrLegacyVersion, detail))
+	}
+	if !version.IsSupported(messageVersion) {
+		detail := "Unknown version: " + strconv.Itoa(messageVersion)
+		return errorhelper.NewDecodeError(structType, "Version", errorhelper.WithDetail(errorhelper.ErrUnknownVersion, detail))
+	}
+	return nil
+}
+
+// missingField returns a DecodeError for a required field that was not set.
+func missingField(structType, field string) error {
+	return errorhelper.NewDecodeError(structType, field, errorhelper.ErrMissingField)
+}
@@ -0,0 +1,11 @@
+// Package provisioning transfers an account's identity to a newly linked
+// device.
+//
+// The new device generates an ephemeral key pair and shows its public key to
+// the primary device, usually in a QR code. The primary encrypts a Message
+// holding the account's identity key pairs and account data to that key, and
+// the new device decrypts it with its ephemeral private key and imports the
+// identity. Messages are encrypted like Signal's provisioning messages: an
+// ECDH agreement with a fresh key of the primary, HKDF with the info
+// "TextSecure Provisioning Message", AES-256-CBC and HMAC-SHA256.
+package provisioning
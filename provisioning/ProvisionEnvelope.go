@@ -0,0 +1,88 @@
+package provisioning
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// EnvelopeSerializer is an interface for serializing and deserializing
+// provisioning envelopes into bytes. An implementation of this interface
+// should be used to encode/decode the object into JSON, Protobuffers, etc.
+type EnvelopeSerializer interface {
+	Serialize(envelope *EnvelopeStructure) []byte
+	Deserialize(serialized []byte) (*EnvelopeStructure, error)
+}
+
+// NewEnvelope returns a new provisioning envelope with the given public key
+// and encrypted body.
+func NewEnvelope(publicKey ecc.ECPublicKeyable, body []byte) *Envelope {
+	return &Envelope{
+		publicKey: publicKey,
+		body:      body,
+	}
+}
+
+// NewEnvelopeFromBytes returns a provisioning envelope from the given bytes
+// using the given serializer.
+func NewEnvelopeFromBytes(serialized []byte, serializer EnvelopeSerializer) (*Envelope, error) {
+	structure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEnvelopeFromStruct(structure)
+}
+
+// NewEnvelopeFromStruct returns a provisioning envelope from the given
+// structure.
+func NewEnvelopeFromStruct(structure *EnvelopeStructure) (*Envelope, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("ProvisionEnvelope", "Structure", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckLength("ProvisionEnvelope", "PublicKey", structure.PublicKey, ecc.KeySize); err != nil {
+		return nil, err
+	}
+	if len(structure.Body) == 0 {
+		return nil, errorhelper.NewDecodeError("ProvisionEnvelope", "Body", errorhelper.ErrMissingField)
+	}
+
+	publicKey, err := ecc.DecodePoint(structure.PublicKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEnvelope(publicKey, structure.Body), nil
+}
+
+// EnvelopeStructure is a serializable structure for provisioning envelopes.
+type EnvelopeStructure struct {
+	PublicKey []byte
+	Body      []byte
+}
+
+// Envelope is an encrypted provisioning message, along with the public key
+// of the key pair it was encrypted with.
+type Envelope struct {
+	publicKey ecc.ECPublicKeyable
+	body      []byte
+}
+
+// PublicKey returns the primary device's ephemeral public key.
+func (e *Envelope) PublicKey() ecc.ECPublicKeyable {
+	return e.publicKey
+}
+
+// Body returns the encrypted body.
+func (e *Envelope) Body() []byte {
+	return e.body
+}
+
+// Serialize returns the envelope as bytes using the given serializer.
+func (e *Envelope) Serialize(serializer EnvelopeSerializer) []byte {
+	structure := &EnvelopeStructure{
+		PublicKey: e.publicKey.Serialize(),
+		Body:      e.body,
+	}
+
+	return serializer.Serialize(structure)
+}
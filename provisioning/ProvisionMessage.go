@@ -0,0 +1,236 @@
+package provisioning
+
+import (
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+const serviceIDKindError string = "Wrong kind of service ID: "
+
+// MessageSerializer is an interface for serializing and deserializing
+// provisioning messages into bytes. An implementation of this interface
+// should be used to encode/decode the object into JSON, Protobuffers, etc.
+type MessageSerializer interface {
+	Serialize(message *MessageStructure) []byte
+	Deserialize(serialized []byte) (*MessageStructure, error)
+}
+
+// NewMessage returns a new provisioning message for the account with the
+// given ACI and ACI identity key pair. The provisioning code is the one-time
+// code the server issued for linking the new device.
+func NewMessage(aciIdentityKeyPair *identity.KeyPair, aci protocol.ServiceID, number, provisioningCode string) *Message {
+	return &Message{
+		aciIdentityKeyPair: aciIdentityKeyPair,
+		aci:                aci,
+		number:             number,
+		provisioningCode:   provisioningCode,
+	}
+}
+
+// NewMessageFromBytes returns a provisioning message from the given bytes
+// using the given serializer.
+func NewMessageFromBytes(serialized []byte, serializer MessageSerializer) (*Message, error) {
+	structure, err := serializer.Deserialize(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMessageFromStruct(structure)
+}
+
+// NewMessageFromStruct returns a provisioning message from the given
+// structure. The identity key pairs are checked, so a private key that
+// doesn't belong to its public key returns an error.
+func NewMessageFromStruct(structure *MessageStructure) (*Message, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("ProvisionMessage", "Structure", errorhelper.ErrMissingField)
+	}
+
+	aciIdentityKeyPair, err := identity.NewKeyPairFromStruct(&identity.KeyPairStructure{
+		PublicKey:  structure.ACIIdentityKeyPublic,
+		PrivateKey: structure.ACIIdentityKeyPrivate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	aci, err := parseServiceID("ACI", structure.ACI, protocol.ACI)
+	if err != nil {
+		return nil, err
+	}
+	message := NewMessage(aciIdentityKeyPair, aci, structure.Number, structure.ProvisioningCode)
+	message.profileKey = structure.ProfileKey
+	message.userAgent = structure.UserAgent
+	message.readReceipts = structure.ReadReceipts
+
+	// The PNI is optional, for primaries that don't have one yet.
+	if structure.PNI != "" {
+		pniIdentityKeyPair, err := identity.NewKeyPairFromStruct(&identity.KeyPairStructure{
+			PublicKey:  structure.PNIIdentityKeyPublic,
+			PrivateKey: structure.PNIIdentityKeyPrivate,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pni, err := parseServiceID("PNI", structure.PNI, protocol.PNI)
+		if err != nil {
+			return nil, err
+		}
+		message.SetPNI(pni, pniIdentityKeyPair)
+	}
+
+	return message, nil
+}
+
+// MessageStructure is a serializable structure for provisioning messages.
+type MessageStructure struct {
+	ACIIdentityKeyPublic  []byte
+	ACIIdentityKeyPrivate []byte
+	PNIIdentityKeyPublic  []byte
+	PNIIdentityKeyPrivate []byte
+	ACI                   string
+	PNI                   string
+	Number                string
+	ProvisioningCode      string
+	ProfileKey            []byte
+	UserAgent             string
+	ReadReceipts          bool
+}
+
+// Message holds the identity and account data that the primary device sends
+// to a newly linked device.
+type Message struct {
+	aciIdentityKeyPair *identity.KeyPair
+	pniIdentityKeyPair *identity.KeyPair
+	aci                protocol.ServiceID
+	pni                protocol.ServiceID
+	number             string
+	provisioningCode   string
+	profileKey         []byte
+	userAgent          string
+	readReceipts       bool
+}
+
+// SetPNI sets the account's PNI and its identity key pair.
+func (m *Message) SetPNI(pni protocol.ServiceID, pniIdentityKeyPair *identity.KeyPair) {
+	m.pni = pni
+	m.pniIdentityKeyPair = pniIdentityKeyPair
+}
+
+// SetProfileKey sets the account's profile key.
+func (m *Message) SetProfileKey(profileKey []byte) {
+	m.profileKey = profileKey
+}
+
+// SetUserAgent sets the user agent of the primary device.
+func (m *Message) SetUserAgent(userAgent string) {
+	m.userAgent = userAgent
+}
+
+// SetReadReceipts sets whether the account sends read receipts.
+func (m *Message) SetReadReceipts(readReceipts bool) {
+	m.readReceipts = readReceipts
+}
+
+// ACIIdentityKeyPair returns the account's ACI identity key pair.
+func (m *Message) ACIIdentityKeyPair() *identity.KeyPair {
+	return m.aciIdentityKeyPair
+}
+
+// PNIIdentityKeyPair returns the account's PNI identity key pair, or nil if
+// the message has no PNI.
+func (m *Message) PNIIdentityKeyPair() *identity.KeyPair {
+	return m.pniIdentityKeyPair
+}
+
+// ACI returns the account's ACI.
+func (m *Message) ACI() protocol.ServiceID {
+	return m.aci
+}
+
+// PNI returns the account's PNI. It is only set if PNIIdentityKeyPair is not
+// nil.
+func (m *Message) PNI() protocol.ServiceID {
+	return m.pni
+}
+
+// Number returns the account's phone number.
+func (m *Message) Number() string {
+	return m.number
+}
+
+// ProvisioningCode returns the code the new device uses to register with
+// the server.
+func (m *Message) ProvisioningCode() string {
+	return m.provisioningCode
+}
+
+// ProfileKey returns the account's profile key.
+func (m *Message) ProfileKey() []byte {
+	return m.profileKey
+}
+
+// UserAgent returns the user agent of the primary device.
+func (m *Message) UserAgent() string {
+	return m.userAgent
+}
+
+// ReadReceipts returns whether the account sends read receipts.
+func (m *Message) ReadReceipts() bool {
+	return m.readReceipts
+}
+
+// Serialize returns the message as bytes using the given serializer.
+func (m *Message) Serialize(serializer MessageSerializer) []byte {
+	structure := &MessageStructure{
+		ACIIdentityKeyPublic:  m.aciIdentityKeyPair.PublicKey().Serialize(),
+		ACIIdentityKeyPrivate: bytehelper.ArrayToSlice(m.aciIdentityKeyPair.PrivateKey().Serialize()),
+		ACI:                   m.aci.String(),
+		Number:                m.number,
+		ProvisioningCode:      m.provisioningCode,
+		ProfileKey:            m.profileKey,
+		UserAgent:             m.userAgent,
+		ReadReceipts:          m.readReceipts,
+	}
+	if m.pniIdentityKeyPair != nil {
+		structure.PNIIdentityKeyPublic = m.pniIdentityKeyPair.PublicKey().Serialize()
+		structure.PNIIdentityKeyPrivate = bytehelper.ArrayToSlice(m.pniIdentityKeyPair.PrivateKey().Serialize())
+		structure.PNI = m.pni.String()
+	}
+
+	return serializer.Serialize(structure)
+}
+
+// EncryptMessage serializes the given message and encrypts it to the new
+// device's ephemeral public key.
+func EncryptMessage(theirPublicKey ecc.ECPublicKeyable, message *Message, serializer MessageSerializer) (*Envelope, error) {
+	return Encrypt(theirPublicKey, message.Serialize(serializer))
+}
+
+// DecryptMessage decrypts the given envelope with the new device's ephemeral
+// key pair and returns the provisioning message it holds.
+func DecryptMessage(ourKeyPair *ecc.ECKeyPair, envelope *Envelope, serializer MessageSerializer) (*Message, error) {
+	plaintext, err := Decrypt(ourKeyPair, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMessageFromBytes(plaintext, serializer)
+}
+
+// parseServiceID parses the given field as a service ID of the given kind.
+func parseServiceID(field, serviceID string, kind protocol.ServiceIDKind) (protocol.ServiceID, error) {
+	parsed, err := protocol.ParseServiceID(serviceID)
+	if err != nil {
+		return parsed, errorhelper.NewDecodeError("ProvisionMessage", field, err)
+	}
+	if parsed.Kind() != kind {
+		return parsed, errorhelper.NewDecodeError("ProvisionMessage", field, errors.New(serviceIDKindError+parsed.String()))
+	}
+
+	return parsed, nil
+}
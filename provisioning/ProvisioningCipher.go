@@ -0,0 +1,111 @@
+package provisioning
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+)
+
+// Version is the version of the provisioning body format.
+const Version byte = 1
+
+// kdfInfo is the HKDF info used to derive the provisioning keys.
+const kdfInfo = "TextSecure Provisioning Message"
+
+const ivLength = 16
+const macLength = sha256.Size
+
+const bodyTooShortError string = "Provisioning body is too short."
+const unsupportedVersionError string = "Unsupported provisioning version: "
+const ciphertextLengthError string = "Provisioning ciphertext is not a whole number of blocks."
+
+// ErrBadMac is returned when a provisioning envelope's MAC does not verify,
+// because it was not encrypted to our key or was tampered with.
+var ErrBadMac = errors.New("Bad provisioning MAC!")
+
+// Encrypt encrypts the given plaintext to the new device's ephemeral public
+// key. The envelope holds the public key of a fresh key pair, whose agreement
+// with the new device's key encrypts the body.
+//
+// Body format: version(1) | iv(16) | AES-256-CBC ciphertext | HMAC-SHA256(32)
+func Encrypt(theirPublicKey ecc.ECPublicKeyable, plaintext []byte) (*Envelope, error) {
+	ourKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	cipherKey, macKey, err := deriveKeys(theirPublicKey, ourKeyPair.PrivateKey())
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, ivLength)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	ciphertext, err := cipher.Encrypt(iv, cipherKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 0, 1+ivLength+len(ciphertext)+macLength)
+	body = append(body, Version)
+	body = append(body, iv...)
+	body = append(body, ciphertext...)
+	body = append(body, calculateMac(macKey, body)...)
+
+	return NewEnvelope(ourKeyPair.PublicKey(), body), nil
+}
+
+// Decrypt decrypts the given envelope with the new device's ephemeral key
+// pair.
+func Decrypt(ourKeyPair *ecc.ECKeyPair, envelope *Envelope) ([]byte, error) {
+	body := envelope.Body()
+	if len(body) < 1+ivLength+macLength {
+		return nil, errors.New(bodyTooShortError)
+	}
+	if body[0] != Version {
+		return nil, errors.New(unsupportedVersionError + strconv.Itoa(int(body[0])))
+	}
+
+	cipherKey, macKey, err := deriveKeys(envelope.PublicKey(), ourKeyPair.PrivateKey())
+	if err != nil {
+		return nil, err
+	}
+	macStart := len(body) - macLength
+	if !hmac.Equal(calculateMac(macKey, body[:macStart]), body[macStart:]) {
+		return nil, ErrBadMac
+	}
+
+	iv := body[1 : 1+ivLength]
+	ciphertext := append([]byte{}, body[1+ivLength:macStart]...)
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New(ciphertextLengthError)
+	}
+	return cipher.Decrypt(iv, cipherKey, ciphertext)
+}
+
+// deriveKeys derives the AES and HMAC keys from the agreement of the given
+// keys.
+func deriveKeys(theirPublicKey ecc.ECPublicKeyable, ourPrivateKey ecc.ECPrivateKeyable) ([]byte, []byte, error) {
+	sharedSecret := kdf.CalculateSharedSecret(theirPublicKey.PublicKey(), ourPrivateKey.Serialize())
+	derived, err := kdf.DeriveSecrets(sharedSecret[:], nil, []byte(kdfInfo), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return derived[:32], derived[32:], nil
+}
+
+// calculateMac returns the HMAC-SHA256 of the given data.
+func calculateMac(macKey, data []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,31 @@
+package ratchet
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/root"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+)
+
+// HeaderKdfInfo is used as the info to derive the initial header keys of a
+// header encrypted session from the master secret.
+const HeaderKdfInfo string = "WhisperHeaderKeys"
+
+// HeaderKeys holds the initial header keys of a header encrypted session.
+// The sender of the first message encrypts headers with SenderKey, and the
+// receiver uses ReceiverNextKey for its first sending chain.
+type HeaderKeys struct {
+	SenderKey       []byte
+	ReceiverNextKey []byte
+}
+
+// newHeaderKeys derives the initial header keys from the given master secret.
+func newHeaderKeys(masterSecret []byte, params *version.Parameters) (*HeaderKeys, error) {
+	derived, err := params.KDF(masterSecret, nil, []byte(HeaderKdfInfo), 2*root.HeaderKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HeaderKeys{
+		SenderKey:       derived[:root.HeaderKeySize],
+		ReceiverNextKey: derived[root.HeaderKeySize:],
+	}, nil
+}
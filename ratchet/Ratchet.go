@@ -3,6 +3,7 @@
 package ratchet
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
@@ -26,6 +27,32 @@ func genDiscontinuity() [32]byte {
 // should be used when we are trying to send a message to someone for the
 // first time.
 func CalculateSenderSession(parameters *SenderParameters) (*session.KeyPair, error) {
+	masterSecret := senderMasterSecret(parameters)
+
+	// Derive the root and chain keys based on the master secret.
+	derivedKeysBytes, err := parameters.VersionParameters().KDF(masterSecret, nil, parameters.VersionParameters().RootKdfInfo, root.DerivedSecretsSize)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys := session.NewDerivedSecrets(derivedKeysBytes)
+	chainKey := chain.NewKey(kdf.DeriveSecrets, derivedKeys.ChainKey(), 0)
+	rootKey := root.NewKey(kdf.DeriveSecrets, derivedKeys.RootKey())
+
+	// Add the root and chain keys to a structure that will hold both keys.
+	sessionKeys := session.NewKeyPair(rootKey, chainKey)
+
+	return sessionKeys, nil
+}
+
+// CalculateSenderHeaderKeys calculates the initial header keys of a header
+// encrypted session for the sender of the first message.
+func CalculateSenderHeaderKeys(parameters *SenderParameters) (*HeaderKeys, error) {
+	return newHeaderKeys(senderMasterSecret(parameters), parameters.VersionParameters())
+}
+
+// senderMasterSecret calculates the shared master secret of a new session
+// for the sender of the first message.
+func senderMasterSecret(parameters *SenderParameters) []byte {
 	var secret [32]byte
 	var publicKey [32]byte
 	var privateKey [32]byte
@@ -73,8 +100,16 @@ func CalculateSenderSession(parameters *SenderParameters) (*session.KeyPair, err
 
 	}
 
+	return masterSecret
+}
+
+// CalculateReceiverSession calculates the key agreement for a sender. This should
+// be used when we are receiving a message from someone for the first time.
+func CalculateReceiverSession(parameters *ReceiverParameters) (*session.KeyPair, error) {
+	masterSecret := receiverMasterSecret(parameters)
+
 	// Derive the root and chain keys based on the master secret.
-	derivedKeysBytes, err := kdf.DeriveSecrets(masterSecret, nil, []byte(root.KdfInfo), root.DerivedSecretsSize)
+	derivedKeysBytes, err := parameters.VersionParameters().KDF(masterSecret, nil, parameters.VersionParameters().RootKdfInfo, root.DerivedSecretsSize)
 	if err != nil {
 		return nil, err
 	}
@@ -88,9 +123,15 @@ func CalculateSenderSession(parameters *SenderParameters) (*session.KeyPair, err
 	return sessionKeys, nil
 }
 
-// CalculateReceiverSession calculates the key agreement for a sender. This should
-// be used when we are receiving a message from someone for the first time.
-func CalculateReceiverSession(parameters *ReceiverParameters) (*session.KeyPair, error) {
+// CalculateReceiverHeaderKeys calculates the initial header keys of a header
+// encrypted session for the receiver of the first message.
+func CalculateReceiverHeaderKeys(parameters *ReceiverParameters) (*HeaderKeys, error) {
+	return newHeaderKeys(receiverMasterSecret(parameters), parameters.VersionParameters())
+}
+
+// receiverMasterSecret calculates the shared master secret of a new session
+// for the receiver of the first message.
+func receiverMasterSecret(parameters *ReceiverParameters) []byte {
 	var secret [32]byte
 	var publicKey [32]byte
 	var privateKey [32]byte
@@ -138,19 +179,7 @@ func CalculateReceiverSession(parameters *ReceiverParameters) (*session.KeyPair,
 
 	}
 
-	// Derive the root and chain keys based on the master secret.
-	derivedKeysBytes, err := kdf.DeriveSecrets(masterSecret, nil, []byte(root.KdfInfo), root.DerivedSecretsSize)
-	if err != nil {
-		return nil, err
-	}
-	derivedKeys := session.NewDerivedSecrets(derivedKeysBytes)
-	chainKey := chain.NewKey(kdf.DeriveSecrets, derivedKeys.ChainKey(), 0)
-	rootKey := root.NewKey(kdf.DeriveSecrets, derivedKeys.RootKey())
-
-	// Add the root and chain keys to a structure that will hold both keys.
-	sessionKeys := session.NewKeyPair(rootKey, chainKey)
-
-	return sessionKeys, nil
+	return masterSecret
 }
 
 // CalculateSymmetricSession calculates the key agreement between two users. This
@@ -193,3 +222,11 @@ func isSender(ourKey, theirKey ecc.ECPublicKeyable) bool {
 
 	return ourKeyInt < theirKeyInt
 }
+
+// KeepsOurSession decides which session to keep when both sides initiated a
+// session with each other at once. Like isSender it compares the base keys,
+// so that both sides reach the same answer: the session with the lower
+// serialized base key is kept.
+func KeepsOurSession(ourBaseKey, theirBaseKey []byte) bool {
+	return bytes.Compare(ourBaseKey, theirBaseKey) < 0
+}
@@ -3,6 +3,7 @@ package ratchet
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 // NewReceiverParameters creates a structure with all the keys needed to construct
@@ -43,6 +44,8 @@ type ReceiverParameters struct {
 
 	theirBaseKey     ecc.ECPublicKeyable
 	theirIdentityKey *identity.Key
+
+	versionParameters *version.Parameters
 }
 
 // OurIdentityKeyPair returns the identity key of the receiver.
@@ -104,3 +107,17 @@ func (r *ReceiverParameters) SetTheirBaseKey(theirBaseKey ecc.ECPublicKeyable) {
 func (r *ReceiverParameters) SetTheirIdentityKey(theirIdentityKey *identity.Key) {
 	r.theirIdentityKey = theirIdentityKey
 }
+
+// VersionParameters returns the parameter set of the session's protocol
+// version. Version 3 is used if none was set.
+func (r *ReceiverParameters) VersionParameters() *version.Parameters {
+	if r.versionParameters == nil {
+		return version.V3
+	}
+	return r.versionParameters
+}
+
+// SetVersionParameters sets the parameter set of the session's protocol version.
+func (r *ReceiverParameters) SetVersionParameters(versionParameters *version.Parameters) {
+	r.versionParameters = versionParameters
+}
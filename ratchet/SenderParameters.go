@@ -3,6 +3,7 @@ package ratchet
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 )
 
 // NewSenderParameters creates a structure with all the keys needed to construct
@@ -43,6 +44,8 @@ type SenderParameters struct {
 	theirSignedPreKey  ecc.ECPublicKeyable
 	theirOneTimePreKey ecc.ECPublicKeyable
 	theirRatchetKey    ecc.ECPublicKeyable
+
+	versionParameters *version.Parameters
 }
 
 // OurIdentityKey returns the identity key pair of the sender.
@@ -104,3 +107,17 @@ func (s *SenderParameters) SetTheirOneTimePreKey(theirOneTimePreKey ecc.ECPublic
 func (s *SenderParameters) SetTheirRatchetKey(theirRatchetKey ecc.ECPublicKeyable) {
 	s.theirRatchetKey = theirRatchetKey
 }
+
+// VersionParameters returns the parameter set of the session's protocol
+// version. Version 3 is used if none was set.
+func (s *SenderParameters) VersionParameters() *version.Parameters {
+	if s.versionParameters == nil {
+		return version.V3
+	}
+	return s.versionParameters
+}
+
+// SetVersionParameters sets the parameter set of the session's protocol version.
+func (s *SenderParameters) SetVersionParameters(versionParameters *version.Parameters) {
+	s.versionParameters = versionParameters
+}
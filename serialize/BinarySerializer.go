@@ -0,0 +1,111 @@
+package serialize
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+)
+
+// Protobuf wire types used by the binary serializers.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// NewBinarySerializer will return a serializer that converts identity key pairs
+// to and from the binary form used by other libsignal implementations. Objects
+// that have no binary form yet are converted to and from JSON.
+func NewBinarySerializer() *Serializer {
+	serializer := NewJSONSerializer()
+
+	serializer.IdentityKeyPair = &BinaryIdentityKeyPairSerializer{}
+
+	return serializer
+}
+
+// BinaryIdentityKeyPairSerializer is a structure for serializing identity key pairs
+// into and from a compact binary form. The encoding is wire compatible with the
+// IdentityKeyPairStructure protobuf used by other libsignal implementations:
+//
+//	message IdentityKeyPairStructure {
+//	    optional bytes publicKey  = 1;
+//	    optional bytes privateKey = 2;
+//	}
+type BinaryIdentityKeyPairSerializer struct{}
+
+// Serialize will take an identity key pair structure and convert it to binary bytes.
+func (b *BinaryIdentityKeyPairSerializer) Serialize(keyPair *identity.KeyPairStructure) []byte {
+	var serialized []byte
+	serialized = appendBytesField(serialized, 1, keyPair.PublicKey)
+	serialized = appendBytesField(serialized, 2, keyPair.PrivateKey)
+
+	return serialized
+}
+
+// Deserialize will take in binary bytes and return an identity key pair structure.
+func (b *BinaryIdentityKeyPairSerializer) Deserialize(serialized []byte) (*identity.KeyPairStructure, error) {
+	var keyPairStructure identity.KeyPairStructure
+	err := readFields(serialized, func(field uint64, value []byte) {
+		switch field {
+		case 1:
+			keyPairStructure.PublicKey = value
+		case 2:
+			keyPairStructure.PrivateKey = value
+		}
+	})
+	if err != nil {
+		logger.Error("Error deserializing identity key pair: ", err)
+		return nil, err
+	}
+
+	return &keyPairStructure, nil
+}
+
+// appendBytesField appends a length-delimited protobuf field to the given buffer.
+// Nil values are omitted.
+func appendBytesField(buf []byte, field uint64, value []byte) []byte {
+	if value == nil {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, field<<3|wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+
+	return append(buf, value...)
+}
+
+// readFields walks the given protobuf encoded bytes and calls the given function
+// for every length-delimited field. Varint fields are skipped.
+func readFields(serialized []byte, onBytes func(field uint64, value []byte)) error {
+	for len(serialized) > 0 {
+		tag, n := binary.Uvarint(serialized)
+		if n <= 0 {
+			return errors.New("Malformed field tag.")
+		}
+		serialized = serialized[n:]
+
+		switch tag & 0x7 {
+		case wireVarint:
+			_, n = binary.Uvarint(serialized)
+			if n <= 0 {
+				return errors.New("Malformed varint field.")
+			}
+			serialized = serialized[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(serialized)
+			if n <= 0 || length > uint64(len(serialized)-n) {
+				return errors.New("Malformed length-delimited field.")
+			}
+			serialized = serialized[n:]
+			value := make([]byte, length)
+			copy(value, serialized[:length])
+			onBytes(tag>>3, value)
+			serialized = serialized[length:]
+		default:
+			return errors.New("Unsupported wire type.")
+		}
+	}
+
+	return nil
+}
@@ -2,9 +2,12 @@ package serialize
 
 import (
 	"encoding/json"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
 	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/provisioning"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
 )
 
@@ -15,6 +18,7 @@ func NewJSONSerializer() *Serializer {
 
 	serializer.SignalMessage = &JSONSignalMessageSerializer{}
 	serializer.PreKeySignalMessage = &JSONPreKeySignalMessageSerializer{}
+	serializer.HeaderEncryptedMessage = &JSONHeaderEncryptedMessageSerializer{}
 	serializer.SignedPreKeyRecord = &JSONSignedPreKeyRecordSerializer{}
 	serializer.PreKeyRecord = &JSONPreKeyRecordSerializer{}
 	serializer.State = &JSONStateSerializer{}
@@ -23,6 +27,10 @@ func NewJSONSerializer() *Serializer {
 	serializer.SenderKeyDistributionMessage = &JSONSenderKeyDistributionMessageSerializer{}
 	serializer.SenderKeyRecord = &JSONSenderKeySessionSerializer{}
 	serializer.SenderKeyState = &JSONSenderKeyStateSerializer{}
+	serializer.IdentityKeyPair = &JSONIdentityKeyPairSerializer{}
+	serializer.ProvisionMessage = &JSONProvisionMessageSerializer{}
+	serializer.ProvisionEnvelope = &JSONProvisionEnvelopeSerializer{}
+	serializer.DeviceList = &JSONDeviceListSerializer{}
 
 	return serializer
 }
@@ -81,6 +89,33 @@ func (j *JSONPreKeySignalMessageSerializer) Deserialize(serialized []byte) (*pro
 	return &preKeySignalMessage, nil
 }
 
+// JSONHeaderEncryptedMessageSerializer is a structure for serializing header
+// encrypted messages into and from JSON.
+type JSONHeaderEncryptedMessageSerializer struct{}
+
+// Serialize will take a header encrypted message structure and convert it to JSON bytes.
+func (j *JSONHeaderEncryptedMessageSerializer) Serialize(message *protocol.HeaderEncryptedMessageStructure) []byte {
+	serialized, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("Error serializing header encrypted message: ", err)
+	}
+	logger.Debug("Serialize result: ", string(serialized))
+
+	return serialized
+}
+
+// Deserialize will take in JSON bytes and return a header encrypted message structure.
+func (j *JSONHeaderEncryptedMessageSerializer) Deserialize(serialized []byte) (*protocol.HeaderEncryptedMessageStructure, error) {
+	var message protocol.HeaderEncryptedMessageStructure
+	err := json.Unmarshal(serialized, &message)
+	if err != nil {
+		logger.Error("Error deserializing header encrypted message: ", err)
+		return nil, err
+	}
+
+	return &message, nil
+}
+
 // JSONSignedPreKeyRecordSerializer is a structure for serializing signed prekey records
 // into and from JSON.
 type JSONSignedPreKeyRecordSerializer struct{}
@@ -300,3 +335,107 @@ func (j *JSONSenderKeySessionSerializer) Deserialize(serialized []byte) (*groupR
 
 	return &sessionStructure, nil
 }
+
+// JSONIdentityKeyPairSerializer is a structure for serializing identity key pairs
+// into and from JSON.
+type JSONIdentityKeyPairSerializer struct{}
+
+// Serialize will take an identity key pair structure and convert it to JSON bytes.
+func (j *JSONIdentityKeyPairSerializer) Serialize(keyPair *identity.KeyPairStructure) []byte {
+	serialized, err := json.Marshal(keyPair)
+	if err != nil {
+		logger.Error("Error serializing identity key pair: ", err)
+	}
+
+	return serialized
+}
+
+// Deserialize will take in JSON bytes and return an identity key pair structure.
+func (j *JSONIdentityKeyPairSerializer) Deserialize(serialized []byte) (*identity.KeyPairStructure, error) {
+	var keyPairStructure identity.KeyPairStructure
+	err := json.Unmarshal(serialized, &keyPairStructure)
+	if err != nil {
+		logger.Error("Error deserializing identity key pair: ", err)
+		return nil, err
+	}
+
+	return &keyPairStructure, nil
+}
+
+// JSONProvisionMessageSerializer is a structure for serializing provisioning
+// messages into and from JSON.
+type JSONProvisionMessageSerializer struct{}
+
+// Serialize will take a provisioning message structure and convert it to JSON bytes.
+func (j *JSONProvisionMessageSerializer) Serialize(message *provisioning.MessageStructure) []byte {
+	serialized, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("Error serializing provisioning message: ", err)
+	}
+
+	return serialized
+}
+
+// Deserialize will take in JSON bytes and return a provisioning message structure.
+func (j *JSONProvisionMessageSerializer) Deserialize(serialized []byte) (*provisioning.MessageStructure, error) {
+	var message provisioning.MessageStructure
+	err := json.Unmarshal(serialized, &message)
+	if err != nil {
+		logger.Error("Error deserializing provisioning message: ", err)
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// JSONProvisionEnvelopeSerializer is a structure for serializing provisioning
+// envelopes into and from JSON.
+type JSONProvisionEnvelopeSerializer struct{}
+
+// Serialize will take a provisioning envelope structure and convert it to JSON bytes.
+func (j *JSONProvisionEnvelopeSerializer) Serialize(envelope *provisioning.EnvelopeStructure) []byte {
+	serialized, err := json.Marshal(envelope)
+	if err != nil {
+		logger.Error("Error serializing provisioning envelope: ", err)
+	}
+
+	return serialized
+}
+
+// Deserialize will take in JSON bytes and return a provisioning envelope structure.
+func (j *JSONProvisionEnvelopeSerializer) Deserialize(serialized []byte) (*provisioning.EnvelopeStructure, error) {
+	var envelope provisioning.EnvelopeStructure
+	err := json.Unmarshal(serialized, &envelope)
+	if err != nil {
+		logger.Error("Error deserializing provisioning envelope: ", err)
+		return nil, err
+	}
+
+	return &envelope, nil
+}
+
+// JSONDeviceListSerializer is a structure for serializing device lists into
+// and from JSON.
+type JSONDeviceListSerializer struct{}
+
+// Serialize will take a device list structure and convert it to JSON bytes.
+func (j *JSONDeviceListSerializer) Serialize(list *devicelist.ListStructure) []byte {
+	serialized, err := json.Marshal(list)
+	if err != nil {
+		logger.Error("Error serializing device list: ", err)
+	}
+
+	return serialized
+}
+
+// Deserialize will take in JSON bytes and return a device list structure.
+func (j *JSONDeviceListSerializer) Deserialize(serialized []byte) (*devicelist.ListStructure, error) {
+	var list devicelist.ListStructure
+	err := json.Unmarshal(serialized, &list)
+	if err != nil {
+		logger.Error("Error deserializing device list: ", err)
+		return nil, err
+	}
+
+	return &list, nil
+}
@@ -3,8 +3,11 @@
 package serialize
 
 import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
 	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/provisioning"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
 )
 
@@ -22,10 +25,15 @@ type Serializer struct {
 	SenderKeyState               groupRecord.SenderKeyStateSerializer
 	SignalMessage                protocol.SignalMessageSerializer
 	PreKeySignalMessage          protocol.PreKeySignalMessageSerializer
+	HeaderEncryptedMessage       protocol.HeaderEncryptedMessageSerializer
 	SenderKeyMessage             protocol.SenderKeyMessageSerializer
 	SenderKeyDistributionMessage protocol.SenderKeyDistributionMessageSerializer
 	SignedPreKeyRecord           record.SignedPreKeySerializer
 	PreKeyRecord                 record.PreKeySerializer
 	State                        record.StateSerializer
 	Session                      record.SessionSerializer
+	IdentityKeyPair              identity.KeyPairSerializer
+	ProvisionMessage             provisioning.MessageSerializer
+	ProvisionEnvelope            provisioning.EnvelopeSerializer
+	DeviceList                   devicelist.ListSerializer
 }
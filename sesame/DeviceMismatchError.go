@@ -0,0 +1,27 @@
+package sesame
+
+import (
+	"fmt"
+)
+
+// DeviceMismatchError is returned by a Deliverer when the devices a message
+// was encrypted for don't match the server's list of devices for the user.
+type DeviceMismatchError struct {
+	// MissingDevices are devices the server has that the message was not
+	// encrypted for.
+	MissingDevices []uint32
+
+	// ExtraDevices are devices the message was encrypted for that the
+	// server no longer has.
+	ExtraDevices []uint32
+
+	// StaleDevices are devices whose registration ID doesn't match the
+	// one the message was encrypted for, because they were reinstalled.
+	StaleDevices []uint32
+}
+
+// Error returns a description of the mismatched devices.
+func (e *DeviceMismatchError) Error() string {
+	return fmt.Sprintf("Device mismatch: missing %v, extra %v, stale %v",
+		e.MissingDevices, e.ExtraDevices, e.StaleDevices)
+}
@@ -0,0 +1,19 @@
+// Package sesame manages the sessions with every device of remote users,
+// following the Sesame algorithm.
+//
+// Each remote device has a session record. The record's current state is
+// the device's active session, and its previous states are inactive
+// sessions that are only used to decrypt. A session that decrypts a message
+// becomes active, so both sides converge on the same session after a new
+// one is built, including when both sides build one at the same time.
+//
+// The server's list of devices is the authority. When it rejects a message
+// because devices were added, removed or reinstalled, the Manager marks
+// removed devices stale, builds fresh sessions for new and reinstalled
+// devices, and retries. Stale devices are no longer sent to, but their
+// sessions are kept for a while to decrypt delayed messages.
+//
+// The server's list is not authenticated, so a server could add devices of
+// its own. With SetDeviceLists, the Manager only encrypts for devices that
+// are in the user's device list, signed with their identity key.
+package sesame
@@ -0,0 +1,337 @@
+package sesame
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// DefaultMaxRetries is the number of times Send retries after a device
+// mismatch.
+const DefaultMaxRetries = 3
+
+// DefaultStaleTimeout is how long the sessions of a stale device are kept
+// to decrypt delayed messages.
+const DefaultStaleTimeout = 30 * 24 * time.Hour
+
+// primaryDeviceID is the device ID of a user's primary device, which is not
+// returned by store.Session.GetSubDeviceSessions.
+const primaryDeviceID uint32 = 1
+
+const unsupportedMessageError string = "Unsupported message type for Sesame: "
+const tooManyRetriesError string = "Too many device mismatches sending to: "
+
+// BundleFetcher fetches prekey bundles for the given devices of a user from
+// the server. If no device IDs are given, it returns bundles for every
+// device of the user.
+type BundleFetcher func(name string, deviceIDs []uint32) ([]*prekey.Bundle, error)
+
+// Deliverer sends messages to the devices of a user. If the devices don't
+// match the server's list, it returns a *DeviceMismatchError.
+type Deliverer func(name string, messages []*DeviceMessage) error
+
+// DeviceMessage is a message encrypted for one device of a user.
+type DeviceMessage struct {
+	DeviceID       uint32
+	RegistrationID uint32
+	Message        protocol.CiphertextMessage
+}
+
+// NewManager returns a new Sesame session manager that uses the given
+// store, fetches bundles with the given BundleFetcher and sends messages
+// with the given Deliverer.
+func NewManager(signalStore store.SignalProtocol, serializer *serialize.Serializer,
+	fetchBundles BundleFetcher, deliver Deliverer) *Manager {
+
+	return &Manager{
+		signalStore:  signalStore,
+		serializer:   serializer,
+		fetchBundles: fetchBundles,
+		deliver:      deliver,
+		maxRetries:   DefaultMaxRetries,
+		staleTimeout: DefaultStaleTimeout,
+		staleDevices: memstore.NewStaleDevice(),
+	}
+}
+
+// Manager keeps track of the sessions with every device of remote users.
+// Calls for the same remote user must not run concurrently, just like the
+// session.Cipher calls they make.
+type Manager struct {
+	signalStore  store.SignalProtocol
+	serializer   *serialize.Serializer
+	fetchBundles BundleFetcher
+	deliver      Deliverer
+	maxRetries   int
+	staleTimeout time.Duration
+	deviceLists  devicelist.Store
+	staleDevices store.StaleDevice
+
+	mutex sync.Mutex
+}
+
+// SetMaxRetries sets the number of times Send retries after a device
+// mismatch.
+func (m *Manager) SetMaxRetries(maxRetries int) {
+	m.maxRetries = maxRetries
+}
+
+// SetStaleTimeout sets how long the sessions of a stale device are kept
+// before PruneStaleDevices deletes them.
+func (m *Manager) SetStaleTimeout(timeout time.Duration) {
+	m.staleTimeout = timeout
+}
+
+// SetStaleDevices makes the manager keep the devices it marks stale in the
+// given store, so they stay stale when the manager is rebuilt. By default
+// they are only kept in memory. It should be called before the manager is
+// used.
+func (m *Manager) SetStaleDevices(staleStore store.StaleDevice) {
+	m.staleDevices = staleStore
+}
+
+// SetDeviceLists makes the manager only encrypt for devices that are in the
+// user's accepted device list, with the registration ID of their session.
+// Lists are accepted into the store with devicelist.Accept. Encrypt returns
+// an *UnlistedDevicesError for users with unlisted devices.
+func (m *Manager) SetDeviceLists(listStore devicelist.Store) {
+	m.deviceLists = listStore
+}
+
+// Devices returns the IDs of the user's devices that have a session and are
+// not stale. These are the devices a message is encrypted for.
+func (m *Manager) Devices(name string) []uint32 {
+	deviceIDs := m.signalStore.GetSubDeviceSessions(name)
+	if m.signalStore.ContainsSession(protocol.NewSignalAddress(name, primaryDeviceID)) {
+		deviceIDs = append([]uint32{primaryDeviceID}, deviceIDs...)
+	}
+
+	devices := make([]uint32, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		if !m.IsStale(protocol.NewSignalAddress(name, deviceID)) {
+			devices = append(devices, deviceID)
+		}
+	}
+
+	return devices
+}
+
+// ActiveSession returns the active session state for the given device, or
+// nil if there is none.
+func (m *Manager) ActiveSession(address *protocol.SignalAddress) *record.State {
+	if !m.signalStore.ContainsSession(address) {
+		return nil
+	}
+	sessionState := m.signalStore.LoadSession(address).SessionState()
+	if !sessionState.HasSenderChain() {
+		return nil
+	}
+
+	return sessionState
+}
+
+// MarkStale marks the given device as stale. Messages are no longer
+// encrypted for it, but its sessions are kept to decrypt delayed messages.
+func (m *Manager) MarkStale(address *protocol.SignalAddress) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.staleDevices.LoadStaleDevice(address); !ok {
+		m.staleDevices.StoreStaleDevice(address, time.Now())
+	}
+}
+
+// IsStale returns true if the given device is stale.
+func (m *Manager) IsStale(address *protocol.SignalAddress) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.staleDevices.LoadStaleDevice(address)
+	return ok
+}
+
+// clearStale marks the given device as active again.
+func (m *Manager) clearStale(address *protocol.SignalAddress) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.staleDevices.DeleteStaleDevice(address)
+}
+
+// PruneStaleDevices deletes the sessions of devices that have been stale
+// for longer than the stale timeout.
+func (m *Manager) PruneStaleDevices() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, address := range m.staleDevices.LoadStaleDeviceAddresses() {
+		since, ok := m.staleDevices.LoadStaleDevice(address)
+		if ok && time.Since(since) >= m.staleTimeout {
+			logger.Debug("Deleting sessions of stale device: ", address)
+			m.signalStore.DeleteSession(address)
+			m.staleDevices.DeleteStaleDevice(address)
+		}
+	}
+}
+
+// Encrypt encrypts the given plaintext for every active device of the given
+// user with the device's active session. If the user has no active
+// devices, sessions are built from bundles for all of them, or for the
+// listed devices if device lists are checked.
+func (m *Manager) Encrypt(name string, plaintext []byte) ([]*DeviceMessage, error) {
+	var list *devicelist.List
+	if m.deviceLists != nil {
+		if list = m.deviceLists.LoadDeviceList(name); list == nil {
+			return nil, &UnlistedDevicesError{Name: name, DeviceIDs: m.Devices(name)}
+		}
+	}
+
+	devices := m.Devices(name)
+	if len(devices) == 0 {
+		var deviceIDs []uint32
+		if list != nil {
+			deviceIDs = list.DeviceIDs()
+		}
+		if err := m.buildSessions(name, deviceIDs); err != nil {
+			return nil, err
+		}
+		devices = m.Devices(name)
+	}
+	if list != nil {
+		if err := m.checkListed(name, list, devices); err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make([]*DeviceMessage, len(devices))
+	for i, deviceID := range devices {
+		address := protocol.NewSignalAddress(name, deviceID)
+		builder := session.NewBuilderFromSignal(m.signalStore, address, m.serializer)
+		message, err := session.NewCipher(builder, address).Encrypt(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		messages[i] = &DeviceMessage{
+			DeviceID:       deviceID,
+			RegistrationID: m.signalStore.LoadSession(address).SessionState().RemoteRegistrationID(),
+			Message:        message,
+		}
+	}
+
+	return messages, nil
+}
+
+// Send encrypts the given plaintext for every device of the given user and
+// delivers it. If the server reports a device mismatch, the devices are
+// updated and the message is encrypted and sent again.
+func (m *Manager) Send(name string, plaintext []byte) error {
+	for attempt := 0; attempt <= m.maxRetries; attempt++ {
+		messages, err := m.Encrypt(name, plaintext)
+		if err != nil {
+			return err
+		}
+
+		err = m.deliver(name, messages)
+		var mismatch *DeviceMismatchError
+		if !errors.As(err, &mismatch) {
+			return err
+		}
+		logger.Debug("Retrying after device mismatch: ", mismatch)
+		if err := m.HandleMismatch(name, mismatch); err != nil {
+			return err
+		}
+	}
+
+	return errors.New(tooManyRetriesError + name)
+}
+
+// HandleMismatch updates the devices of the given user to match the server.
+// Removed devices are marked stale, and fresh sessions are built for new
+// and reinstalled devices. The old session of a reinstalled device is kept
+// as an inactive session.
+func (m *Manager) HandleMismatch(name string, mismatch *DeviceMismatchError) error {
+	for _, deviceID := range mismatch.ExtraDevices {
+		m.MarkStale(protocol.NewSignalAddress(name, deviceID))
+	}
+
+	deviceIDs := append(append([]uint32{}, mismatch.MissingDevices...), mismatch.StaleDevices...)
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+
+	return m.buildSessions(name, deviceIDs)
+}
+
+// checkListed returns an *UnlistedDevicesError if any of the given devices
+// is not in the given list with the registration ID of its session.
+func (m *Manager) checkListed(name string, list *devicelist.List, devices []uint32) error {
+	var unlisted []uint32
+	for _, deviceID := range devices {
+		sessionState := m.signalStore.LoadSession(protocol.NewSignalAddress(name, deviceID)).SessionState()
+		if !list.Contains(deviceID, sessionState.RemoteRegistrationID()) {
+			unlisted = append(unlisted, deviceID)
+		}
+	}
+	if len(unlisted) > 0 {
+		return &UnlistedDevicesError{Name: name, DeviceIDs: unlisted}
+	}
+
+	return nil
+}
+
+// buildSessions fetches bundles for the given devices of a user and builds
+// new active sessions with them.
+func (m *Manager) buildSessions(name string, deviceIDs []uint32) error {
+	bundles, err := m.fetchBundles(name, deviceIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, bundle := range bundles {
+		address := protocol.NewSignalAddress(name, bundle.DeviceID())
+		builder := session.NewBuilderFromSignal(m.signalStore, address, m.serializer)
+		if err := builder.ProcessBundle(bundle); err != nil {
+			return err
+		}
+		m.clearStale(address)
+	}
+
+	return nil
+}
+
+// Decrypt decrypts the given message from the given device. The session
+// that decrypts it becomes the device's active session. A PreKeySignalMessage
+// builds a new session, and marks the device as active again if it was
+// stale.
+func (m *Manager) Decrypt(sender *protocol.SignalAddress, message protocol.CiphertextMessage) ([]byte, error) {
+	builder := session.NewBuilderFromSignal(m.signalStore, sender, m.serializer)
+	cipher := session.NewCipher(builder, sender)
+
+	switch message := message.(type) {
+	case *protocol.PreKeySignalMessage:
+		if _, err := builder.Process(message); err != nil {
+			return nil, err
+		}
+		plaintext, err := cipher.Decrypt(message.WhisperMessage())
+		if err != nil {
+			return nil, err
+		}
+		m.clearStale(sender)
+		return plaintext, nil
+	case *protocol.SignalMessage:
+		return cipher.Decrypt(message)
+	}
+
+	return nil, errors.New(unsupportedMessageError + strconv.FormatUint(uint64(message.Type()), 10))
+}
@@ -0,0 +1,23 @@
+package sesame
+
+import (
+	"fmt"
+)
+
+// UnlistedDevicesError is returned by Encrypt and Send when device lists are
+// checked and some of a user's devices are not in their accepted device
+// list. Fetch and accept the user's latest list, then send again.
+type UnlistedDevicesError struct {
+	// Name is the user whose devices are not listed.
+	Name string
+
+	// DeviceIDs are the devices that are not listed with the registration
+	// ID of their session. If the user has no accepted list, every device
+	// is unlisted.
+	DeviceIDs []uint32
+}
+
+// Error returns a description of the unlisted devices.
+func (e *UnlistedDevicesError) Error() string {
+	return fmt.Sprintf("Devices of %s are not in their device list: %v", e.Name, e.DeviceIDs)
+}
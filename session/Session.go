@@ -3,23 +3,59 @@ package session
 
 import (
 	"errors"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/events"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ratchet"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
-	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/medium"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+	"strconv"
 )
 
 // Define error constants used for error messages.
-const untrustedIdentityError string = "Untrusted identity"
-const noSignedPreKeyError string = "No signed prekey!"
-const invalidSignatureError string = "Invalid signature on device key!"
-const nilOneTimePreKeyError string = "Prekey store returned a nil one time prekey! Was the key already processed?"
+const unsupportedMessageTypeError string = "Unsupported message type: "
+const noHeaderSerializerError string = "No serializer for header encrypted messages!"
+const noValidSessionsError string = "No valid sessions."
+const refreshedChainError string = "Refreshed chain starts before the end of the chain it replaced!"
+const noIdentityKeyError string = "No identity key to follow a refreshed chain!"
+const unknownLocalIdentityError string = "No local identity for service ID: "
+
+// Errors returned by session builders and ciphers. Errors with details, such
+// as the remote address or message counter, wrap one of these, so callers can
+// check the cause with errors.Is.
+var (
+	ErrUntrustedIdentity     = errors.New("Untrusted identity")
+	ErrNoSignedPreKey        = errors.New("No signed prekey!")
+	ErrInvalidSignature      = errors.New("Invalid signature on device key!")
+	ErrMissingOneTimePreKey  = errors.New("Prekey store returned a nil one time prekey! Was the key already processed?")
+	ErrInvalidRegistrationID = errors.New("Invalid remote registration ID!")
+	ErrUnsupportedVersion    = errors.New("Unsupported message version!")
+	ErrLegacyEncrypt         = errors.New("Refusing to encrypt with a legacy version!")
+	ErrLegacyMode            = errors.New("Legacy mode is required to decrypt this message version!")
+	ErrHeaderEncryption      = errors.New("Header encryption is not enabled!")
+	ErrNoHeaderKey           = errors.New("No header key for session!")
+	ErrHeaderDecrypt         = errors.New("Unable to decrypt message header!")
+	ErrNoSession             = errors.New("No session!")
+	ErrOldCounter            = errors.New("Received message with old counter!")
+	ErrTooFarInFuture        = errors.New("Too many messages into the future!")
+)
+
+// RegistrationIDChangeHandler is called when a remote client's registration ID
+// differs from the one in our existing session. A changed registration ID means
+// the remote client has reinstalled, so the existing session is archived and a
+// new one is built.
+type RegistrationIDChangeHandler func(remoteAddress *protocol.SignalAddress, oldRegistrationID, newRegistrationID uint32)
 
 // NewBuilder constructs a session builder.
 func NewBuilder(sessionStore store.Session, preKeyStore store.PreKey,
@@ -33,6 +69,7 @@ func NewBuilder(sessionStore store.Session, preKeyStore store.PreKey,
 		identityKeyStore:  identityStore,
 		remoteAddress:     remoteAddress,
 		serializer:        serializer,
+		supportedVersions: version.Supported(),
 	}
 
 	return &builder
@@ -50,11 +87,27 @@ func NewBuilderFromSignal(signalStore store.SignalProtocol,
 		identityKeyStore:  signalStore,
 		remoteAddress:     remoteAddress,
 		serializer:        serializer,
+		supportedVersions: version.Supported(),
 	}
 
 	return &builder
 }
 
+// NewBuilderForService constructs a session builder using the store of the
+// local identity with the given service ID. Pass the destination service ID
+// of a received message, so a message sent to our PNI is processed with the
+// PNI identity key and prekeys, and one sent to our ACI with the ACI's.
+func NewBuilderForService(identities store.LocalIdentities, localServiceID protocol.ServiceID,
+	remoteAddress *protocol.SignalAddress, serializer *serialize.Serializer) (*Builder, error) {
+
+	signalStore := identities.IdentityStore(localServiceID)
+	if signalStore == nil {
+		return nil, errors.New(unknownLocalIdentityError + localServiceID.String())
+	}
+
+	return NewBuilderFromSignal(signalStore, remoteAddress, serializer), nil
+}
+
 // Builder is responsible for setting up encrypted sessions.
 // Once a session has been established, SessionCipher can be
 // used to encrypt/decrypt messages in that session.
@@ -75,29 +128,129 @@ type Builder struct {
 	identityKeyStore  store.IdentityKey
 	remoteAddress     *protocol.SignalAddress
 	serializer        *serialize.Serializer
+	supportedVersions []int
+	headerEncryption  bool
+	pendingBuffer     *pending.Buffer
+	observer          observer.Observer
+	eventBus          *events.Bus
+
+	registrationIDChangeHandler RegistrationIDChangeHandler
+}
+
+// SetSupportedVersions sets the protocol versions this builder will use
+// when building sessions. By default every version in the version package
+// is supported. Sessions built from a bundle use the newest version that
+// both sides support.
+func (b *Builder) SetSupportedVersions(versions ...int) {
+	b.supportedVersions = versions
+}
+
+// SupportedVersions returns the protocol versions this builder will use when
+// building sessions. These should be advertised with our prekey bundles.
+func (b *Builder) SupportedVersions() []int {
+	return b.supportedVersions
+}
+
+// isSupportedVersion returns true if the given version is in the builder's
+// supported versions.
+func (b *Builder) isSupportedVersion(messageVersion int) bool {
+	for _, v := range b.supportedVersions {
+		if v == messageVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHeaderEncryption enables or disables header encryption for sessions
+// built from bundles. Header encrypted sessions hide the sender ratchet key
+// and message counters from relays. It must also be enabled to accept
+// sessions that the remote side built with header encryption.
+func (b *Builder) SetHeaderEncryption(enabled bool) {
+	b.headerEncryption = enabled
+}
+
+// HeaderEncryption returns true if header encryption is enabled.
+func (b *Builder) HeaderEncryption() bool {
+	return b.headerEncryption
+}
+
+// SetPendingBuffer sets the buffer for messages that arrive before their
+// session. Ciphers created from this builder buffer such messages, and
+// Process decrypts them once it has built their session.
+func (b *Builder) SetPendingBuffer(buffer *pending.Buffer) {
+	b.pendingBuffer = buffer
+}
+
+// SetObserver sets the observer for this builder and the ciphers created
+// from it. By default the shared observer from observer.Setup is used.
+func (b *Builder) SetObserver(o observer.Observer) {
+	b.observer = o
+}
+
+// observe returns the builder's observer, or the shared observer if none
+// was set.
+func (b *Builder) observe() observer.Observer {
+	if b.observer != nil {
+		return b.observer
+	}
+	return observer.Get()
+}
+
+// SetEventBus sets the bus that this builder and the ciphers created from it
+// publish session lifecycle events to.
+func (b *Builder) SetEventBus(bus *events.Bus) {
+	b.eventBus = bus
+}
+
+// SetRegistrationIDChangeHandler sets the function that is called when the
+// remote client's registration ID changes.
+func (b *Builder) SetRegistrationIDChangeHandler(handler RegistrationIDChangeHandler) {
+	b.registrationIDChangeHandler = handler
 }
 
 // Process builds a new session from a session record and pre
 // key signal message.
 func (b *Builder) Process(message *protocol.PreKeySignalMessage) (unsignedPreKeyID *optional.Uint32, err error) {
+	span := b.observe().StartSpan(observer.OperationProcess)
+	defer func() {
+		observer.Finish(b.observe(), span, observer.OperationProcess, err, failureReason(err))
+	}()
 
 	// Load or create session record for this session.
 	sessionRecord := b.sessionStore.LoadSession(b.remoteAddress)
 
+	// Ensure the remote registration ID is valid.
+	if !keyhelper.IsValidRegistrationID(message.RegistrationID(), true) {
+		return nil, ErrInvalidRegistrationID
+	}
+
 	// Check to see if the keys are trusted.
 	theirIdentityKey := message.IdentityKey()
 	if !(b.identityKeyStore.IsTrustedIdentity(b.remoteAddress, theirIdentityKey)) {
-		return nil, errors.New(untrustedIdentityError)
+		return nil, ErrUntrustedIdentity
+	}
+
+	// Ensure we support the version the sender chose.
+	if !b.isSupportedVersion(message.MessageVersion()) {
+		return nil, errorhelper.WithDetail(ErrUnsupportedVersion, "version "+strconv.Itoa(message.MessageVersion()))
 	}
 
-	// Use version 3 of the signal/axolotl protocol.
-	unsignedPreKeyID, err = b.processV3(sessionRecord, message)
+	// Build the session using the version the sender chose. Its events
+	// are only published once the session is stored.
+	var emitted []events.Event
+	unsignedPreKeyID, err = b.processV3(sessionRecord, message, &emitted)
 	if err != nil {
 		return nil, err
 	}
 
-	// Save the identity key to our identity store.
+	// Store the session and save the identity key to our identity store.
+	identityChanged := b.identityChanged(theirIdentityKey)
+	b.sessionStore.StoreSession(b.remoteAddress, sessionRecord)
 	b.identityKeyStore.SaveIdentity(b.remoteAddress, theirIdentityKey)
+	b.publish(identityChanged)
+	b.publish(emitted...)
+	b.retryPending()
 
 	// Return the unsignedPreKeyID
 	return unsignedPreKeyID, nil
@@ -105,9 +258,10 @@ func (b *Builder) Process(message *protocol.PreKeySignalMessage) (unsignedPreKey
 
 // ProcessV3 builds a new session from a session record and pre key
 // signal message. After a session is constructed in this way, the embedded
-// SignalMessage can be decrypted.
-func (b *Builder) processV3(sessionRecord *record.Session,
-	message *protocol.PreKeySignalMessage) (unsignedPreKeyID *optional.Uint32, err error) {
+// SignalMessage can be decrypted. This handles every version from 3 onwards,
+// using the parameters of the message's version.
+func (b *Builder) processV3(sessionRecord *record.Session, message *protocol.PreKeySignalMessage,
+	emitted *[]events.Event) (unsignedPreKeyID *optional.Uint32, err error) {
 
 	logger.Debug("Processing message with PreKeyID: ", message.PreKeyID())
 
@@ -123,10 +277,24 @@ func (b *Builder) processV3(sessionRecord *record.Session,
 
 	// Load our signed prekey from our signed prekey store.
 	ourSignedPreKeyRecord := b.signedPreKeyStore.LoadSignedPreKey(message.SignedPreKeyID())
+	if ourSignedPreKeyRecord == nil {
+		logger.Error(ErrNoSignedPreKey)
+		return nil, ErrNoSignedPreKey
+	}
 	ourSignedPreKey := ourSignedPreKeyRecord.KeyPair()
 
+	// Get the parameter set for the message's version.
+	versionParameters, err := version.Get(message.MessageVersion())
+	if err != nil {
+		return nil, err
+	}
+	if message.IsHeaderEncrypted() && !b.headerEncryption {
+		return nil, ErrHeaderEncryption
+	}
+
 	// Build the parameters of the session.
 	parameters := ratchet.NewEmptyReceiverParameters()
+	parameters.SetVersionParameters(versionParameters)
 	parameters.SetTheirBaseKey(message.BaseKey())
 	parameters.SetTheirIdentityKey(message.IdentityKey())
 	parameters.SetOurIdentityKeyPair(b.identityKeyStore.GetIdentityKeyPair())
@@ -135,20 +303,32 @@ func (b *Builder) processV3(sessionRecord *record.Session,
 
 	// Set our one time pre key with the one from our prekey store
 	// if the message contains a valid pre key id
+	var oneTimePreKey *record.PreKey
 	if message.PreKeyID() != nil {
-		oneTimePreKey := b.preKeyStore.LoadPreKey(message.PreKeyID().Value)
+		oneTimePreKey = b.preKeyStore.LoadPreKey(message.PreKeyID().Value)
 		if oneTimePreKey == nil {
-			logger.Error(nilOneTimePreKeyError)
-			return nil, errors.New(nilOneTimePreKeyError)
+			logger.Error(ErrMissingOneTimePreKey)
+			return nil, ErrMissingOneTimePreKey
 		}
 		parameters.SetOurOneTimePreKey(oneTimePreKey.KeyPair())
 	} else {
 		parameters.SetOurOneTimePreKey(nil)
 	}
 
-	// If this is a fresh record, archive our current state.
+	// If our current state is still waiting for a reply to our own
+	// PreKeySignalMessage, both sides initiated a session at once. Both
+	// sides must keep the same session, so the base keys decide.
+	simultaneous := !sessionRecord.IsFresh() && sessionRecord.SessionState().HasUnacknowledgedPreKeyMessage()
+	keepOurs := simultaneous && ratchet.KeepsOurSession(
+		sessionRecord.SessionState().SenderBaseKey(),
+		message.BaseKey().Serialize(),
+	)
+
+	// If this is not a fresh record, archive our current state.
 	if !sessionRecord.IsFresh() {
+		*emitted = append(*emitted, b.checkRegistrationID(sessionRecord, message.RegistrationID())...)
 		sessionRecord.ArchiveCurrentState()
+		b.observe().SessionArchived()
 	}
 
 	///////// Initialize our session /////////
@@ -157,19 +337,49 @@ func (b *Builder) processV3(sessionRecord *record.Session,
 	if sessionErr != nil {
 		return nil, sessionErr
 	}
-	sessionState.SetVersion(protocol.CurrentVersion)
+	sessionState.SetVersion(versionParameters.Version)
 	sessionState.SetRemoteIdentityKey(parameters.TheirIdentityKey())
 	sessionState.SetLocalIdentityKey(parameters.OurIdentityKeyPair().PublicKey())
 	sessionState.SetSenderChain(parameters.OurRatchetKey(), derivedKeys.ChainKey)
 	sessionState.SetRootKey(derivedKeys.RootKey)
 
+	// Our first header key is only known after the remote side's ratchet
+	// key is received, so we start without one.
+	if message.IsHeaderEncrypted() {
+		headerKeys, err := ratchet.CalculateReceiverHeaderKeys(parameters)
+		if err != nil {
+			return nil, err
+		}
+		sessionState.SetHeaderKeys(nil, headerKeys.ReceiverNextKey, headerKeys.SenderKey)
+	}
+
 	// Set the session's registration ids and base key
 	sessionState.SetLocalRegistrationID(b.identityKeyStore.GetLocalRegistrationId())
 	sessionState.SetRemoteRegistrationID(message.RegistrationID())
 	sessionState.SetSenderBaseKey(message.BaseKey().Serialize())
+	if simultaneous {
+		logger.Debug("Simultaneous session initiation with ", b.remoteAddress, ", keeping our session: ", keepOurs)
+		sessionRecord.ResolveSimultaneousInitiation(keepOurs)
+	}
+	*emitted = append(*emitted, &events.SessionCreated{
+		RemoteAddress: b.remoteAddress,
+		Version:       versionParameters.Version,
+	})
+	if oneTimePreKey != nil {
+		*emitted = append(*emitted, &events.PreKeyConsumed{
+			RemoteAddress: b.remoteAddress,
+			PreKeyID:      oneTimePreKey.ID().Value,
+			LastResort:    oneTimePreKey.IsLastResort(),
+		})
+	}
 
-	// Remove the PreKey from our store and return the message prekey id if it is valid.
-	if message.PreKeyID() != nil && message.PreKeyID().Value != medium.MaxValue {
+	// Remove the PreKey from our store and return the message prekey id if it
+	// is valid. The last resort prekey is never removed.
+	if oneTimePreKey != nil && oneTimePreKey.IsLastResort() {
+		b.observe().PreKeyConsumed(observer.KeyLastResort)
+	}
+	if oneTimePreKey != nil && !oneTimePreKey.IsLastResort() {
+		b.observe().PreKeyConsumed(observer.KeyPreKey)
 		logger.Debug("Removing preKey from our prekey store: ", message.PreKeyID().Value)
 		b.preKeyStore.RemovePreKey(message.PreKeyID().Value)
 		return message.PreKeyID(), nil
@@ -177,17 +387,55 @@ func (b *Builder) processV3(sessionRecord *record.Session,
 	return nil, nil
 }
 
+// retryPending decrypts the buffered messages from the remote address now
+// that there is a session, and passes the results to the buffer's handler.
+func (b *Builder) retryPending() {
+	if b.pendingBuffer == nil {
+		return
+	}
+	messages := b.pendingBuffer.TakeSessionMessages(b.remoteAddress)
+	if len(messages) == 0 {
+		return
+	}
+
+	logger.Debug("Retrying ", len(messages), " buffered messages from ", b.remoteAddress)
+	cipher := NewCipher(b, b.remoteAddress)
+	for _, message := range messages {
+		var plaintext []byte
+		var err error
+		switch ciphertext := message.Ciphertext.(type) {
+		case *protocol.SignalMessage:
+			plaintext, err = cipher.Decrypt(ciphertext)
+		case *protocol.HeaderEncryptedMessage:
+			plaintext, err = cipher.DecryptHeaderEncrypted(ciphertext)
+		default:
+			err = errors.New(unsupportedMessageTypeError + strconv.FormatUint(uint64(ciphertext.Type()), 10))
+		}
+		b.pendingBuffer.Deliver(message, plaintext, err)
+	}
+}
+
 // ProcessBundle builds a new session from a PreKeyBundle retrieved
 // from a server.
-func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
+func (b *Builder) ProcessBundle(preKey *prekey.Bundle) (err error) {
+	span := b.observe().StartSpan(observer.OperationProcessBundle)
+	defer func() {
+		observer.Finish(b.observe(), span, observer.OperationProcessBundle, err, failureReason(err))
+	}()
+
+	// Ensure the remote registration ID is valid.
+	if !keyhelper.IsValidRegistrationID(preKey.RegistrationID(), true) {
+		return ErrInvalidRegistrationID
+	}
+
 	// Check to see if the keys are trusted.
 	if !(b.identityKeyStore.IsTrustedIdentity(b.remoteAddress, preKey.IdentityKey())) {
-		return errors.New(untrustedIdentityError)
+		return ErrUntrustedIdentity
 	}
 
 	// Check to see if the bundle has a signed pre key.
 	if preKey.SignedPreKey() == nil {
-		return errors.New(noSignedPreKeyError)
+		return ErrNoSignedPreKey
 	}
 
 	// Verify the signature of the pre key
@@ -195,7 +443,17 @@ func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
 	preKeyBytes := preKey.SignedPreKey().Serialize()
 	preKeySignature := preKey.SignedPreKeySignature()
 	if !ecc.VerifySignature(preKeyPublic, preKeyBytes, preKeySignature) {
-		return errors.New(invalidSignatureError)
+		return ErrInvalidSignature
+	}
+
+	// Choose the newest version we both support.
+	sessionVersion, err := version.Negotiate(b.supportedVersions, preKey.SupportedVersions())
+	if err != nil {
+		return err
+	}
+	versionParameters, err := version.Get(sessionVersion)
+	if err != nil {
+		return err
 	}
 
 	// Load our session and generate keys.
@@ -210,6 +468,7 @@ func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
 
 	// Build the parameters of the session
 	parameters := ratchet.NewEmptySenderParameters()
+	parameters.SetVersionParameters(versionParameters)
 	parameters.SetOurBaseKey(ourBaseKey)
 	parameters.SetOurIdentityKey(b.identityKeyStore.GetIdentityKeyPair())
 	parameters.SetTheirIdentityKey(preKey.IdentityKey())
@@ -217,9 +476,12 @@ func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
 	parameters.SetTheirRatchetKey(theirSignedPreKey)
 	parameters.SetTheirOneTimePreKey(theirOneTimePreKey)
 
-	// If this is a fresh record, archive our current state.
+	// If this is not a fresh record, archive our current state.
+	var emitted []events.Event
 	if !sessionRecord.IsFresh() {
+		emitted = b.checkRegistrationID(sessionRecord, preKey.RegistrationID())
 		sessionRecord.ArchiveCurrentState()
+		b.observe().SessionArchived()
 	}
 
 	///////// Initialize our session /////////
@@ -234,21 +496,29 @@ func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
 	if keyErr != nil {
 		return keyErr
 	}
-	sendingChain, chainErr := derivedKeys.RootKey.CreateChain(
+	sendingChain, nextSenderHeaderKey, chainErr := derivedKeys.RootKey.CreateChainWithHeaderKey(
 		parameters.TheirRatchetKey(),
 		sendingRatchetKey,
+		versionParameters,
 	)
 	if chainErr != nil {
 		return chainErr
 	}
 
 	// Calculate the sender session.
-	sessionState.SetVersion(protocol.CurrentVersion)
+	sessionState.SetVersion(sessionVersion)
 	sessionState.SetRemoteIdentityKey(parameters.TheirIdentityKey())
 	sessionState.SetLocalIdentityKey(parameters.OurIdentityKey().PublicKey())
 	sessionState.AddReceiverChain(parameters.TheirRatchetKey(), derivedKeys.ChainKey.Current())
 	sessionState.SetSenderChain(sendingRatchetKey, sendingChain.ChainKey)
 	sessionState.SetRootKey(sendingChain.RootKey)
+	if b.headerEncryption {
+		headerKeys, err := ratchet.CalculateSenderHeaderKeys(parameters)
+		if err != nil {
+			return err
+		}
+		sessionState.SetHeaderKeys(headerKeys.SenderKey, nextSenderHeaderKey, headerKeys.ReceiverNextKey)
+	}
 
 	// Update our session record with the unackowledged prekey message
 	sessionState.SetUnacknowledgedPreKeyMessage(
@@ -273,8 +543,109 @@ func (b *Builder) ProcessBundle(preKey *prekey.Bundle) error {
 	)
 
 	// Store the session in our session store and save the identity in our identity store.
+	identityChanged := b.identityChanged(preKey.IdentityKey())
 	b.sessionStore.StoreSession(b.remoteAddress, sessionRecord)
 	b.identityKeyStore.SaveIdentity(b.remoteAddress, preKey.IdentityKey())
+	b.publish(identityChanged)
+	b.publish(emitted...)
+	b.publish(&events.SessionCreated{
+		RemoteAddress: b.remoteAddress,
+		Version:       sessionVersion,
+		Initiator:     true,
+	})
 
 	return nil
 }
+
+// checkRegistrationID compares the remote registration ID of the given
+// session with the new one, and calls the registration ID change handler
+// if the remote client has reinstalled. It returns the events of archiving
+// the current state.
+func (b *Builder) checkRegistrationID(sessionRecord *record.Session, registrationID uint32) []events.Event {
+	archived := []events.Event{&events.SessionArchived{RemoteAddress: b.remoteAddress}}
+	oldRegistrationID := sessionRecord.SessionState().RemoteRegistrationID()
+	if oldRegistrationID == 0 || oldRegistrationID == registrationID {
+		return archived
+	}
+
+	logger.Warning("Registration ID for ", b.remoteAddress, " changed from ", oldRegistrationID,
+		" to ", registrationID, ", archiving session and rebuilding...")
+	if b.registrationIDChangeHandler != nil {
+		b.registrationIDChangeHandler(b.remoteAddress, oldRegistrationID, registrationID)
+	}
+	return append(archived, &events.SessionReset{
+		RemoteAddress:     b.remoteAddress,
+		OldRegistrationID: oldRegistrationID,
+		NewRegistrationID: registrationID,
+	})
+}
+
+// identityChanged returns an IdentityChanged event if the given identity
+// differs from the saved one, or nil. The saved identity can only be loaded
+// from an enumerable identity store.
+func (b *Builder) identityChanged(identityKey *identity.Key) events.Event {
+	identityStore, ok := b.identityKeyStore.(store.EnumerableIdentityKey)
+	if !ok {
+		return nil
+	}
+	saved := identityStore.LoadIdentity(b.remoteAddress)
+	if saved == nil || saved.Fingerprint() == identityKey.Fingerprint() {
+		return nil
+	}
+	return &events.IdentityChanged{
+		RemoteAddress: b.remoteAddress,
+		OldIdentity:   saved,
+		NewIdentity:   identityKey,
+	}
+}
+
+// publish publishes the given events to the builder's event bus. Nil
+// events are skipped.
+func (b *Builder) publish(emitted ...events.Event) {
+	if b.eventBus == nil {
+		return
+	}
+	for _, event := range emitted {
+		if event != nil {
+			b.eventBus.Publish(event)
+		}
+	}
+}
+
+// failureReason returns the observer's failure reason for the given error.
+func failureReason(err error) observer.Reason {
+	switch {
+	case err == nil:
+		return observer.ReasonOther
+	case errors.Is(err, protocol.ErrBadMac), errors.Is(err, cipher.ErrInvalidPKCS7Data),
+		errors.Is(err, cipher.ErrInvalidPKCS7Padding), errors.Is(err, cipher.ErrInvalidBlockSize):
+		return observer.ReasonInvalidMessage
+	}
+	var decodeError *errorhelper.DecodeError
+	if errors.As(err, &decodeError) {
+		return observer.ReasonInvalidMessage
+	}
+
+	switch {
+	case errors.Is(err, ErrNoSession):
+		return observer.ReasonNoSession
+	case errors.Is(err, ErrUntrustedIdentity):
+		return observer.ReasonUntrustedIdentity
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrNoSignedPreKey):
+		return observer.ReasonInvalidSignature
+	case errors.Is(err, ErrInvalidRegistrationID):
+		return observer.ReasonInvalidRegistrationID
+	case errors.Is(err, ErrUnsupportedVersion), errors.Is(err, ErrLegacyEncrypt),
+		errors.Is(err, ErrLegacyMode), errors.Is(err, ErrHeaderEncryption):
+		return observer.ReasonUnsupportedVersion
+	case errors.Is(err, ErrMissingOneTimePreKey):
+		return observer.ReasonMissingPreKey
+	case errors.Is(err, ErrOldCounter):
+		return observer.ReasonDuplicateMessage
+	case errors.Is(err, ErrTooFarInFuture):
+		return observer.ReasonTooFarInFuture
+	case errors.Is(err, ErrNoHeaderKey), errors.Is(err, ErrHeaderDecrypt):
+		return observer.ReasonInvalidMessage
+	}
+	return observer.ReasonOther
+}
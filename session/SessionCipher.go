@@ -2,16 +2,25 @@ package session
 
 import (
 	"errors"
-	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/events"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/chain"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/message"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/root"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/session"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
 	"strconv"
+	"time"
 )
 
 const maxFutureMessages = 5000
@@ -20,30 +29,59 @@ const maxFutureMessages = 5000
 // session. In order to use the session cipher, a session must have already
 // been created and stored using session.Builder.
 func NewCipher(builder *Builder, remoteAddress *protocol.SignalAddress) *Cipher {
-	cipher := &Cipher{
-		sessionStore:            builder.sessionStore,
-		preKeyMessageSerializer: builder.serializer.PreKeySignalMessage,
-		signalMessageSerializer: builder.serializer.SignalMessage,
-		preKeyStore:             builder.preKeyStore,
-		remoteAddress:           remoteAddress,
-	}
+	cipher := NewCipherWithSerializer(remoteAddress, builder.sessionStore, builder.preKeyStore, builder.serializer)
+	cipher.identityKeyStore = builder.identityKeyStore
+	cipher.pendingBuffer = builder.pendingBuffer
+	cipher.observer = builder.observer
+	cipher.eventBus = builder.eventBus
 
 	return cipher
 }
 
+// NewCipherFromSession constructs a session cipher without a session builder.
+// If the session store has no session for the remote address yet, the given
+// session is stored. The cipher behaves like one built from a builder without
+// an identity key store, pending buffer, observer or event bus, and can't
+// encrypt header encrypted sessions until SetHeaderEncryptedMessageSerializer
+// is called. Use NewCipherWithSerializer to set all serializers at once.
 func NewCipherFromSession(session *record.Session, remoteAddress *protocol.SignalAddress,
 	sessionStore store.Session, preKeyStore store.PreKey,
 	preKeyMessageSerializer protocol.PreKeySignalMessageSerializer,
 	signalMessageSerializer protocol.SignalMessageSerializer) *Cipher {
-	cipher := &Cipher{
+
+	if session != nil && !sessionStore.ContainsSession(remoteAddress) {
+		sessionStore.StoreSession(remoteAddress, session)
+	}
+
+	return newCipher(remoteAddress, sessionStore, preKeyStore, preKeyMessageSerializer, signalMessageSerializer, nil)
+}
+
+// NewCipherWithSerializer constructs a session cipher without a session
+// builder, using the message serializers of the given serializer. Use
+// SetIdentityKeyStore, SetPendingBuffer, SetObserver and SetEventBus to set
+// the rest of what a builder provides.
+func NewCipherWithSerializer(remoteAddress *protocol.SignalAddress, sessionStore store.Session,
+	preKeyStore store.PreKey, serializer *serialize.Serializer) *Cipher {
+
+	return newCipher(remoteAddress, sessionStore, preKeyStore,
+		serializer.PreKeySignalMessage, serializer.SignalMessage, serializer.HeaderEncryptedMessage)
+}
+
+// newCipher sets the fields that every session cipher needs, so that ciphers
+// behave the same way regardless of how they were constructed.
+func newCipher(remoteAddress *protocol.SignalAddress, sessionStore store.Session, preKeyStore store.PreKey,
+	preKeyMessageSerializer protocol.PreKeySignalMessageSerializer,
+	signalMessageSerializer protocol.SignalMessageSerializer,
+	headerMessageSerializer protocol.HeaderEncryptedMessageSerializer) *Cipher {
+
+	return &Cipher{
 		sessionStore:            sessionStore,
 		preKeyMessageSerializer: preKeyMessageSerializer,
 		signalMessageSerializer: signalMessageSerializer,
+		headerMessageSerializer: headerMessageSerializer,
 		preKeyStore:             preKeyStore,
 		remoteAddress:           remoteAddress,
 	}
-
-	return cipher
 }
 
 // Cipher is the main entry point for Signal Protocol encrypt/decrypt operations.
@@ -53,34 +91,168 @@ type Cipher struct {
 	sessionStore            store.Session
 	preKeyMessageSerializer protocol.PreKeySignalMessageSerializer
 	signalMessageSerializer protocol.SignalMessageSerializer
+	headerMessageSerializer protocol.HeaderEncryptedMessageSerializer
 	preKeyStore             store.PreKey
+	identityKeyStore        store.IdentityKey
 	remoteAddress           *protocol.SignalAddress
+	pendingBuffer           *pending.Buffer
+	observer                observer.Observer
+	eventBus                *events.Bus
+	legacyMode              bool
+	refreshPolicy           RefreshPolicy
+}
+
+// RefreshPolicy decides when the cipher forces a new sender ratchet key,
+// even if the remote side has not replied. A zero value field is ignored.
+type RefreshPolicy struct {
+	// MaxMessages is the number of messages sent on a sender chain before
+	// a new ratchet key is generated.
+	MaxMessages uint32
+
+	// MaxAge is how long a sender chain is used before a new ratchet key
+	// is generated.
+	MaxAge time.Duration
+}
+
+// SetRefreshPolicy sets the policy for forcing new sender ratchet keys.
+func (d *Cipher) SetRefreshPolicy(policy RefreshPolicy) {
+	d.refreshPolicy = policy
+}
+
+// RefreshPolicy returns the policy for forcing new sender ratchet keys.
+func (d *Cipher) RefreshPolicy() RefreshPolicy {
+	return d.refreshPolicy
+}
+
+// Refresh marks the session so that a new sender ratchet key is generated
+// with the next encrypted message. This heals the session after a
+// compromise without waiting for the remote side to reply. The step is
+// delayed until the remote side has acknowledged the session and at least
+// one message was sent on the current sender chain, since the remote side
+// can't follow it otherwise. The remote side needs its identity key to
+// follow the new chain, see SetIdentityKeyStore.
+func (d *Cipher) Refresh() error {
+	if !d.sessionStore.ContainsSession(d.remoteAddress) {
+		return errorhelper.WithDetail(ErrNoSession, d.remoteAddress.String())
+	}
+	sessionRecord := d.sessionStore.LoadSession(d.remoteAddress)
+	sessionRecord.SessionState().SetNeedsRefresh(true)
+	d.sessionStore.StoreSession(d.remoteAddress, sessionRecord)
+
+	return nil
+}
+
+// SetLegacyMode enables or disables decryption of legacy message versions,
+// such as version 2 messages found in old archives. Legacy versions are
+// never used to encrypt. Legacy messages must be decoded with
+// protocol.NewLegacySignalMessageFromBytes.
+func (d *Cipher) SetLegacyMode(enabled bool) {
+	d.legacyMode = enabled
+}
+
+// SetHeaderEncryptedMessageSerializer sets the serializer used for header
+// encrypted messages. Ciphers created with NewCipher use the builder's
+// serializer, and ciphers created with NewCipherFromSession have none.
+func (d *Cipher) SetHeaderEncryptedMessageSerializer(serializer protocol.HeaderEncryptedMessageSerializer) {
+	d.headerMessageSerializer = serializer
+}
+
+// LegacyMode returns true if decryption of legacy message versions is enabled.
+func (d *Cipher) LegacyMode() bool {
+	return d.legacyMode
+}
+
+// SetObserver sets the observer for this cipher. By default the builder's
+// observer is used.
+func (d *Cipher) SetObserver(o observer.Observer) {
+	d.observer = o
+}
+
+// SetIdentityKeyStore sets the store of our identity key, which is needed
+// to follow the remote side's refreshed sender chains. By default the
+// builder's identity key store is used.
+func (d *Cipher) SetIdentityKeyStore(identityKeyStore store.IdentityKey) {
+	d.identityKeyStore = identityKeyStore
+}
+
+// SetPendingBuffer sets the buffer that holds messages which arrive before
+// their session. By default the builder's buffer is used.
+func (d *Cipher) SetPendingBuffer(buffer *pending.Buffer) {
+	d.pendingBuffer = buffer
+}
+
+// SetEventBus sets the bus that session events are published on. By default
+// the builder's bus is used.
+func (d *Cipher) SetEventBus(bus *events.Bus) {
+	d.eventBus = bus
+}
+
+// observe returns the cipher's observer, or the shared observer if none was
+// set.
+func (d *Cipher) observe() observer.Observer {
+	if d.observer != nil {
+		return d.observer
+	}
+	return observer.Get()
 }
 
 // Encrypt will take the given message in bytes and return an object that follows
 // the CiphertextMessage interface.
-func (d *Cipher) Encrypt(plaintext []byte) (protocol.CiphertextMessage, error) {
+func (d *Cipher) Encrypt(plaintext []byte) (encrypted protocol.CiphertextMessage, err error) {
+	span := d.observe().StartSpan(observer.OperationEncrypt)
+	defer func() {
+		if err == nil {
+			d.observe().MessageEncrypted(encrypted.Type())
+		}
+		observer.Finish(d.observe(), span, observer.OperationEncrypt, err, failureReason(err))
+	}()
+
 	sessionRecord := d.sessionStore.LoadSession(d.remoteAddress)
 	sessionState := sessionRecord.SessionState()
+	versionParameters, err := sessionState.VersionParameters()
+	if err != nil {
+		return nil, err
+	}
+	if versionParameters.ReadOnly {
+		return nil, errorhelper.WithDetail(ErrLegacyEncrypt, "version "+strconv.Itoa(versionParameters.Version))
+	}
+	if d.shouldRefresh(sessionState) {
+		if err := refreshSenderChain(sessionState, versionParameters); err != nil {
+			return nil, err
+		}
+	}
 	chainKey := sessionState.SenderChainKey()
-	messageKeys := chainKey.MessageKeys()
-	senderEphemeral := sessionState.SenderRatchetKey()
+	messageKeys := chainKey.DeriveMessageKeys(versionParameters)
+	senderEphemeral := sessionState.SenderChainRatchetKey()
+	previousRatchetKey := sessionState.SenderRefreshParentKey()
 	previousCounter := sessionState.PreviousCounter()
 	sessionVersion := sessionState.Version()
 
-	ciphertextBody, err := encrypt(messageKeys, plaintext)
+	ciphertextBody, err := encrypt(versionParameters, messageKeys, plaintext)
 	logger.Debug("Got ciphertextBody: ", ciphertextBody)
 	if err != nil {
 		return nil, err
 	}
 
+	if sessionState.HeaderEncrypted() {
+		ciphertextMessage, err := d.encryptHeader(sessionState, chainKey.Index(), messageKeys, ciphertextBody)
+		if err != nil {
+			return nil, err
+		}
+		sessionState.SetSenderChainKey(chainKey.NextKey())
+		d.sessionStore.StoreSession(d.remoteAddress, sessionRecord)
+
+		return ciphertextMessage, nil
+	}
+
 	var ciphertextMessage protocol.CiphertextMessage
-	ciphertextMessage, err = protocol.NewSignalMessage(
+	ciphertextMessage, err = protocol.NewRefreshedSignalMessage(
 		sessionVersion,
 		chainKey.Index(),
 		previousCounter,
 		messageKeys.MacKey(),
 		senderEphemeral,
+		previousRatchetKey,
 		ciphertextBody,
 		sessionState.LocalIdentityKey(),
 		sessionState.RemoteIdentityKey(),
@@ -121,6 +293,58 @@ func (d *Cipher) Encrypt(plaintext []byte) (protocol.CiphertextMessage, error) {
 	return ciphertextMessage, nil
 }
 
+// encryptHeader returns a header encrypted message with the given ciphertext.
+// If the remote side hasn't acknowledged the session yet, it is sent as a
+// PreKeySignalMessage.
+func (d *Cipher) encryptHeader(sessionState *record.State, counter uint32,
+	messageKeys *message.Keys, ciphertextBody []byte) (protocol.CiphertextMessage, error) {
+
+	if sessionState.SenderHeaderKey() == nil {
+		return nil, ErrNoHeaderKey
+	}
+	if d.headerMessageSerializer == nil {
+		return nil, errors.New(noHeaderSerializerError)
+	}
+	header := protocol.NewMessageHeader(
+		sessionState.SenderRatchetKey(),
+		counter,
+		sessionState.PreviousCounter(),
+	)
+	headerMessage, err := protocol.NewHeaderEncryptedMessage(
+		sessionState.Version(),
+		header,
+		sessionState.SenderHeaderKey(),
+		messageKeys.MacKey(),
+		ciphertextBody,
+		sessionState.LocalIdentityKey(),
+		sessionState.RemoteIdentityKey(),
+		d.headerMessageSerializer,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !sessionState.HasUnacknowledgedPreKeyMessage() {
+		return headerMessage, nil
+	}
+
+	items, err := sessionState.UnackPreKeyMessageItems()
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.NewHeaderEncryptedPreKeySignalMessage(
+		sessionState.Version(),
+		sessionState.LocalRegistrationID(),
+		items.PreKeyID(),
+		items.SignedPreKeyID(),
+		items.BaseKey(),
+		sessionState.LocalIdentityKey(),
+		headerMessage,
+		d.preKeyMessageSerializer,
+		d.signalMessageSerializer,
+	)
+}
+
 // Decrypt decrypts the given message using an existing session that
 // is stored in the session store.
 func (d *Cipher) Decrypt(ciphertextMessage *protocol.SignalMessage) ([]byte, error) {
@@ -131,14 +355,21 @@ func (d *Cipher) Decrypt(ciphertextMessage *protocol.SignalMessage) ([]byte, err
 
 // DecryptAndGetKey decrypts the given message using an existing session that
 // is stored in the session store and returns the message keys used for encryption.
-func (d *Cipher) DecryptAndGetKey(ciphertextMessage *protocol.SignalMessage) ([]byte, *message.Keys, error) {
+func (d *Cipher) DecryptAndGetKey(ciphertextMessage *protocol.SignalMessage) (plaintext []byte, messageKeys *message.Keys, err error) {
+	span := d.observe().StartSpan(observer.OperationDecrypt)
+	defer func() { d.finishDecrypt(span, ciphertextMessage, err) }()
+
 	if !d.sessionStore.ContainsSession(d.remoteAddress) {
-		return nil, nil, errors.New("No session for: " + d.remoteAddress.String())
+		if d.pendingBuffer != nil {
+			d.pendingBuffer.AddSessionMessage(d.remoteAddress, ciphertextMessage)
+			return nil, nil, pending.ErrBuffered
+		}
+		return nil, nil, errorhelper.WithDetail(ErrNoSession, d.remoteAddress.String())
 	}
 
 	// Load the session record from our session store and decrypt the message.
 	sessionRecord := d.sessionStore.LoadSession(d.remoteAddress)
-	plaintext, messageKeys, err := d.DecryptWithRecord(sessionRecord, ciphertextMessage)
+	plaintext, messageKeys, err = d.DecryptWithRecord(sessionRecord, ciphertextMessage)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -149,11 +380,30 @@ func (d *Cipher) DecryptAndGetKey(ciphertextMessage *protocol.SignalMessage) ([]
 	return plaintext, messageKeys, nil
 }
 
+// finishDecrypt reports the result of decrypting the given message and ends
+// the span. A buffered message is not a failure.
+func (d *Cipher) finishDecrypt(span observer.Span, ciphertextMessage protocol.CiphertextMessage, err error) {
+	if errors.Is(err, pending.ErrBuffered) {
+		span.SetAttribute("buffered", "true")
+		span.End(nil)
+		return
+	}
+	if err == nil {
+		d.observe().MessageDecrypted(ciphertextMessage.Type())
+	}
+	observer.Finish(d.observe(), span, observer.OperationDecrypt, err, failureReason(err))
+}
+
 // DecryptWithKey will decrypt the given message using the given symmetric key. This
 // can be used when decrypting messages at a later time if the message key was saved.
 func (d *Cipher) DecryptWithKey(ciphertextMessage *protocol.SignalMessage, key *message.Keys) ([]byte, error) {
+	versionParameters, err := d.decryptParameters(ciphertextMessage.MessageVersion())
+	if err != nil {
+		return nil, err
+	}
+
 	logger.Debug("Decrypting ciphertext body: ", ciphertextMessage.Body())
-	plaintext, err := decrypt(key, ciphertextMessage.Body())
+	plaintext, err := decrypt(versionParameters, key, ciphertextMessage.Body())
 	if err != nil {
 		logger.Error("Unable to get plain text from ciphertext: ", err)
 		return nil, err
@@ -164,38 +414,81 @@ func (d *Cipher) DecryptWithKey(ciphertextMessage *protocol.SignalMessage, key *
 
 // DecryptWithRecord decrypts the given message using the given session record.
 func (d *Cipher) DecryptWithRecord(sessionRecord *record.Session, ciphertext *protocol.SignalMessage) ([]byte, *message.Keys, error) {
+	return decryptWithRecord(sessionRecord, d.promoted, func(state *record.State) ([]byte, *message.Keys, error) {
+		return d.DecryptWithState(state, ciphertext)
+	})
+}
+
+// decryptWithRecord decrypts a message with the current state of the given
+// session record, or else with the first previous state that can decrypt it.
+// Each state is tried on a copy, so a failed attempt leaves it unchanged.
+// The promoted function is called when a previous state is promoted.
+func decryptWithRecord(sessionRecord *record.Session, promoted func(),
+	decryptWithState func(*record.State) ([]byte, *message.Keys, error)) ([]byte, *message.Keys, error) {
+
 	logger.Debug("Decrypting ciphertext with record: ", sessionRecord)
-	previousStates := sessionRecord.PreviousSessionStates()
-	sessionState := sessionRecord.SessionState()
 
 	// Try and decrypt the message with the current session state.
-	plaintext, messageKeys, err := d.DecryptWithState(sessionState, ciphertext)
+	sessionState, err := sessionRecord.SessionState().Copy()
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, messageKeys, currentErr := decryptWithState(sessionState)
+	if currentErr == nil {
+		// If decryption was successful, set the session state and return the plain text.
+		sessionRecord.SetState(sessionState)
+		return plaintext, messageKeys, nil
+	}
 
 	// If we received an error using the current session state, loop
 	// through all previous states.
-	if err != nil {
-		logger.Warning(err)
-		for i, state := range previousStates {
-			// Try decrypting the message with previous states
-			plaintext, messageKeys, err = d.DecryptWithState(state, ciphertext)
-			if err != nil {
-				continue
-			}
-
-			// If successful, remove and promote the state.
-			previousStates = append(previousStates[:i], previousStates[i+1:]...)
-			sessionRecord.PromoteState(state)
-
-			return plaintext, messageKeys, nil
+	logger.Warning(currentErr)
+	for i, previousState := range sessionRecord.PreviousSessionStates() {
+		// Try decrypting the message with previous states
+		state, err := previousState.Copy()
+		if err != nil {
+			continue
+		}
+		plaintext, messageKeys, err = decryptWithState(state)
+		if err != nil {
+			continue
 		}
 
-		return nil, nil, errors.New("No valid sessions.")
+		// If successful, promote the state. A superseded state is left
+		// where it is, so both sides keep the same state.
+		if state.Superseded() {
+			sessionRecord.SetPreviousState(i, state)
+		} else {
+			sessionRecord.PromotePreviousState(i, state)
+			promoted()
+		}
+
+		return plaintext, messageKeys, nil
 	}
 
-	// If decryption was successful, set the session state and return the plain text.
-	sessionRecord.SetState(sessionState)
+	return nil, nil, &noValidSessions{err: currentErr}
+}
 
-	return plaintext, messageKeys, nil
+// promoted reports that a previous session state was promoted.
+func (d *Cipher) promoted() {
+	d.observe().SessionPromoted()
+	if d.eventBus != nil {
+		d.eventBus.Publish(&events.StatePromoted{RemoteAddress: d.remoteAddress})
+	}
+}
+
+// noValidSessions is returned when no session state can decrypt a message.
+// It wraps the error from the current state.
+type noValidSessions struct {
+	err error
+}
+
+func (n *noValidSessions) Error() string {
+	return noValidSessionsError
+}
+
+func (n *noValidSessions) Unwrap() error {
+	return n.err
 }
 
 // DecryptWithState decrypts the given message with the given session state.
@@ -207,28 +500,35 @@ func (d *Cipher) DecryptWithState(sessionState *record.State, ciphertextMessage
 		return nil, nil, errors.New(err)
 	}
 
+	// Each state only decrypts messages of its own version, since the version
+	// determines how the message keys and MAC are derived.
 	if ciphertextMessage.MessageVersion() != sessionState.Version() {
 		err := "Wrong message version!"
 		logger.Error("Unable to decrypt message with state: ", err)
 		return nil, nil, errors.New(err)
 	}
+	versionParameters, err := d.decryptParameters(sessionState.Version())
+	if err != nil {
+		logger.Error("Unable to decrypt message with state: ", err)
+		return nil, nil, err
+	}
 
 	messageVersion := ciphertextMessage.MessageVersion()
 	theirEphemeral := ciphertextMessage.SenderRatchetKey()
 	counter := ciphertextMessage.Counter()
-	chainKey, chainCreateErr := getOrCreateChainKey(sessionState, theirEphemeral)
+	chainKey, chainCreateErr := d.getOrCreateChainKey(sessionState, ciphertextMessage, versionParameters)
 	if chainCreateErr != nil {
 		logger.Error("Unable to get or create chain key: ", chainCreateErr)
 		return nil, nil, chainCreateErr
 	}
 
-	messageKeys, keysCreateErr := getOrCreateMessageKeys(sessionState, theirEphemeral, chainKey, counter)
+	messageKeys, keysCreateErr := getOrCreateMessageKeys(sessionState, theirEphemeral, chainKey, counter, versionParameters, d.observe())
 	if keysCreateErr != nil {
 		logger.Error("Unable to get or create message keys: ", keysCreateErr)
 		return nil, nil, keysCreateErr
 	}
 
-	err := ciphertextMessage.VerifyMac(messageVersion, sessionState.RemoteIdentityKey(), sessionState.LocalIdentityKey(), messageKeys.MacKey())
+	err = ciphertextMessage.VerifyMac(messageVersion, sessionState.RemoteIdentityKey(), sessionState.LocalIdentityKey(), messageKeys.MacKey())
 	if err != nil {
 		logger.Error("Unable to verify ciphertext mac: ", err)
 		return nil, nil, err
@@ -244,8 +544,155 @@ func (d *Cipher) DecryptWithState(sessionState *record.State, ciphertextMessage
 	return plaintext, messageKeys, nil
 }
 
+// DecryptHeaderEncrypted decrypts the given header encrypted message using an
+// existing session that is stored in the session store. Messages that came
+// in a PreKeySignalMessage must be processed with session.Builder first.
+func (d *Cipher) DecryptHeaderEncrypted(ciphertextMessage *protocol.HeaderEncryptedMessage) (plaintext []byte, err error) {
+	span := d.observe().StartSpan(observer.OperationDecrypt)
+	defer func() { d.finishDecrypt(span, ciphertextMessage, err) }()
+
+	if !d.sessionStore.ContainsSession(d.remoteAddress) {
+		if d.pendingBuffer != nil {
+			d.pendingBuffer.AddSessionMessage(d.remoteAddress, ciphertextMessage)
+			return nil, pending.ErrBuffered
+		}
+		return nil, errorhelper.WithDetail(ErrNoSession, d.remoteAddress.String())
+	}
+
+	sessionRecord := d.sessionStore.LoadSession(d.remoteAddress)
+	plaintext, _, err = decryptWithRecord(sessionRecord, d.promoted, func(state *record.State) ([]byte, *message.Keys, error) {
+		return d.decryptHeaderEncryptedWithState(state, ciphertextMessage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.sessionStore.StoreSession(d.remoteAddress, sessionRecord)
+
+	return plaintext, nil
+}
+
+// decryptHeaderEncryptedWithState decrypts the given header encrypted message
+// with the given session state.
+func (d *Cipher) decryptHeaderEncryptedWithState(sessionState *record.State,
+	ciphertextMessage *protocol.HeaderEncryptedMessage) ([]byte, *message.Keys, error) {
+
+	if !sessionState.HasSenderChain() || !sessionState.HeaderEncrypted() {
+		return nil, nil, ErrNoHeaderKey
+	}
+	if ciphertextMessage.MessageVersion() != sessionState.Version() {
+		return nil, nil, errors.New("Wrong message version!")
+	}
+	versionParameters, err := d.decryptParameters(sessionState.Version())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Headers of messages on chains we already have are encrypted with that
+	// chain's header key. A header that opens with the next receiver header
+	// key starts a new chain.
+	var header *protocol.MessageHeader
+	for _, headerKey := range sessionState.ReceiverHeaderKeys() {
+		if header, err = ciphertextMessage.DecryptHeader(headerKey); err == nil {
+			break
+		}
+	}
+	isNextChain := false
+	if header == nil {
+		header, err = ciphertextMessage.DecryptHeader(sessionState.NextReceiverHeaderKey())
+		if err != nil {
+			return nil, nil, ErrHeaderDecrypt
+		}
+		isNextChain = true
+	}
+
+	theirEphemeral := header.SenderRatchetKey()
+	var chainKey *chain.Key
+	switch {
+	case sessionState.HasReceiverChain(theirEphemeral):
+		chainKey = sessionState.ReceiverChainKey(theirEphemeral)
+	case isNextChain:
+		chainKey, err = stepHeaderEncryptedRatchet(sessionState, theirEphemeral, versionParameters)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, ErrHeaderDecrypt
+	}
+
+	messageKeys, err := getOrCreateMessageKeys(sessionState, theirEphemeral, chainKey, header.Counter(), versionParameters, d.observe())
+	if err != nil {
+		logger.Error("Unable to get or create message keys: ", err)
+		return nil, nil, err
+	}
+
+	err = ciphertextMessage.VerifyMac(sessionState.RemoteIdentityKey(), sessionState.LocalIdentityKey(), messageKeys.MacKey())
+	if err != nil {
+		logger.Error("Unable to verify ciphertext mac: ", err)
+		return nil, nil, err
+	}
+
+	plaintext, err := decrypt(versionParameters, messageKeys, ciphertextMessage.Body())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessionState.ClearUnackPreKeyMessage()
+
+	return plaintext, messageKeys, nil
+}
+
+// stepHeaderEncryptedRatchet creates the receiver chain for the remote side's
+// new ratchet key and a new sender chain, like getOrCreateChainKey. The next
+// header keys become the header keys of the new chains, and new next header
+// keys are derived with them.
+func stepHeaderEncryptedRatchet(sessionState *record.State, theirEphemeral ecc.ECPublicKeyable,
+	versionParameters *version.Parameters) (*chain.Key, error) {
+
+	rootKey := sessionState.RootKey()
+	ourEphemeral := sessionState.SenderRatchetKeyPair()
+	receiverChain, nextReceiverHeaderKey, err := rootKey.CreateChainWithHeaderKey(theirEphemeral, ourEphemeral, versionParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate a new ephemeral key pair and create a new chain with it.
+	ourNewEphemeral, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	senderChain, nextSenderHeaderKey, err := receiverChain.RootKey.CreateChainWithHeaderKey(theirEphemeral, ourNewEphemeral, versionParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set our session state parameters.
+	sessionState.SetRootKey(senderChain.RootKey)
+	sessionState.AddReceiverChainWithHeaderKey(theirEphemeral, receiverChain.ChainKey, sessionState.NextReceiverHeaderKey())
+	previousCounter := max(sessionState.SenderChainKey().Index()-1, 0)
+	sessionState.SetPreviousCounter(previousCounter)
+	sessionState.SetSenderChain(ourNewEphemeral, senderChain.ChainKey)
+	sessionState.SetHeaderKeys(sessionState.NextSenderHeaderKey(), nextSenderHeaderKey, nextReceiverHeaderKey)
+
+	return receiverChain.ChainKey.(*chain.Key), nil
+}
+
+// decryptParameters returns the parameter set used to decrypt messages of the
+// given version. Legacy versions are only returned in legacy mode.
+func (d *Cipher) decryptParameters(messageVersion int) (*version.Parameters, error) {
+	versionParameters, err := version.Lookup(messageVersion)
+	if err != nil {
+		return nil, err
+	}
+	if versionParameters.ReadOnly && !d.legacyMode {
+		return nil, errorhelper.WithDetail(ErrLegacyMode, "version "+strconv.Itoa(messageVersion))
+	}
+
+	return versionParameters, nil
+}
+
 func getOrCreateMessageKeys(sessionState *record.State, theirEphemeral ecc.ECPublicKeyable,
-	chainKey *chain.Key, counter uint32) (*message.Keys, error) {
+	chainKey *chain.Key, counter uint32, versionParameters *version.Parameters,
+	o observer.Observer) (*message.Keys, error) {
 
 	if chainKey.Index() > counter {
 		if sessionState.HasMessageKeys(theirEphemeral, counter) {
@@ -253,39 +700,78 @@ func getOrCreateMessageKeys(sessionState *record.State, theirEphemeral ecc.ECPub
 		}
 		index := strconv.FormatUint(uint64(chainKey.Index()), 10)
 		count := strconv.FormatUint(uint64(counter), 10)
-		return nil, errors.New(
-			"Received message with old counter: " + index + " , " + count,
-		)
+		return nil, errorhelper.WithDetail(ErrOldCounter, "chain index "+index+", counter "+count)
 	}
 
+	chainKey, err := skipMessageKeys(sessionState, theirEphemeral, chainKey, counter, versionParameters, o)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionState.SetReceiverChainKey(theirEphemeral, chainKey.NextKey())
+	return chainKey.DeriveMessageKeys(versionParameters), nil
+}
+
+// skipMessageKeys stores the message keys of the given receiver chain up to
+// the given counter, so that skipped messages can still be decrypted, and
+// returns the chain key at the counter.
+func skipMessageKeys(sessionState *record.State, theirEphemeral ecc.ECPublicKeyable,
+	chainKey *chain.Key, counter uint32, versionParameters *version.Parameters,
+	o observer.Observer) (*chain.Key, error) {
+
 	if counter-chainKey.Index() > maxFutureMessages {
-		return nil, errors.New("Too many messages into the future!")
+		return nil, ErrTooFarInFuture
 	}
 
+	stored, evicted := 0, 0
 	for chainKey.Index() < counter {
-		messageKeys := chainKey.MessageKeys()
-		sessionState.SetMessageKeys(theirEphemeral, messageKeys)
+		messageKeys := chainKey.DeriveMessageKeys(versionParameters)
+		if sessionState.SetMessageKeys(theirEphemeral, messageKeys) {
+			evicted++
+		}
+		stored++
 		chainKey = chainKey.NextKey()
 	}
+	if stored > 0 {
+		o.SkippedKeysStored(stored)
+	}
+	if evicted > 0 {
+		o.SkippedKeysEvicted(evicted)
+	}
 
-	sessionState.SetReceiverChainKey(theirEphemeral, chainKey.NextKey())
-	return chainKey.MessageKeys(), nil
+	return chainKey, nil
 }
 
 // getOrCreateChainKey will either return the existing chain key or
-// create a new one with the given session state and ephemeral key.
-func getOrCreateChainKey(sessionState *record.State, theirEphemeral ecc.ECPublicKeyable) (*chain.Key, error) {
+// create a new one with the given session state and the message's ephemeral key.
+func (d *Cipher) getOrCreateChainKey(sessionState *record.State, ciphertextMessage *protocol.SignalMessage,
+	versionParameters *version.Parameters) (*chain.Key, error) {
 
 	// If our session state already has a receiver chain, use their
 	// ephemeral key in the existing chain.
+	theirEphemeral := ciphertextMessage.SenderRatchetKey()
 	if sessionState.HasReceiverChain(theirEphemeral) {
 		return sessionState.ReceiverChainKey(theirEphemeral), nil
 	}
 
+	// A refreshed chain is derived from the chain it replaced, which the
+	// message names with its previous ratchet key.
+	if ciphertextMessage.PreviousRatchetKey() != nil {
+		return d.followRefreshedChain(sessionState, ciphertextMessage, versionParameters)
+	}
+
+	return stepRatchet(sessionState, theirEphemeral, versionParameters)
+}
+
+// stepRatchet creates the receiver chain for the remote side's new ratchet
+// key and a new sender chain with a new ratchet key of ours.
+func stepRatchet(sessionState *record.State, theirEphemeral ecc.ECPublicKeyable,
+	versionParameters *version.Parameters) (*chain.Key, error) {
+
 	// If we don't have a chain key, create one with ephemeral keys.
 	rootKey := sessionState.RootKey()
 	ourEphemeral := sessionState.SenderRatchetKeyPair()
-	receiverChain, rErr := rootKey.CreateChain(theirEphemeral, ourEphemeral)
+	receiverChain, rErr := rootKey.CreateChainWithParameters(theirEphemeral, ourEphemeral, versionParameters)
 	if rErr != nil {
 		return nil, rErr
 	}
@@ -297,7 +783,7 @@ func getOrCreateChainKey(sessionState *record.State, theirEphemeral ecc.ECPublic
 	}
 
 	// Create a new chain using our new ephemeral key.
-	senderChain, cErr := receiverChain.RootKey.CreateChain(theirEphemeral, ourNewEphemeral)
+	senderChain, cErr := receiverChain.RootKey.CreateChainWithParameters(theirEphemeral, ourNewEphemeral, versionParameters)
 	if cErr != nil {
 		return nil, cErr
 	}
@@ -312,18 +798,140 @@ func getOrCreateChainKey(sessionState *record.State, theirEphemeral ecc.ECPublic
 	return receiverChain.ChainKey.(*chain.Key), nil
 }
 
-// decrypt will use the given message keys and ciphertext and return
-// the plaintext bytes.
-func decrypt(keys *message.Keys, body []byte) ([]byte, error) {
+// followRefreshedChain creates the receiver chain for a message on a
+// refreshed sender chain. The chain it replaced ends after the message's
+// previous counter, and the new chain is derived from that chain's next
+// chain key and our identity key. If we haven't received the replaced
+// chain yet, it was started by a DH ratchet step.
+func (d *Cipher) followRefreshedChain(sessionState *record.State, ciphertextMessage *protocol.SignalMessage,
+	versionParameters *version.Parameters) (*chain.Key, error) {
+
+	identityKeyPair, err := d.identityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	parentKey := ciphertextMessage.PreviousRatchetKey()
+	var parentChainKey *chain.Key
+	if sessionState.HasReceiverChain(parentKey) {
+		parentChainKey = sessionState.ReceiverChainKey(parentKey)
+	} else if parentChainKey, err = stepRatchet(sessionState, parentKey, versionParameters); err != nil {
+		return nil, err
+	}
+
+	// Keep the message keys of the replaced chain's skipped messages, and
+	// move it past the chain key the new chain is derived from.
+	refreshIndex := ciphertextMessage.PreviousCounter() + 1
+	if parentChainKey.Index() > refreshIndex {
+		return nil, errors.New(refreshedChainError)
+	}
+	parentChainKey, err = skipMessageKeys(sessionState, parentKey, parentChainKey, refreshIndex, versionParameters, d.observe())
+	if err != nil {
+		return nil, err
+	}
+	sessionState.SetReceiverChainKey(parentKey, parentChainKey.NextKey())
+
+	theirEphemeral := ciphertextMessage.SenderRatchetKey()
+	chainKey, err := deriveRefreshedChain(parentChainKey, theirEphemeral, identityKeyPair, versionParameters)
+	if err != nil {
+		return nil, err
+	}
+	sessionState.AddReceiverChain(theirEphemeral, chainKey)
+
+	return chainKey, nil
+}
+
+// identityKeyPair returns our identity key pair as a key pair for Diffie-
+// Hellman agreements.
+func (d *Cipher) identityKeyPair() (*ecc.ECKeyPair, error) {
+	if d.identityKeyStore == nil {
+		return nil, errors.New(noIdentityKeyError)
+	}
+	keyPair := d.identityKeyStore.GetIdentityKeyPair()
+
+	return ecc.NewECKeyPair(keyPair.PublicKey().PublicKey(), keyPair.PrivateKey()), nil
+}
+
+// shouldRefresh returns true if a new sender ratchet key should be generated
+// before encrypting with the given session state. The remote side can only
+// follow the new key once it has acknowledged the session and has a message
+// from the current sender chain.
+func (d *Cipher) shouldRefresh(sessionState *record.State) bool {
+	// Header encrypted sessions only step their ratchet on replies, since
+	// the remote side needs the next header key to find a new chain.
+	if sessionState.HeaderEncrypted() {
+		return false
+	}
+	if sessionState.HasUnacknowledgedPreKeyMessage() {
+		return false
+	}
+	index := sessionState.SenderChainKey().Index()
+	if index == 0 {
+		return false
+	}
+	if sessionState.NeedsRefresh() {
+		return true
+	}
+	if d.refreshPolicy.MaxMessages > 0 && index >= d.refreshPolicy.MaxMessages {
+		return true
+	}
+	if d.refreshPolicy.MaxAge > 0 {
+		created := time.Unix(sessionState.SenderChainTimestamp(), 0)
+		return time.Since(created) >= d.refreshPolicy.MaxAge
+	}
+	return false
+}
+
+// refreshSenderChain replaces the sender chain key with one derived from the
+// current chain key and the Diffie-Hellman output of a new refresh key and
+// the remote side's identity key. The root key and our ratchet key pair are
+// left alone, so the DH ratchet continues the same way whether or not the
+// remote side has seen the refresh. The refresh key's private key is not
+// kept.
+func refreshSenderChain(sessionState *record.State, versionParameters *version.Parameters) error {
+	refreshKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	chainKey := sessionState.SenderChainKey()
+	theirIdentityKey := sessionState.RemoteIdentityKey().PublicKey()
+	refreshedChainKey, err := deriveRefreshedChain(chainKey, theirIdentityKey, refreshKeyPair, versionParameters)
+	if err != nil {
+		return err
+	}
+
+	sessionState.SetPreviousCounter(chainKey.Index() - 1)
+	sessionState.RefreshSenderChain(refreshKeyPair.PublicKey(), refreshedChainKey)
+	sessionState.SetNeedsRefresh(false)
+
+	return nil
+}
+
+// deriveRefreshedChain derives the first chain key of a refreshed chain. The
+// chain key it replaces is used in place of a root key, so the remote side
+// can follow the refresh from its receiver chain without our root key.
+func deriveRefreshedChain(chainKey session.ChainKeyable, theirKey ecc.ECPublicKeyable, ourKeyPair *ecc.ECKeyPair,
+	versionParameters *version.Parameters) (*chain.Key, error) {
+
+	derived, err := root.NewKey(kdf.DeriveSecrets, chainKey.Key()).CreateChainWithParameters(theirKey, ourKeyPair, versionParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return derived.ChainKey.(*chain.Key), nil
+}
+
+// decrypt will use the given version's cipher, message keys and ciphertext
+// and return the plaintext bytes.
+func decrypt(versionParameters *version.Parameters, keys *message.Keys, body []byte) ([]byte, error) {
 	logger.Debug("Using cipherKey: ", keys.CipherKey())
-	return cipher.Decrypt(keys.Iv(), keys.CipherKey(), bytehelper.CopySlice(body))
+	return versionParameters.Cipher.Decrypt(keys.Iv(), keys.CipherKey(), bytehelper.CopySlice(body))
 }
 
-// encrypt will use the given cipher, message keys, and plaintext bytes
+// encrypt will use the given version's cipher, message keys, and plaintext bytes
 // and return ciphertext bytes.
-func encrypt(messageKeys *message.Keys, plaintext []byte) ([]byte, error) {
+func encrypt(versionParameters *version.Parameters, messageKeys *message.Keys, plaintext []byte) ([]byte, error) {
 	logger.Debug("Using cipherKey: ", messageKeys.CipherKey())
-	return cipher.Encrypt(messageKeys.Iv(), messageKeys.CipherKey(), plaintext)
+	return versionParameters.Cipher.Encrypt(messageKeys.Iv(), messageKeys.CipherKey(), plaintext)
 }
 
 // Max is a uint32 implementation of math.Max
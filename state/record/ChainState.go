@@ -6,6 +6,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/chain"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/message"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // NewReceiverChainPair will return a new ReceiverChainPair object.
@@ -39,29 +40,61 @@ func NewChainFromStructure(structure *ChainStructure) (*Chain, error) {
 	// Alias to SliceToArray
 	getArray := bytehelper.SliceToArray
 
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("Chain", "Structure", errorhelper.ErrMissingField)
+	}
+	err := errorhelper.CheckMaxCount("Chain", "MessageKeys", len(structure.MessageKeys), maxMessageKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	// Build the sender ratchet key from bytes.
 	senderRatchetKeyPublic, err := ecc.DecodePoint(structure.SenderRatchetKeyPublic, 0)
 	if err != nil {
 		return nil, err
 	}
 	var senderRatchetKeyPrivate ecc.ECPrivateKeyable
-	if len(structure.SenderRatchetKeyPrivate) == 32 {
+	if structure.SenderRatchetKeyPrivate != nil {
+		err = errorhelper.CheckLength("Chain", "SenderRatchetKeyPrivate", structure.SenderRatchetKeyPrivate, 32)
+		if err != nil {
+			return nil, err
+		}
 		senderRatchetKeyPrivate = ecc.NewDjbECPrivateKey(getArray(structure.SenderRatchetKeyPrivate))
 	}
 	senderRatchetKeyPair := ecc.NewECKeyPair(senderRatchetKeyPublic, senderRatchetKeyPrivate)
 
-	// Build our message keys from the message key structures.
+	// Build the chain key from its structure.
+	chainKey, err := chain.NewKeyFromStruct(structure.ChainKey, kdf.DeriveSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build our message keys from the message key structures. Stored message
+	// keys are for skipped messages, so they must be behind the chain key.
 	messageKeys := make([]*message.Keys, len(structure.MessageKeys))
 	for i := range structure.MessageKeys {
-		messageKeys[i] = message.NewKeysFromStruct(structure.MessageKeys[i])
+		messageKeys[i], err = message.NewKeysFromStruct(structure.MessageKeys[i])
+		if err != nil {
+			return nil, err
+		}
+		if messageKeys[i].Index() >= chainKey.Index() {
+			return nil, errorhelper.NewDecodeError("Chain", "MessageKeys", errorhelper.ErrInvalidCounter)
+		}
 	}
 
 	// Build our new chain state.
 	chainState := NewChain(
 		senderRatchetKeyPair,
-		chain.NewKeyFromStruct(structure.ChainKey, kdf.DeriveSecrets),
+		chainKey,
 		messageKeys,
 	)
+	if structure.HeaderKey != nil {
+		err = errorhelper.CheckLength("Chain", "HeaderKey", structure.HeaderKey, 32)
+		if err != nil {
+			return nil, err
+		}
+		chainState.headerKey = structure.HeaderKey
+	}
 
 	return chainState, nil
 }
@@ -72,6 +105,7 @@ type ChainStructure struct {
 	SenderRatchetKeyPrivate []byte
 	ChainKey                *chain.KeyStructure
 	MessageKeys             []*message.KeysStructure
+	HeaderKey               []byte
 }
 
 // Chain is a structure used inside the SessionState that keeps
@@ -80,6 +114,7 @@ type Chain struct {
 	senderRatchetKeyPair *ecc.ECKeyPair
 	chainKey             *chain.Key
 	messageKeys          []*message.Keys
+	headerKey            []byte
 }
 
 // SenderRatchetKey returns the sender's EC keypair.
@@ -103,6 +138,17 @@ func (c *Chain) SetChainKey(key *chain.Key) {
 	c.chainKey = key
 }
 
+// HeaderKey returns the key that headers of messages on this chain are
+// encrypted with, or nil if the session doesn't use header encryption.
+func (c *Chain) HeaderKey() []byte {
+	return c.headerKey
+}
+
+// SetHeaderKey will set the chain's header key.
+func (c *Chain) SetHeaderKey(key []byte) {
+	c.headerKey = key
+}
+
 // MessageKeys will return the message keys associated with the
 // chain state.
 func (c *Chain) MessageKeys() []*message.Keys {
@@ -153,5 +199,6 @@ func (c *Chain) structure() *ChainStructure {
 		SenderRatchetKeyPrivate: senderRatchetKeyPrivate,
 		ChainKey:                chain.NewStructFromKey(c.chainKey),
 		MessageKeys:             messageKeys,
+		HeaderKey:               c.headerKey,
 	}
 }
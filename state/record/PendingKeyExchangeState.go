@@ -4,6 +4,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // NewPendingKeyExchange will return a new PendingKeyExchange object.
@@ -20,16 +21,37 @@ func NewPendingKeyExchange(sequence uint32, localBaseKeyPair, localRatchetKeyPai
 
 // NewPendingKeyExchangeFromStruct will return a PendingKeyExchange object from
 // the given structure. This is used to get a deserialized pending prekey exchange
-// fetched from persistent storage.
-func NewPendingKeyExchangeFromStruct(structure *PendingKeyExchangeStructure) *PendingKeyExchange {
+// fetched from persistent storage. An error is returned if any of the keys are
+// malformed.
+func NewPendingKeyExchangeFromStruct(structure *PendingKeyExchangeStructure) (*PendingKeyExchange, error) {
 	// Return nil if no structure was provided.
 	if structure == nil {
-		return nil
+		return nil, nil
 	}
 
 	// Alias the SliceToArray method.
 	getArray := bytehelper.SliceToArray
 
+	// Every key is stored as raw 32 byte key material.
+	errors := errorhelper.NewMultiError()
+	fields := []struct {
+		name  string
+		bytes []byte
+	}{
+		{"LocalBaseKeyPublic", structure.LocalBaseKeyPublic},
+		{"LocalBaseKeyPrivate", structure.LocalBaseKeyPrivate},
+		{"LocalRatchetKeyPublic", structure.LocalRatchetKeyPublic},
+		{"LocalRatchetKeyPrivate", structure.LocalRatchetKeyPrivate},
+		{"LocalIdentityKeyPublic", structure.LocalIdentityKeyPublic},
+		{"LocalIdentityKeyPrivate", structure.LocalIdentityKeyPrivate},
+	}
+	for _, field := range fields {
+		errors.Add(errorhelper.CheckLength("PendingKeyExchange", field.name, field.bytes, 32))
+	}
+	if errors.HasErrors() {
+		return nil, errors
+	}
+
 	// Convert the bytes in the given structure to ECC objects.
 	localBaseKeyPair := ecc.NewECKeyPair(
 		ecc.NewDjbECPublicKey(getArray(structure.LocalBaseKeyPublic)),
@@ -50,7 +72,7 @@ func NewPendingKeyExchangeFromStruct(structure *PendingKeyExchangeStructure) *Pe
 		localBaseKeyPair:     localBaseKeyPair,
 		localRatchetKeyPair:  localRatchetKeyPair,
 		localIdentityKeyPair: localIdentityKeyPair,
-	}
+	}, nil
 }
 
 // PendingKeyExchangeStructure is a serializable structure for pending
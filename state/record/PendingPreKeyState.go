@@ -2,6 +2,7 @@ package record
 
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
 )
 
@@ -19,6 +20,9 @@ func NewPendingPreKey(preKeyID *optional.Uint32, signedPreKeyID uint32,
 // NewPendingPreKeyFromStruct will return a new pending prekey object from the
 // given structure.
 func NewPendingPreKeyFromStruct(preKey *PendingPreKeyStructure) (*PendingPreKey, error) {
+	if preKey == nil {
+		return nil, errorhelper.NewDecodeError("PendingPreKey", "Structure", errorhelper.ErrMissingField)
+	}
 	baseKey, err := ecc.DecodePoint(preKey.BaseKey, 0)
 	if err != nil {
 		return nil, err
@@ -3,9 +3,15 @@ package record
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/medium"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
 )
 
+// LastResortPreKeyID is the ID reserved for the last resort prekey. Regular
+// prekey IDs are always below it.
+const LastResortPreKeyID uint32 = medium.MaxValue
+
 // PreKeySerializer is an interface for serializing and deserializing
 // PreKey objects into bytes. An implementation of this interface should be
 // used to encode/decode the object into JSON, Protobuffers, etc.
@@ -27,6 +33,13 @@ func NewPreKeyFromBytes(serialized []byte, serializer PreKeySerializer) (*PreKey
 
 // NewPreKeyFromStruct returns a PreKey record using the given serializable structure.
 func NewPreKeyFromStruct(structure *PreKeyStructure, serializer PreKeySerializer) (*PreKey, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("PreKey", "Structure", errorhelper.ErrMissingField)
+	}
+	if err := errorhelper.CheckLength("PreKey", "PrivateKey", structure.PrivateKey, 32); err != nil {
+		return nil, err
+	}
+
 	// Create the prekey record from the structure.
 	preKey := &PreKey{
 		structure:  *structure,
@@ -34,7 +47,10 @@ func NewPreKeyFromStruct(structure *PreKeyStructure, serializer PreKeySerializer
 	}
 
 	// Generate the ECC key from bytes.
-	publicKey := ecc.NewDjbECPublicKey(bytehelper.SliceToArray(structure.PublicKey))
+	publicKey, err := ecc.DecodePoint(structure.PublicKey, 0)
+	if err != nil {
+		return nil, err
+	}
 	privateKey := ecc.NewDjbECPrivateKey(bytehelper.SliceToArray(structure.PrivateKey))
 	keyPair := ecc.NewECKeyPair(publicKey, privateKey)
 	preKey.keyPair = keyPair
@@ -56,11 +72,22 @@ func NewPreKey(id uint32, keyPair *ecc.ECKeyPair, serializer PreKeySerializer) *
 	}
 }
 
+// NewLastResortPreKey returns a new last resort pre key record. Last resort
+// prekeys are never removed from the store once they are used. New last resort
+// prekeys should use LastResortPreKeyID.
+func NewLastResortPreKey(id uint32, keyPair *ecc.ECKeyPair, serializer PreKeySerializer) *PreKey {
+	preKey := NewPreKey(id, keyPair, serializer)
+	preKey.structure.LastResort = true
+
+	return preKey
+}
+
 // PreKeyStructure is a structure for serializing PreKey records.
 type PreKeyStructure struct {
 	ID         uint32
 	PublicKey  []byte
 	PrivateKey []byte
+	LastResort bool
 }
 
 // PreKey record is a structure for storing pre keys inside
@@ -77,6 +104,12 @@ func (p *PreKey) ID() *optional.Uint32 {
 	return optional.NewOptionalUint32(p.structure.ID)
 }
 
+// IsLastResort returns true if this is a last resort prekey, which must
+// not be removed from the store when it is used.
+func (p *PreKey) IsLastResort() bool {
+	return p.structure.LastResort || p.structure.ID == LastResortPreKeyID
+}
+
 // KeyPair returns the pre key record's key pair.
 func (p *PreKey) KeyPair() *ecc.ECKeyPair {
 	return p.keyPair
@@ -2,6 +2,8 @@ package record
 
 import (
 	"bytes"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // archivedStatesMaxLength describes how many previous session
@@ -46,10 +48,17 @@ func NewSession(serializer SessionSerializer, stateSerializer StateSerializer) *
 func NewSessionFromStructure(structure *SessionStructure, serializer SessionSerializer,
 	stateSerializer StateSerializer) (*Session, error) {
 
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("Session", "Structure", errorhelper.ErrMissingField)
+	}
+	err := errorhelper.CheckMaxCount("Session", "PreviousStates", len(structure.PreviousStates), archivedStatesMaxLength)
+	if err != nil {
+		return nil, err
+	}
+
 	// Build our previous states from structure.
 	previousStates := make([]*State, len(structure.PreviousStates))
 	for i := range structure.PreviousStates {
-		var err error
 		previousStates[i], err = NewStateFromStructure(structure.PreviousStates[i], stateSerializer)
 		if err != nil {
 			return nil, err
@@ -130,7 +139,7 @@ func (r *Session) PreviousSessionStates() []*State {
 // base key exists in the current and previous states.
 func (r *Session) HasSessionState(version int, senderBaseKey []byte) bool {
 	// Ensure the session state version is identical to this one.
-	if r.sessionState.Version() == version {
+	if r.sessionState.Version() != version {
 		return false
 	}
 
@@ -174,6 +183,38 @@ func (r *Session) PromoteState(promotedState *State) {
 	}
 }
 
+// SetPreviousState replaces the previous state at the given index with the
+// given state.
+func (r *Session) SetPreviousState(index int, state *State) {
+	r.previousStates[index] = state
+}
+
+// PromotePreviousState removes the previous state at the given index and
+// promotes the given state, which replaces it, to the current state.
+func (r *Session) PromotePreviousState(index int, state *State) {
+	previousStates := make([]*State, 0, len(r.previousStates)-1)
+	previousStates = append(previousStates, r.previousStates[:index]...)
+	r.previousStates = append(previousStates, r.previousStates[index+1:]...)
+	r.PromoteState(state)
+}
+
+// ResolveSimultaneousInitiation settles which of two states is kept after
+// both sides initiated a session at once. It must be called right after the
+// remote side's state was promoted over our own with PromoteState. If
+// keepArchived is true our archived state becomes current again, otherwise
+// it stays archived. Either way the other state is marked superseded.
+func (r *Session) ResolveSimultaneousInitiation(keepArchived bool) {
+	if len(r.previousStates) == 0 {
+		return
+	}
+	if !keepArchived {
+		r.previousStates[0].SetSuperseded(true)
+		return
+	}
+	r.sessionState.SetSuperseded(true)
+	r.sessionState, r.previousStates[0] = r.previousStates[0], r.sessionState
+}
+
 // Serialize will return the session as serialized bytes so it can be
 // persistently stored.
 func (r *Session) Serialize() []byte {
@@ -9,9 +9,10 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/root"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/session"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
-	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+	"time"
 )
 
 const maxMessageKeys int = 2000
@@ -45,25 +46,88 @@ func NewState(serializer StateSerializer) *State {
 // NewStateFromStructure will return a new session state with the
 // given state structure.
 func NewStateFromStructure(structure *StateStructure, serializer StateSerializer) (*State, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SessionState", "Structure", errorhelper.ErrMissingField)
+	}
+	err := errorhelper.CheckMaxCount("SessionState", "ReceiverChains", len(structure.ReceiverChains), maxReceiverChains)
+	if err != nil {
+		return nil, err
+	}
+
 	// Keep a list of errors, so they can be handled once.
 	errors := errorhelper.NewMultiError()
 
+	// Build our state object. Fields that were never set on the original
+	// state are left empty.
+	state := &State{
+		localRegistrationID:  structure.LocalRegistrationID,
+		needsRefresh:         structure.NeedsRefresh,
+		previousCounter:      structure.PreviousCounter,
+		receiverChains:       make([]*Chain, len(structure.ReceiverChains)),
+		remoteRegistrationID: structure.RemoteRegistrationID,
+		senderChainTimestamp: structure.SenderChainTimestamp,
+		serializer:           serializer,
+		sessionVersion:       structure.SessionVersion,
+		superseded:           structure.Superseded,
+	}
+
 	// Convert our ecc keys from bytes into object form.
-	localIdentityPublic, err := ecc.DecodePoint(structure.LocalIdentityPublic, 0)
-	errors.Add(err)
-	remoteIdentityPublic, err := ecc.DecodePoint(structure.RemoteIdentityPublic, 0)
-	errors.Add(err)
-	senderBaseKey, err := ecc.DecodePoint(structure.SenderBaseKey, 0)
-	errors.Add(err)
-	pendingPreKey, err := NewPendingPreKeyFromStruct(structure.PendingPreKey)
-	errors.Add(err)
-	senderChain, err := NewChainFromStructure(structure.SenderChain)
-	errors.Add(err)
+	if structure.LocalIdentityPublic != nil {
+		localIdentityPublic, err := ecc.DecodePoint(structure.LocalIdentityPublic, 0)
+		errors.Add(err)
+		state.localIdentityPublic = identity.NewKey(localIdentityPublic)
+	}
+	if structure.RemoteIdentityPublic != nil {
+		remoteIdentityPublic, err := ecc.DecodePoint(structure.RemoteIdentityPublic, 0)
+		errors.Add(err)
+		state.remoteIdentityPublic = identity.NewKey(remoteIdentityPublic)
+	}
+	if structure.SenderBaseKey != nil {
+		var err error
+		state.senderBaseKey, err = ecc.DecodePoint(structure.SenderBaseKey, 0)
+		errors.Add(err)
+	}
+	if structure.RootKey != nil {
+		errors.Add(errorhelper.CheckLength("SessionState", "RootKey", structure.RootKey, 32))
+		state.rootKey = root.NewKey(kdf.DeriveSecrets, structure.RootKey)
+	}
+	if structure.SenderRefreshKey != nil {
+		var err error
+		state.senderRefreshKey, err = ecc.DecodePoint(structure.SenderRefreshKey, 0)
+		errors.Add(err)
+		state.senderRefreshParentKey, err = ecc.DecodePoint(structure.SenderRefreshParentKey, 0)
+		errors.Add(err)
+	}
+	if structure.NextReceiverHeaderKey != nil {
+		errors.Add(errorhelper.CheckLength("SessionState", "NextReceiverHeaderKey", structure.NextReceiverHeaderKey, 32))
+		errors.Add(errorhelper.CheckLength("SessionState", "NextSenderHeaderKey", structure.NextSenderHeaderKey, 32))
+		if structure.SenderHeaderKey != nil {
+			errors.Add(errorhelper.CheckLength("SessionState", "SenderHeaderKey", structure.SenderHeaderKey, 32))
+		}
+		state.senderHeaderKey = structure.SenderHeaderKey
+		state.nextSenderHeaderKey = structure.NextSenderHeaderKey
+		state.nextReceiverHeaderKey = structure.NextReceiverHeaderKey
+	}
+	if structure.PendingKeyExchange != nil {
+		var err error
+		state.pendingKeyExchange, err = NewPendingKeyExchangeFromStruct(structure.PendingKeyExchange)
+		errors.Add(err)
+	}
+	if structure.PendingPreKey != nil {
+		var err error
+		state.pendingPreKey, err = NewPendingPreKeyFromStruct(structure.PendingPreKey)
+		errors.Add(err)
+	}
+	if structure.SenderChain != nil {
+		var err error
+		state.senderChain, err = NewChainFromStructure(structure.SenderChain)
+		errors.Add(err)
+	}
 
 	// Build our receiver chains from structure.
-	receiverChains := make([]*Chain, len(structure.ReceiverChains))
 	for i := range structure.ReceiverChains {
-		receiverChains[i], err = NewChainFromStructure(structure.ReceiverChains[i])
+		var err error
+		state.receiverChains[i], err = NewChainFromStructure(structure.ReceiverChains[i])
 		errors.Add(err)
 	}
 
@@ -72,43 +136,32 @@ func NewStateFromStructure(structure *StateStructure, serializer StateSerializer
 		return nil, errors
 	}
 
-	// Build our state object.
-	state := &State{
-		localIdentityPublic:  identity.NewKey(localIdentityPublic),
-		localRegistrationID:  structure.LocalRegistrationID,
-		needsRefresh:         structure.NeedsRefresh,
-		pendingKeyExchange:   NewPendingKeyExchangeFromStruct(structure.PendingKeyExchange),
-		pendingPreKey:        pendingPreKey,
-		previousCounter:      structure.PreviousCounter,
-		receiverChains:       receiverChains,
-		remoteIdentityPublic: identity.NewKey(remoteIdentityPublic),
-		remoteRegistrationID: structure.RemoteRegistrationID,
-		rootKey:              root.NewKey(kdf.DeriveSecrets, structure.RootKey),
-		senderBaseKey:        senderBaseKey,
-		senderChain:          senderChain,
-		serializer:           serializer,
-		sessionVersion:       structure.SessionVersion,
-	}
-
 	return state, nil
 }
 
 // StateStructure is the structure of a session state. Fields are public
 // to be used for serialization and deserialization.
 type StateStructure struct {
-	LocalIdentityPublic  []byte
-	LocalRegistrationID  uint32
-	NeedsRefresh         bool
-	PendingKeyExchange   *PendingKeyExchangeStructure
-	PendingPreKey        *PendingPreKeyStructure
-	PreviousCounter      uint32
-	ReceiverChains       []*ChainStructure
-	RemoteIdentityPublic []byte
-	RemoteRegistrationID uint32
-	RootKey              []byte
-	SenderBaseKey        []byte
-	SenderChain          *ChainStructure
-	SessionVersion       int
+	LocalIdentityPublic    []byte
+	LocalRegistrationID    uint32
+	NeedsRefresh           bool
+	NextReceiverHeaderKey  []byte
+	NextSenderHeaderKey    []byte
+	PendingKeyExchange     *PendingKeyExchangeStructure
+	PendingPreKey          *PendingPreKeyStructure
+	PreviousCounter        uint32
+	ReceiverChains         []*ChainStructure
+	RemoteIdentityPublic   []byte
+	RemoteRegistrationID   uint32
+	RootKey                []byte
+	SenderBaseKey          []byte
+	SenderChain            *ChainStructure
+	SenderChainTimestamp   int64
+	SenderHeaderKey        []byte
+	SenderRefreshKey       []byte
+	SenderRefreshParentKey []byte
+	SessionVersion         int
+	Superseded             bool
 }
 
 // State is a session state that contains the structure for
@@ -116,20 +169,27 @@ type StateStructure struct {
 // The session state is implemented as a struct rather than protobuffers
 // to allow other serialization methods.
 type State struct {
-	localIdentityPublic  *identity.Key
-	localRegistrationID  uint32
-	needsRefresh         bool
-	pendingKeyExchange   *PendingKeyExchange
-	pendingPreKey        *PendingPreKey
-	previousCounter      uint32
-	receiverChains       []*Chain
-	remoteIdentityPublic *identity.Key
-	remoteRegistrationID uint32
-	rootKey              *root.Key
-	senderBaseKey        ecc.ECPublicKeyable
-	senderChain          *Chain
-	serializer           StateSerializer
-	sessionVersion       int
+	localIdentityPublic    *identity.Key
+	localRegistrationID    uint32
+	needsRefresh           bool
+	nextReceiverHeaderKey  []byte
+	nextSenderHeaderKey    []byte
+	pendingKeyExchange     *PendingKeyExchange
+	pendingPreKey          *PendingPreKey
+	previousCounter        uint32
+	receiverChains         []*Chain
+	remoteIdentityPublic   *identity.Key
+	remoteRegistrationID   uint32
+	rootKey                *root.Key
+	senderBaseKey          ecc.ECPublicKeyable
+	senderChain            *Chain
+	senderChainTimestamp   int64
+	senderHeaderKey        []byte
+	senderRefreshKey       ecc.ECPublicKeyable
+	senderRefreshParentKey ecc.ECPublicKeyable
+	serializer             StateSerializer
+	sessionVersion         int
+	superseded             bool
 }
 
 // SenderBaseKey returns the sender's base key in bytes.
@@ -142,8 +202,12 @@ func (s *State) SenderBaseKey() []byte {
 
 // SetSenderBaseKey sets the sender's base key with the given bytes.
 func (s *State) SetSenderBaseKey(senderBaseKey []byte) {
-	senderBaseKeyArray := bytehelper.SliceToArray(senderBaseKey)
-	s.senderBaseKey = ecc.NewDjbECPublicKey(senderBaseKeyArray)
+	senderBaseKeyPublic, err := ecc.DecodePoint(senderBaseKey, 0)
+	if err != nil {
+		logger.Error("Unable to decode sender base key: ", err)
+		return
+	}
+	s.senderBaseKey = senderBaseKeyPublic
 }
 
 // Version returns the session's version.
@@ -152,8 +216,15 @@ func (s *State) Version() int {
 }
 
 // SetVersion sets the session state's version number.
-func (s *State) SetVersion(version int) {
-	s.sessionVersion = version
+func (s *State) SetVersion(sessionVersion int) {
+	s.sessionVersion = sessionVersion
+}
+
+// VersionParameters returns the parameter set for the session state's
+// version. This determines the KDF info, MAC layout and cipher used by the
+// session. States of legacy versions return read-only parameters.
+func (s *State) VersionParameters() (*version.Parameters, error) {
+	return version.Lookup(s.sessionVersion)
 }
 
 // RemoteIdentityKey returns the identity key of the remote user.
@@ -199,6 +270,90 @@ func (s *State) SetRootKey(rootKey session.RootKeyable) {
 	s.rootKey = rootKey.(*root.Key)
 }
 
+// NeedsRefresh returns true if a new sender ratchet key should be generated
+// before the next message is encrypted.
+func (s *State) NeedsRefresh() bool {
+	return s.needsRefresh
+}
+
+// SetNeedsRefresh sets whether a new sender ratchet key should be generated
+// before the next message is encrypted.
+func (s *State) SetNeedsRefresh(needsRefresh bool) {
+	s.needsRefresh = needsRefresh
+}
+
+// Superseded returns true if this state lost to another state after both
+// sides initiated a session at once. A superseded state still decrypts
+// messages, but never becomes the current state again.
+func (s *State) Superseded() bool {
+	return s.superseded
+}
+
+// SetSuperseded marks the state as superseded by another state.
+func (s *State) SetSuperseded(superseded bool) {
+	s.superseded = superseded
+}
+
+// HeaderEncrypted returns true if the session encrypts message headers.
+func (s *State) HeaderEncrypted() bool {
+	return s.nextReceiverHeaderKey != nil
+}
+
+// SetHeaderKeys will set the header keys of a header encrypted session. The
+// sender header key encrypts the headers of our current sender chain, and
+// is nil until we have a sender chain the remote side can follow. The next
+// header keys are used by the next sender and receiver chains.
+func (s *State) SetHeaderKeys(senderKey, nextSenderKey, nextReceiverKey []byte) {
+	s.senderHeaderKey = senderKey
+	s.nextSenderHeaderKey = nextSenderKey
+	s.nextReceiverHeaderKey = nextReceiverKey
+}
+
+// SenderHeaderKey returns the key used to encrypt the headers of our
+// messages.
+func (s *State) SenderHeaderKey() []byte {
+	return s.senderHeaderKey
+}
+
+// NextSenderHeaderKey returns the header key of our next sender chain.
+func (s *State) NextSenderHeaderKey() []byte {
+	return s.nextSenderHeaderKey
+}
+
+// NextReceiverHeaderKey returns the header key of the remote side's next
+// sender chain.
+func (s *State) NextReceiverHeaderKey() []byte {
+	return s.nextReceiverHeaderKey
+}
+
+// ReceiverHeaderKeys returns the header keys of our receiver chains, newest
+// first. Messages skipped on these chains are found by their header key.
+func (s *State) ReceiverHeaderKeys() [][]byte {
+	headerKeys := make([][]byte, 0, len(s.receiverChains))
+	for i := len(s.receiverChains) - 1; i >= 0; i-- {
+		if s.receiverChains[i].headerKey != nil {
+			headerKeys = append(headerKeys, s.receiverChains[i].headerKey)
+		}
+	}
+
+	return headerKeys
+}
+
+// RemoteRatchetKey returns the sender ratchet key of the most recent receiver
+// chain, or nil if there are no receiver chains.
+func (s *State) RemoteRatchetKey() ecc.ECPublicKeyable {
+	if len(s.receiverChains) == 0 {
+		return nil
+	}
+	return s.receiverChains[len(s.receiverChains)-1].senderRatchetKeyPair.PublicKey()
+}
+
+// SenderChainTimestamp returns the time the sender chain was created as a
+// unix timestamp.
+func (s *State) SenderChainTimestamp() int64 {
+	return s.senderChainTimestamp
+}
+
 // SenderRatchetKey returns the public ratchet key of the sender.
 func (s *State) SenderRatchetKey() ecc.ECPublicKeyable {
 	return s.senderChain.senderRatchetKeyPair.PublicKey()
@@ -280,6 +435,15 @@ func (s *State) AddReceiverChain(senderRatchetKey ecc.ECPublicKeyable, chainKey
 	}
 }
 
+// AddReceiverChainWithHeaderKey will add the given ratchet key, chain key and
+// header key to the session state.
+func (s *State) AddReceiverChainWithHeaderKey(senderRatchetKey ecc.ECPublicKeyable, chainKey session.ChainKeyable,
+	headerKey []byte) {
+
+	s.AddReceiverChain(senderRatchetKey, chainKey)
+	s.receiverChains[len(s.receiverChains)-1].headerKey = headerKey
+}
+
 // SetSenderChain will set the given ratchet key pair and chain key for this session
 // state.
 func (s *State) SetSenderChain(senderRatchetKeyPair *ecc.ECKeyPair, chainKey session.ChainKeyable) {
@@ -289,6 +453,37 @@ func (s *State) SetSenderChain(senderRatchetKeyPair *ecc.ECKeyPair, chainKey ses
 
 	// Set the sender chain.
 	s.senderChain = chain
+	s.senderChainTimestamp = time.Now().Unix()
+	s.senderRefreshKey = nil
+	s.senderRefreshParentKey = nil
+}
+
+// RefreshSenderChain replaces the chain key of our sender chain with the
+// given refreshed chain key. Our ratchet key pair is kept for the next DH
+// ratchet step, and messages on the refreshed chain carry the given refresh
+// key instead of it.
+func (s *State) RefreshSenderChain(refreshKey ecc.ECPublicKeyable, chainKey session.ChainKeyable) {
+	s.senderRefreshParentKey = s.SenderChainRatchetKey()
+	s.senderRefreshKey = refreshKey
+	s.senderChain.chainKey = chainKey.(*chain.Key)
+	s.senderChainTimestamp = time.Now().Unix()
+}
+
+// SenderChainRatchetKey returns the ratchet key that messages on our sender
+// chain carry. This is the refresh key of a refreshed sender chain, and our
+// ratchet key otherwise.
+func (s *State) SenderChainRatchetKey() ecc.ECPublicKeyable {
+	if s.senderRefreshKey != nil {
+		return s.senderRefreshKey
+	}
+	return s.SenderRatchetKey()
+}
+
+// SenderRefreshParentKey returns the ratchet key of the sender chain that
+// our refreshed sender chain replaced, or nil if the sender chain hasn't
+// been refreshed since the last DH ratchet step.
+func (s *State) SenderRefreshParentKey() ecc.ECPublicKeyable {
+	return s.senderRefreshParentKey
 }
 
 // SenderChainKey will return the chain key of the session state.
@@ -370,8 +565,9 @@ func (s *State) RemoveMessageKeys(senderEphemeral ecc.ECPublicKeyable, counter u
 }
 
 // SetMessageKeys will update the chain associated with the given sender key with
-// the given message keys.
-func (s *State) SetMessageKeys(senderEphemeral ecc.ECPublicKeyable, messageKeys *message.Keys) {
+// the given message keys. It returns true if the oldest message keys were
+// dropped to make room.
+func (s *State) SetMessageKeys(senderEphemeral ecc.ECPublicKeyable, messageKeys *message.Keys) bool {
 	chainAndIndex := s.receiverChain(senderEphemeral)
 	chainState := chainAndIndex.ReceiverChain
 
@@ -387,7 +583,9 @@ func (s *State) SetMessageKeys(senderEphemeral ecc.ECPublicKeyable, messageKeys
 
 	if len(chainState.MessageKeys()) > maxMessageKeys {
 		chainState.PopFirstMessageKeys()
+		return true
 	}
+	return false
 }
 
 // SetReceiverChainKey sets the session's receiver chain key with the given chain key
@@ -491,6 +689,12 @@ func (s *State) LocalRegistrationID() uint32 {
 	return s.localRegistrationID
 }
 
+// Copy returns a deep copy of the state, so that it can be changed without
+// changing this state.
+func (s *State) Copy() (*State, error) {
+	return NewStateFromStructure(s.structure(), s.serializer)
+}
+
 // Serialize will return the state as bytes using the given serializer.
 func (s *State) Serialize() []byte {
 	return s.serializer.Serialize(s.structure())
@@ -511,20 +715,47 @@ func (s *State) structure() *StateStructure {
 		pendingKeyExchange = s.pendingKeyExchange.structure()
 	}
 
-	// Build and return our state structure.
-	return &StateStructure{
-		LocalIdentityPublic:  s.localIdentityPublic.Serialize(),
+	// Build our state structure.
+	structure := &StateStructure{
 		LocalRegistrationID:  s.localRegistrationID,
 		NeedsRefresh:         s.needsRefresh,
 		PendingKeyExchange:   pendingKeyExchange,
-		PendingPreKey:        s.pendingPreKey.structure(),
 		PreviousCounter:      s.previousCounter,
 		ReceiverChains:       receiverChains,
-		RemoteIdentityPublic: s.remoteIdentityPublic.Serialize(),
 		RemoteRegistrationID: s.remoteRegistrationID,
-		RootKey:              s.rootKey.Bytes(),
-		SenderBaseKey:        s.senderBaseKey.Serialize(),
-		SenderChain:          s.senderChain.structure(),
+		SenderChainTimestamp: s.senderChainTimestamp,
 		SessionVersion:       s.sessionVersion,
+		Superseded:           s.superseded,
+	}
+
+	// Only include the fields that have been set. A fresh state has none of them.
+	if s.localIdentityPublic != nil {
+		structure.LocalIdentityPublic = s.localIdentityPublic.Serialize()
+	}
+	if s.remoteIdentityPublic != nil {
+		structure.RemoteIdentityPublic = s.remoteIdentityPublic.Serialize()
+	}
+	if s.pendingPreKey != nil {
+		structure.PendingPreKey = s.pendingPreKey.structure()
+	}
+	if s.rootKey != nil {
+		structure.RootKey = s.rootKey.Bytes()
 	}
+	if s.senderBaseKey != nil {
+		structure.SenderBaseKey = s.senderBaseKey.Serialize()
+	}
+	if s.senderChain != nil {
+		structure.SenderChain = s.senderChain.structure()
+	}
+	if s.HeaderEncrypted() {
+		structure.SenderHeaderKey = s.senderHeaderKey
+		structure.NextSenderHeaderKey = s.nextSenderHeaderKey
+		structure.NextReceiverHeaderKey = s.nextReceiverHeaderKey
+	}
+	if s.senderRefreshKey != nil {
+		structure.SenderRefreshKey = s.senderRefreshKey.Serialize()
+		structure.SenderRefreshParentKey = s.senderRefreshParentKey.Serialize()
+	}
+
+	return structure
 }
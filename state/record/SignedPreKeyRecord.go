@@ -3,6 +3,7 @@ package record
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 )
 
 // SignedPreKeySerializer is an interface for serializing and deserializing
@@ -30,6 +31,16 @@ func NewSignedPreKeyFromBytes(serialized []byte, serializer SignedPreKeySerializ
 func NewSignedPreKeyFromStruct(structure *SignedPreKeyStructure,
 	serializer SignedPreKeySerializer) (*SignedPreKey, error) {
 
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("SignedPreKey", "Structure", errorhelper.ErrMissingField)
+	}
+	errors := errorhelper.NewMultiError()
+	errors.Add(errorhelper.CheckLength("SignedPreKey", "PrivateKey", structure.PrivateKey, 32))
+	errors.Add(errorhelper.CheckLength("SignedPreKey", "Signature", structure.Signature, 64))
+	if errors.HasErrors() {
+		return nil, errors
+	}
+
 	// Create the signed prekey record from the structure.
 	signedPreKey := &SignedPreKey{
 		structure:  *structure,
@@ -38,7 +49,10 @@ func NewSignedPreKeyFromStruct(structure *SignedPreKeyStructure,
 	}
 
 	// Generate the ECC key from bytes.
-	publicKey := ecc.NewDjbECPublicKey(bytehelper.SliceToArray(structure.PublicKey))
+	publicKey, err := ecc.DecodePoint(structure.PublicKey, 0)
+	if err != nil {
+		return nil, err
+	}
 	privateKey := ecc.NewDjbECPrivateKey(bytehelper.SliceToArray(structure.PrivateKey))
 	keyPair := ecc.NewECKeyPair(publicKey, privateKey)
 	signedPreKey.keyPair = keyPair
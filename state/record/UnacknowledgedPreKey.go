@@ -2,6 +2,7 @@ package record
 
 import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
 )
 
@@ -17,14 +18,22 @@ func NewUnackPreKeyMessageItems(preKeyID *optional.Uint32, signedPreKeyID uint32
 }
 
 // NewUnackPreKeyMessageItemsFromStruct will return a new unacknowledged prekey
-// message items object from the given structure.
-func NewUnackPreKeyMessageItemsFromStruct(structure *UnackPreKeyMessageItemsStructure) *UnackPreKeyMessageItems {
-	baseKey, _ := ecc.DecodePoint(structure.BaseKey, 0)
+// message items object from the given structure. An error is returned if
+// the base key is malformed.
+func NewUnackPreKeyMessageItemsFromStruct(structure *UnackPreKeyMessageItemsStructure) (*UnackPreKeyMessageItems, error) {
+	if structure == nil {
+		return nil, errorhelper.NewDecodeError("UnackPreKeyMessageItems", "Structure", errorhelper.ErrMissingField)
+	}
+	baseKey, err := ecc.DecodePoint(structure.BaseKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	return NewUnackPreKeyMessageItems(
 		structure.PreKeyID,
 		structure.SignedPreKeyID,
 		baseKey,
-	)
+	), nil
 }
 
 // UnackPreKeyMessageItemsStructure is a serializable structure for unackowledged
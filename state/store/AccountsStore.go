@@ -0,0 +1,22 @@
+package store
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+)
+
+// Accounts is a backend that hosts the stores of many local accounts, such
+// as a database shared by every identity of a service. Each account has its
+// own identity, prekeys, sessions and sender keys, and nothing stored for one
+// account is visible to another. Use the storetest package to check an
+// implementation.
+type Accounts interface {
+	// Create an empty store for a new local account with the given identity
+	// key pair and registration ID. It fails if the account already exists.
+	CreateAccount(accountID string, identityKeyPair *identity.KeyPair, registrationID uint32) (SignalProtocol, error)
+
+	// Return the store of the given local account, or nil if there is none.
+	Account(accountID string) SignalProtocol
+
+	// Delete the given local account and everything stored for it.
+	RemoveAccount(accountID string)
+}
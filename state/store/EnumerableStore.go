@@ -0,0 +1,46 @@
+package store
+
+import (
+	groupStore "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// EnumerablePreKey is a PreKey store that can list every stored prekey.
+type EnumerablePreKey interface {
+	PreKey
+
+	// Load every prekey record in the store.
+	LoadPreKeys() []*record.PreKey
+}
+
+// EnumerableSession is a Session store that can list every stored session.
+type EnumerableSession interface {
+	Session
+
+	// Load the addresses of every session in the store.
+	LoadSessionAddresses() []*protocol.SignalAddress
+}
+
+// EnumerableIdentityKey is an IdentityKey store that can list every trusted
+// remote identity.
+type EnumerableIdentityKey interface {
+	IdentityKey
+
+	// Load the addresses of every saved remote identity.
+	LoadIdentityAddresses() []*protocol.SignalAddress
+
+	// Load the saved identity key for the given address, or nil if there is none.
+	LoadIdentity(address *protocol.SignalAddress) *identity.Key
+}
+
+// EnumerableSignalProtocol is a SignalProtocol store whose contents can be
+// listed in full, for example to write a backup.
+type EnumerableSignalProtocol interface {
+	SignalProtocol
+	EnumerableIdentityKey
+	EnumerablePreKey
+	EnumerableSession
+	groupStore.EnumerableSenderKey
+}
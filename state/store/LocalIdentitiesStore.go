@@ -0,0 +1,17 @@
+package store
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// LocalIdentities holds a store for each local identity of an account, such
+// as its ACI and its PNI. Each identity has its own identity key pair,
+// registration ID, prekeys and sessions.
+type LocalIdentities interface {
+	// Return the store of the local identity with the given service ID, or
+	// nil if the service ID is not one of ours.
+	IdentityStore(localServiceID protocol.ServiceID) SignalProtocol
+
+	// Return the service IDs of every local identity.
+	LocalServiceIDs() []protocol.ServiceID
+}
@@ -7,6 +7,13 @@ import (
 
 // Session store is an interface for the persistent storage of session
 // state information for remote clients.
+//
+// Addresses must be compared by value: two different pointers to equal
+// addresses refer to the same session. LoadSession must return a fresh
+// record rather than nil when there is no session for the address, and
+// GetSubDeviceSessions returns every device ID other than 1 that has a
+// session under the given name. Use the storetest package to check an
+// implementation.
 type Session interface {
 	LoadSession(address *protocol.SignalAddress) *record.Session
 	GetSubDeviceSessions(name string) []uint32
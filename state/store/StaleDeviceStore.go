@@ -0,0 +1,24 @@
+package store
+
+import (
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// StaleDevice store is an interface for storing the remote devices that a
+// session manager marked stale, with the time each one was marked.
+type StaleDevice interface {
+	// Load the time the given device was marked stale, and whether it is
+	// stale.
+	LoadStaleDevice(address *protocol.SignalAddress) (time.Time, bool)
+
+	// Load the addresses of every stale device.
+	LoadStaleDeviceAddresses() []*protocol.SignalAddress
+
+	// Store the time the given device was marked stale.
+	StoreStaleDevice(address *protocol.SignalAddress, since time.Time)
+
+	// Delete the given device, marking it as active again.
+	DeleteStaleDevice(address *protocol.SignalAddress)
+}
@@ -0,0 +1,85 @@
+package memstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+const accountExistsError string = "Account already exists: "
+
+// Ensure the in-memory backend implements the accounts interface.
+var _ store.Accounts = (*Accounts)(nil)
+
+// NewAccounts returns a new in-memory backend for the stores of many local
+// accounts, which uses the given serializer to store their records.
+func NewAccounts(serializer *serialize.Serializer) *Accounts {
+	return &Accounts{
+		accounts:   make(map[string]*SignalProtocol),
+		serializer: serializer,
+	}
+}
+
+// Accounts is an in-memory backend partitioned by account ID. Each account
+// gets its own in-memory store, so accounts never share a record.
+type Accounts struct {
+	mutex      sync.RWMutex
+	accounts   map[string]*SignalProtocol
+	serializer *serialize.Serializer
+}
+
+// CreateAccount creates an empty store for a new local account.
+func (a *Accounts) CreateAccount(accountID string, identityKeyPair *identity.KeyPair,
+	registrationID uint32) (store.SignalProtocol, error) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.accounts[accountID]; ok {
+		return nil, errors.New(accountExistsError + accountID)
+	}
+	account := NewSignalProtocol(identityKeyPair, registrationID, a.serializer)
+	a.accounts[accountID] = account
+
+	return account, nil
+}
+
+// Account returns the store of the given local account, or nil if there is
+// none.
+func (a *Accounts) Account(accountID string) store.SignalProtocol {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	account, ok := a.accounts[accountID]
+	if !ok {
+		return nil
+	}
+
+	return account
+}
+
+// AccountIDs returns the IDs of every account, in order.
+func (a *Accounts) AccountIDs() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	accountIDs := make([]string, 0, len(a.accounts))
+	for accountID := range a.accounts {
+		accountIDs = append(accountIDs, accountID)
+	}
+	sort.Strings(accountIDs)
+
+	return accountIDs
+}
+
+// RemoveAccount deletes the given local account and its store.
+func (a *Accounts) RemoveAccount(accountID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.accounts, accountID)
+}
@@ -0,0 +1,59 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+)
+
+// Ensure the in-memory device list store implements the interface.
+var _ devicelist.Store = (*DeviceList)(nil)
+
+// NewDeviceList returns a new in-memory store of accepted device lists that
+// uses the given serializer to store them.
+func NewDeviceList(serializer *serialize.Serializer) *DeviceList {
+	return &DeviceList{
+		lists:      make(map[string][]byte),
+		serializer: serializer,
+	}
+}
+
+// DeviceList is an in-memory store of the accepted device lists of remote
+// users.
+type DeviceList struct {
+	mutex      sync.RWMutex
+	lists      map[string][]byte
+	serializer *serialize.Serializer
+}
+
+// LoadDeviceList returns the accepted device list of the given user, or nil
+// if there is none.
+func (d *DeviceList) LoadDeviceList(name string) *devicelist.List {
+	d.mutex.RLock()
+	serialized, ok := d.lists[name]
+	d.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	list, err := devicelist.NewListFromBytes(serialized, d.serializer.DeviceList)
+	if err != nil {
+		logger.Error("Unable to deserialize stored device list for ", name, ": ", err)
+		return nil
+	}
+
+	return list
+}
+
+// StoreDeviceList stores the given list as the accepted device list of the
+// given user.
+func (d *DeviceList) StoreDeviceList(name string, list *devicelist.List) {
+	serialized := list.Serialize(d.serializer.DeviceList)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lists[name] = serialized
+}
@@ -0,0 +1,8 @@
+// Package memstore provides thread-safe, in-memory implementations of every
+// Signal Protocol store.
+//
+// Records are kept in their serialized form and deserialized on every load,
+// so a record is only changed in the store when it is stored again, and
+// callers never share a record with another goroutine. Addresses and sender
+// key names are keyed by value, so equal addresses always find the same record.
+package memstore
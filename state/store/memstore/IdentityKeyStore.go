@@ -0,0 +1,77 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// NewIdentityKey returns a new in-memory identity key store for the given
+// local identity key pair and registration ID.
+func NewIdentityKey(identityKeyPair *identity.KeyPair, localRegistrationID uint32) *IdentityKey {
+	return &IdentityKey{
+		trustedKeys:         make(map[protocol.SignalAddress]*identity.Key),
+		identityKeyPair:     identityKeyPair,
+		localRegistrationID: localRegistrationID,
+	}
+}
+
+// IdentityKey is an in-memory store of the local identity and the
+// identities of remote clients.
+type IdentityKey struct {
+	mutex               sync.RWMutex
+	trustedKeys         map[protocol.SignalAddress]*identity.Key
+	identityKeyPair     *identity.KeyPair
+	localRegistrationID uint32
+}
+
+// GetIdentityKeyPair returns the local client's identity key pair.
+func (i *IdentityKey) GetIdentityKeyPair() *identity.KeyPair {
+	return i.identityKeyPair
+}
+
+// GetLocalRegistrationId returns the local client's registration ID.
+func (i *IdentityKey) GetLocalRegistrationId() uint32 {
+	return i.localRegistrationID
+}
+
+// SaveIdentity saves a remote client's identity key.
+func (i *IdentityKey) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.trustedKeys[*address] = identityKey
+}
+
+// IsTrustedIdentity returns true if there is no saved identity for the given
+// address, or if the saved identity matches the given one.
+func (i *IdentityKey) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	trusted := i.trustedKeys[*address]
+	return trusted == nil || trusted.Fingerprint() == identityKey.Fingerprint()
+}
+
+// LoadIdentityAddresses returns the addresses of every saved remote identity.
+func (i *IdentityKey) LoadIdentityAddresses() []*protocol.SignalAddress {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	addresses := make([]*protocol.SignalAddress, 0, len(i.trustedKeys))
+	for address := range i.trustedKeys {
+		addresses = append(addresses, &address)
+	}
+
+	return addresses
+}
+
+// LoadIdentity returns the saved identity for the given address, or nil if
+// there is none.
+func (i *IdentityKey) LoadIdentity(address *protocol.SignalAddress) *identity.Key {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.trustedKeys[*address]
+}
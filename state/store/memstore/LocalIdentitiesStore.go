@@ -0,0 +1,89 @@
+package memstore
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// Ensure the in-memory local identities implement the interface.
+var _ store.LocalIdentities = (*LocalIdentities)(nil)
+
+// NewLocalIdentities returns a new, empty set of in-memory local identity
+// stores, which use the given serializer to store their records.
+func NewLocalIdentities(serializer *serialize.Serializer) *LocalIdentities {
+	return &LocalIdentities{
+		identities: make(map[protocol.ServiceID]*SignalProtocol),
+		serializer: serializer,
+	}
+}
+
+// LocalIdentities keeps an in-memory store for each local identity of an
+// account.
+type LocalIdentities struct {
+	mutex      sync.RWMutex
+	identities map[protocol.ServiceID]*SignalProtocol
+	serializer *serialize.Serializer
+}
+
+// AddIdentity adds an empty store for the local identity with the given
+// service ID, identity key pair and registration ID, replacing any store the
+// service ID had.
+func (l *LocalIdentities) AddIdentity(localServiceID protocol.ServiceID, identityKeyPair *identity.KeyPair,
+	registrationID uint32) *SignalProtocol {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	identityStore := NewSignalProtocol(identityKeyPair, registrationID, l.serializer)
+	l.identities[localServiceID] = identityStore
+
+	return identityStore
+}
+
+// IdentityStore returns the store of the local identity with the given
+// service ID, or nil if there is none.
+func (l *LocalIdentities) IdentityStore(localServiceID protocol.ServiceID) store.SignalProtocol {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	identityStore, ok := l.identities[localServiceID]
+	if !ok {
+		return nil
+	}
+
+	return identityStore
+}
+
+// LocalServiceIDs returns the service IDs of every local identity, the ACI
+// first.
+func (l *LocalIdentities) LocalServiceIDs() []protocol.ServiceID {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	serviceIDs := make([]protocol.ServiceID, 0, len(l.identities))
+	for serviceID := range l.identities {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Slice(serviceIDs, func(i, j int) bool {
+		if serviceIDs[i].Kind() != serviceIDs[j].Kind() {
+			return serviceIDs[i].Kind() < serviceIDs[j].Kind()
+		}
+		return serviceIDs[i].String() < serviceIDs[j].String()
+	})
+
+	return serviceIDs
+}
+
+// RemoveIdentity deletes the local identity with the given service ID and
+// its store.
+func (l *LocalIdentities) RemoveIdentity(localServiceID protocol.ServiceID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.identities, localServiceID)
+}
@@ -0,0 +1,66 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+	groupStore "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+)
+
+// Ensure the in-memory MLS group store implements the interface.
+var _ groupStore.MLSGroup = (*MLSGroup)(nil)
+
+// NewMLSGroup returns a new in-memory store of MLS groups joined with the
+// given identity key pair.
+func NewMLSGroup(identityKeyPair *identity.KeyPair) *MLSGroup {
+	return &MLSGroup{
+		store:           make(map[string][]byte),
+		identityKeyPair: identityKeyPair,
+	}
+}
+
+// MLSGroup is an in-memory store of MLS group state.
+type MLSGroup struct {
+	mutex           sync.RWMutex
+	store           map[string][]byte
+	identityKeyPair *identity.KeyPair
+}
+
+// StoreMLSGroup stores the given group under the given ID.
+func (m *MLSGroup) StoreMLSGroup(groupID []byte, group *mls.Group) {
+	serialized := group.Serialize()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.store[string(groupID)] = serialized
+}
+
+// LoadMLSGroup returns a copy of the group with the given ID, or nil if
+// there is none.
+func (m *MLSGroup) LoadMLSGroup(groupID []byte) *mls.Group {
+	m.mutex.RLock()
+	serialized, ok := m.store[string(groupID)]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	group, err := mls.NewGroupFromBytes(serialized, m.identityKeyPair)
+	if err != nil {
+		logger.Error("Unable to deserialize stored MLS group: ", err)
+		return nil
+	}
+
+	return group
+}
+
+// DeleteMLSGroup deletes the group with the given ID.
+func (m *MLSGroup) DeleteMLSGroup(groupID []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.store, string(groupID))
+}
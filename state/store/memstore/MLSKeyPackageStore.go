@@ -0,0 +1,66 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+	groupStore "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+)
+
+// Ensure the in-memory MLS key package store implements the interface.
+var _ groupStore.MLSKeyPackage = (*MLSKeyPackage)(nil)
+
+// NewMLSKeyPackage returns a new in-memory store of MLS key package
+// records.
+func NewMLSKeyPackage() *MLSKeyPackage {
+	return &MLSKeyPackage{
+		store: make(map[string][]byte),
+	}
+}
+
+// MLSKeyPackage is an in-memory store of the local client's MLS key
+// package records.
+type MLSKeyPackage struct {
+	mutex sync.RWMutex
+	store map[string][]byte
+}
+
+// StoreMLSKeyPackage stores the given record under the given key package
+// reference.
+func (m *MLSKeyPackage) StoreMLSKeyPackage(ref []byte, keyPackage *mls.KeyPackageRecord) {
+	serialized := keyPackage.Serialize()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.store[string(ref)] = serialized
+}
+
+// LoadMLSKeyPackage returns the record with the given key package
+// reference, or nil if there is none.
+func (m *MLSKeyPackage) LoadMLSKeyPackage(ref []byte) *mls.KeyPackageRecord {
+	m.mutex.RLock()
+	serialized, ok := m.store[string(ref)]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	keyPackage, err := mls.NewKeyPackageRecordFromBytes(serialized)
+	if err != nil {
+		logger.Error("Unable to deserialize stored MLS key package: ", err)
+		return nil
+	}
+
+	return keyPackage
+}
+
+// RemoveMLSKeyPackage removes the record with the given key package
+// reference.
+func (m *MLSKeyPackage) RemoveMLSKeyPackage(ref []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.store, string(ref))
+}
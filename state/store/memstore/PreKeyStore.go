@@ -0,0 +1,90 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// NewPreKey returns a new in-memory prekey store that uses the given
+// serializer to store its records.
+func NewPreKey(serializer *serialize.Serializer) *PreKey {
+	return &PreKey{
+		store:      make(map[uint32][]byte),
+		serializer: serializer,
+	}
+}
+
+// PreKey is an in-memory store of the local client's prekeys.
+type PreKey struct {
+	mutex      sync.RWMutex
+	store      map[uint32][]byte
+	serializer *serialize.Serializer
+}
+
+// LoadPreKey returns the prekey with the given ID, or nil if there is none.
+func (p *PreKey) LoadPreKey(preKeyID uint32) *record.PreKey {
+	p.mutex.RLock()
+	serialized, ok := p.store[preKeyID]
+	p.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return p.deserialize(serialized)
+}
+
+// LoadPreKeys returns every prekey in the store.
+func (p *PreKey) LoadPreKeys() []*record.PreKey {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	preKeys := make([]*record.PreKey, 0, len(p.store))
+	for _, serialized := range p.store {
+		if preKey := p.deserialize(serialized); preKey != nil {
+			preKeys = append(preKeys, preKey)
+		}
+	}
+
+	return preKeys
+}
+
+// StorePreKey stores the given prekey under the given ID.
+func (p *PreKey) StorePreKey(preKeyID uint32, preKeyRecord *record.PreKey) {
+	serialized := preKeyRecord.Serialize()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.store[preKeyID] = serialized
+}
+
+// ContainsPreKey returns true if a prekey with the given ID is stored.
+func (p *PreKey) ContainsPreKey(preKeyID uint32) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	_, ok := p.store[preKeyID]
+	return ok
+}
+
+// RemovePreKey removes the prekey with the given ID.
+func (p *PreKey) RemovePreKey(preKeyID uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.store, preKeyID)
+}
+
+// deserialize returns the prekey from the given stored bytes.
+func (p *PreKey) deserialize(serialized []byte) *record.PreKey {
+	preKey, err := record.NewPreKeyFromBytes(serialized, p.serializer.PreKeyRecord)
+	if err != nil {
+		logger.Error("Unable to deserialize stored prekey: ", err)
+		return nil
+	}
+
+	return preKey
+}
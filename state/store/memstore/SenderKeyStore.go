@@ -0,0 +1,73 @@
+package memstore
+
+import (
+	"sync"
+
+	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+)
+
+// NewSenderKey returns a new in-memory sender key store that uses the given
+// serializer to store its records.
+func NewSenderKey(serializer *serialize.Serializer) *SenderKey {
+	return &SenderKey{
+		store:      make(map[protocol.SenderKeyName][]byte),
+		serializer: serializer,
+	}
+}
+
+// SenderKey is an in-memory store of group sender keys.
+type SenderKey struct {
+	mutex      sync.RWMutex
+	store      map[protocol.SenderKeyName][]byte
+	serializer *serialize.Serializer
+}
+
+// StoreSenderKey stores the given sender key under the given name.
+func (s *SenderKey) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+	serialized := keyRecord.Serialize()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.store[*senderKeyName] = serialized
+}
+
+// LoadSenderKey returns a copy of the sender key with the given name. If
+// there is none, an empty record is returned.
+func (s *SenderKey) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+	s.mutex.RLock()
+	serialized, ok := s.store[*senderKeyName]
+	s.mutex.RUnlock()
+	if !ok {
+		return s.newSenderKey()
+	}
+
+	senderKey, err := groupRecord.NewSenderKeyFromBytes(serialized, s.serializer.SenderKeyRecord, s.serializer.SenderKeyState)
+	if err != nil {
+		logger.Error("Unable to deserialize stored sender key for ", senderKeyName.GroupID(), ": ", err)
+		return s.newSenderKey()
+	}
+
+	return senderKey
+}
+
+// LoadSenderKeyNames returns the names of every stored sender key.
+func (s *SenderKey) LoadSenderKeyNames() []*protocol.SenderKeyName {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names := make([]*protocol.SenderKeyName, 0, len(s.store))
+	for name := range s.store {
+		names = append(names, &name)
+	}
+
+	return names
+}
+
+// newSenderKey returns an empty sender key record.
+func (s *SenderKey) newSenderKey() *groupRecord.SenderKey {
+	return groupRecord.NewSenderKey(s.serializer.SenderKeyRecord, s.serializer.SenderKeyState)
+}
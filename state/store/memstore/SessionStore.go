@@ -0,0 +1,119 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// defaultDeviceID is the device ID of a user's primary device, which is not
+// counted as a sub device.
+const defaultDeviceID uint32 = 1
+
+// NewSession returns a new in-memory session store that uses the given
+// serializer to store its records.
+func NewSession(serializer *serialize.Serializer) *Session {
+	return &Session{
+		sessions:   make(map[protocol.SignalAddress][]byte),
+		serializer: serializer,
+	}
+}
+
+// Session is an in-memory store of sessions with remote clients.
+type Session struct {
+	mutex      sync.RWMutex
+	sessions   map[protocol.SignalAddress][]byte
+	serializer *serialize.Serializer
+}
+
+// LoadSession returns a copy of the session for the given address. If there
+// is no session, a fresh one is returned. It is not stored until StoreSession
+// is called.
+func (s *Session) LoadSession(address *protocol.SignalAddress) *record.Session {
+	s.mutex.RLock()
+	serialized, ok := s.sessions[*address]
+	s.mutex.RUnlock()
+	if !ok {
+		return s.newSession()
+	}
+
+	sessionRecord, err := record.NewSessionFromBytes(serialized, s.serializer.Session, s.serializer.State)
+	if err != nil {
+		logger.Error("Unable to deserialize stored session for ", address, ": ", err)
+		return s.newSession()
+	}
+
+	return sessionRecord
+}
+
+// LoadSessionAddresses returns the addresses of every stored session.
+func (s *Session) LoadSessionAddresses() []*protocol.SignalAddress {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	addresses := make([]*protocol.SignalAddress, 0, len(s.sessions))
+	for address := range s.sessions {
+		addresses = append(addresses, &address)
+	}
+
+	return addresses
+}
+
+// GetSubDeviceSessions returns the device IDs of every session with the
+// given name, other than the primary device.
+func (s *Session) GetSubDeviceSessions(name string) []uint32 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var deviceIDs []uint32
+	for address := range s.sessions {
+		if address.Name() == name && address.DeviceID() != defaultDeviceID {
+			deviceIDs = append(deviceIDs, address.DeviceID())
+		}
+	}
+
+	return deviceIDs
+}
+
+// StoreSession stores the given session for the given address.
+func (s *Session) StoreSession(remoteAddress *protocol.SignalAddress, sessionRecord *record.Session) {
+	serialized := sessionRecord.Serialize()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[*remoteAddress] = serialized
+}
+
+// ContainsSession returns true if a session is stored for the given address.
+func (s *Session) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.sessions[*remoteAddress]
+	return ok
+}
+
+// DeleteSession removes the session for the given address.
+func (s *Session) DeleteSession(remoteAddress *protocol.SignalAddress) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, *remoteAddress)
+}
+
+// DeleteAllSessions removes every stored session.
+func (s *Session) DeleteAllSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions = make(map[protocol.SignalAddress][]byte)
+}
+
+// newSession returns a fresh session record.
+func (s *Session) newSession() *record.Session {
+	return record.NewSession(s.serializer.Session, s.serializer.State)
+}
@@ -0,0 +1,35 @@
+package memstore
+
+import (
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// Ensure the in-memory stores implement every store interface.
+var _ store.EnumerableSignalProtocol = (*SignalProtocol)(nil)
+
+// NewSignalProtocol returns a new in-memory store for the given local
+// identity key pair and registration ID, which uses the given serializer
+// to store its records.
+func NewSignalProtocol(identityKeyPair *identity.KeyPair, localRegistrationID uint32,
+	serializer *serialize.Serializer) *SignalProtocol {
+
+	return &SignalProtocol{
+		IdentityKey:  NewIdentityKey(identityKeyPair, localRegistrationID),
+		PreKey:       NewPreKey(serializer),
+		Session:      NewSession(serializer),
+		SignedPreKey: NewSignedPreKey(serializer),
+		SenderKey:    NewSenderKey(serializer),
+	}
+}
+
+// SignalProtocol is an in-memory store that implements every store needed
+// in the Signal Protocol. It is safe for concurrent use.
+type SignalProtocol struct {
+	*IdentityKey
+	*PreKey
+	*Session
+	*SignedPreKey
+	*SenderKey
+}
@@ -0,0 +1,91 @@
+package memstore
+
+import (
+	"sync"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// NewSignedPreKey returns a new in-memory signed prekey store that uses the
+// given serializer to store its records.
+func NewSignedPreKey(serializer *serialize.Serializer) *SignedPreKey {
+	return &SignedPreKey{
+		store:      make(map[uint32][]byte),
+		serializer: serializer,
+	}
+}
+
+// SignedPreKey is an in-memory store of the local client's signed prekeys.
+type SignedPreKey struct {
+	mutex      sync.RWMutex
+	store      map[uint32][]byte
+	serializer *serialize.Serializer
+}
+
+// LoadSignedPreKey returns the signed prekey with the given ID, or nil if
+// there is none.
+func (s *SignedPreKey) LoadSignedPreKey(signedPreKeyID uint32) *record.SignedPreKey {
+	s.mutex.RLock()
+	serialized, ok := s.store[signedPreKeyID]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return s.deserialize(serialized)
+}
+
+// LoadSignedPreKeys returns every signed prekey in the store.
+func (s *SignedPreKey) LoadSignedPreKeys() []*record.SignedPreKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	signedPreKeys := make([]*record.SignedPreKey, 0, len(s.store))
+	for _, serialized := range s.store {
+		if signedPreKey := s.deserialize(serialized); signedPreKey != nil {
+			signedPreKeys = append(signedPreKeys, signedPreKey)
+		}
+	}
+
+	return signedPreKeys
+}
+
+// StoreSignedPreKey stores the given signed prekey under the given ID.
+func (s *SignedPreKey) StoreSignedPreKey(signedPreKeyID uint32, signedPreKeyRecord *record.SignedPreKey) {
+	serialized := signedPreKeyRecord.Serialize()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.store[signedPreKeyID] = serialized
+}
+
+// ContainsSignedPreKey returns true if a signed prekey with the given ID is stored.
+func (s *SignedPreKey) ContainsSignedPreKey(signedPreKeyID uint32) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.store[signedPreKeyID]
+	return ok
+}
+
+// RemoveSignedPreKey removes the signed prekey with the given ID.
+func (s *SignedPreKey) RemoveSignedPreKey(signedPreKeyID uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.store, signedPreKeyID)
+}
+
+// deserialize returns the signed prekey from the given stored bytes.
+func (s *SignedPreKey) deserialize(serialized []byte) *record.SignedPreKey {
+	signedPreKey, err := record.NewSignedPreKeyFromBytes(serialized, s.serializer.SignedPreKeyRecord)
+	if err != nil {
+		logger.Error("Unable to deserialize stored signed prekey: ", err)
+		return nil
+	}
+
+	return signedPreKey
+}
@@ -0,0 +1,65 @@
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+)
+
+// Ensure the in-memory stale device store implements the interface.
+var _ store.StaleDevice = (*StaleDevice)(nil)
+
+// NewStaleDevice returns a new in-memory store of stale devices.
+func NewStaleDevice() *StaleDevice {
+	return &StaleDevice{
+		devices: make(map[protocol.SignalAddress]time.Time),
+	}
+}
+
+// StaleDevice is an in-memory store of the remote devices that were marked
+// stale.
+type StaleDevice struct {
+	mutex   sync.RWMutex
+	devices map[protocol.SignalAddress]time.Time
+}
+
+// LoadStaleDevice returns the time the given device was marked stale, and
+// false if it isn't stale.
+func (s *StaleDevice) LoadStaleDevice(address *protocol.SignalAddress) (time.Time, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	since, ok := s.devices[*address]
+	return since, ok
+}
+
+// LoadStaleDeviceAddresses returns the addresses of every stale device.
+func (s *StaleDevice) LoadStaleDeviceAddresses() []*protocol.SignalAddress {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	addresses := make([]*protocol.SignalAddress, 0, len(s.devices))
+	for address := range s.devices {
+		addresses = append(addresses, &address)
+	}
+
+	return addresses
+}
+
+// StoreStaleDevice stores the time the given device was marked stale.
+func (s *StaleDevice) StoreStaleDevice(address *protocol.SignalAddress, since time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.devices[*address] = since
+}
+
+// DeleteStaleDevice deletes the given device from the store.
+func (s *StaleDevice) DeleteStaleDevice(address *protocol.SignalAddress) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.devices, *address)
+}
@@ -0,0 +1,140 @@
+package storetest
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// AccountsFactory returns a new, empty accounts backend whose stores encode
+// records with the given serializer. Every call must return an independent
+// backend.
+type AccountsFactory func(serializer *serialize.Serializer) store.Accounts
+
+// RunAccountsTests runs the conformance suite against accounts backends built
+// with the given factory. The store suite runs against accounts of a single
+// backend, followed by checks that accounts are isolated from each other.
+func RunAccountsTests(t *testing.T, factory AccountsFactory) {
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, factory) })
+	t.Run("Isolation", func(t *testing.T) { testAccountIsolation(t, accountFactory(factory)) })
+	t.Run("SignalProtocol", func(t *testing.T) { RunSignalProtocolStoreTests(t, accountFactory(factory)) })
+}
+
+// accountFactory returns a store factory that creates a new account in a
+// single backend for every call.
+func accountFactory(factory AccountsFactory) Factory {
+	var mutex sync.Mutex
+	var backend store.Accounts
+	count := 0
+
+	return func(identityKeyPair *identity.KeyPair, registrationID uint32, serializer *serialize.Serializer) store.SignalProtocol {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if backend == nil {
+			backend = factory(serializer)
+		}
+		count++
+		account, err := backend.CreateAccount("account-"+strconv.Itoa(count), identityKeyPair, registrationID)
+		if err != nil {
+			return nil
+		}
+		return account
+	}
+}
+
+// testAccounts checks creating, loading and removing accounts.
+func testAccounts(t *testing.T, factory AccountsFactory) {
+	serializer := serialize.NewJSONSerializer()
+	backend := factory(serializer)
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Unable to generate identity key pair: ", err)
+	}
+
+	if backend.Account("alice") != nil {
+		t.Fatal("Account must return nil for an account that doesn't exist.")
+	}
+	created, err := backend.CreateAccount("alice", identityKeyPair, 42)
+	if err != nil || created == nil {
+		t.Fatal("Unable to create account: ", err)
+	}
+	if _, err := backend.CreateAccount("alice", identityKeyPair, 42); err == nil {
+		t.Error("Creating an account that already exists should fail.")
+	}
+
+	// The account's store must hold the account's identity.
+	loaded := backend.Account("alice")
+	if loaded == nil {
+		t.Fatal("Account should return the store of a created account.")
+	}
+	if loaded.GetIdentityKeyPair().PublicKey().Fingerprint() != identityKeyPair.PublicKey().Fingerprint() ||
+		loaded.GetLocalRegistrationId() != 42 {
+		t.Error("The account's store does not match the account's identity.")
+	}
+
+	// Removing an account deletes everything stored for it.
+	loaded.StoreSession(bobAddress(), newTestSession(&account{serializer: serializer, registrationID: 42}, 1))
+	backend.RemoveAccount("alice")
+	if backend.Account("alice") != nil {
+		t.Fatal("A removed account should not be found.")
+	}
+	recreated, err := backend.CreateAccount("alice", identityKeyPair, 42)
+	if err != nil {
+		t.Fatal("Unable to create a removed account again: ", err)
+	}
+	if recreated.ContainsSession(bobAddress()) {
+		t.Error("Removing an account should delete its sessions.")
+	}
+}
+
+// testAccountIsolation runs two conversations between accounts of the same
+// backend that use the same addresses, prekey IDs and group, which only
+// succeeds if nothing is shared between accounts.
+func testAccountIsolation(t *testing.T, factory Factory) {
+	pairs := make([][2]*account, 2)
+	for i := range pairs {
+		pairs[i] = [2]*account{newAccount(t, factory), newAccount(t, factory)}
+	}
+
+	for i, pair := range pairs {
+		alice, bob := pair[0], pair[1]
+		aliceCipher, bobCipher := establishSession(t, alice, bob)
+		exchangeMessages(t, alice, aliceCipher, bobCipher, fmt.Sprint("Alice ", i))
+		distributeSenderKey(t, alice, bob, aliceAddress(), aliceCipher, bobCipher)
+	}
+	for i, pair := range pairs {
+		exchangeGroupMessages(t, pair[0], pair[1], aliceAddress(), fmt.Sprint("Alice group ", i))
+	}
+
+	// Each Alice only trusts her own Bob.
+	for i, pair := range pairs {
+		otherBob := pairs[1-i][1]
+		if pair[0].store.IsTrustedIdentity(bobAddress(), otherBob.identityKeyPair.PublicKey()) {
+			t.Error("An identity saved by one account should not be trusted by another account.")
+		}
+		if pair[0].store.ContainsPreKey(1) || !pair[1].store.ContainsPreKey(2) {
+			t.Error("Prekeys should only be stored for the account that stored them.")
+		}
+	}
+
+	// Each Alice has her own sender key for the group.
+	keyIDs := make([]uint32, len(pairs))
+	for i, pair := range pairs {
+		state, err := pair[0].store.LoadSenderKey(protocol.NewSenderKeyName("group", aliceAddress())).SenderKeyState()
+		if err != nil {
+			t.Fatal("Expected a sender key for the group: ", err)
+		}
+		keyIDs[i] = state.KeyID()
+	}
+	if keyIDs[0] == keyIDs[1] {
+		t.Error("Sender keys should only be stored for the account that stored them.")
+	}
+}
@@ -0,0 +1,68 @@
+package storetest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// concurrentWorkers is the number of goroutines used by the concurrency checks.
+const concurrentWorkers = 16
+
+// testConcurrency checks that a store can be used from many goroutines at
+// once. Run the suite with the race detector to find unsynchronized access.
+func testConcurrency(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+	preKeys := local.generatePreKeys(t, 1, concurrentWorkers)
+	signedPreKey := local.generateSignedPreKey(t, 1)
+	senderKeyRecord := newTestSenderKey(t, local)
+
+	var wait sync.WaitGroup
+	for i := 0; i < concurrentWorkers; i++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+
+			deviceID := uint32(worker + 1)
+			address := protocol.NewSignalAddress("Bob", deviceID)
+			name := protocol.NewSenderKeyName("group", address)
+			for j := 0; j < 10; j++ {
+				signalStore.StorePreKey(preKeys[worker].ID().Value, preKeys[worker])
+				signalStore.LoadPreKey(preKeys[worker].ID().Value)
+				signalStore.StoreSignedPreKey(signedPreKey.ID(), signedPreKey)
+				signalStore.LoadSignedPreKeys()
+
+				signalStore.StoreSession(address, newTestSession(local, deviceID))
+				signalStore.LoadSession(address)
+				signalStore.GetSubDeviceSessions("Bob")
+
+				signalStore.SaveIdentity(address, local.identityKeyPair.PublicKey())
+				signalStore.IsTrustedIdentity(address, local.identityKeyPair.PublicKey())
+
+				signalStore.StoreSenderKey(name, senderKeyRecord)
+				signalStore.LoadSenderKey(name)
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	for i := 0; i < concurrentWorkers; i++ {
+		deviceID := uint32(i + 1)
+		address := protocol.NewSignalAddress("Bob", deviceID)
+		if !signalStore.ContainsPreKey(preKeys[i].ID().Value) {
+			t.Error("Prekey ", preKeys[i].ID().Value, " was lost during concurrent use.")
+		}
+		if !signalStore.ContainsSession(address) ||
+			signalStore.LoadSession(address).SessionState().RemoteRegistrationID() != deviceID {
+			t.Error("Session for ", address, " was lost during concurrent use.")
+		}
+		if signalStore.LoadSenderKey(protocol.NewSenderKeyName("group", address)).IsEmpty() {
+			t.Error("Sender key for ", address, " was lost during concurrent use.")
+		}
+	}
+	if len(signalStore.GetSubDeviceSessions("Bob")) != concurrentWorkers-1 {
+		t.Error("Expected ", concurrentWorkers-1, " sub device sessions, got: ", len(signalStore.GetSubDeviceSessions("Bob")))
+	}
+}
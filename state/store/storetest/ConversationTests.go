@@ -0,0 +1,223 @@
+package storetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+)
+
+// Addresses used for conversations. New address objects are built every
+// time one is needed, so stores that key records by pointer will fail.
+func aliceAddress() *protocol.SignalAddress { return protocol.NewSignalAddress("Alice", 1) }
+func bobAddress() *protocol.SignalAddress   { return protocol.NewSignalAddress("Bob", 1) }
+
+// testConversation checks a full one-to-one conversation between two stores.
+func testConversation(t *testing.T, factory Factory) {
+	alice := newAccount(t, factory)
+	bob := newAccount(t, factory)
+	aliceCipher, bobCipher := establishSession(t, alice, bob)
+
+	// Send a few rounds of messages back and forth, building new ciphers each
+	// round so that all state has to come from the stores.
+	for round := 0; round < 3; round++ {
+		exchangeMessages(t, alice, aliceCipher, bobCipher, fmt.Sprint("Alice round ", round))
+		exchangeMessages(t, bob, bobCipher, aliceCipher, fmt.Sprint("Bob round ", round))
+
+		aliceCipher = newCipher(alice, bobAddress())
+		bobCipher = newCipher(bob, aliceAddress())
+	}
+}
+
+// testGroupConversation checks a group conversation between two stores, with
+// the sender keys distributed over a one-to-one session.
+func testGroupConversation(t *testing.T, factory Factory) {
+	alice := newAccount(t, factory)
+	bob := newAccount(t, factory)
+	aliceCipher, bobCipher := establishSession(t, alice, bob)
+
+	// Each member distributes their sender key to the other.
+	distributeSenderKey(t, alice, bob, aliceAddress(), aliceCipher, bobCipher)
+	distributeSenderKey(t, bob, alice, bobAddress(), bobCipher, aliceCipher)
+
+	for round := 0; round < 3; round++ {
+		exchangeGroupMessages(t, alice, bob, aliceAddress(), fmt.Sprint("Alice group round ", round))
+		exchangeGroupMessages(t, bob, alice, bobAddress(), fmt.Sprint("Bob group round ", round))
+	}
+}
+
+// establishSession builds a session from Alice to Bob using a prekey bundle
+// loaded from Bob's store, and sends one message each way.
+func establishSession(t *testing.T, alice, bob *account) (*session.Cipher, *session.Cipher) {
+	t.Helper()
+
+	// Publish Bob's prekeys into his store.
+	preKeys := bob.generatePreKeys(t, 1, 10)
+	for _, preKey := range preKeys {
+		bob.store.StorePreKey(preKey.ID().Value, preKey)
+	}
+	signedPreKey := bob.generateSignedPreKey(t, 1)
+	bob.store.StoreSignedPreKey(signedPreKey.ID(), signedPreKey)
+
+	// Build Bob's bundle from what his store returns.
+	preKey := bob.store.LoadPreKey(preKeys[0].ID().Value)
+	loadedSignedPreKey := bob.store.LoadSignedPreKey(signedPreKey.ID())
+	if preKey == nil || loadedSignedPreKey == nil {
+		t.Fatal("Unable to load Bob's published prekeys.")
+	}
+	bundle := prekey.NewBundle(
+		bob.store.GetLocalRegistrationId(),
+		bobAddress().DeviceID(),
+		preKey.ID(),
+		loadedSignedPreKey.ID(),
+		preKey.KeyPair().PublicKey(),
+		loadedSignedPreKey.KeyPair().PublicKey(),
+		loadedSignedPreKey.Signature(),
+		bob.store.GetIdentityKeyPair().PublicKey(),
+	)
+
+	// Alice processes the bundle and sends the first message.
+	if err := newBuilder(alice, bobAddress()).ProcessBundle(bundle); err != nil {
+		t.Fatal("Unable to process Bob's prekey bundle: ", err)
+	}
+	if !alice.store.ContainsSession(bobAddress()) {
+		t.Fatal("Alice's store does not contain the session built from Bob's bundle.")
+	}
+	aliceCipher := newCipher(alice, bobAddress())
+	encrypted, err := aliceCipher.Encrypt([]byte("Hello Bob"))
+	if err != nil {
+		t.Fatal("Unable to encrypt first message: ", err)
+	}
+	received, err := protocol.NewPreKeySignalMessageFromBytes(encrypted.Serialize(),
+		bob.serializer.PreKeySignalMessage, bob.serializer.SignalMessage)
+	if err != nil {
+		t.Fatal("First message is not a prekey message: ", err)
+	}
+
+	// Bob builds his side of the session and decrypts it.
+	if _, err := newBuilder(bob, aliceAddress()).Process(received); err != nil {
+		t.Fatal("Unable to process Alice's prekey message: ", err)
+	}
+	if bob.store.ContainsPreKey(preKeys[0].ID().Value) {
+		t.Error("Bob's used one-time prekey should have been removed from his store.")
+	}
+	bobCipher := newCipher(bob, aliceAddress())
+	plaintext, err := bobCipher.Decrypt(received.WhisperMessage())
+	if err != nil {
+		t.Fatal("Unable to decrypt first message: ", err)
+	}
+	if string(plaintext) != "Hello Bob" {
+		t.Fatal("First message does not match: ", string(plaintext))
+	}
+	if !bob.store.IsTrustedIdentity(aliceAddress(), alice.identityKeyPair.PublicKey()) {
+		t.Error("Bob should trust Alice's identity after building a session.")
+	}
+
+	// Bob replies, which acknowledges the session.
+	exchangeMessages(t, bob, bobCipher, aliceCipher, "Hello Alice")
+
+	return aliceCipher, bobCipher
+}
+
+// exchangeMessages encrypts a few messages with the sending cipher and checks
+// that the receiving cipher decrypts them.
+func exchangeMessages(t *testing.T, sender *account, sending, receiving *session.Cipher, text string) {
+	t.Helper()
+
+	for i := 0; i < 5; i++ {
+		message := fmt.Sprint(text, " ", i)
+		encrypted, err := sending.Encrypt([]byte(message))
+		if err != nil {
+			t.Fatal("Unable to encrypt message: ", err)
+		}
+		received, err := protocol.NewSignalMessageFromBytes(encrypted.Serialize(), sender.serializer.SignalMessage)
+		if err != nil {
+			t.Fatal("Expected a signal message after the session was acknowledged: ", err)
+		}
+		plaintext, err := receiving.Decrypt(received)
+		if err != nil {
+			t.Fatal("Unable to decrypt message: ", err)
+		}
+		if string(plaintext) != message {
+			t.Fatal("Decrypted message does not match - Encrypted: ", message, " Decrypted: ", string(plaintext))
+		}
+	}
+}
+
+// distributeSenderKey creates the sender's group session and sends its
+// distribution message to the receiver over their one-to-one session.
+func distributeSenderKey(t *testing.T, sender, receiver *account, senderAddress *protocol.SignalAddress,
+	sending, receiving *session.Cipher) {
+
+	t.Helper()
+
+	senderKeyName := protocol.NewSenderKeyName("group", senderAddress)
+	distribution, err := groups.NewGroupSessionBuilder(sender.store, sender.serializer).Create(senderKeyName)
+	if err != nil {
+		t.Fatal("Unable to create group session: ", err)
+	}
+	encrypted, err := sending.Encrypt(distribution.Serialize())
+	if err != nil {
+		t.Fatal("Unable to encrypt sender key distribution message: ", err)
+	}
+	received, err := protocol.NewSignalMessageFromBytes(encrypted.Serialize(), sender.serializer.SignalMessage)
+	if err != nil {
+		t.Fatal("Unable to receive sender key distribution message: ", err)
+	}
+	plaintext, err := receiving.Decrypt(received)
+	if err != nil {
+		t.Fatal("Unable to decrypt sender key distribution message: ", err)
+	}
+	receivedDistribution, err := protocol.NewSenderKeyDistributionMessageFromBytes(plaintext,
+		receiver.serializer.SenderKeyDistributionMessage)
+	if err != nil {
+		t.Fatal("Unable to read sender key distribution message: ", err)
+	}
+
+	name := protocol.NewSenderKeyName("group", protocol.NewSignalAddress(senderAddress.Name(), senderAddress.DeviceID()))
+	groups.NewGroupSessionBuilder(receiver.store, receiver.serializer).Process(name, receivedDistribution)
+}
+
+// exchangeGroupMessages encrypts a few group messages as the sender and checks
+// that the receiver decrypts them. New ciphers are built for every message.
+func exchangeGroupMessages(t *testing.T, sender, receiver *account, senderAddress *protocol.SignalAddress, text string) {
+	t.Helper()
+
+	for i := 0; i < 5; i++ {
+		message := fmt.Sprint(text, " ", i)
+		sendingName := protocol.NewSenderKeyName("group", protocol.NewSignalAddress(senderAddress.Name(), senderAddress.DeviceID()))
+		sending := groups.NewGroupCipher(groups.NewGroupSessionBuilder(sender.store, sender.serializer), sendingName, sender.store)
+		encrypted, err := sending.Encrypt([]byte(message))
+		if err != nil {
+			t.Fatal("Unable to encrypt group message: ", err)
+		}
+		received, err := protocol.NewSenderKeyMessageFromBytes(encrypted.(*protocol.SenderKeyMessage).SignedSerialize(),
+			receiver.serializer.SenderKeyMessage)
+		if err != nil {
+			t.Fatal("Unable to receive group message: ", err)
+		}
+
+		receivingName := protocol.NewSenderKeyName("group", protocol.NewSignalAddress(senderAddress.Name(), senderAddress.DeviceID()))
+		receiving := groups.NewGroupCipher(groups.NewGroupSessionBuilder(receiver.store, receiver.serializer), receivingName, receiver.store)
+		plaintext, err := receiving.Decrypt(received)
+		if err != nil {
+			t.Fatal("Unable to decrypt group message: ", err)
+		}
+		if string(plaintext) != message {
+			t.Fatal("Decrypted group message does not match - Encrypted: ", message, " Decrypted: ", string(plaintext))
+		}
+	}
+}
+
+// newBuilder returns a session builder for the given account's store.
+func newBuilder(local *account, remoteAddress *protocol.SignalAddress) *session.Builder {
+	return session.NewBuilder(local.store, local.store, local.store, local.store, remoteAddress, local.serializer)
+}
+
+// newCipher returns a session cipher for the given account's store.
+func newCipher(local *account, remoteAddress *protocol.SignalAddress) *session.Cipher {
+	return session.NewCipher(newBuilder(local, remoteAddress), remoteAddress)
+}
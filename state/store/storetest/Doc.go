@@ -0,0 +1,19 @@
+// Package storetest provides a conformance test suite for implementations of
+// the Signal Protocol store interfaces.
+//
+// Store authors can run every check against their own implementation from a
+// regular Go test:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.RunSignalProtocolStoreTests(t, func(identityKeyPair *identity.KeyPair,
+//			registrationID uint32, serializer *serialize.Serializer) store.SignalProtocol {
+//
+//			return mystore.New(identityKeyPair, registrationID, serializer)
+//		})
+//	}
+//
+// The suite checks the behavioral contracts of each store, concurrent use,
+// and full one-to-one and group conversations between two stores. Backends
+// that host many accounts are checked with RunAccountsTests, which also runs
+// the store suite against the backend's accounts.
+package storetest
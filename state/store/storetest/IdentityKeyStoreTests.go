@@ -0,0 +1,51 @@
+package storetest
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// testIdentityKeyStore checks the IdentityKey store contract.
+func testIdentityKeyStore(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+
+	if signalStore.GetIdentityKeyPair() == nil ||
+		signalStore.GetIdentityKeyPair().PublicKey().Fingerprint() != local.identityKeyPair.PublicKey().Fingerprint() {
+		t.Error("GetIdentityKeyPair does not return the local identity key pair.")
+	}
+	if signalStore.GetLocalRegistrationId() != local.registrationID {
+		t.Error("GetLocalRegistrationId does not return the local registration ID.")
+	}
+
+	remote, _ := keyhelper.GenerateIdentityKeyPair()
+	other, _ := keyhelper.GenerateIdentityKeyPair()
+
+	// Trust on first use.
+	if !signalStore.IsTrustedIdentity(protocol.NewSignalAddress("Bob", 1), remote.PublicKey()) {
+		t.Error("An unknown identity should be trusted on first use.")
+	}
+
+	// Saved identities must be found with any equal address.
+	signalStore.SaveIdentity(protocol.NewSignalAddress("Bob", 1), remote.PublicKey())
+	if !signalStore.IsTrustedIdentity(protocol.NewSignalAddress("Bob", 1), remote.PublicKey()) {
+		t.Error("A saved identity should be trusted.")
+	}
+	if signalStore.IsTrustedIdentity(protocol.NewSignalAddress("Bob", 1), other.PublicKey()) {
+		t.Error("A different identity for a saved address should not be trusted. " +
+			"Make sure addresses are compared by value, not by pointer.")
+	}
+
+	// Identities are saved per device.
+	if !signalStore.IsTrustedIdentity(protocol.NewSignalAddress("Bob", 2), other.PublicKey()) {
+		t.Error("An identity saved for one device should not affect another device.")
+	}
+
+	// Saving again replaces the identity.
+	signalStore.SaveIdentity(protocol.NewSignalAddress("Bob", 1), other.PublicKey())
+	if !signalStore.IsTrustedIdentity(protocol.NewSignalAddress("Bob", 1), other.PublicKey()) {
+		t.Error("A replaced identity should be trusted.")
+	}
+}
@@ -0,0 +1,87 @@
+package storetest
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+)
+
+// testPreKeyStore checks the PreKey store contract.
+func testPreKeyStore(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+
+	if signalStore.ContainsPreKey(1) || signalStore.LoadPreKey(1) != nil {
+		t.Error("An empty store should not contain any prekeys.")
+	}
+
+	preKeys := local.generatePreKeys(t, 1, 5)
+	for _, preKey := range preKeys {
+		signalStore.StorePreKey(preKey.ID().Value, preKey)
+	}
+	for _, preKey := range preKeys {
+		id := preKey.ID().Value
+		if !signalStore.ContainsPreKey(id) {
+			t.Fatal("Stored prekey ", id, " is not contained in the store.")
+		}
+		loaded := signalStore.LoadPreKey(id)
+		if loaded == nil {
+			t.Fatal("Stored prekey ", id, " could not be loaded.")
+		}
+		if loaded.ID().Value != id || !sameKeyPair(loaded.KeyPair(), preKey.KeyPair()) {
+			t.Error("Loaded prekey ", id, " does not match the stored prekey.")
+		}
+	}
+
+	signalStore.RemovePreKey(preKeys[0].ID().Value)
+	if signalStore.ContainsPreKey(preKeys[0].ID().Value) || signalStore.LoadPreKey(preKeys[0].ID().Value) != nil {
+		t.Error("A removed prekey should not be in the store.")
+	}
+	if !signalStore.ContainsPreKey(preKeys[1].ID().Value) {
+		t.Error("Removing a prekey should not remove other prekeys.")
+	}
+}
+
+// testSignedPreKeyStore checks the SignedPreKey store contract.
+func testSignedPreKeyStore(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+
+	if signalStore.ContainsSignedPreKey(1) || signalStore.LoadSignedPreKey(1) != nil {
+		t.Error("An empty store should not contain any signed prekeys.")
+	}
+	if len(signalStore.LoadSignedPreKeys()) != 0 {
+		t.Error("An empty store should not list any signed prekeys.")
+	}
+
+	first := local.generateSignedPreKey(t, 1)
+	second := local.generateSignedPreKey(t, 2)
+	signalStore.StoreSignedPreKey(first.ID(), first)
+	signalStore.StoreSignedPreKey(second.ID(), second)
+
+	loaded := signalStore.LoadSignedPreKey(first.ID())
+	if loaded == nil {
+		t.Fatal("Stored signed prekey could not be loaded.")
+	}
+	if loaded.ID() != first.ID() || loaded.Timestamp() != first.Timestamp() ||
+		loaded.Signature() != first.Signature() || !sameKeyPair(loaded.KeyPair(), first.KeyPair()) {
+		t.Error("Loaded signed prekey does not match the stored signed prekey.")
+	}
+	if len(signalStore.LoadSignedPreKeys()) != 2 {
+		t.Error("Expected 2 signed prekeys, got: ", len(signalStore.LoadSignedPreKeys()))
+	}
+
+	signalStore.RemoveSignedPreKey(first.ID())
+	if signalStore.ContainsSignedPreKey(first.ID()) || signalStore.LoadSignedPreKey(first.ID()) != nil {
+		t.Error("A removed signed prekey should not be in the store.")
+	}
+	if len(signalStore.LoadSignedPreKeys()) != 1 {
+		t.Error("Expected 1 signed prekey after removal, got: ", len(signalStore.LoadSignedPreKeys()))
+	}
+}
+
+// sameKeyPair returns true if the given key pairs hold the same keys.
+func sameKeyPair(a, b *ecc.ECKeyPair) bool {
+	return a.PublicKey().PublicKey() == b.PublicKey().PublicKey() &&
+		a.PrivateKey().Serialize() == b.PrivateKey().Serialize()
+}
@@ -0,0 +1,66 @@
+package storetest
+
+import (
+	"testing"
+
+	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// testSenderKeyStore checks the SenderKey store contract.
+func testSenderKeyStore(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+	name := protocol.NewSenderKeyName("group", protocol.NewSignalAddress("Bob", 1))
+
+	// Loading a missing sender key must return an empty record.
+	loaded := signalStore.LoadSenderKey(name)
+	if loaded == nil {
+		t.Fatal("LoadSenderKey must return an empty record, not nil, when there is no sender key.")
+	}
+	if !loaded.IsEmpty() {
+		t.Error("LoadSenderKey should return an empty record when there is no sender key.")
+	}
+
+	// Stored sender keys must be found with any equal name.
+	senderKeyRecord := newTestSenderKey(t, local)
+	state, _ := senderKeyRecord.SenderKeyState()
+	signalStore.StoreSenderKey(name, senderKeyRecord)
+
+	loaded = signalStore.LoadSenderKey(protocol.NewSenderKeyName("group", protocol.NewSignalAddress("Bob", 1)))
+	if loaded == nil || loaded.IsEmpty() {
+		t.Fatal("A stored sender key should be loaded. " +
+			"Make sure sender key names are compared by value, not by pointer.")
+	}
+	loadedState, err := loaded.SenderKeyState()
+	if err != nil || loadedState.KeyID() != state.KeyID() {
+		t.Error("Loaded sender key does not match the stored sender key.")
+	}
+
+	// Sender keys are stored per group and per sender.
+	others := []*protocol.SenderKeyName{
+		protocol.NewSenderKeyName("other", protocol.NewSignalAddress("Bob", 1)),
+		protocol.NewSenderKeyName("group", protocol.NewSignalAddress("Bob", 2)),
+		protocol.NewSenderKeyName("group", protocol.NewSignalAddress("Carol", 1)),
+	}
+	for _, other := range others {
+		if loaded := signalStore.LoadSenderKey(other); loaded != nil && !loaded.IsEmpty() {
+			t.Error("A sender key stored for one name should not be found for ", other.String())
+		}
+	}
+}
+
+// newTestSenderKey returns a sender key record with a new sending state.
+func newTestSenderKey(t *testing.T, local *account) *groupRecord.SenderKey {
+	t.Helper()
+
+	signingKey, err := keyhelper.GenerateSenderSigningKey()
+	if err != nil {
+		t.Fatal("Unable to generate sender signing key: ", err)
+	}
+	senderKeyRecord := groupRecord.NewSenderKey(local.serializer.SenderKeyRecord, local.serializer.SenderKeyState)
+	senderKeyRecord.SetSenderKeyState(keyhelper.GenerateSenderKeyID(), 0, keyhelper.GenerateSenderKey(), signingKey)
+
+	return senderKeyRecord
+}
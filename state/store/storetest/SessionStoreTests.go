@@ -0,0 +1,82 @@
+package storetest
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// testSessionStore checks the Session store contract.
+func testSessionStore(t *testing.T, factory Factory) {
+	local := newAccount(t, factory)
+	signalStore := local.store
+	bob := protocol.NewSignalAddress("Bob", 1)
+
+	// Loading a missing session must return a fresh record without storing it.
+	loaded := signalStore.LoadSession(bob)
+	if loaded == nil {
+		t.Fatal("LoadSession must return a fresh record, not nil, when there is no session.")
+	}
+	if !loaded.IsFresh() {
+		t.Error("LoadSession should return a fresh record when there is no session.")
+	}
+	if signalStore.ContainsSession(bob) {
+		t.Error("Loading a missing session should not store it.")
+	}
+
+	// Stored sessions must be found with any equal address.
+	signalStore.StoreSession(bob, newTestSession(local, 42))
+	if !signalStore.ContainsSession(protocol.NewSignalAddress("Bob", 1)) {
+		t.Fatal("A stored session should be contained in the store. " +
+			"Make sure addresses are compared by value, not by pointer.")
+	}
+	loaded = signalStore.LoadSession(protocol.NewSignalAddress("Bob", 1))
+	if loaded == nil || loaded.SessionState().RemoteRegistrationID() != 42 {
+		t.Fatal("Loaded session does not match the stored session.")
+	}
+	if signalStore.ContainsSession(protocol.NewSignalAddress("Bob", 2)) {
+		t.Error("A session stored for one device should not be found for another device.")
+	}
+
+	// Storing again replaces the session.
+	signalStore.StoreSession(bob, newTestSession(local, 43))
+	if signalStore.LoadSession(bob).SessionState().RemoteRegistrationID() != 43 {
+		t.Error("Storing a session should replace the previous session.")
+	}
+
+	// Sub device sessions list every device other than the primary device.
+	for _, deviceID := range []uint32{2, 3} {
+		signalStore.StoreSession(protocol.NewSignalAddress("Bob", deviceID), newTestSession(local, deviceID))
+	}
+	signalStore.StoreSession(protocol.NewSignalAddress("Carol", 5), newTestSession(local, 5))
+	subDevices := signalStore.GetSubDeviceSessions("Bob")
+	sort.Slice(subDevices, func(i, j int) bool { return subDevices[i] < subDevices[j] })
+	if len(subDevices) != 2 || subDevices[0] != 2 || subDevices[1] != 3 {
+		t.Error("Expected sub device sessions [2 3], got: ", subDevices)
+	}
+
+	// Deleting removes one session, or all of them.
+	signalStore.DeleteSession(protocol.NewSignalAddress("Bob", 2))
+	if signalStore.ContainsSession(protocol.NewSignalAddress("Bob", 2)) {
+		t.Error("A deleted session should not be in the store.")
+	}
+	if !signalStore.ContainsSession(protocol.NewSignalAddress("Bob", 3)) {
+		t.Error("Deleting a session should not delete other sessions.")
+	}
+	signalStore.DeleteAllSessions()
+	if signalStore.ContainsSession(bob) || signalStore.ContainsSession(protocol.NewSignalAddress("Carol", 5)) {
+		t.Error("DeleteAllSessions should remove every session.")
+	}
+}
+
+// newTestSession returns a session record that can be told apart by its
+// remote registration ID.
+func newTestSession(local *account, remoteRegistrationID uint32) *record.Session {
+	sessionRecord := record.NewSession(local.serializer.Session, local.serializer.State)
+	sessionRecord.SessionState().SetLocalRegistrationID(local.registrationID)
+	sessionRecord.SessionState().SetRemoteRegistrationID(remoteRegistrationID)
+
+	return sessionRecord
+}
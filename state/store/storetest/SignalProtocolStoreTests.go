@@ -0,0 +1,83 @@
+package storetest
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// Factory returns a new, empty store for the given local identity key pair
+// and registration ID. Records given to the store are encoded with the given
+// serializer. Every call must return an independent store.
+type Factory func(identityKeyPair *identity.KeyPair, registrationID uint32, serializer *serialize.Serializer) store.SignalProtocol
+
+// RunSignalProtocolStoreTests runs the full conformance suite against stores
+// built with the given factory. Each group of checks runs as a subtest.
+func RunSignalProtocolStoreTests(t *testing.T, factory Factory) {
+	t.Run("IdentityKey", func(t *testing.T) { testIdentityKeyStore(t, factory) })
+	t.Run("PreKey", func(t *testing.T) { testPreKeyStore(t, factory) })
+	t.Run("SignedPreKey", func(t *testing.T) { testSignedPreKeyStore(t, factory) })
+	t.Run("Session", func(t *testing.T) { testSessionStore(t, factory) })
+	t.Run("SenderKey", func(t *testing.T) { testSenderKeyStore(t, factory) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, factory) })
+	t.Run("Conversation", func(t *testing.T) { testConversation(t, factory) })
+	t.Run("GroupConversation", func(t *testing.T) { testGroupConversation(t, factory) })
+}
+
+// account is a local identity along with the store built for it.
+type account struct {
+	identityKeyPair *identity.KeyPair
+	registrationID  uint32
+	store           store.SignalProtocol
+	serializer      *serialize.Serializer
+}
+
+// newAccount generates a new identity and builds an empty store for it.
+func newAccount(t *testing.T, factory Factory) *account {
+	t.Helper()
+
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Unable to generate identity key pair: ", err)
+	}
+	serializer := serialize.NewJSONSerializer()
+	registrationID := keyhelper.GenerateRegistrationID()
+
+	signalStore := factory(identityKeyPair, registrationID, serializer)
+	if signalStore == nil {
+		t.Fatal("Factory returned a nil store.")
+	}
+
+	return &account{
+		identityKeyPair: identityKeyPair,
+		registrationID:  registrationID,
+		store:           signalStore,
+		serializer:      serializer,
+	}
+}
+
+// generatePreKeys generates the given number of prekeys starting at the given ID.
+func (a *account) generatePreKeys(t *testing.T, start, count int) []*record.PreKey {
+	t.Helper()
+
+	preKeys, err := keyhelper.GeneratePreKeys(start, count, a.serializer.PreKeyRecord)
+	if err != nil {
+		t.Fatal("Unable to generate prekeys: ", err)
+	}
+	return preKeys
+}
+
+// generateSignedPreKey generates a signed prekey with the given ID.
+func (a *account) generateSignedPreKey(t *testing.T, signedPreKeyID uint32) *record.SignedPreKey {
+	t.Helper()
+
+	signedPreKey, err := keyhelper.GenerateSignedPreKey(a.identityKeyPair, signedPreKeyID, a.serializer.SignedPreKeyRecord)
+	if err != nil {
+		t.Fatal("Unable to generate signed prekey: ", err)
+	}
+	return signedPreKey
+}
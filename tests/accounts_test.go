@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/client"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/events"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/storetest"
+)
+
+// TestMemStoreAccountsConformance runs the accounts conformance suite
+// against the in-memory backend.
+func TestMemStoreAccountsConformance(t *testing.T) {
+	storetest.RunAccountsTests(t, func(serializer *serialize.Serializer) store.Accounts {
+		return memstore.NewAccounts(serializer)
+	})
+}
+
+// TestManyAccounts runs many accounts hosted in one in-memory backend, each
+// talking to the next one concurrently.
+func TestManyAccounts(t *testing.T) {
+	const count = 20
+	serializer := newSerializer()
+	backend := memstore.NewAccounts(serializer)
+	buses := make(map[string]*events.Bus)
+	host := client.NewHost(backend, func(accountID string) client.Options {
+		return client.Options{Serializer: serializer, EventBus: buses[accountID]}
+	})
+
+	// Create every account with its keys, and open its client.
+	users := make([]*user, count)
+	clients := make([]*client.Client, count)
+	recorders := make([]*eventRecorder, count)
+	for i := range users {
+		accountID := "bot-" + strconv.Itoa(i)
+		users[i] = newUser(accountID, 1, serializer)
+		signalStore, err := backend.CreateAccount(accountID, users[i].identityKeyPair, users[i].registrationID)
+		if err != nil {
+			t.Fatal("Unable to create account: ", err)
+		}
+		storeUserKeys(users[i], signalStore, serializer)
+
+		recorders[i] = &eventRecorder{}
+		buses[accountID] = events.NewBus()
+		buses[accountID].Subscribe(recorders[i].record)
+		if clients[i], err = host.Open(accountID, users[i].address); err != nil {
+			t.Fatal("Unable to open account: ", err)
+		}
+	}
+	if _, err := backend.CreateAccount("bot-0", users[0].identityKeyPair, users[0].registrationID); err == nil {
+		t.Error("Expected creating an existing account to fail.")
+	}
+	if _, err := host.Open("bot-0", users[1].address); err == nil {
+		t.Error("Expected opening an account with another address to fail.")
+	}
+
+	// Every account sends to the next one, then replies to the previous one.
+	envelopes := make([]*client.Envelope, count)
+	runAccounts(count, t, func(i int) error {
+		if err := clients[i].StartSession(users[(i+1)%count].name, newBundle(users[(i+1)%count], 0)); err != nil {
+			return err
+		}
+		envelope, err := clients[i].Encrypt(users[(i+1)%count].address, []byte(fmt.Sprint("Hello from ", i)))
+		envelopes[(i+1)%count] = envelope
+		return err
+	})
+	replies := make([]*client.Envelope, count)
+	runAccounts(count, t, func(i int) error {
+		plaintext, err := clients[i].Decrypt(envelopes[i])
+		if err != nil {
+			return err
+		}
+		previous := (i + count - 1) % count
+		if want := fmt.Sprint("Hello from ", previous); string(plaintext) != want {
+			return fmt.Errorf("got %q, want %q", plaintext, want)
+		}
+		reply, err := clients[i].Encrypt(users[previous].address, []byte(fmt.Sprint("Reply from ", i)))
+		replies[previous] = reply
+		return err
+	})
+	runAccounts(count, t, func(i int) error {
+		plaintext, err := clients[i].Decrypt(replies[i])
+		if err != nil {
+			return err
+		}
+		if want := fmt.Sprint("Reply from ", (i+1)%count); string(plaintext) != want {
+			return fmt.Errorf("got %q, want %q", plaintext, want)
+		}
+		return nil
+	})
+
+	// Each account only has sessions with its neighbours, and only saw its
+	// own events.
+	for i := range users {
+		signalStore := backend.Account(users[i].name).(*memstore.SignalProtocol)
+		if sessions := signalStore.LoadSessionAddresses(); len(sessions) != 2 {
+			t.Errorf("Got %d sessions for account %d, want 2", len(sessions), i)
+		}
+		if received := recorders[i].take(); len(received) != 3 {
+			t.Errorf("Got %d events for account %d, want 3: %+v", len(received), i, received)
+		}
+	}
+	if accountIDs := backend.AccountIDs(); len(accountIDs) != count {
+		t.Errorf("Got %d accounts, want %d", len(accountIDs), count)
+	}
+
+	// A closed account is opened again from the backend.
+	host.Close("bot-0")
+	if host.Client("bot-0") != nil {
+		t.Error("Expected a closed account to have no client.")
+	}
+	reopened, err := host.Open("bot-0", users[0].address)
+	if err != nil {
+		t.Fatal("Unable to open account again: ", err)
+	}
+	if !reopened.HasSession(users[1].address) {
+		t.Error("Expected a reopened account to keep its sessions.")
+	}
+	backend.RemoveAccount("bot-0")
+	host.Close("bot-0")
+	if _, err := host.Open("bot-0", users[0].address); err == nil {
+		t.Error("Expected opening a removed account to fail.")
+	}
+}
+
+// runAccounts calls the given function for every account concurrently.
+func runAccounts(count int, t *testing.T, run func(i int) error) {
+	var wait sync.WaitGroup
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			errs[i] = run(i)
+		}(i)
+	}
+	wait.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Account %d failed: %v", i, err)
+		}
+	}
+}
+
+// storeUserKeys stores the user's prekeys and signed prekey in the given
+// store.
+func storeUserKeys(u *user, signalStore store.SignalProtocol, serializer *serialize.Serializer) {
+	for _, preKey := range u.preKeys {
+		signalStore.StorePreKey(preKey.ID().Value,
+			record.NewPreKey(preKey.ID().Value, preKey.KeyPair(), serializer.PreKeyRecord))
+	}
+	signalStore.StoreSignedPreKey(u.signedPreKey.ID(), record.NewSignedPreKey(u.signedPreKey.ID(),
+		u.signedPreKey.Timestamp(), u.signedPreKey.KeyPair(), u.signedPreKey.Signature(), serializer.SignedPreKeyRecord))
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// TestSignalAddress checks comparing, printing and parsing signal addresses.
+func TestSignalAddress(t *testing.T) {
+	addresses := []*protocol.SignalAddress{
+		protocol.NewSignalAddress("Alice", 1),
+		protocol.NewSignalAddress("+14151231234", 42),
+		protocol.NewSignalAddress("name~with~separators", 4294967295),
+		protocol.NewSignalAddress("", 0),
+	}
+	for _, address := range addresses {
+		parsed, err := protocol.ParseSignalAddress(address.String())
+		if err != nil {
+			t.Fatal("Unable to parse address ", address, ": ", err)
+		}
+		if !parsed.Equal(address) || *parsed != *address {
+			t.Error("Parsed address ", parsed, " does not equal ", address)
+		}
+	}
+
+	if protocol.NewSignalAddress("Alice", 1).Equal(protocol.NewSignalAddress("Alice", 2)) {
+		t.Error("Addresses with different device IDs should not be equal.")
+	}
+	if protocol.NewSignalAddress("Alice", 1).Equal(nil) {
+		t.Error("An address should not equal nil.")
+	}
+
+	for _, invalid := range []string{"Alice", "Alice~", "Alice~one", "Alice~-1", "Alice~4294967296"} {
+		if _, err := protocol.ParseSignalAddress(invalid); err == nil {
+			t.Error("Invalid address ", invalid, " should not parse.")
+		}
+	}
+}
+
+// TestSenderKeyName checks comparing, printing and parsing sender key names.
+func TestSenderKeyName(t *testing.T) {
+	sender := protocol.NewSignalAddress("Bob~Smith", 3)
+	name := protocol.NewSenderKeyName("group", sender)
+
+	parsed, err := protocol.ParseSenderKeyName(name.String())
+	if err != nil {
+		t.Fatal("Unable to parse sender key name ", name, ": ", err)
+	}
+	if !parsed.Equal(name) || *parsed != *name {
+		t.Error("Parsed sender key name ", parsed, " does not equal ", name)
+	}
+	if !parsed.Sender().Equal(sender) {
+		t.Error("Parsed sender ", parsed.Sender(), " does not equal ", sender)
+	}
+
+	// Names built from different but equal addresses must be usable as the same key.
+	names := map[protocol.SenderKeyName]bool{*name: true}
+	if !names[*protocol.NewSenderKeyName("group", protocol.NewSignalAddress("Bob~Smith", 3))] {
+		t.Error("Equal sender key names should find the same map entry.")
+	}
+	if name.Equal(protocol.NewSenderKeyName("other", sender)) {
+		t.Error("Sender key names with different groups should not be equal.")
+	}
+
+	if _, err := protocol.ParseSenderKeyName("group"); err == nil {
+		t.Error("Invalid sender key name should not parse.")
+	}
+}
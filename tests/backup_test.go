@@ -0,0 +1,257 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/backup"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// backupParams are cheap Argon2id parameters to keep the tests fast.
+var backupParams = kdf.PassphraseParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+// TestBackupRoundtrip checks backing up a store and restoring it into another
+// store, then continuing the restored sessions.
+func TestBackupRoundtrip(t *testing.T) {
+
+	// Create a serializer object that will be used to encode/decode data.
+	serializer := newSerializer()
+	passphrase := []byte("correct horse battery staple")
+
+	// Create our users and establish a one-to-one and a group session.
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	aliceCipher, bobCipher := buildBackupSessions(alice, bob, serializer, t)
+	aliceSenderKeyName := protocol.NewSenderKeyName("123", alice.address)
+	aliceGroupCipher := buildBackupGroupSession(alice, bob, aliceSenderKeyName, aliceCipher, bobCipher, serializer, t)
+
+	// Give Bob a sending sender key too, so both kinds of sender key state are backed up.
+	if _, err := bob.groupBuilder.Create(protocol.NewSenderKeyName("123", bob.address)); err != nil {
+		t.Fatal("Unable to create group session: ", err)
+	}
+
+	// Write Bob's store into an archive.
+	logger.Info("Writing Bob's backup archive...")
+	bobStore := bob.store
+	var archive bytes.Buffer
+	err := backup.WriteWithParams(&archive, bobStore, passphrase, serializer, backupParams)
+	if err != nil {
+		t.Fatal("Unable to write backup: ", err)
+	}
+	if bytes.Contains(archive.Bytes(), bob.identityKeyPair.PublicKey().Serialize()) {
+		t.Fatal("Backup contains Bob's identity key in the clear.")
+	}
+
+	// Restore the archive into a new store.
+	logger.Info("Restoring Bob's backup archive...")
+	reader, err := backup.NewReader(bytes.NewReader(archive.Bytes()), passphrase, serializer)
+	if err != nil {
+		t.Fatal("Unable to read backup: ", err)
+	}
+	assertSameKeyPair(bob.identityKeyPair, reader.IdentityKeyPair(), t)
+	if reader.RegistrationID() != bob.registrationID {
+		t.Fatal("Restored registration ID does not match.")
+	}
+	restored := memstore.NewSignalProtocol(reader.IdentityKeyPair(), reader.RegistrationID(), serializer)
+	if err := reader.RestoreInto(restored); err != nil {
+		t.Fatal("Unable to restore backup: ", err)
+	}
+
+	// Check that every record was restored.
+	if len(restored.LoadPreKeys()) != len(bobStore.LoadPreKeys()) {
+		t.Error("Restored ", len(restored.LoadPreKeys()), " prekeys, expected ", len(bobStore.LoadPreKeys()))
+	}
+	if len(restored.LoadSignedPreKeys()) != len(bobStore.LoadSignedPreKeys()) {
+		t.Error("Restored signed prekey count does not match.")
+	}
+	if len(restored.LoadSessionAddresses()) != len(bobStore.LoadSessionAddresses()) {
+		t.Fatal("Restored session count does not match.")
+	}
+	if len(restored.LoadSenderKeyNames()) != 2 {
+		t.Fatal("Expected two restored sender keys, got: ", len(restored.LoadSenderKeyNames()))
+	}
+	if len(restored.LoadIdentityAddresses()) != len(bobStore.LoadIdentityAddresses()) {
+		t.Error("Restored trusted identity count does not match.")
+	}
+
+	// Continue the one-to-one session with the restored store.
+	if !restored.ContainsSession(alice.address) {
+		t.Fatal("Bob's session with Alice was not restored.")
+	}
+	restoredBuilder := session.NewBuilder(restored, restored, restored, restored, alice.address, serializer)
+	restoredCipher := session.NewCipher(restoredBuilder, alice.address)
+
+	aliceMessageStrings, aliceMessages := sendMessages(10, aliceCipher, serializer, t)
+	receiveMessages(aliceMessages, aliceMessageStrings, restoredCipher, t)
+	bobMessageStrings, bobMessages := sendMessages(10, restoredCipher, serializer, t)
+	receiveMessages(bobMessages, bobMessageStrings, aliceCipher, t)
+
+	// Continue the group session with the restored store.
+	restoredGroupBuilder := groups.NewGroupSessionBuilder(restored, serializer)
+	restoredGroupCipher := groups.NewGroupCipher(restoredGroupBuilder, aliceSenderKeyName, restored)
+
+	groupMessageStrings, groupMessages := sendGroupMessages(10, aliceGroupCipher, serializer, t)
+	receiveGroupMessages(groupMessages, groupMessageStrings, restoredGroupCipher, t)
+}
+
+// TestBackupCorruption checks that archives read with the wrong passphrase, or
+// that were tampered with or truncated, are rejected.
+func TestBackupCorruption(t *testing.T) {
+	serializer := newSerializer()
+	passphrase := []byte("correct horse battery staple")
+
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	buildBackupSessions(alice, bob, serializer, t)
+
+	var archive bytes.Buffer
+	err := backup.WriteWithParams(&archive, bob.store, passphrase, serializer, backupParams)
+	if err != nil {
+		t.Fatal("Unable to write backup: ", err)
+	}
+	exported := archive.Bytes()
+
+	// restore is a helper to fully read and restore the given archive.
+	restore := func(archive, passphrase []byte) error {
+		reader, err := backup.NewReader(bytes.NewReader(archive), passphrase, serializer)
+		if err != nil {
+			return err
+		}
+		restored := memstore.NewSignalProtocol(reader.IdentityKeyPair(), reader.RegistrationID(), serializer)
+		return reader.RestoreInto(restored)
+	}
+
+	if err := restore(exported, passphrase); err != nil {
+		t.Fatal("Unable to restore untouched backup: ", err)
+	}
+
+	// A wrong passphrase must fail.
+	if err := restore(exported, []byte("wrong")); err != backup.ErrBadPassphrase {
+		t.Error("Expected bad passphrase error, got: ", err)
+	}
+
+	// Any modification of the header or a frame must fail.
+	for _, i := range []int{0, 10, 30, len(exported) / 2, len(exported) - 1} {
+		tampered := append([]byte{}, exported...)
+		tampered[i] ^= 0x01
+		if err := restore(tampered, passphrase); err == nil {
+			t.Error("Tampered backup at byte ", i, " should not restore.")
+		}
+	}
+
+	// Dropping the end of the archive must fail.
+	if err := restore(exported[:len(exported)-1], passphrase); err != backup.ErrTruncated {
+		t.Error("Expected truncated error, got: ", err)
+	}
+
+	// A truncated archive must leave the store untouched, even though every
+	// record before the cut was read.
+	reader, err := backup.NewReader(bytes.NewReader(exported[:len(exported)-1]), passphrase, serializer)
+	if err != nil {
+		t.Fatal("Unable to read truncated backup header: ", err)
+	}
+	untouched := memstore.NewSignalProtocol(reader.IdentityKeyPair(), reader.RegistrationID(), serializer)
+	if err := reader.RestoreInto(untouched); err != backup.ErrTruncated {
+		t.Error("Expected truncated error, got: ", err)
+	}
+	if len(untouched.LoadPreKeys()) != 0 || len(untouched.LoadSignedPreKeys()) != 0 ||
+		len(untouched.LoadSessionAddresses()) != 0 || len(untouched.LoadSenderKeyNames()) != 0 ||
+		len(untouched.LoadIdentityAddresses()) != 0 {
+		t.Error("Truncated backup should not restore any records.")
+	}
+
+	if err := restore([]byte("SIGNAL"), passphrase); err != backup.ErrNotBackup {
+		t.Error("Expected not backup error, got: ", err)
+	}
+
+	// Data after the end entry must fail.
+	if err := restore(append(append([]byte{}, exported...), 0x00), passphrase); err != backup.ErrTrailingData {
+		t.Error("Expected trailing data error, got: ", err)
+	}
+
+	// Argon2id parameters above the caller's limit or the hard cap must fail
+	// before a key is derived.
+	_, err = backup.NewReaderWithLimit(bytes.NewReader(exported), passphrase, serializer,
+		kdf.PassphraseParams{Memory: backupParams.Memory - 1})
+	if err != kdf.ErrInvalidPassphraseParams {
+		t.Error("Expected invalid passphrase params error, got: ", err)
+	}
+	tooLarge := append([]byte{}, exported...)
+	binary.BigEndian.PutUint32(tooLarge[13:17], 1024*1024+1)
+	if err := restore(tooLarge, passphrase); err != kdf.ErrInvalidPassphraseParams {
+		t.Error("Expected invalid passphrase params error, got: ", err)
+	}
+}
+
+// buildBackupSessions establishes a one-to-one session between the given
+// users, with one message sent each way.
+func buildBackupSessions(alice, bob *user, serializer *serialize.Serializer, t *testing.T) (*session.Cipher, *session.Cipher) {
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	retrievedPreKey := prekey.NewBundle(
+		bob.registrationID,
+		bob.deviceID,
+		bob.preKeys[0].ID(),
+		bob.signedPreKey.ID(),
+		bob.preKeys[0].KeyPair().PublicKey(),
+		bob.signedPreKey.KeyPair().PublicKey(),
+		bob.signedPreKey.Signature(),
+		bob.identityKeyPair.PublicKey(),
+	)
+	if err := alice.sessionBuilder.ProcessBundle(retrievedPreKey); err != nil {
+		t.Fatal("Unable to process retrieved prekey bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	aliceMessageStrings, aliceMessages := sendMessages(1, aliceCipher, serializer, t)
+
+	if _, err := bob.sessionBuilder.Process(aliceMessages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekeysignal message: ", err)
+	}
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	receiveMessages(aliceMessages, aliceMessageStrings, bobCipher, t)
+
+	bobMessageStrings, bobMessages := sendMessages(1, bobCipher, serializer, t)
+	receiveMessages(bobMessages, bobMessageStrings, aliceCipher, t)
+
+	return aliceCipher, bobCipher
+}
+
+// buildBackupGroupSession creates Alice's sender key and distributes it to Bob
+// over the given one-to-one session.
+func buildBackupGroupSession(alice, bob *user, senderKeyName *protocol.SenderKeyName, aliceCipher, bobCipher *session.Cipher,
+	serializer *serialize.Serializer, t *testing.T) *groups.GroupCipher {
+
+	skdm, err := alice.groupBuilder.Create(senderKeyName)
+	if err != nil {
+		t.Fatal("Unable to create group session: ", err)
+	}
+	encryptedSkdm, err := aliceCipher.Encrypt(skdm.Serialize())
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	receivedMessage, err := protocol.NewSignalMessageFromBytes(encryptedSkdm.Serialize(), serializer.SignalMessage)
+	if err != nil {
+		t.Fatal("Unable to emulate receiving message as JSON: ", err)
+	}
+	msg, err := bobCipher.Decrypt(receivedMessage)
+	if err != nil {
+		t.Fatal("Unable to decrypt message: ", err)
+	}
+	receivedSkdm, err := protocol.NewSenderKeyDistributionMessageFromBytes(msg, serializer.SenderKeyDistributionMessage)
+	if err != nil {
+		t.Fatal("Unable to create senderkey distribution message from bytes: ", err)
+	}
+	bob.groupBuilder.Process(senderKeyName, receivedSkdm)
+
+	return groups.NewGroupCipher(alice.groupBuilder, senderKeyName, alice.senderKeyStore)
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/client"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+)
+
+// TestClient checks one-to-one and group messaging through the client
+// facade.
+func TestClient(t *testing.T) {
+	for _, headerEncryption := range []bool{false, true} {
+		serializer := newSerializer()
+		aliceUser := newUser("Alice", 1, serializer)
+		bobUser := newUser("Bob", 2, serializer)
+		options := client.Options{Serializer: serializer, HeaderEncryption: headerEncryption}
+		alice := client.New(aliceUser.store, aliceUser.address, options)
+		bob := client.New(bobUser.store, bobUser.address, options)
+
+		// Alice starts a session and both sides talk.
+		if err := alice.StartSession("Bob", newBundle(bobUser, 0)); err != nil {
+			t.Fatal("Unable to start session: ", err)
+		}
+		for i := 0; i < 3; i++ {
+			clientRoundtrip(alice, bob, "Hello Bob", t)
+			clientRoundtrip(bob, alice, "Hello Alice", t)
+		}
+		if !bob.HasSession(aliceUser.address) {
+			t.Error("Expected Bob to have a session with Alice.")
+		}
+
+		// Alice distributes her sender key and sends to the group.
+		distribution, err := alice.CreateGroupSession("group")
+		if err != nil {
+			t.Fatal("Unable to create group session: ", err)
+		}
+		envelope, err := alice.Encrypt(bobUser.address, distribution)
+		if err != nil {
+			t.Fatal("Unable to encrypt distribution message: ", err)
+		}
+		received, err := bob.Decrypt(envelope)
+		if err != nil {
+			t.Fatal("Unable to decrypt distribution message: ", err)
+		}
+		if err := bob.ProcessGroupSession("group", envelope.Sender, received); err != nil {
+			t.Fatal("Unable to process group session: ", err)
+		}
+		for _, text := range []string{"Hello group", "Hello again"} {
+			envelope, err := alice.GroupEncrypt("group", []byte(text))
+			if err != nil {
+				t.Fatal("Unable to encrypt group message: ", err)
+			}
+			if envelope.Type != protocol.SENDERKEY_TYPE || envelope.GroupID != "group" {
+				t.Errorf("Unexpected group envelope: %+v", envelope)
+			}
+			plaintext, err := bob.Decrypt(envelope)
+			if err != nil {
+				t.Fatal("Unable to decrypt group message: ", err)
+			}
+			if string(plaintext) != text {
+				t.Errorf("Got %q, want %q", plaintext, text)
+			}
+		}
+
+		// Group messages need a group ID.
+		envelope.GroupID = ""
+		envelope.Type = protocol.SENDERKEY_TYPE
+		if _, err := bob.GroupDecrypt(envelope); err == nil {
+			t.Error("Expected a group message without a group ID to fail.")
+		}
+	}
+}
+
+// clientRoundtrip sends the given text from one client to the other and
+// checks that it is decrypted.
+func clientRoundtrip(from, to *client.Client, text string, t *testing.T) {
+	envelope, err := from.Encrypt(to.Address(), []byte(text))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	if !envelope.Sender.Equal(from.Address()) {
+		t.Errorf("Got sender %v, want %v", envelope.Sender, from.Address())
+	}
+	plaintext, err := to.Decrypt(envelope)
+	if err != nil {
+		t.Fatal("Unable to decrypt message: ", err)
+	}
+	if string(plaintext) != text {
+		t.Errorf("Got %q, want %q", plaintext, text)
+	}
+}
+
+// TestClientUnknownSignedPreKey checks that a prekey message for a signed
+// prekey the recipient doesn't have is rejected instead of panicking.
+func TestClientUnknownSignedPreKey(t *testing.T) {
+	serializer := newSerializer()
+	aliceUser := newUser("Alice", 1, serializer)
+	bobUser := newUser("Bob", 2, serializer)
+	options := client.Options{Serializer: serializer}
+	alice := client.New(aliceUser.store, aliceUser.address, options)
+	bob := client.New(bobUser.store, bobUser.address, options)
+
+	if err := alice.StartSession("Bob", newBundle(bobUser, 0)); err != nil {
+		t.Fatal("Unable to start session: ", err)
+	}
+	envelope, err := alice.Encrypt(bobUser.address, []byte("Hello Bob"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	if envelope.Type != protocol.PREKEY_TYPE {
+		t.Fatalf("Got envelope type %d, want a prekey message", envelope.Type)
+	}
+
+	bobUser.signedPreKeyStore.RemoveSignedPreKey(bobUser.signedPreKey.ID())
+	if _, err := bob.Decrypt(envelope); err == nil {
+		t.Error("Expected a message for an unknown signed prekey to fail.")
+	}
+	if bob.HasSession(aliceUser.address) {
+		t.Error("Expected no session to be created for an unknown signed prekey.")
+	}
+}
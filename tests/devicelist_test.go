@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/sesame"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// TestDeviceList checks signing, verifying and serializing device lists.
+func TestDeviceList(t *testing.T) {
+	serializer := newSerializer()
+	bob := newUser("Bob", 1, serializer)
+	mallory := newUser("Mallory", 1, serializer)
+
+	list, err := devicelist.NewList(bob.identityKeyPair, 1,
+		[]devicelist.Device{{DeviceID: 2, RegistrationID: 200}, {DeviceID: 1, RegistrationID: 100}}, nil)
+	if err != nil {
+		t.Fatal("Unable to create device list: ", err)
+	}
+	if err := list.Verify(bob.identityKeyPair.PublicKey()); err != nil {
+		t.Error("Unable to verify device list: ", err)
+	}
+	if err := list.Verify(mallory.identityKeyPair.PublicKey()); !errors.Is(err, devicelist.ErrInvalidSignature) {
+		t.Errorf("Expected a list verified with another identity to fail, got: %v", err)
+	}
+	if !list.Contains(2, 200) || list.Contains(2, 201) || list.Contains(3, 300) {
+		t.Error("Unexpected devices in list: ", list.Devices())
+	}
+
+	// The list survives serialization, with its devices in order.
+	received, err := devicelist.NewListFromBytes(list.Serialize(serializer.DeviceList), serializer.DeviceList)
+	if err != nil {
+		t.Fatal("Unable to read device list: ", err)
+	}
+	if err := received.Verify(bob.identityKeyPair.PublicKey()); err != nil {
+		t.Error("Unable to verify received device list: ", err)
+	}
+	if deviceIDs := received.DeviceIDs(); len(deviceIDs) != 2 || deviceIDs[0] != 1 || deviceIDs[1] != 2 {
+		t.Errorf("Got devices %v, want [1 2]", deviceIDs)
+	}
+
+	// Changing a registration ID breaks the signature.
+	signature := list.Signature()
+	structure := &devicelist.ListStructure{
+		Version:   1,
+		Devices:   []devicelist.DeviceStructure{{DeviceID: 1, RegistrationID: 100}, {DeviceID: 2, RegistrationID: 666}},
+		Signature: signature[:],
+	}
+	tampered, err := devicelist.NewListFromStruct(structure)
+	if err != nil {
+		t.Fatal("Unable to read tampered device list: ", err)
+	}
+	if err := tampered.Verify(bob.identityKeyPair.PublicKey()); !errors.Is(err, devicelist.ErrInvalidSignature) {
+		t.Errorf("Expected a tampered list to fail verification, got: %v", err)
+	}
+
+	// Devices can't be listed twice, or be listed and revoked.
+	if _, err := devicelist.NewList(bob.identityKeyPair, 1,
+		[]devicelist.Device{{DeviceID: 1, RegistrationID: 100}, {DeviceID: 1, RegistrationID: 101}}, nil); err == nil {
+		t.Error("Expected a device listed twice to fail.")
+	}
+	if _, err := list.Next(bob.identityKeyPair, list.Devices(), 2); err == nil {
+		t.Error("Expected a device both listed and revoked to fail.")
+	}
+}
+
+// TestDeviceListAccept checks that accepted device lists can't be rolled
+// back and keep their revocations.
+func TestDeviceListAccept(t *testing.T) {
+	serializer := newSerializer()
+	bob := newUser("Bob", 1, serializer)
+	listStore := memstore.NewDeviceList(serializer)
+	identityKey := bob.identityKeyPair.PublicKey()
+	devices := []devicelist.Device{{DeviceID: 1, RegistrationID: 100}, {DeviceID: 2, RegistrationID: 200}}
+
+	first, _ := devicelist.NewList(bob.identityKeyPair, 1, devices, nil)
+	if err := devicelist.Accept(listStore, "Bob", identityKey, first); err != nil {
+		t.Fatal("Unable to accept device list: ", err)
+	}
+	if err := devicelist.Accept(listStore, "Bob", identityKey, first); err != nil {
+		t.Error("Accepting the same list again should succeed: ", err)
+	}
+	conflicting, _ := devicelist.NewList(bob.identityKeyPair, 1, devices[:1], nil)
+	if err := devicelist.Accept(listStore, "Bob", identityKey, conflicting); !errors.Is(err, devicelist.ErrRollback) {
+		t.Errorf("Expected a conflicting list with the same version to fail, got: %v", err)
+	}
+
+	// Bob revokes his second device.
+	second, err := first.Next(bob.identityKeyPair, devices[:1], 2)
+	if err != nil {
+		t.Fatal("Unable to create next device list: ", err)
+	}
+	if err := devicelist.Accept(listStore, "Bob", identityKey, second); err != nil {
+		t.Fatal("Unable to accept next device list: ", err)
+	}
+	if stored := listStore.LoadDeviceList("Bob"); stored == nil || stored.Version() != 2 || !stored.IsRevoked(2) {
+		t.Fatalf("Unexpected stored device list: %+v", stored)
+	}
+	if err := devicelist.Accept(listStore, "Bob", identityKey, first); !errors.Is(err, devicelist.ErrRollback) {
+		t.Errorf("Expected an older list to fail, got: %v", err)
+	}
+	restored, _ := devicelist.NewList(bob.identityKeyPair, 3, devices, nil)
+	if err := devicelist.Accept(listStore, "Bob", identityKey, restored); !errors.Is(err, devicelist.ErrRevokedDevice) {
+		t.Errorf("Expected a list restoring a revoked device to fail, got: %v", err)
+	}
+
+	// Lists signed by another key are never accepted, but after Bob
+	// reinstalls, his new identity starts over.
+	reinstalled := newUser("Bob", 1, serializer)
+	newFirst, _ := devicelist.NewList(reinstalled.identityKeyPair, 1, devices, nil)
+	if err := devicelist.Accept(listStore, "Bob", identityKey, newFirst); !errors.Is(err, devicelist.ErrInvalidSignature) {
+		t.Errorf("Expected a list of another identity to fail, got: %v", err)
+	}
+	if err := devicelist.Accept(listStore, "Bob", reinstalled.identityKeyPair.PublicKey(), newFirst); err != nil {
+		t.Error("Unable to accept the list of a new identity: ", err)
+	}
+}
+
+// TestSesameDeviceList checks that a sender refuses to encrypt for devices
+// that are not in the recipient's signed device list.
+func TestSesameDeviceList(t *testing.T) {
+	serializer := newSerializer()
+	server := newSesameServer(serializer)
+	alice := server.register(newUser("Alice", 1, serializer))
+	bob1 := server.register(newUser("Bob", 1, serializer))
+	bob2 := server.register(newUser("Bob", 2, serializer))
+	listStore := memstore.NewDeviceList(serializer)
+	aliceManager := server.newManager(alice)
+	aliceManager.SetDeviceLists(listStore)
+
+	// Without a device list, Alice doesn't send at all.
+	var unlisted *sesame.UnlistedDevicesError
+	if err := aliceManager.Send("Bob", []byte("Hello")); !errors.As(err, &unlisted) {
+		t.Fatalf("Expected an unlisted devices error, got: %v", err)
+	}
+
+	// Bob's primary device signs his device list.
+	list, _ := devicelist.NewList(bob1.identityKeyPair, 1, []devicelist.Device{
+		{DeviceID: 1, RegistrationID: bob1.registrationID},
+		{DeviceID: 2, RegistrationID: bob2.registrationID},
+	}, nil)
+	if err := devicelist.Accept(listStore, "Bob", bob1.identityKeyPair.PublicKey(), list); err != nil {
+		t.Fatal("Unable to accept device list: ", err)
+	}
+	sendSesame(aliceManager, "Bob", "Hello", t)
+	server.receive(bob1, "Hello", t)
+	server.receive(bob2, "Hello", t)
+
+	// The server adds a device that Bob didn't list.
+	server.register(newUser("Bob", 3, serializer))
+	err := aliceManager.Send("Bob", []byte("Injected"))
+	if !errors.As(err, &unlisted) || len(unlisted.DeviceIDs) != 1 || unlisted.DeviceIDs[0] != 3 {
+		t.Fatalf("Expected device 3 to be unlisted, got: %v", err)
+	}
+	if len(server.inbox[*bob1.address]) != 0 {
+		t.Error("Nothing should be delivered when a device is unlisted.")
+	}
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/events"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// TestSessionEvents checks the lifecycle events published by the session
+// builder and cipher.
+func TestSessionEvents(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	aliceEvents, bobEvents := &eventRecorder{}, &eventRecorder{}
+	aliceBus, bobBus := events.NewBus(), events.NewBus()
+	aliceBus.Subscribe(aliceEvents.record)
+	bobBus.Subscribe(bobEvents.record)
+	alice.sessionBuilder.SetEventBus(aliceBus)
+	bob.sessionBuilder.SetEventBus(bobBus)
+
+	// Alice builds a session, and Bob builds his side from her message.
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	messageStrings, messages := sendMessages(1, aliceCipher, serializer, t)
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	created := aliceEvents.take()
+	if len(created) != 1 || !created[0].(*events.SessionCreated).Initiator {
+		t.Fatalf("Unexpected events for Alice: %+v", created)
+	}
+	received := bobEvents.take()
+	if len(received) != 2 {
+		t.Fatalf("Unexpected events for Bob: %+v", received)
+	}
+	if event, ok := received[0].(*events.SessionCreated); !ok || event.Initiator || event.Version != 3 {
+		t.Errorf("Unexpected session created event: %+v", received[0])
+	}
+	if event, ok := received[1].(*events.PreKeyConsumed); !ok || event.PreKeyID != bob.preKeys[0].ID().Value || event.LastResort {
+		t.Errorf("Unexpected prekey consumed event: %+v", received[1])
+	}
+
+	// A reply on the old session promotes it after Alice built a new one.
+	messageStrings, messages = sendMessages(1, bobCipher, serializer, t)
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 1)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	assertEventTypes(aliceEvents.take(), t, &events.SessionArchived{}, &events.SessionCreated{}, &events.StatePromoted{})
+
+	// Bob reinstalls with a new registration ID.
+	bob.registrationID++
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 2)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	reset := aliceEvents.take()
+	assertEventTypes(reset, t, &events.SessionArchived{}, &events.SessionReset{}, &events.SessionCreated{})
+	if event := reset[1].(*events.SessionReset); event.NewRegistrationID != bob.registrationID {
+		t.Errorf("Unexpected session reset event: %+v", event)
+	}
+}
+
+// TestIdentityChangedEvent checks that a session built with a new remote
+// identity publishes an IdentityChanged event.
+func TestIdentityChangedEvent(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.sessionBuilder = session.NewBuilder(alice.sessionStore, alice.preKeyStore, alice.signedPreKeyStore,
+		&trustingIdentityStore{alice.identityStore}, bob.address, serializer)
+
+	recorder := &eventRecorder{}
+	bus := events.NewBus()
+	bus.Subscribe(recorder.record)
+	alice.sessionBuilder.SetEventBus(bus)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	recorder.take()
+
+	reinstalled := newUser("Bob", 2, serializer)
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(reinstalled, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	changed := recorder.take()
+	if len(changed) == 0 {
+		t.Fatal("Expected an identity changed event.")
+	}
+	event, ok := changed[0].(*events.IdentityChanged)
+	if !ok {
+		t.Fatalf("Unexpected events: %+v", changed)
+	}
+	if event.OldIdentity.Fingerprint() != bob.identityKeyPair.PublicKey().Fingerprint() ||
+		event.NewIdentity.Fingerprint() != reinstalled.identityKeyPair.PublicKey().Fingerprint() {
+		t.Errorf("Unexpected identities in event: %+v", event)
+	}
+}
+
+// TestAsyncSubscriber checks that asynchronous subscribers receive events in
+// order and stop after unsubscribing.
+func TestAsyncSubscriber(t *testing.T) {
+	bus := events.NewBus()
+	received := make(chan events.Event, 10)
+	block := make(chan struct{})
+	unsubscribe := bus.SubscribeAsync(func(event events.Event) {
+		<-block
+		received <- event
+	})
+
+	// Publishing doesn't wait for the blocked subscriber.
+	address := protocol.NewSignalAddress("Bob", 1)
+	for i := uint32(1); i <= 3; i++ {
+		bus.Publish(&events.PreKeyConsumed{RemoteAddress: address, PreKeyID: i})
+	}
+	unsubscribe()
+	bus.Publish(&events.PreKeyConsumed{RemoteAddress: address, PreKeyID: 4})
+	close(block)
+
+	for i := uint32(1); i <= 3; i++ {
+		select {
+		case event := <-received:
+			if id := event.(*events.PreKeyConsumed).PreKeyID; id != i {
+				t.Errorf("Got prekey %d, want %d", id, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for event ", i)
+		}
+	}
+	select {
+	case event := <-received:
+		t.Errorf("Got event after unsubscribing: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// eventRecorder records the events it is called with.
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []events.Event
+}
+
+func (r *eventRecorder) record(event events.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+// take returns and clears the recorded events.
+func (r *eventRecorder) take() []events.Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	recorded := r.events
+	r.events = nil
+	return recorded
+}
+
+// assertEventTypes checks that the given events have the types of the
+// expected events, in order.
+func assertEventTypes(recorded []events.Event, t *testing.T, expected ...events.Event) {
+	if len(recorded) != len(expected) {
+		t.Fatalf("Got %d events, want %d: %+v", len(recorded), len(expected), recorded)
+	}
+	for i := range expected {
+		if got, want := eventType(recorded[i]), eventType(expected[i]); got != want {
+			t.Errorf("Got event %s at %d, want %s", got, i, want)
+		}
+	}
+}
+
+// eventType returns the name of the given event's type.
+func eventType(event events.Event) string {
+	switch event.(type) {
+	case *events.SessionCreated:
+		return "SessionCreated"
+	case *events.SessionArchived:
+		return "SessionArchived"
+	case *events.SessionReset:
+		return "SessionReset"
+	case *events.StatePromoted:
+		return "StatePromoted"
+	case *events.IdentityChanged:
+		return "IdentityChanged"
+	case *events.PreKeyConsumed:
+		return "PreKeyConsumed"
+	}
+	return "unknown"
+}
+
+// trustingIdentityStore is an identity store that trusts every identity.
+type trustingIdentityStore struct {
+	*memstore.IdentityKey
+}
+
+func (s *trustingIdentityStore) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	return true
+}
@@ -0,0 +1,633 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/devicelist"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/ratchet"
+	groupRecord "github.com/kabuke/fix-forside-libsignal-protocol-go/groups/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/message"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/provisioning"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+)
+
+// fuzzSeeds holds valid serializations of every object that can be
+// decoded from bytes. They are used as the seed corpus for the fuzz targets.
+type fuzzSeeds struct {
+	signalMessage                []byte
+	preKeySignalMessage          []byte
+	senderKeyMessage             []byte
+	senderKeyDistributionMessage []byte
+	preKey                       []byte
+	signedPreKey                 []byte
+	session                      []byte
+	sessionState                 []byte
+	senderKey                    []byte
+	senderKeyState               []byte
+	identityKeyPair              []byte
+}
+
+// newFuzzSeeds runs a short conversation between two users and collects
+// the serialized messages and records it produces. Bob receives Alice's
+// messages out of order, so his session holds a skipped message key. The
+// session record seed is an empty record instead, since the fuzzer's
+// minimization time grows with the square of the input size and session
+// states are fuzzed on their own.
+func newFuzzSeeds(tb testing.TB, serializer *serialize.Serializer) *fuzzSeeds {
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		tb.Fatal("Unable to process bundle: ", err)
+	}
+
+	// Alice sends two messages, Bob decrypts the second one first.
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	first, err := aliceCipher.Encrypt([]byte("first"))
+	if err != nil {
+		tb.Fatal("Unable to encrypt message: ", err)
+	}
+	second, err := aliceCipher.Encrypt([]byte("second"))
+	if err != nil {
+		tb.Fatal("Unable to encrypt message: ", err)
+	}
+	received, err := protocol.NewPreKeySignalMessageFromBytes(second.Serialize(), serializer.PreKeySignalMessage, serializer.SignalMessage)
+	if err != nil {
+		tb.Fatal("Unable to decode prekey message: ", err)
+	}
+	if _, err := bob.sessionBuilder.Process(received); err != nil {
+		tb.Fatal("Unable to process prekey message: ", err)
+	}
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	if _, err := bobCipher.Decrypt(received.WhisperMessage()); err != nil {
+		tb.Fatal("Unable to decrypt message: ", err)
+	}
+	bobSession := bob.sessionStore.LoadSession(alice.address)
+
+	// Alice starts a group and sends a message to it.
+	senderKeyName := protocol.NewSenderKeyName("fuzz", alice.address)
+	skdm, err := alice.groupBuilder.Create(senderKeyName)
+	if err != nil {
+		tb.Fatal("Unable to create group session: ", err)
+	}
+	groupCipher := groups.NewGroupCipher(alice.groupBuilder, senderKeyName, alice.senderKeyStore)
+	groupMessage, err := groupCipher.Encrypt([]byte("group"))
+	if err != nil {
+		tb.Fatal("Unable to encrypt group message: ", err)
+	}
+	senderKey := alice.senderKeyStore.LoadSenderKey(senderKeyName)
+	senderKeyState, err := senderKey.SenderKeyState()
+	if err != nil {
+		tb.Fatal("Unable to load sender key state: ", err)
+	}
+
+	return &fuzzSeeds{
+		signalMessage:                received.WhisperMessage().Serialize(),
+		preKeySignalMessage:          first.Serialize(),
+		senderKeyMessage:             groupMessage.(*protocol.SenderKeyMessage).SignedSerialize(),
+		senderKeyDistributionMessage: skdm.Serialize(),
+		preKey:                       bob.preKeys[1].Serialize(),
+		signedPreKey:                 bob.signedPreKey.Serialize(),
+		session:                      record.NewSession(serializer.Session, serializer.State).Serialize(),
+		sessionState:                 bobSession.SessionState().Serialize(),
+		senderKey:                    senderKey.Serialize(),
+		senderKeyState:               senderKeyState.Serialize(),
+		identityKeyPair:              alice.identityKeyPair.Serialize(serializer.IdentityKeyPair),
+	}
+}
+
+// addFuzzSeeds adds the given seed and a few truncated and empty variants
+// of it to the fuzz corpus. Logging is turned off while fuzzing, since
+// formatting the decoded objects takes longer than decoding them.
+func addFuzzSeeds(f *testing.F, seed []byte) {
+	previousLogger := logger.Logger
+	logger.Logger = &quietLogger{}
+	f.Cleanup(func() { logger.Logger = previousLogger })
+
+	f.Add(seed)
+	f.Add(seed[:len(seed)/2])
+	f.Add([]byte{})
+	f.Add([]byte("null"))
+	f.Add([]byte("{}"))
+}
+
+// quietLogger is a logger that drops every message.
+type quietLogger struct{}
+
+func (q *quietLogger) Debug(caller, message string)   {}
+func (q *quietLogger) Info(caller, message string)    {}
+func (q *quietLogger) Warning(caller, message string) {}
+func (q *quietLogger) Error(caller, message string)   {}
+func (q *quietLogger) Configure(settings string)      {}
+
+func FuzzSignalMessage(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).signalMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewSignalMessageFromBytes(data, serializer.SignalMessage)
+		if err == nil {
+			msg.Serialize()
+		}
+	})
+}
+
+func FuzzLegacySignalMessage(f *testing.F) {
+	serializer := newSerializer()
+	ratchetKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		f.Fatal("Unable to generate key pair: ", err)
+	}
+
+	// The library refuses to build version 2 messages, so the seed is built
+	// from its structure.
+	structure := &protocol.SignalMessageStructure{
+		Version:    version.V2.Version,
+		Counter:    1,
+		RatchetKey: ratchetKeyPair.PublicKey().Serialize(),
+		CipherText: []byte("ciphertext"),
+		Mac:        make([]byte, version.V2.MacLength),
+	}
+	addFuzzSeeds(f, serializer.SignalMessage.Serialize(structure))
+	f.Add(newFuzzSeeds(f, serializer).signalMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewLegacySignalMessageFromBytes(data, serializer.SignalMessage)
+		if err == nil {
+			msg.Serialize()
+		}
+	})
+}
+
+func FuzzPreKeySignalMessage(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).preKeySignalMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewPreKeySignalMessageFromBytes(data, serializer.PreKeySignalMessage, serializer.SignalMessage)
+		if err == nil {
+			msg.Serialize()
+		}
+	})
+}
+
+func FuzzHeaderEncryptedMessage(f *testing.F) {
+	serializer := newSerializer()
+	identityKeyPair, err := ecc.GenerateKeyPair()
+	if err != nil {
+		f.Fatal("Unable to generate key pair: ", err)
+	}
+	identityKey := identity.NewKey(identityKeyPair.PublicKey())
+	header := protocol.NewMessageHeader(identityKeyPair.PublicKey(), 1, 0)
+	msg, err := protocol.NewHeaderEncryptedMessage(version.Default, header, make([]byte, 32), make([]byte, 32),
+		[]byte("ciphertext"), identityKey, identityKey, serializer.HeaderEncryptedMessage)
+	if err != nil {
+		f.Fatal("Unable to create header encrypted message: ", err)
+	}
+	addFuzzSeeds(f, msg.Serialize())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewHeaderEncryptedMessageFromBytes(data, serializer.HeaderEncryptedMessage)
+		if err == nil {
+			msg.DecryptHeader(make([]byte, 32))
+			msg.Serialize()
+		}
+	})
+}
+
+func FuzzSenderKeyMessage(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).senderKeyMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewSenderKeyMessageFromBytes(data, serializer.SenderKeyMessage)
+		if err == nil {
+			msg.SignedSerialize()
+		}
+	})
+}
+
+func FuzzSenderKeyDistributionMessage(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).senderKeyDistributionMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.NewSenderKeyDistributionMessageFromBytes(data, serializer.SenderKeyDistributionMessage)
+		if err == nil {
+			msg.Serialize()
+		}
+	})
+}
+
+func FuzzPreKeyRecord(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).preKey)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		preKey, err := record.NewPreKeyFromBytes(data, serializer.PreKeyRecord)
+		if err == nil {
+			preKey.Serialize()
+		}
+	})
+}
+
+func FuzzSignedPreKeyRecord(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).signedPreKey)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		signedPreKey, err := record.NewSignedPreKeyFromBytes(data, serializer.SignedPreKeyRecord)
+		if err == nil {
+			signedPreKey.Serialize()
+		}
+	})
+}
+
+func FuzzSessionRecord(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).session)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sessionRecord, err := record.NewSessionFromBytes(data, serializer.Session, serializer.State)
+		if err == nil {
+			sessionRecord.Serialize()
+		}
+	})
+}
+
+func FuzzSessionState(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).sessionState)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		state, err := record.NewStateFromBytes(data, serializer.State)
+		if err == nil {
+			state.Serialize()
+		}
+	})
+}
+
+func FuzzSenderKeyRecord(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).senderKey)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		senderKey, err := groupRecord.NewSenderKeyFromBytes(data, serializer.SenderKeyRecord, serializer.SenderKeyState)
+		if err == nil {
+			senderKey.Serialize()
+		}
+	})
+}
+
+func FuzzSenderKeyState(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).senderKeyState)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		state, err := groupRecord.NewSenderKeyStateFromBytes(data, serializer.SenderKeyState)
+		if err == nil {
+			state.Serialize()
+		}
+	})
+}
+
+func FuzzIdentityKeyPair(f *testing.F) {
+	serializer := newSerializer()
+	addFuzzSeeds(f, newFuzzSeeds(f, serializer).identityKeyPair)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		keyPair, err := identity.NewKeyPairFromBytes(data, serializer.IdentityKeyPair)
+		if err == nil {
+			keyPair.Serialize(serializer.IdentityKeyPair)
+		}
+	})
+}
+
+func FuzzProvisionEnvelope(f *testing.F) {
+	serializer := newSerializer()
+	ephemeral, message := newProvisionFuzzSeed(f)
+	envelope, err := provisioning.EncryptMessage(ephemeral.PublicKey(), message, serializer.ProvisionMessage)
+	if err != nil {
+		f.Fatal("Unable to encrypt provisioning message: ", err)
+	}
+	addFuzzSeeds(f, envelope.Serialize(serializer.ProvisionEnvelope))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		envelope, err := provisioning.NewEnvelopeFromBytes(data, serializer.ProvisionEnvelope)
+		if err == nil {
+			provisioning.DecryptMessage(ephemeral, envelope, serializer.ProvisionMessage)
+			envelope.Serialize(serializer.ProvisionEnvelope)
+		}
+	})
+}
+
+func FuzzProvisionMessage(f *testing.F) {
+	serializer := newSerializer()
+	_, message := newProvisionFuzzSeed(f)
+	addFuzzSeeds(f, message.Serialize(serializer.ProvisionMessage))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := provisioning.NewMessageFromBytes(data, serializer.ProvisionMessage)
+		if err == nil {
+			message.Serialize(serializer.ProvisionMessage)
+		}
+	})
+}
+
+// newProvisionFuzzSeed returns a new device's ephemeral key pair and a
+// provisioning message with every field set.
+func newProvisionFuzzSeed(f *testing.F) (*ecc.ECKeyPair, *provisioning.Message) {
+	ephemeral, err := ecc.GenerateKeyPair()
+	if err != nil {
+		f.Fatal("Unable to generate ephemeral key pair: ", err)
+	}
+	aciIdentityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		f.Fatal("Unable to generate ACI identity: ", err)
+	}
+	pniIdentityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		f.Fatal("Unable to generate PNI identity: ", err)
+	}
+
+	message := provisioning.NewMessage(aciIdentityKeyPair, protocol.NewACI(testUUIDBytes), "+15555550123", "123456")
+	message.SetPNI(protocol.NewPNI([16]byte{1, 2, 3, 4}), pniIdentityKeyPair)
+	message.SetProfileKey([]byte("profile key"))
+	message.SetUserAgent("Go")
+	message.SetReadReceipts(true)
+
+	return ephemeral, message
+}
+
+func FuzzDeviceList(f *testing.F) {
+	serializer := newSerializer()
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		f.Fatal("Error generating identity keys: ", err)
+	}
+	list, err := devicelist.NewList(identityKeyPair, 2,
+		[]devicelist.Device{{DeviceID: 1, RegistrationID: 100}, {DeviceID: 3, RegistrationID: 300}}, []uint32{2})
+	if err != nil {
+		f.Fatal("Unable to create device list: ", err)
+	}
+	addFuzzSeeds(f, list.Serialize(serializer.DeviceList))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		list, err := devicelist.NewListFromBytes(data, serializer.DeviceList)
+		if err == nil {
+			list.Verify(identityKeyPair.PublicKey())
+			list.Serialize(serializer.DeviceList)
+		}
+	})
+}
+
+// mlsFuzzSeeds holds valid serializations of every MLS object that can be
+// decoded from bytes.
+type mlsFuzzSeeds struct {
+	identityKeyPair    *identity.KeyPair
+	keyPackageRecord   []byte
+	keyPackage         []byte
+	proposal           []byte
+	commit             []byte
+	welcome            []byte
+	applicationMessage []byte
+	group              []byte
+}
+
+// newMLSFuzzSeeds has Alice create a group, add Bob and send a message, and
+// collects the serialized objects it produces.
+func newMLSFuzzSeeds(tb testing.TB) *mlsFuzzSeeds {
+	alice, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		tb.Fatal("Unable to generate identity key pair: ", err)
+	}
+	bob, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		tb.Fatal("Unable to generate identity key pair: ", err)
+	}
+	keyPackageRecord, err := mls.NewKeyPackageRecord(bob)
+	if err != nil {
+		tb.Fatal("Unable to create key package: ", err)
+	}
+
+	group, err := mls.NewGroup([]byte("fuzz"), alice)
+	if err != nil {
+		tb.Fatal("Unable to create group: ", err)
+	}
+	proposal, err := group.ProposeAdd(keyPackageRecord.KeyPackage())
+	if err != nil {
+		tb.Fatal("Unable to propose add: ", err)
+	}
+	commit, welcome, err := group.Commit()
+	if err != nil {
+		tb.Fatal("Unable to commit: ", err)
+	}
+	message, err := group.Encrypt([]byte("fuzz"))
+	if err != nil {
+		tb.Fatal("Unable to encrypt: ", err)
+	}
+
+	return &mlsFuzzSeeds{
+		identityKeyPair:    alice,
+		keyPackageRecord:   keyPackageRecord.Serialize(),
+		keyPackage:         keyPackageRecord.KeyPackage().Serialize(),
+		proposal:           proposal.Serialize(),
+		commit:             commit.Serialize(),
+		welcome:            welcome.Serialize(),
+		applicationMessage: message.Serialize(),
+		group:              group.Serialize(),
+	}
+}
+
+func FuzzMLSKeyPackageRecord(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).keyPackageRecord)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		record, err := mls.NewKeyPackageRecordFromBytes(data)
+		if err == nil {
+			record.Serialize()
+		}
+	})
+}
+
+func FuzzMLSKeyPackage(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).keyPackage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		keyPackage, err := mls.NewKeyPackageFromBytes(data)
+		if err == nil {
+			keyPackage.Verify()
+			keyPackage.Serialize()
+		}
+	})
+}
+
+func FuzzMLSProposal(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).proposal)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		proposal, err := mls.NewProposalFromBytes(data)
+		if err == nil {
+			proposal.Serialize()
+		}
+	})
+}
+
+func FuzzMLSCommit(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).commit)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		commit, err := mls.NewCommitFromBytes(data)
+		if err == nil {
+			commit.Serialize()
+		}
+	})
+}
+
+func FuzzMLSWelcome(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).welcome)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		welcome, err := mls.NewWelcomeFromBytes(data)
+		if err == nil {
+			welcome.KeyPackageRefs()
+			welcome.Serialize()
+		}
+	})
+}
+
+func FuzzMLSApplicationMessage(f *testing.F) {
+	addFuzzSeeds(f, newMLSFuzzSeeds(f).applicationMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := mls.NewApplicationMessageFromBytes(data)
+		if err == nil {
+			message.Serialize()
+		}
+	})
+}
+
+func FuzzMLSGroup(f *testing.F) {
+	seeds := newMLSFuzzSeeds(f)
+	addFuzzSeeds(f, seeds.group)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		group, err := mls.NewGroupFromBytes(data, seeds.identityKeyPair)
+		if err == nil {
+			group.Serialize()
+		}
+	})
+}
+
+// TestMalformedStructures checks that malformed structures are rejected
+// with typed decode errors instead of panicking.
+func TestMalformedStructures(t *testing.T) {
+	serializer := newSerializer()
+	seeds := newFuzzSeeds(t, serializer)
+
+	signalMessage, _ := serializer.SignalMessage.Deserialize(seeds.signalMessage)
+	senderKeyMessage, _ := serializer.SenderKeyMessage.Deserialize(seeds.senderKeyMessage)
+	skdm, _ := serializer.SenderKeyDistributionMessage.Deserialize(seeds.senderKeyDistributionMessage)
+
+	tests := []struct {
+		name   string
+		decode func() error
+		want   error
+	}{
+		{"empty point", func() error {
+			_, err := ecc.DecodePoint(nil, 0)
+			return err
+		}, errorhelper.ErrMissingField},
+		{"short point", func() error {
+			_, err := ecc.DecodePoint([]byte{ecc.DjbType, 1, 2, 3}, 0)
+			return err
+		}, errorhelper.ErrInvalidLength},
+		{"point offset past end", func() error {
+			_, err := ecc.DecodePoint([]byte{ecc.DjbType}, 5)
+			return err
+		}, errorhelper.ErrMissingField},
+		{"bad key type", func() error {
+			_, err := ecc.DecodePoint(make([]byte, 33), 0)
+			return err
+		}, errorhelper.ErrInvalidKeyType},
+		{"legacy signal message", func() error {
+			structure := *signalMessage
+			structure.Version = protocol.UnsupportedVersion
+			_, err := protocol.NewSignalMessageFromStruct(&structure, serializer.SignalMessage)
+			return err
+		}, errorhelper.ErrLegacyVersion},
+		{"future signal message", func() error {
+			structure := *signalMessage
+			structure.Version = version.Latest + 1
+			_, err := protocol.NewSignalMessageFromStruct(&structure, serializer.SignalMessage)
+			return err
+		}, errorhelper.ErrUnknownVersion},
+		{"short mac", func() error {
+			structure := *signalMessage
+			structure.Mac = structure.Mac[:4]
+			_, err := protocol.NewSignalMessageFromStruct(&structure, serializer.SignalMessage)
+			return err
+		}, errorhelper.ErrInvalidLength},
+		{"missing sender key signature", func() error {
+			structure := *senderKeyMessage
+			structure.Signature = nil
+			_, err := protocol.NewSenderKeyMessageFromStruct(&structure, serializer.SenderKeyMessage)
+			return err
+		}, errorhelper.ErrMissingField},
+		{"short distribution chain key", func() error {
+			structure := *skdm
+			structure.ChainKey = structure.ChainKey[:16]
+			_, err := protocol.NewSenderKeyDistributionMessageFromStruct(&structure, serializer.SenderKeyDistributionMessage)
+			return err
+		}, errorhelper.ErrInvalidLength},
+		{"short message key", func() error {
+			_, err := message.NewKeysFromStruct(&message.KeysStructure{
+				CipherKey: make([]byte, 32),
+				MacKey:    make([]byte, 32),
+				IV:        make([]byte, 8),
+			})
+			return err
+		}, errorhelper.ErrInvalidLength},
+		{"missing chain", func() error {
+			_, err := record.NewChainFromStructure(nil)
+			return err
+		}, errorhelper.ErrMissingField},
+		{"too many receiver chains", func() error {
+			_, err := record.NewStateFromStructure(&record.StateStructure{
+				ReceiverChains: make([]*record.ChainStructure, 6),
+			}, serializer.State)
+			return err
+		}, errorhelper.ErrInvalidCounter},
+		{"unacknowledged prekey without base key", func() error {
+			_, err := record.NewUnackPreKeyMessageItemsFromStruct(&record.UnackPreKeyMessageItemsStructure{})
+			return err
+		}, errorhelper.ErrMissingField},
+		{"short pending key exchange", func() error {
+			_, err := record.NewPendingKeyExchangeFromStruct(&record.PendingKeyExchangeStructure{
+				LocalBaseKeyPublic: make([]byte, 31),
+			})
+			return err
+		}, errorhelper.ErrInvalidLength},
+		{"sender key state with future message key", func() error {
+			_, err := groupRecord.NewSenderKeyStateFromBytes(corruptSenderKeyState(t, seeds, serializer), serializer.SenderKeyState)
+			return err
+		}, errorhelper.ErrInvalidCounter},
+	}
+
+	for _, test := range tests {
+		err := test.decode()
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		var decodeErr *errorhelper.DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("%s: error %v is not a DecodeError", test.name, err)
+		}
+	}
+}
+
+// corruptSenderKeyState returns the seed sender key state with a stored
+// message key that is ahead of its chain key.
+func corruptSenderKeyState(t *testing.T, seeds *fuzzSeeds, serializer *serialize.Serializer) []byte {
+	structure, err := serializer.SenderKeyState.Deserialize(seeds.senderKeyState)
+	if err != nil {
+		t.Fatal("Unable to deserialize sender key state: ", err)
+	}
+	structure.Keys = append(structure.Keys, &ratchet.SenderMessageKeyStructure{
+		Iteration: structure.SenderChainKey.Iteration + 10,
+		IV:        make([]byte, 16),
+		CipherKey: make([]byte, 32),
+	})
+	return serializer.SenderKeyState.Serialize(structure)
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// TestHeaderEncryption checks that header encrypted sessions work in both
+// directions over several ratchet steps.
+func TestHeaderEncryption(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, aliceCipher, bobCipher := buildHeaderEncryptedSessions(serializer, t)
+
+	if !alice.sessionStore.LoadSession(bob.address).SessionState().HeaderEncrypted() {
+		t.Fatal("Alice's session should be header encrypted.")
+	}
+	if !bob.sessionStore.LoadSession(alice.address).SessionState().HeaderEncrypted() {
+		t.Fatal("Bob's session should be header encrypted.")
+	}
+
+	for i := 0; i < 4; i++ {
+		messageStrings, messages := sendMessages(3, bobCipher, serializer, t)
+		assertHeaderEncrypted(messages, t)
+		receiveMessages(messages, messageStrings, aliceCipher, t)
+
+		messageStrings, messages = sendMessages(3, aliceCipher, serializer, t)
+		assertHeaderEncrypted(messages, t)
+		receiveMessages(messages, messageStrings, bobCipher, t)
+	}
+}
+
+// TestHeaderEncryptionOutOfOrder checks that skipped messages are found by
+// the header keys of older chains.
+func TestHeaderEncryptionOutOfOrder(t *testing.T) {
+	serializer := newSerializer()
+	_, _, aliceCipher, bobCipher := buildHeaderEncryptedSessions(serializer, t)
+
+	// Bob sends on two chains, and Alice receives them in reverse order.
+	firstStrings, firstMessages := sendMessages(3, bobCipher, serializer, t)
+	receiveMessages(firstMessages[:1], firstStrings[:1], aliceCipher, t)
+	messageStrings, messages := sendMessages(1, aliceCipher, serializer, t)
+	receiveMessages(messages, messageStrings, bobCipher, t)
+	secondStrings, secondMessages := sendMessages(3, bobCipher, serializer, t)
+
+	receiveMessages(secondMessages[2:], secondStrings[2:], aliceCipher, t)
+	receiveMessages(firstMessages[2:], firstStrings[2:], aliceCipher, t)
+	receiveMessages(secondMessages[:2], secondStrings[:2], aliceCipher, t)
+	receiveMessages(firstMessages[1:2], firstStrings[1:2], aliceCipher, t)
+
+	// A message can't be decrypted twice.
+	if _, err := aliceCipher.DecryptHeaderEncrypted(firstMessages[1].(*protocol.HeaderEncryptedMessage)); err == nil {
+		t.Error("A replayed message should not decrypt.")
+	}
+}
+
+// TestHeaderEncryptionHidesHeader checks that the sender ratchet key is not
+// sent in the clear.
+func TestHeaderEncryptionHidesHeader(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, _, bobCipher := buildHeaderEncryptedSessions(serializer, t)
+
+	message := encryptMessage("Hello", bobCipher, serializer, t)
+	ratchetKey := bob.sessionStore.LoadSession(alice.address).SessionState().SenderRatchetKey().PublicKey()
+	if bytes.Contains(message.Serialize(), ratchetKey[:]) {
+		t.Error("Header encrypted message contains the sender ratchet key.")
+	}
+
+	// A header can't be decrypted with the wrong key.
+	headerMessage := message.(*protocol.HeaderEncryptedMessage)
+	if _, err := headerMessage.DecryptHeader(make([]byte, 32)); err == nil {
+		t.Error("Header decrypted with the wrong key.")
+	}
+}
+
+// TestHeaderEncryptionNotEnabled checks that a header encrypted session is
+// only accepted if the receiver has enabled header encryption.
+func TestHeaderEncryptionNotEnabled(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+	alice.sessionBuilder.SetHeaderEncryption(true)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	message := encryptMessage("Hello", aliceCipher, serializer, t).(*protocol.PreKeySignalMessage)
+	if !message.IsHeaderEncrypted() || message.WhisperMessage() != nil {
+		t.Fatal("Expected a header encrypted prekey message.")
+	}
+	if _, err := bob.sessionBuilder.Process(message); err == nil {
+		t.Error("Processed a header encrypted message without header encryption enabled.")
+	}
+}
+
+// TestHeaderEncryptionCipherFromSession checks that a cipher built without a
+// session builder continues a header encrypted session.
+func TestHeaderEncryptionCipherFromSession(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, _, bobCipher := buildHeaderEncryptedSessions(serializer, t)
+
+	// The session is moved into a new store, which has no session yet.
+	sessionStore := memstore.NewSession(serializer)
+	aliceCipher := session.NewCipherFromSession(
+		alice.sessionStore.LoadSession(bob.address), bob.address,
+		sessionStore, alice.preKeyStore,
+		serializer.PreKeySignalMessage, serializer.SignalMessage,
+	)
+	if !sessionStore.ContainsSession(bob.address) {
+		t.Fatal("Expected the session to be stored.")
+	}
+	if _, err := aliceCipher.Encrypt([]byte("Hello")); err == nil {
+		t.Fatal("Expected encryption to fail without a header encrypted message serializer.")
+	}
+	aliceCipher.SetHeaderEncryptedMessageSerializer(serializer.HeaderEncryptedMessage)
+
+	for i := 0; i < 2; i++ {
+		messageStrings, messages := sendMessages(3, aliceCipher, serializer, t)
+		assertHeaderEncrypted(messages, t)
+		receiveMessages(messages, messageStrings, bobCipher, t)
+
+		messageStrings, messages = sendMessages(3, bobCipher, serializer, t)
+		receiveMessages(messages, messageStrings, aliceCipher, t)
+	}
+
+	// A cipher built with a serializer has every message serializer.
+	aliceCipher = session.NewCipherWithSerializer(bob.address, sessionStore, alice.preKeyStore, serializer)
+	messageStrings, messages := sendMessages(3, aliceCipher, serializer, t)
+	assertHeaderEncrypted(messages, t)
+	receiveMessages(messages, messageStrings, bobCipher, t)
+}
+
+// buildHeaderEncryptedSessions builds an acknowledged header encrypted
+// session between Alice and Bob.
+func buildHeaderEncryptedSessions(serializer *serialize.Serializer, t *testing.T) (*user, *user, *session.Cipher, *session.Cipher) {
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+	alice.sessionBuilder.SetHeaderEncryption(true)
+	bob.sessionBuilder.SetHeaderEncryption(true)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+
+	// Alice's first messages are sent as prekey messages until Bob replies.
+	messageStrings, messages := sendMessages(2, aliceCipher, serializer, t)
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	for i := range messages {
+		preKeyMessage := messages[i].(*protocol.PreKeySignalMessage)
+		headerMessage, err := protocol.NewHeaderEncryptedMessageFromBytes(
+			preKeyMessage.HeaderEncryptedMessage(), serializer.HeaderEncryptedMessage,
+		)
+		if err != nil {
+			t.Fatal("Unable to decode header encrypted message: ", err)
+		}
+		messages[i] = headerMessage
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	messageStrings, messages = sendMessages(1, bobCipher, serializer, t)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+
+	return alice, bob, aliceCipher, bobCipher
+}
+
+// assertHeaderEncrypted fails the test if any of the given messages is not
+// a header encrypted message.
+func assertHeaderEncrypted(messages []protocol.CiphertextMessage, t *testing.T) {
+	for _, message := range messages {
+		if message.Type() != protocol.HEADER_ENCRYPTED_TYPE {
+			t.Fatalf("Got message type %d, want %d", message.Type(), protocol.HEADER_ENCRYPTED_TYPE)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/hpke"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// hpkeVector is an RFC 9180 test vector, with the first two sequence
+// numbers and the three exports of each.
+type hpkeVector struct {
+	name        string
+	aead        hpke.AEAD
+	ikmE        string
+	ikmR        string
+	ikmS        string
+	enc         string
+	ciphertexts []string
+	exports     []string
+}
+
+// hpkeVectors are the RFC 9180 vectors of the supported suites and modes.
+var hpkeVectors = []hpkeVector{
+	{
+		name: "A.1.1 base AES-128-GCM",
+		aead: hpke.AES128GCM,
+		ikmE: "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234",
+		ikmR: "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037",
+		enc:  "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431",
+		ciphertexts: []string{
+			"f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a",
+			"af2d7e9ac9ae7e270f46ba1f975be53c09f8d875bdc8535458c2494e8a6eab251c03d0c22a56b8ca42c2063b84",
+		},
+		exports: []string{
+			"3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee",
+			"2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5",
+			"e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931",
+		},
+	},
+	{
+		name: "A.1.3 auth AES-128-GCM",
+		aead: hpke.AES128GCM,
+		ikmE: "6e6d8f200ea2fb20c30b003a8b4f433d2f4ed4c2658d5bc8ce2fef718059c9f7",
+		ikmR: "f1d4a30a4cef8d6d4e3b016e6fd3799ea057db4f345472ed302a67ce1c20cdec",
+		ikmS: "94b020ce91d73fca4649006c7e7329a67b40c55e9e93cc907d282bbbff386f58",
+		enc:  "23fb952571a14a25e3d678140cd0e5eb47a0961bb18afcf85896e5453c312e76",
+		ciphertexts: []string{
+			"5fd92cc9d46dbf8943e72a07e42f363ed5f721212cd90bcfd072bfd9f44e06b80fd17824947496e21b680c141b",
+			"d3736bb256c19bfa93d79e8f80b7971262cb7c887e35c26370cfed62254369a1b52e3d505b79dd699f002bc8ed",
+		},
+		exports: []string{
+			"28c70088017d70c896a8420f04702c5a321d9cbf0279fba899b59e51bac72c85",
+			"25dfc004b0892be1888c3914977aa9c9bbaf2c7471708a49e1195af48a6f29ce",
+			"5a0131813abc9a522cad678eb6bafaabc43389934adb8097d23c5ff68059eb64",
+		},
+	},
+	{
+		name: "A.2.1 base ChaCha20-Poly1305",
+		aead: hpke.ChaCha20Poly1305,
+		ikmE: "909a9b35d3dc4713a5e72a4da274b55d3d3821a37e5d099e74a647db583a904b",
+		ikmR: "1ac01f181fdf9f352797655161c58b75c656a6cc2716dcb66372da835542e1df",
+		enc:  "1afa08d3dec047a643885163f1180476fa7ddb54c6a8029ea33f95796bf2ac4a",
+		ciphertexts: []string{
+			"1c5250d8034ec2b784ba2cfd69dbdb8af406cfe3ff938e131f0def8c8b60b4db21993c62ce81883d2dd1b51a28",
+			"6b53c051e4199c518de79594e1c4ab18b96f081549d45ce015be002090bb119e85285337cc95ba5f59992dc98c",
+		},
+		exports: []string{
+			"4bbd6243b8bb54cec311fac9df81841b6fd61f56538a775e7c80a9f40160606e",
+			"8c1df14732580e5501b00f82b10a1647b40713191b7c1240ac80e2b68808ba69",
+			"5acb09211139c43b3090489a9da433e8a30ee7188ba8b0a9a1ccf0c229283e53",
+		},
+	},
+}
+
+// TestHPKEVectors checks the sender and recipient contexts against the
+// RFC 9180 test vectors.
+func TestHPKEVectors(t *testing.T) {
+	info := decodeHex("4f6465206f6e2061204772656369616e2055726e", t)
+	plaintext := []byte("Beauty is truth, truth beauty")
+	exporterContexts := [][]byte{nil, {0x00}, []byte("TestContext")}
+
+	for _, vector := range hpkeVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			suite, err := hpke.NewSuite(vector.aead)
+			if err != nil {
+				t.Fatal("Unable to create suite: ", err)
+			}
+			suite.SetRandom(bytes.NewReader(decodeHex(vector.ikmE, t)))
+			recipient, _ := hpke.DeriveKeyPair(decodeHex(vector.ikmR, t))
+
+			var enc []byte
+			var sender, receiver *hpke.Context
+			if vector.ikmS == "" {
+				enc, sender, err = suite.SetupBaseS(recipient.PublicKey(), info)
+				if err == nil {
+					receiver, err = suite.SetupBaseR(enc, recipient, info)
+				}
+			} else {
+				senderKeyPair, _ := hpke.DeriveKeyPair(decodeHex(vector.ikmS, t))
+				enc, sender, err = suite.SetupAuthS(recipient.PublicKey(), info, senderKeyPair)
+				if err == nil {
+					receiver, err = suite.SetupAuthR(enc, recipient, info, senderKeyPair.PublicKey())
+				}
+			}
+			if err != nil {
+				t.Fatal("Unable to set up contexts: ", err)
+			}
+			if !bytes.Equal(enc, decodeHex(vector.enc, t)) {
+				t.Errorf("Got encapsulated key %x, want %s", enc, vector.enc)
+			}
+
+			for i, expected := range vector.ciphertexts {
+				aad := []byte(fmt.Sprintf("Count-%d", i))
+				ciphertext, err := sender.Seal(aad, plaintext)
+				if err != nil {
+					t.Fatal("Unable to seal: ", err)
+				}
+				if !bytes.Equal(ciphertext, decodeHex(expected, t)) {
+					t.Errorf("Got ciphertext %d %x, want %s", i, ciphertext, expected)
+				}
+				opened, err := receiver.Open(aad, ciphertext)
+				if err != nil {
+					t.Fatal("Unable to open: ", err)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Errorf("Got plaintext %q, want %q", opened, plaintext)
+				}
+			}
+
+			for i, expected := range vector.exports {
+				exported, err := receiver.Export(exporterContexts[i], 32)
+				if err != nil {
+					t.Fatal("Unable to export: ", err)
+				}
+				if !bytes.Equal(exported, decodeHex(expected, t)) {
+					t.Errorf("Got export %d %x, want %s", i, exported, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestHPKEIdentityKeys seals to identity keys in base and auth mode with
+// every AEAD, and checks that the wrong keys and tampered ciphertexts fail.
+func TestHPKEIdentityKeys(t *testing.T) {
+	alice, _ := keyhelper.GenerateIdentityKeyPair()
+	bob, _ := keyhelper.GenerateIdentityKeyPair()
+	eve, _ := keyhelper.GenerateIdentityKeyPair()
+	aliceKeyPair, bobKeyPair, eveKeyPair := hpkeKeyPair(alice), hpkeKeyPair(bob), hpkeKeyPair(eve)
+	info := []byte("envelope v2")
+	aad := []byte("header")
+
+	for _, aead := range []hpke.AEAD{hpke.AES128GCM, hpke.AES256GCM, hpke.ChaCha20Poly1305} {
+		suite, err := hpke.NewSuite(aead)
+		if err != nil {
+			t.Fatal("Unable to create suite: ", err)
+		}
+
+		// Base mode.
+		enc, ciphertext, err := suite.Seal(bob.PublicKey().PublicKey(), info, aad, []byte("Hello Bob"))
+		if err != nil {
+			t.Fatal("Unable to seal: ", err)
+		}
+		plaintext, err := suite.Open(enc, bobKeyPair, info, aad, ciphertext)
+		if err != nil {
+			t.Fatal("Unable to open: ", err)
+		}
+		if string(plaintext) != "Hello Bob" {
+			t.Errorf("Got plaintext %q, want %q", plaintext, "Hello Bob")
+		}
+		if _, err := suite.Open(enc, eveKeyPair, info, aad, ciphertext); err != hpke.ErrOpen {
+			t.Error("Expected a ciphertext for Bob not to open for Eve, got: ", err)
+		}
+		if _, err := suite.Open(enc, bobKeyPair, []byte("envelope v3"), aad, ciphertext); err != hpke.ErrOpen {
+			t.Error("Expected a different info to fail, got: ", err)
+		}
+		tampered := append([]byte{}, ciphertext...)
+		tampered[0] ^= 0x01
+		if _, err := suite.Open(enc, bobKeyPair, info, aad, tampered); err != hpke.ErrOpen {
+			t.Error("Expected a tampered ciphertext to fail, got: ", err)
+		}
+		if _, err := suite.Open(enc[1:], bobKeyPair, info, aad, ciphertext); err != hpke.ErrInvalidEncapsulatedKey {
+			t.Error("Expected a short encapsulated key to fail, got: ", err)
+		}
+
+		// Auth mode.
+		enc, sender, err := suite.SetupAuthS(bob.PublicKey().PublicKey(), info, aliceKeyPair)
+		if err != nil {
+			t.Fatal("Unable to set up sender: ", err)
+		}
+		receiver, err := suite.SetupAuthR(enc, bobKeyPair, info, alice.PublicKey().PublicKey())
+		if err != nil {
+			t.Fatal("Unable to set up receiver: ", err)
+		}
+		forged, _ := suite.SetupAuthR(enc, bobKeyPair, info, eve.PublicKey().PublicKey())
+		for _, message := range []string{"first", "second"} {
+			ciphertext, err := sender.Seal(aad, []byte(message))
+			if err != nil {
+				t.Fatal("Unable to seal: ", err)
+			}
+			if _, err := forged.Open(aad, ciphertext); err != hpke.ErrOpen {
+				t.Error("Expected a message from Alice not to open as Eve's, got: ", err)
+			}
+			plaintext, err := receiver.Open(aad, ciphertext)
+			if err != nil {
+				t.Fatal("Unable to open: ", err)
+			}
+			if string(plaintext) != message {
+				t.Errorf("Got plaintext %q, want %q", plaintext, message)
+			}
+		}
+
+		senderSecret, _ := sender.Export([]byte("attachment key"), 32)
+		receiverSecret, _ := receiver.Export([]byte("attachment key"), 32)
+		if !bytes.Equal(senderSecret, receiverSecret) {
+			t.Error("The sender and receiver exported different secrets.")
+		}
+	}
+
+	if _, err := hpke.NewSuite(hpke.AEAD(0xffff)); err == nil {
+		t.Error("Expected the export-only AEAD to be unsupported.")
+	}
+}
+
+// hpkeKeyPair returns the ecc key pair of the given identity key pair.
+func hpkeKeyPair(keyPair *identity.KeyPair) *ecc.ECKeyPair {
+	return ecc.NewECKeyPair(keyPair.PublicKey().PublicKey(), keyPair.PrivateKey())
+}
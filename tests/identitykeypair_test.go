@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// TestIdentityKeyPairSerializing checks serializing and deserializing identity
+// key pairs with both the JSON and binary serializers.
+func TestIdentityKeyPairSerializing(t *testing.T) {
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Error generating identity keys: ", err)
+	}
+
+	serializers := map[string]identity.KeyPairSerializer{
+		"json":   newSerializer().IdentityKeyPair,
+		"binary": serialize.NewBinarySerializer().IdentityKeyPair,
+	}
+	for name, serializer := range serializers {
+		serialized := identityKeyPair.Serialize(serializer)
+		logger.Info("Serialized ", name, " identity key pair: ", len(serialized), " bytes")
+
+		deserialized, err := identity.NewKeyPairFromBytes(serialized, serializer)
+		if err != nil {
+			t.Fatal("Unable to deserialize ", name, " identity key pair: ", err)
+		}
+		assertSameKeyPair(identityKeyPair, deserialized, t)
+	}
+}
+
+// TestIdentityKeyPairMismatch checks that a key pair whose private key does not
+// belong to its public key is rejected.
+func TestIdentityKeyPairMismatch(t *testing.T) {
+	serializer := serialize.NewBinarySerializer().IdentityKeyPair
+	alice, _ := keyhelper.GenerateIdentityKeyPair()
+	bob, _ := keyhelper.GenerateIdentityKeyPair()
+
+	mixed := identity.NewKeyPair(alice.PublicKey(), bob.PrivateKey())
+	_, err := identity.NewKeyPairFromBytes(mixed.Serialize(serializer), serializer)
+	if err == nil {
+		t.Error("Mismatched identity key pair should not deserialize.")
+	}
+
+	_, err = identity.NewKeyPairFromBytes([]byte{0x0a, 0x05, 0x01}, serializer)
+	if err == nil {
+		t.Error("Truncated identity key pair should not deserialize.")
+	}
+}
+
+// TestIdentityKeyPairExport checks exporting and importing an identity key pair
+// with a passphrase.
+func TestIdentityKeyPairExport(t *testing.T) {
+	serializer := newSerializer().IdentityKeyPair
+	params := identity.ExportParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+	passphrase := []byte("correct horse battery staple")
+
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Error generating identity keys: ", err)
+	}
+
+	logger.Info("Exporting identity key pair...")
+	exported, err := identity.ExportKeyPairWithParams(identityKeyPair, passphrase, serializer, params)
+	if err != nil {
+		t.Fatal("Unable to export identity key pair: ", err)
+	}
+	if bytes.Contains(exported, bytehelper.ArrayToSlice(identityKeyPair.PrivateKey().Serialize())) {
+		t.Fatal("Export contains the private key in the clear.")
+	}
+
+	logger.Info("Importing identity key pair...")
+	imported, err := identity.ImportKeyPair(exported, passphrase, serializer)
+	if err != nil {
+		t.Fatal("Unable to import identity key pair: ", err)
+	}
+	assertSameKeyPair(identityKeyPair, imported, t)
+
+	// A wrong passphrase must fail.
+	_, err = identity.ImportKeyPair(exported, []byte("wrong"), serializer)
+	if err != identity.ErrBadPassphrase {
+		t.Error("Expected bad passphrase error, got: ", err)
+	}
+
+	// Any modification of the header or ciphertext must fail.
+	for _, i := range []int{0, 9, 20, len(exported) - 1} {
+		tampered := append([]byte{}, exported...)
+		tampered[i] ^= 0x01
+		if _, err := identity.ImportKeyPair(tampered, passphrase, serializer); err == nil {
+			t.Error("Tampered export at byte ", i, " should not import.")
+		}
+	}
+
+	// Truncated exports must fail.
+	if _, err := identity.ImportKeyPair(exported[:10], passphrase, serializer); err != identity.ErrExportTooShort {
+		t.Error("Expected export too short error, got: ", err)
+	}
+}
+
+// TestIdentityKeyPairImportLimit checks that exports with Argon2id parameters
+// above the hard cap or the caller's limit are rejected before deriving a key.
+func TestIdentityKeyPairImportLimit(t *testing.T) {
+	serializer := newSerializer().IdentityKeyPair
+	passphrase := []byte("correct horse battery staple")
+	identityKeyPair, _ := keyhelper.GenerateIdentityKeyPair()
+
+	params := identity.ExportParams{Time: 2, Memory: 16 * 1024, Threads: 1}
+	exported, err := identity.ExportKeyPairWithParams(identityKeyPair, passphrase, serializer, params)
+	if err != nil {
+		t.Fatal("Unable to export identity key pair: ", err)
+	}
+
+	// A limit at or above the export's parameters accepts it.
+	if _, err := identity.ImportKeyPairWithLimit(exported, passphrase, serializer, params); err != nil {
+		t.Error("Unable to import identity key pair within the limit: ", err)
+	}
+
+	// A stricter limit rejects it.
+	limits := []identity.ExportParams{{Time: 1}, {Memory: 8 * 1024}}
+	for _, limit := range limits {
+		_, err := identity.ImportKeyPairWithLimit(exported, passphrase, serializer, limit)
+		if err != identity.ErrInvalidExportParams {
+			t.Error("Expected invalid export params error for limit ", limit, ", got: ", err)
+		}
+	}
+
+	// Memory above 1 GiB is never accepted, even without a limit.
+	tooLarge := append([]byte{}, exported...)
+	binary.BigEndian.PutUint32(tooLarge[5:9], 1024*1024+1)
+	if _, err := identity.ImportKeyPair(tooLarge, passphrase, serializer); err != identity.ErrInvalidExportParams {
+		t.Error("Expected invalid export params error, got: ", err)
+	}
+}
+
+// assertSameKeyPair fails the test if the given identity key pairs differ.
+func assertSameKeyPair(expected, actual *identity.KeyPair, t *testing.T) {
+	if expected.PublicKey().Fingerprint() != actual.PublicKey().Fingerprint() {
+		t.Fatal("Public identity keys do not match.")
+	}
+	if expected.PrivateKey().Serialize() != actual.PrivateKey().Serialize() {
+		t.Fatal("Private identity keys do not match.")
+	}
+}
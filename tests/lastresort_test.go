@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/optional"
+)
+
+// TestLastResortPreKey checks that the last resort prekey uses the reserved ID
+// and is kept after sessions are built with it.
+func TestLastResortPreKey(t *testing.T) {
+	serializer := newSerializer()
+	bob := newUser("Bob", 2, serializer)
+
+	lastResortKey, err := keyhelper.GenerateLastResortKey(serializer.PreKeyRecord)
+	if err != nil {
+		t.Fatal("Unable to generate last resort key: ", err)
+	}
+	if lastResortKey.ID().Value != record.LastResortPreKeyID || !lastResortKey.IsLastResort() {
+		t.Fatal("Last resort key should use the reserved ID, got: ", lastResortKey.ID().Value)
+	}
+	bob.store.StorePreKey(lastResortKey.ID().Value, lastResortKey)
+	if !bob.store.LoadPreKey(record.LastResortPreKeyID).IsLastResort() {
+		t.Fatal("Stored last resort key lost its flag.")
+	}
+
+	// Several senders build sessions with the last resort key.
+	for _, name := range []string{"Alice", "Carol"} {
+		logger.Info(name, " building a session with Bob's last resort key...")
+		unsignedPreKeyID := processWithPreKey(t, newUser(name, 1, serializer), bob, lastResortKey, serializer)
+		if unsignedPreKeyID != nil {
+			t.Error("Using the last resort key should not report a used prekey.")
+		}
+		if !bob.store.ContainsPreKey(record.LastResortPreKeyID) {
+			t.Fatal("The last resort key was removed after ", name, " used it.")
+		}
+	}
+
+	// Regular prekeys are still removed.
+	processWithPreKey(t, newUser("Dave", 1, serializer), bob, bob.preKeys[1], serializer)
+	if bob.store.ContainsPreKey(bob.preKeys[1].ID().Value) {
+		t.Error("A regular prekey should be removed after it is used.")
+	}
+}
+
+// TestLastResortPreKeyMigration checks migrating a last resort key that was
+// stored under the legacy ID 0.
+func TestLastResortPreKeyMigration(t *testing.T) {
+	serializer := newSerializer()
+	bob := newUser("Bob", 2, serializer)
+
+	// Replace prekey 0 with a legacy, unflagged last resort key.
+	keyPair, _ := ecc.GenerateKeyPair()
+	legacyKey := record.NewPreKey(0, keyPair, serializer.PreKeyRecord)
+	bob.store.StorePreKey(0, legacyKey)
+
+	migrated, err := keyhelper.MigrateLastResortKey(bob.store, 0, serializer.PreKeyRecord)
+	if err != nil {
+		t.Fatal("Unable to migrate last resort key: ", err)
+	}
+	if migrated.ID().Value != record.LastResortPreKeyID || !bob.store.LoadPreKey(record.LastResortPreKeyID).IsLastResort() {
+		t.Error("Migrated key should be stored under the reserved ID.")
+	}
+	if !bob.store.LoadPreKey(0).IsLastResort() {
+		t.Error("Legacy key should be flagged as last resort.")
+	}
+
+	// Bundles published before the migration keep working, and the key stays.
+	processWithPreKey(t, newUser("Alice", 1, serializer), bob, legacyKey, serializer)
+	if !bob.store.ContainsPreKey(0) {
+		t.Error("The legacy last resort key was removed after it was used.")
+	}
+	processWithPreKey(t, newUser("Carol", 1, serializer), bob, migrated, serializer)
+
+	if _, err := keyhelper.MigrateLastResortKey(bob.store, 12345, serializer.PreKeyRecord); err == nil {
+		t.Error("Migrating a missing key should fail.")
+	}
+}
+
+// processWithPreKey builds a session from the sender to the receiver using
+// the given prekey, and has the receiver process the first message. The
+// prekey ID reported by the receiver's builder is returned.
+func processWithPreKey(t *testing.T, sender, receiver *user, preKey *record.PreKey, serializer *serialize.Serializer) *optional.Uint32 {
+	bundle := prekey.NewBundle(
+		receiver.registrationID,
+		receiver.deviceID,
+		preKey.ID(),
+		receiver.signedPreKey.ID(),
+		preKey.KeyPair().PublicKey(),
+		receiver.signedPreKey.KeyPair().PublicKey(),
+		receiver.signedPreKey.Signature(),
+		receiver.identityKeyPair.PublicKey(),
+	)
+	sender.buildSession(receiver.address, serializer)
+	if err := sender.sessionBuilder.ProcessBundle(bundle); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	message, err := session.NewCipher(sender.sessionBuilder, receiver.address).Encrypt([]byte("Hello"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+
+	builder := session.NewBuilderFromSignal(receiver.store, sender.address, serializer)
+	unsignedPreKeyID, err := builder.Process(message.(*protocol.PreKeySignalMessage))
+	if err != nil {
+		t.Fatal("Unable to process message: ", err)
+	}
+	return unsignedPreKeyID
+}
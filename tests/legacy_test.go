@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TestLegacyVersion2 checks that version 2 messages can be decrypted in
+// legacy mode, and that version 2 is never used to encrypt.
+func TestLegacyVersion2(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	// Establish a session, then mark both sides as a version 2 session, as
+	// if it had been restored from an old archive.
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	messageStrings, messages := sendMessages(1, aliceCipher, serializer, t)
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+	setSessionVersion(alice, bob.address, version.V2.Version)
+	setSessionVersion(bob, alice.address, version.V2.Version)
+
+	if _, err := aliceCipher.Encrypt([]byte("Hello")); err == nil {
+		t.Error("Encrypting with a version 2 session should fail.")
+	}
+
+	plaintexts := []string{"First legacy message", "Second legacy message", "Third legacy message"}
+	for _, plaintext := range plaintexts {
+		serialized := encryptLegacyMessage(alice, bob.address, []byte(plaintext), serializer, t)
+
+		// Version 2 messages are rejected unless explicitly decoded as legacy.
+		if _, err := protocol.NewSignalMessageFromBytes(serialized, serializer.SignalMessage); !errors.Is(err, errorhelper.ErrLegacyVersion) {
+			t.Fatal("Expected legacy version error, got: ", err)
+		}
+		message, err := protocol.NewLegacySignalMessageFromBytes(serialized, serializer.SignalMessage)
+		if err != nil {
+			t.Fatal("Unable to decode legacy message: ", err)
+		}
+
+		bobCipher.SetLegacyMode(false)
+		if _, err := bobCipher.Decrypt(message); err == nil {
+			t.Fatal("Decrypting a version 2 message without legacy mode should fail.")
+		}
+		bobCipher.SetLegacyMode(true)
+		decrypted, err := bobCipher.Decrypt(message)
+		if err != nil {
+			t.Fatal("Unable to decrypt legacy message: ", err)
+		}
+		if string(decrypted) != plaintext {
+			t.Fatalf("Decrypted %q, want %q", decrypted, plaintext)
+		}
+	}
+
+	if _, err := bobCipher.Encrypt([]byte("Hello")); err == nil {
+		t.Error("Encrypting with a version 2 session should fail in legacy mode.")
+	}
+}
+
+// TestDeriveSecretsV2 checks that the version 2 HKDF counts its expand
+// iterations from 0.
+func TestDeriveSecretsV2(t *testing.T) {
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+	info := []byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9}
+
+	okm, err := kdf.DeriveSecretsV2(ikm, salt, info, 42)
+	if err != nil {
+		t.Fatal("Unable to derive secrets: ", err)
+	}
+
+	// T(0) = HMAC(PRK, info | 0x00), T(1) = HMAC(PRK, T(0) | info | 0x01)
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x00})
+	first := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(first)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	expected := append(first, mac.Sum(nil)...)[:42]
+	if !bytes.Equal(okm, expected) {
+		t.Errorf("DeriveSecretsV2 returned %x, want %x", okm, expected)
+	}
+
+	v3, _ := kdf.DeriveSecrets(ikm, salt, info, 42)
+	if bytes.Equal(okm, v3) {
+		t.Error("Version 2 and version 3 HKDF output should differ.")
+	}
+}
+
+// setSessionVersion changes the version of the user's stored session with
+// the given address.
+func setSessionVersion(u *user, address *protocol.SignalAddress, sessionVersion int) {
+	sessionRecord := u.sessionStore.LoadSession(address)
+	sessionRecord.SessionState().SetVersion(sessionVersion)
+	u.sessionStore.StoreSession(address, sessionRecord)
+}
+
+// encryptLegacyMessage builds a serialized version 2 message the way legacy
+// clients did, since the library refuses to encrypt with version 2.
+func encryptLegacyMessage(u *user, address *protocol.SignalAddress, plaintext []byte,
+	serializer *serialize.Serializer, t *testing.T) []byte {
+
+	sessionRecord := u.sessionStore.LoadSession(address)
+	state := sessionRecord.SessionState()
+	chainKey := state.SenderChainKey()
+	messageKeys := chainKey.DeriveMessageKeys(version.V2)
+
+	body, err := version.V2.Cipher.Encrypt(messageKeys.Iv(), messageKeys.CipherKey(), plaintext)
+	if err != nil {
+		t.Fatal("Unable to encrypt legacy message: ", err)
+	}
+	structure := &protocol.SignalMessageStructure{
+		Version:         version.V2.Version,
+		Counter:         chainKey.Index(),
+		PreviousCounter: state.PreviousCounter(),
+		RatchetKey:      state.SenderRatchetKey().Serialize(),
+		CipherText:      body,
+	}
+
+	// Version 2 MACs only cover the serialized message.
+	mac := hmac.New(sha256.New, messageKeys.MacKey())
+	mac.Write(serializer.SignalMessage.Serialize(structure))
+	structure.Mac = mac.Sum(nil)[:version.V2.MacLength]
+
+	state.SetSenderChainKey(chainKey.NextKey())
+	u.sessionStore.StoreSession(address, sessionRecord)
+
+	return serializer.SignalMessage.Serialize(structure)
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// TestMemStoreAddressKeys checks that the in-memory stores find records by
+// equal addresses rather than by identical pointers.
+func TestMemStoreAddressKeys(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	buildBackupSessions(alice, bob, serializer, t)
+
+	address := protocol.NewSignalAddress("Bob", 2)
+	if !alice.store.ContainsSession(address) {
+		t.Fatal("Session should be found with an equal address.")
+	}
+	if !alice.store.LoadSession(address).SessionState().HasSenderChain() {
+		t.Error("Loaded session should not be fresh.")
+	}
+	if alice.store.LoadIdentity(address) == nil {
+		t.Error("Identity should be found with an equal address.")
+	}
+
+	// Loading a missing session returns a fresh record without storing it.
+	missing := protocol.NewSignalAddress("Carol", 1)
+	if alice.store.LoadSession(missing) == nil || !alice.store.LoadSession(missing).IsFresh() {
+		t.Error("Missing session should load as a fresh record.")
+	}
+	if alice.store.ContainsSession(missing) {
+		t.Error("Loading a missing session should not store it.")
+	}
+
+	// Loaded records are copies until stored again.
+	loaded := alice.store.LoadSession(address)
+	loaded.ArchiveCurrentState()
+	if !alice.store.LoadSession(address).SessionState().HasSenderChain() {
+		t.Error("Changing a loaded session should not change the stored session.")
+	}
+}
+
+// TestMemStoreConcurrency checks using the in-memory stores from many
+// goroutines at once.
+func TestMemStoreConcurrency(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	signalStore := memstore.NewSignalProtocol(alice.identityKeyPair, alice.registrationID, serializer)
+	sessionRecord := alice.store.LoadSession(protocol.NewSignalAddress("Bob", 2))
+
+	var wait sync.WaitGroup
+	for i := uint32(0); i < 32; i++ {
+		wait.Add(1)
+		go func(deviceID uint32) {
+			defer wait.Done()
+			address := protocol.NewSignalAddress("Bob", deviceID)
+			signalStore.StoreSession(address, sessionRecord)
+			signalStore.StorePreKey(deviceID, alice.preKeys[deviceID])
+			signalStore.SaveIdentity(address, alice.identityKeyPair.PublicKey())
+			signalStore.LoadSession(address)
+			signalStore.GetSubDeviceSessions("Bob")
+			signalStore.LoadPreKeys()
+		}(i)
+	}
+	wait.Wait()
+
+	if len(signalStore.LoadSessionAddresses()) != 32 || len(signalStore.LoadPreKeys()) != 32 {
+		t.Error("Expected 32 sessions and prekeys after concurrent stores.")
+	}
+	if len(signalStore.GetSubDeviceSessions("Bob")) != 31 {
+		t.Error("Expected 31 sub device sessions, got: ", len(signalStore.GetSubDeviceSessions("Bob")))
+	}
+}
@@ -0,0 +1,481 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups/mls"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// mlsUser is a member of an MLS group in a test.
+type mlsUser struct {
+	name        string
+	identity    *identity.KeyPair
+	keyPackages *memstore.MLSKeyPackage
+	group       *mls.Group
+}
+
+func newMLSUser(name string, t *testing.T) *mlsUser {
+	identityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Unable to generate identity key pair: ", err)
+	}
+	return &mlsUser{name: name, identity: identityKeyPair, keyPackages: memstore.NewMLSKeyPackage()}
+}
+
+// publishKeyPackage stores a new key package record and returns its
+// public key package, as a server would hand it out.
+func (u *mlsUser) publishKeyPackage(t *testing.T) *mls.KeyPackage {
+	record, err := mls.NewKeyPackageRecord(u.identity)
+	if err != nil {
+		t.Fatal("Unable to create key package: ", err)
+	}
+	u.keyPackages.StoreMLSKeyPackage(record.KeyPackage().Ref(), record)
+
+	keyPackage, err := mls.NewKeyPackageFromBytes(record.KeyPackage().Serialize())
+	if err != nil {
+		t.Fatal("Unable to deserialize key package: ", err)
+	}
+	return keyPackage
+}
+
+// join joins the group from the given serialized Welcome.
+func (u *mlsUser) join(serialized []byte, t *testing.T) {
+	welcome, err := mls.NewWelcomeFromBytes(serialized)
+	if err != nil {
+		t.Fatal("Unable to deserialize welcome: ", err)
+	}
+	for _, ref := range welcome.KeyPackageRefs() {
+		record := u.keyPackages.LoadMLSKeyPackage(ref)
+		if record == nil {
+			continue
+		}
+		u.group, err = mls.NewGroupFromWelcome(welcome, record, u.identity)
+		if err != nil {
+			t.Fatal(u.name, " was unable to join: ", err)
+		}
+		u.keyPackages.RemoveMLSKeyPackage(ref)
+		return
+	}
+	t.Fatal("The welcome has no key package of ", u.name)
+}
+
+// commit commits the pending proposals and has the given members process
+// the commit. It returns the serialized Welcome, if any.
+func (u *mlsUser) commit(t *testing.T, members ...*mlsUser) []byte {
+	commit, welcome, err := u.group.Commit()
+	if err != nil {
+		t.Fatal(u.name, " was unable to commit: ", err)
+	}
+	serialized := commit.Serialize()
+	for _, member := range members {
+		received, err := mls.NewCommitFromBytes(serialized)
+		if err != nil {
+			t.Fatal("Unable to deserialize commit: ", err)
+		}
+		if err := member.group.ProcessCommit(received); err != nil {
+			t.Fatal(member.name, " was unable to process commit: ", err)
+		}
+	}
+	if welcome == nil {
+		return nil
+	}
+	return welcome.Serialize()
+}
+
+// receiveProposal has the given members receive a serialized proposal.
+func receiveProposal(proposal *mls.Proposal, t *testing.T, members ...*mlsUser) {
+	for _, member := range members {
+		received, err := mls.NewProposalFromBytes(proposal.Serialize())
+		if err != nil {
+			t.Fatal("Unable to deserialize proposal: ", err)
+		}
+		if err := member.group.ReceiveProposal(received); err != nil {
+			t.Fatal(member.name, " was unable to receive proposal: ", err)
+		}
+	}
+}
+
+// checkMLSMessage encrypts a message from the sender and checks that every
+// receiver decrypts it from the sender.
+func checkMLSMessage(sender *mlsUser, t *testing.T, receivers ...*mlsUser) {
+	plaintext := []byte("Hello from " + sender.name)
+	message, err := sender.group.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(sender.name, " was unable to encrypt: ", err)
+	}
+	if message.Type() != protocol.MLS_TYPE {
+		t.Error("Unexpected message type: ", message.Type())
+	}
+	for _, receiver := range receivers {
+		received, err := mls.NewApplicationMessageFromBytes(message.Serialize())
+		if err != nil {
+			t.Fatal("Unable to deserialize message: ", err)
+		}
+		decrypted, member, err := receiver.group.Decrypt(received)
+		if err != nil {
+			t.Fatal(receiver.name, " was unable to decrypt: ", err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s got %q, want %q", receiver.name, decrypted, plaintext)
+		}
+		if member.LeafIndex != sender.group.LeafIndex() || !bytes.Equal(member.IdentityKey.Serialize(), sender.identity.PublicKey().Serialize()) {
+			t.Error(receiver.name, " got the wrong sender.")
+		}
+	}
+}
+
+// checkMLSEpoch checks that every member is in the same epoch with the
+// same secrets.
+func checkMLSEpoch(epoch uint64, t *testing.T, members ...*mlsUser) {
+	first := members[0].group
+	exported, _ := first.Export("test", []byte("context"), 42)
+	for _, member := range members {
+		if member.group.Epoch() != epoch {
+			t.Errorf("%s is in epoch %d, want %d", member.name, member.group.Epoch(), epoch)
+		}
+		if !bytes.Equal(member.group.EpochAuthenticator(), first.EpochAuthenticator()) {
+			t.Error(member.name, " has a different epoch authenticator.")
+		}
+		if secret, _ := member.group.Export("test", []byte("context"), 42); !bytes.Equal(secret, exported) {
+			t.Error(member.name, " exports a different secret.")
+		}
+		if len(member.group.Members()) != len(members) {
+			t.Errorf("%s has %d members, want %d", member.name, len(member.group.Members()), len(members))
+		}
+	}
+}
+
+// TestMLSGroup runs a group through adds, updates, removes and self
+// updates, and checks that every member agrees on each epoch.
+func TestMLSGroup(t *testing.T) {
+	alice, bob, carol, dave := newMLSUser("Alice", t), newMLSUser("Bob", t), newMLSUser("Carol", t), newMLSUser("Dave", t)
+
+	var err error
+	alice.group, err = mls.NewGroup([]byte("book club"), alice.identity)
+	if err != nil {
+		t.Fatal("Unable to create group: ", err)
+	}
+	checkMLSEpoch(0, t, alice)
+
+	// Alice adds Bob and Carol with one commit.
+	for _, user := range []*mlsUser{bob, carol} {
+		if _, err := alice.group.ProposeAdd(user.publishKeyPackage(t)); err != nil {
+			t.Fatal("Unable to propose add: ", err)
+		}
+	}
+	welcome := alice.commit(t)
+	bob.join(welcome, t)
+	carol.join(welcome, t)
+	checkMLSEpoch(1, t, alice, bob, carol)
+	checkMLSMessage(bob, t, alice, carol)
+	checkMLSMessage(alice, t, bob, carol)
+
+	// Carol proposes an update, which Alice commits.
+	proposal, err := carol.group.ProposeUpdate()
+	if err != nil {
+		t.Fatal("Unable to propose update: ", err)
+	}
+	receiveProposal(proposal, t, alice, bob)
+	alice.commit(t, bob, carol)
+	checkMLSEpoch(2, t, alice, bob, carol)
+	checkMLSMessage(carol, t, alice, bob)
+
+	// Bob adds Dave, who gets a path secret from the Welcome.
+	if _, err := bob.group.ProposeAdd(dave.publishKeyPackage(t)); err != nil {
+		t.Fatal("Unable to propose add: ", err)
+	}
+	dave.join(bob.commit(t, alice, carol), t)
+	checkMLSEpoch(3, t, alice, bob, carol, dave)
+	checkMLSMessage(dave, t, alice, bob, carol)
+
+	// Carol proposes removing Bob, and Dave commits it.
+	proposal, err = carol.group.ProposeRemove(bob.group.LeafIndex())
+	if err != nil {
+		t.Fatal("Unable to propose remove: ", err)
+	}
+	receiveProposal(proposal, t, dave, alice, bob)
+	commit, _, err := dave.group.Commit()
+	if err != nil {
+		t.Fatal("Unable to commit: ", err)
+	}
+	for _, member := range []*mlsUser{alice, carol} {
+		if err := member.group.ProcessCommit(commit); err != nil {
+			t.Fatal(member.name, " was unable to process commit: ", err)
+		}
+	}
+	if err := bob.group.ProcessCommit(commit); err != mls.ErrRemoved {
+		t.Error("Expected Bob to be removed, got: ", err)
+	}
+	checkMLSEpoch(4, t, alice, carol, dave)
+
+	// Bob can't read the new epoch's messages.
+	message, _ := alice.group.Encrypt([]byte("Bob is gone"))
+	if _, _, err := bob.group.Decrypt(message.(*mls.ApplicationMessage)); err != mls.ErrWrongEpoch {
+		t.Error("Expected Bob to be unable to decrypt, got: ", err)
+	}
+
+	// An empty commit updates Carol's path.
+	carol.commit(t, alice, dave)
+	checkMLSEpoch(5, t, alice, carol, dave)
+	checkMLSMessage(alice, t, carol, dave)
+
+	// Bob's leaf is reused by the next add.
+	eve := newMLSUser("Eve", t)
+	if _, err := alice.group.ProposeAdd(eve.publishKeyPackage(t)); err != nil {
+		t.Fatal("Unable to propose add: ", err)
+	}
+	eve.join(alice.commit(t, carol, dave), t)
+	if eve.group.LeafIndex() != 1 {
+		t.Error("Expected Eve to take Bob's leaf, got: ", eve.group.LeafIndex())
+	}
+	checkMLSEpoch(6, t, alice, carol, dave, eve)
+	checkMLSMessage(eve, t, alice, carol, dave)
+}
+
+// TestMLSParentHashes checks that members join from a Welcome whose tree has
+// parent nodes set by commits of different members, including a node that
+// gained an unmerged leaf after its commit.
+func TestMLSParentHashes(t *testing.T) {
+	names := []string{"Alice", "Bob", "Carol", "Dave", "Eve", "Frank", "Grace", "Heidi", "Ivan"}
+	users := make([]*mlsUser, len(names))
+	for i, name := range names {
+		users[i] = newMLSUser(name, t)
+	}
+	alice, eve, heidi, ivan := users[0], users[4], users[7], users[8]
+	alice.group, _ = mls.NewGroup([]byte("parent hashes"), alice.identity)
+
+	// Alice adds six members, who take leaves 1 to 6.
+	for _, user := range users[1:7] {
+		alice.group.ProposeAdd(user.publishKeyPackage(t))
+	}
+	welcome := alice.commit(t)
+	for _, user := range users[1:7] {
+		user.join(welcome, t)
+	}
+
+	// Eve sets the keys of her path in the right half of the tree.
+	eve.commit(t, append(append([]*mlsUser{}, users[:4]...), users[5:7]...)...)
+
+	// Heidi takes leaf 7 below Eve's path, but outside Alice's.
+	alice.group.ProposeAdd(heidi.publishKeyPackage(t))
+	heidi.join(alice.commit(t, users[1:7]...), t)
+	if heidi.group.LeafIndex() != 7 {
+		t.Fatal("Expected Heidi to take leaf 7, got: ", heidi.group.LeafIndex())
+	}
+	checkMLSEpoch(3, t, users[:8]...)
+	checkMLSMessage(heidi, t, users[:7]...)
+
+	// After Heidi's commit, Ivan joins a tree with paths from three members.
+	heidi.commit(t, users[:7]...)
+	alice.group.ProposeAdd(ivan.publishKeyPackage(t))
+	ivan.join(alice.commit(t, users[1:8]...), t)
+	checkMLSEpoch(5, t, users...)
+	checkMLSMessage(ivan, t, users[:8]...)
+}
+
+// TestMLSMessages checks out of order, duplicate, tampered and misdirected
+// application messages.
+func TestMLSMessages(t *testing.T) {
+	alice, bob := newMLSUser("Alice", t), newMLSUser("Bob", t)
+	alice.group, _ = mls.NewGroup([]byte("pair"), alice.identity)
+	alice.group.ProposeAdd(bob.publishKeyPackage(t))
+	bob.join(alice.commit(t), t)
+
+	var messages []*mls.ApplicationMessage
+	for i := 0; i < 3; i++ {
+		message, err := alice.group.Encrypt([]byte{byte(i)})
+		if err != nil {
+			t.Fatal("Unable to encrypt: ", err)
+		}
+		messages = append(messages, message.(*mls.ApplicationMessage))
+	}
+	for _, i := range []int{2, 0, 1} {
+		plaintext, _, err := bob.group.Decrypt(messages[i])
+		if err != nil {
+			t.Fatal("Unable to decrypt out of order message: ", err)
+		}
+		if !bytes.Equal(plaintext, []byte{byte(i)}) {
+			t.Errorf("Got %x, want %x", plaintext, i)
+		}
+	}
+	if _, _, err := bob.group.Decrypt(messages[1]); err != mls.ErrDuplicateMessage {
+		t.Error("Expected a duplicate message to fail, got: ", err)
+	}
+
+	// A tampered message fails and doesn't use up its key.
+	message, _ := alice.group.Encrypt([]byte("original"))
+	serialized := message.Serialize()
+	tampered := append([]byte{}, serialized...)
+	tampered[len(tampered)-1] ^= 0x01
+	received, _ := mls.NewApplicationMessageFromBytes(tampered)
+	if _, _, err := bob.group.Decrypt(received); err != mls.ErrInvalidMessage {
+		t.Error("Expected a tampered message to fail, got: ", err)
+	}
+	received, _ = mls.NewApplicationMessageFromBytes(serialized)
+	if plaintext, _, err := bob.group.Decrypt(received); err != nil || string(plaintext) != "original" {
+		t.Error("Unable to decrypt the original message: ", err)
+	}
+
+	other, _ := mls.NewGroup([]byte("other"), bob.identity)
+	message, _ = other.Encrypt([]byte("hello"))
+	if _, _, err := alice.group.Decrypt(message.(*mls.ApplicationMessage)); err != mls.ErrWrongGroup {
+		t.Error("Expected a message of another group to fail, got: ", err)
+	}
+	if _, err := mls.NewApplicationMessageFromBytes(serialized[:len(serialized)-1]); err == nil {
+		t.Error("Expected a truncated message to fail.")
+	}
+}
+
+// TestMLSExportLength checks that exports longer than HKDF can produce are
+// rejected with an error.
+func TestMLSExportLength(t *testing.T) {
+	alice := newMLSUser("Alice", t)
+	group, err := mls.NewGroup([]byte("book club"), alice.identity)
+	if err != nil {
+		t.Fatal("Unable to create group: ", err)
+	}
+
+	if secret, err := group.Export("test", nil, 255*32); err != nil || len(secret) != 255*32 {
+		t.Errorf("Unable to export the longest secret: %v", err)
+	}
+	for _, length := range []int{0, 255*32 + 1} {
+		if _, err := group.Export("test", nil, length); err != mls.ErrInvalidExportLength {
+			t.Errorf("Expected invalid export length error for %d bytes, got: %v", length, err)
+		}
+	}
+}
+
+// TestMLSInvalidCommits checks that commits are only processed once, in
+// their epoch, and with a valid confirmation tag and signature.
+func TestMLSInvalidCommits(t *testing.T) {
+	alice, bob, carol := newMLSUser("Alice", t), newMLSUser("Bob", t), newMLSUser("Carol", t)
+	alice.group, _ = mls.NewGroup([]byte("club"), alice.identity)
+	alice.group.ProposeAdd(bob.publishKeyPackage(t))
+	alice.group.ProposeAdd(carol.publishKeyPackage(t))
+	welcome := alice.commit(t)
+	bob.join(welcome, t)
+	carol.join(welcome, t)
+
+	commit, _, err := alice.group.Commit()
+	if err != nil {
+		t.Fatal("Unable to commit: ", err)
+	}
+	serialized := commit.Serialize()
+
+	tampered := append([]byte{}, serialized...)
+	tampered[len(tampered)-1] ^= 0x01
+	received, _ := mls.NewCommitFromBytes(tampered)
+	if err := bob.group.ProcessCommit(received); err != mls.ErrInvalidConfirmationTag {
+		t.Error("Expected a tampered confirmation tag to fail, got: ", err)
+	}
+	// The signature comes before the length-prefixed confirmation tag.
+	tampered = append([]byte{}, serialized...)
+	tampered[len(tampered)-4-32-1] ^= 0x01
+	received, _ = mls.NewCommitFromBytes(tampered)
+	if err := bob.group.ProcessCommit(received); err != mls.ErrInvalidSignature {
+		t.Error("Expected a tampered signature to fail, got: ", err)
+	}
+
+	// A failed commit leaves the group unchanged.
+	received, _ = mls.NewCommitFromBytes(serialized)
+	if err := bob.group.ProcessCommit(received); err != nil {
+		t.Fatal("Unable to process commit: ", err)
+	}
+	if err := bob.group.ProcessCommit(received); err != mls.ErrWrongEpoch {
+		t.Error("Expected a replayed commit to fail, got: ", err)
+	}
+	if err := carol.group.ProcessCommit(received); err != nil {
+		t.Fatal("Unable to process commit: ", err)
+	}
+	checkMLSEpoch(2, t, alice, bob, carol)
+
+	// Only the key package's owner can use a Welcome to it.
+	dave := newMLSUser("Dave", t)
+	keyPackage := dave.publishKeyPackage(t)
+	alice.group.ProposeAdd(keyPackage)
+	_, daveWelcome, err := alice.group.Commit()
+	if err != nil {
+		t.Fatal("Unable to commit: ", err)
+	}
+	record := dave.keyPackages.LoadMLSKeyPackage(keyPackage.Ref())
+	if _, err := mls.NewGroupFromWelcome(daveWelcome, record, bob.identity); err != mls.ErrWrongIdentity {
+		t.Error("Expected another identity to fail, got: ", err)
+	}
+	otherRecord, _ := mls.NewKeyPackageRecord(dave.identity)
+	if _, err := mls.NewGroupFromWelcome(daveWelcome, otherRecord, dave.identity); err != mls.ErrNoMatchingKeyPackage {
+		t.Error("Expected another key package to fail, got: ", err)
+	}
+
+	// Key packages must be signed by their identity key.
+	tampered = append([]byte{}, keyPackage.Serialize()...)
+	tampered[len(tampered)-1] ^= 0x01
+	forged, err := mls.NewKeyPackageFromBytes(tampered)
+	if err != nil {
+		t.Fatal("Unable to deserialize key package: ", err)
+	}
+	if _, err := alice.group.ProposeAdd(forged); err != mls.ErrInvalidSignature {
+		t.Error("Expected a forged key package to fail, got: ", err)
+	}
+}
+
+// TestMLSStores keeps every member's group in a store between operations,
+// so each step runs on deserialized state.
+func TestMLSStores(t *testing.T) {
+	alice, bob, carol := newMLSUser("Alice", t), newMLSUser("Bob", t), newMLSUser("Carol", t)
+	stores := make(map[*mlsUser]*memstore.MLSGroup)
+	groupID := []byte("stored")
+	save := func(users ...*mlsUser) {
+		for _, user := range users {
+			if stores[user] == nil {
+				stores[user] = memstore.NewMLSGroup(user.identity)
+			}
+			stores[user].StoreMLSGroup(groupID, user.group)
+			user.group = stores[user].LoadMLSGroup(groupID)
+			if user.group == nil {
+				t.Fatal("Unable to load the group of ", user.name)
+			}
+		}
+	}
+
+	alice.group, _ = mls.NewGroup(groupID, alice.identity)
+	save(alice)
+	alice.group.ProposeAdd(bob.publishKeyPackage(t))
+	save(alice)
+	bob.join(alice.commit(t), t)
+	save(alice, bob)
+
+	checkMLSMessage(alice, t, bob)
+	save(alice, bob)
+	checkMLSMessage(alice, t, bob)
+	save(alice, bob)
+
+	proposal, _ := bob.group.ProposeUpdate()
+	save(bob)
+	receiveProposal(proposal, t, alice)
+	save(alice)
+	alice.group.ProposeAdd(carol.publishKeyPackage(t))
+	save(alice)
+	carol.join(alice.commit(t, bob), t)
+	save(alice, bob, carol)
+	checkMLSEpoch(2, t, alice, bob, carol)
+	checkMLSMessage(bob, t, alice, carol)
+
+	// A group can't be loaded with another identity.
+	if _, err := mls.NewGroupFromBytes(alice.group.Serialize(), bob.identity); err != mls.ErrWrongIdentity {
+		t.Error("Expected another identity to fail, got: ", err)
+	}
+	serialized := alice.group.Serialize()
+	if _, err := mls.NewGroupFromBytes(serialized[:len(serialized)-1], alice.identity); err == nil {
+		t.Error("Expected truncated state to fail.")
+	}
+
+	stores[alice].DeleteMLSGroup(groupID)
+	if stores[alice].LoadMLSGroup(groupID) != nil {
+		t.Error("Expected the deleted group to be gone.")
+	}
+}
@@ -0,0 +1,338 @@
+package tests
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/noise"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+	"golang.org/x/crypto/curve25519"
+)
+
+// TestNoiseIK checks that a device authenticates to a server with its
+// identity key over an IK handshake, and that the transport works both ways.
+func TestNoiseIK(t *testing.T) {
+	deviceIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	serverIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	prologue := []byte("relay v1")
+
+	device, err := noise.NewIdentityHandshakeState(noise.PatternIK, true, prologue, deviceIdentity, serverIdentity.PublicKey())
+	if err != nil {
+		t.Fatal("Unable to create initiator: ", err)
+	}
+	server, err := noise.NewIdentityHandshakeState(noise.PatternIK, false, prologue, serverIdentity, nil)
+	if err != nil {
+		t.Fatal("Unable to create responder: ", err)
+	}
+	if device.ProtocolName() != "Noise_IK_25519_ChaChaPoly_SHA256" {
+		t.Error("Unexpected protocol name: ", device.ProtocolName())
+	}
+
+	// The device's first message carries its identity and an encrypted
+	// payload.
+	first, err := device.WriteMessage([]byte("device 2"))
+	if err != nil {
+		t.Fatal("Unable to write first message: ", err)
+	}
+	if bytes.Contains(first, []byte("device 2")) {
+		t.Error("The first payload is not encrypted.")
+	}
+	payload, err := server.ReadMessage(first)
+	if err != nil {
+		t.Fatal("Unable to read first message: ", err)
+	}
+	if string(payload) != "device 2" {
+		t.Errorf("Got payload %q, want %q", payload, "device 2")
+	}
+	remoteIdentity := server.RemoteIdentity()
+	if remoteIdentity == nil || !bytes.Equal(remoteIdentity.Serialize(), deviceIdentity.PublicKey().Serialize()) {
+		t.Error("The server didn't learn the device's identity key.")
+	}
+
+	second, err := server.WriteMessage(nil)
+	if err != nil {
+		t.Fatal("Unable to write second message: ", err)
+	}
+	if _, err := device.ReadMessage(second); err != nil {
+		t.Fatal("Unable to read second message: ", err)
+	}
+	if !device.IsFinished() || !server.IsFinished() {
+		t.Fatal("Expected the handshake to be finished.")
+	}
+	if !bytes.Equal(device.HandshakeHash(), server.HandshakeHash()) {
+		t.Error("The handshake hashes differ.")
+	}
+
+	deviceSend, deviceReceive, err := device.Split()
+	if err != nil {
+		t.Fatal("Unable to split device: ", err)
+	}
+	serverSend, serverReceive, _ := server.Split()
+	exchangeNoise(deviceSend, serverReceive, "Hello server", t)
+	exchangeNoise(serverSend, deviceReceive, "Hello device", t)
+
+	// Both sides rekey after the same message.
+	deviceSend.Rekey()
+	serverReceive.Rekey()
+	exchangeNoise(deviceSend, serverReceive, "After rekey", t)
+}
+
+// TestNoiseIKFailures checks that wrong keys, tampered messages and
+// messages out of turn are rejected.
+func TestNoiseIKFailures(t *testing.T) {
+	deviceIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	serverIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	otherIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+
+	if _, err := noise.NewIdentityHandshakeState(noise.PatternIK, true, nil, deviceIdentity, nil); !errors.Is(err, noise.ErrMissingRemoteKey) {
+		t.Errorf("Expected IK without the server's key to fail, got: %v", err)
+	}
+	if _, err := noise.NewIdentityHandshakeState(noise.PatternIK, true, nil, nil, serverIdentity.PublicKey()); !errors.Is(err, noise.ErrMissingStaticKey) {
+		t.Errorf("Expected IK without the device's key to fail, got: %v", err)
+	}
+
+	// A device that expects another server key can't talk to the server.
+	device, _ := noise.NewIdentityHandshakeState(noise.PatternIK, true, nil, deviceIdentity, otherIdentity.PublicKey())
+	server, _ := noise.NewIdentityHandshakeState(noise.PatternIK, false, nil, serverIdentity, nil)
+	first, _ := device.WriteMessage(nil)
+	if _, err := server.ReadMessage(first); !errors.Is(err, noise.ErrDecrypt) {
+		t.Errorf("Expected a message for another server key to fail, got: %v", err)
+	}
+
+	// Different prologues fail too.
+	device, _ = noise.NewIdentityHandshakeState(noise.PatternIK, true, []byte("v1"), deviceIdentity, serverIdentity.PublicKey())
+	server, _ = noise.NewIdentityHandshakeState(noise.PatternIK, false, []byte("v2"), serverIdentity, nil)
+	first, _ = device.WriteMessage(nil)
+	if _, err := server.ReadMessage(first); !errors.Is(err, noise.ErrDecrypt) {
+		t.Errorf("Expected a different prologue to fail, got: %v", err)
+	}
+
+	device, _ = noise.NewIdentityHandshakeState(noise.PatternIK, true, nil, deviceIdentity, serverIdentity.PublicKey())
+	server, _ = noise.NewIdentityHandshakeState(noise.PatternIK, false, nil, serverIdentity, nil)
+	if _, err := server.WriteMessage(nil); !errors.Is(err, noise.ErrWrongTurn) {
+		t.Errorf("Expected the responder writing first to fail, got: %v", err)
+	}
+	if _, _, err := device.Split(); !errors.Is(err, noise.ErrHandshakeIncomplete) {
+		t.Errorf("Expected splitting an unfinished handshake to fail, got: %v", err)
+	}
+	first, _ = device.WriteMessage(nil)
+	if _, err := server.ReadMessage(first[:20]); !errors.Is(err, noise.ErrMessageTooShort) {
+		t.Errorf("Expected a truncated message to fail, got: %v", err)
+	}
+
+	server, _ = noise.NewIdentityHandshakeState(noise.PatternIK, false, nil, serverIdentity, nil)
+	first[len(first)-1] ^= 1
+	if _, err := server.ReadMessage(first); !errors.Is(err, noise.ErrDecrypt) {
+		t.Errorf("Expected a tampered message to fail, got: %v", err)
+	}
+}
+
+// TestNoiseXX checks that both sides learn each other's identity keys over
+// an XX handshake.
+func TestNoiseXX(t *testing.T) {
+	deviceIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	serverIdentity, _ := keyhelper.GenerateIdentityKeyPair()
+	device, _ := noise.NewIdentityHandshakeState(noise.PatternXX, true, nil, deviceIdentity, nil)
+	server, _ := noise.NewIdentityHandshakeState(noise.PatternXX, false, nil, serverIdentity, nil)
+
+	for sender, receiver := device, server; !device.IsFinished(); sender, receiver = receiver, sender {
+		message, err := sender.WriteMessage(nil)
+		if err != nil {
+			t.Fatal("Unable to write handshake message: ", err)
+		}
+		if _, err := receiver.ReadMessage(message); err != nil {
+			t.Fatal("Unable to read handshake message: ", err)
+		}
+	}
+
+	if !bytes.Equal(device.RemoteIdentity().Serialize(), serverIdentity.PublicKey().Serialize()) {
+		t.Error("The device didn't learn the server's identity key.")
+	}
+	if !bytes.Equal(server.RemoteIdentity().Serialize(), deviceIdentity.PublicKey().Serialize()) {
+		t.Error("The server didn't learn the device's identity key.")
+	}
+	deviceSend, _, _ := device.Split()
+	_, serverReceive, _ := server.Split()
+	exchangeNoise(deviceSend, serverReceive, "Hello server", t)
+}
+
+// noiseVector is a test vector in the JSON format of the cacophony and snow
+// test vectors.
+type noiseVector struct {
+	ProtocolName     string   `json:"protocol_name"`
+	InitPrologue     string   `json:"init_prologue"`
+	InitPSKs         []string `json:"init_psks"`
+	InitStatic       string   `json:"init_static"`
+	InitEphemeral    string   `json:"init_ephemeral"`
+	InitRemoteStatic string   `json:"init_remote_static"`
+	RespPrologue     string   `json:"resp_prologue"`
+	RespStatic       string   `json:"resp_static"`
+	RespEphemeral    string   `json:"resp_ephemeral"`
+	RespRemoteStatic string   `json:"resp_remote_static"`
+	HandshakeHash    string   `json:"handshake_hash"`
+	Messages         []struct {
+		Payload    string `json:"payload"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"messages"`
+}
+
+// noiseVectors holds the Noise test vectors in the cacophony and snow format.
+// cacophony-ik.txt holds the cacophony IK vector; more vector files from
+// those repositories can be added to testdata/noise.
+//
+//go:embed testdata/noise/*.txt
+var noiseVectors embed.FS
+
+// TestNoiseVectors runs the Noise test vectors of the supported patterns.
+func TestNoiseVectors(t *testing.T) {
+	patterns := map[string]*noise.Pattern{
+		"Noise_IK_25519_ChaChaPoly_SHA256": noise.PatternIK,
+		"Noise_XX_25519_ChaChaPoly_SHA256": noise.PatternXX,
+		"Noise_NK_25519_ChaChaPoly_SHA256": noise.PatternNK,
+	}
+
+	files, _ := fs.Glob(noiseVectors, "testdata/noise/*.txt")
+	ran := 0
+	for _, file := range files {
+		serialized, err := noiseVectors.ReadFile(file)
+		if err != nil {
+			t.Fatal("Unable to read test vectors: ", err)
+		}
+		var vectors struct {
+			Vectors []noiseVector `json:"vectors"`
+		}
+		if err := json.Unmarshal(serialized, &vectors); err != nil {
+			t.Fatalf("Unable to parse %s: %v", file, err)
+		}
+		for _, vector := range vectors.Vectors {
+			pattern, ok := patterns[vector.ProtocolName]
+			if !ok || len(vector.InitPSKs) > 0 {
+				continue
+			}
+			t.Run(filepath.Base(file)+"/"+vector.ProtocolName, func(t *testing.T) {
+				runNoiseVector(vector, pattern, t)
+			})
+			ran++
+		}
+	}
+	if ran == 0 {
+		t.Fatal("No Noise test vectors in testdata/noise.")
+	}
+}
+
+// runNoiseVector runs the handshake and transport messages of the given
+// vector, and checks every ciphertext.
+func runNoiseVector(vector noiseVector, pattern *noise.Pattern, t *testing.T) {
+	initiator, err := noise.NewHandshakeState(pattern, true, decodeHex(vector.InitPrologue, t),
+		noiseKeyPair(vector.InitStatic, t), noisePublicKey(vector.InitRemoteStatic, t))
+	if err != nil {
+		t.Fatal("Unable to create initiator: ", err)
+	}
+	initiator.SetEphemeralKeyPair(noiseKeyPair(vector.InitEphemeral, t))
+	responder, err := noise.NewHandshakeState(pattern, false, decodeHex(vector.RespPrologue, t),
+		noiseKeyPair(vector.RespStatic, t), noisePublicKey(vector.RespRemoteStatic, t))
+	if err != nil {
+		t.Fatal("Unable to create responder: ", err)
+	}
+	responder.SetEphemeralKeyPair(noiseKeyPair(vector.RespEphemeral, t))
+
+	var initiatorSend, initiatorReceive, responderSend, responderReceive *noise.CipherState
+	for i, message := range vector.Messages {
+		payload := decodeHex(message.Payload, t)
+		var ciphertext []byte
+		var received []byte
+		switch {
+		case !initiator.IsFinished():
+			sender, receiver := initiator, responder
+			if i%2 == 1 {
+				sender, receiver = responder, initiator
+			}
+			if ciphertext, err = sender.WriteMessage(payload); err != nil {
+				t.Fatalf("Unable to write message %d: %v", i, err)
+			}
+			if received, err = receiver.ReadMessage(ciphertext); err != nil {
+				t.Fatalf("Unable to read message %d: %v", i, err)
+			}
+			if initiator.IsFinished() {
+				initiatorSend, initiatorReceive, _ = initiator.Split()
+				responderSend, responderReceive, _ = responder.Split()
+				if vector.HandshakeHash != "" && hex.EncodeToString(initiator.HandshakeHash()) != vector.HandshakeHash {
+					t.Errorf("Got handshake hash %x, want %s", initiator.HandshakeHash(), vector.HandshakeHash)
+				}
+			}
+		case i%2 == 0:
+			ciphertext, _ = initiatorSend.Encrypt(nil, payload)
+			received, err = responderReceive.Decrypt(nil, ciphertext)
+		default:
+			ciphertext, _ = responderSend.Encrypt(nil, payload)
+			received, err = initiatorReceive.Decrypt(nil, ciphertext)
+		}
+
+		if hex.EncodeToString(ciphertext) != message.Ciphertext {
+			t.Errorf("Message %d: got ciphertext %x, want %s", i, ciphertext, message.Ciphertext)
+		}
+		if err != nil || !bytes.Equal(received, payload) {
+			t.Errorf("Message %d: got payload %x (%v), want %x", i, received, err, payload)
+		}
+	}
+}
+
+// exchangeNoise encrypts the given message with the sender's cipher state,
+// and checks that the receiver's decrypts it.
+func exchangeNoise(sender, receiver *noise.CipherState, plaintext string, t *testing.T) {
+	ciphertext, err := sender.Encrypt(nil, []byte(plaintext))
+	if err != nil {
+		t.Fatal("Unable to encrypt transport message: ", err)
+	}
+	decrypted, err := receiver.Decrypt(nil, ciphertext)
+	if err != nil {
+		t.Fatal("Unable to decrypt transport message: ", err)
+	}
+	if string(decrypted) != plaintext {
+		t.Errorf("Got %q, want %q", decrypted, plaintext)
+	}
+}
+
+// noiseKeyPair returns the key pair of the given hex encoded private key, or
+// nil if it is empty.
+func noiseKeyPair(privateKey string, t *testing.T) *ecc.ECKeyPair {
+	if privateKey == "" {
+		return nil
+	}
+	var private [32]byte
+	copy(private[:], decodeHex(privateKey, t))
+	public, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal("Unable to derive public key: ", err)
+	}
+
+	return ecc.NewECKeyPair(noisePublicKey(hex.EncodeToString(public), t), ecc.NewDjbECPrivateKey(private))
+}
+
+// noisePublicKey returns the given hex encoded public key, or nil if it is
+// empty.
+func noisePublicKey(publicKey string, t *testing.T) ecc.ECPublicKeyable {
+	if publicKey == "" {
+		return nil
+	}
+	var public [32]byte
+	copy(public[:], decodeHex(publicKey, t))
+
+	return ecc.NewDjbECPublicKey(public)
+}
+
+// decodeHex decodes the given hex string of a test vector.
+func decodeHex(value string, t *testing.T) []byte {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal("Invalid hex in test vector: ", err)
+	}
+	return decoded
+}
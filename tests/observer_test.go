@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// TestObserverSession checks the metrics reported for one-to-one sessions.
+func TestObserverSession(t *testing.T) {
+	serializer := newSerializer()
+	metrics := observer.NewExpvar(new(expvar.Map))
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+	alice.sessionBuilder.SetObserver(metrics)
+	bob.sessionBuilder.SetObserver(metrics)
+
+	// Decrypting without a session fails.
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	messageStrings, messages := sendMessages(1, aliceCipher, serializer, t)
+	if _, err := bobCipher.Decrypt(messages[0].(*protocol.PreKeySignalMessage).WhisperMessage()); !errors.Is(err, session.ErrNoSession) {
+		t.Fatal("Expected decrypting without a session to fail, got: ", err)
+	}
+
+	// Build the session and skip two of Alice's messages.
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+	messageStrings, messages = sendMessages(1, bobCipher, serializer, t)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	messageStrings, messages = sendMessages(3, aliceCipher, serializer, t)
+	receiveMessages(messages[2:], messageStrings[2:], bobCipher, t)
+
+	// A replayed message fails as a duplicate.
+	if _, err := bobCipher.Decrypt(messages[2].(*protocol.SignalMessage)); !errors.Is(err, session.ErrOldCounter) {
+		t.Fatal("Expected decrypting a duplicate message to fail, got: ", err)
+	}
+
+	// Building a new session archives the old one.
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 1)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+
+	expected := map[string]int64{
+		"process_bundle.calls":              2,
+		"process.calls":                     1,
+		"encrypt.calls":                     5,
+		"encrypt.prekey":                    1,
+		"encrypt.signal":                    4,
+		"decrypt.calls":                     5,
+		"decrypt.signal":                    3,
+		"consumed.prekey":                   1,
+		"skipped_keys.stored":               2,
+		"session.archived":                  1,
+		"failure.decrypt.no_session":        1,
+		"failure.decrypt.duplicate_message": 1,
+	}
+	checkCounters(metrics, expected, t)
+	if counter(metrics, "decrypt.nanoseconds") <= 0 {
+		t.Error("Expected the decrypt duration to be counted.")
+	}
+}
+
+// TestObserverGroup checks the metrics reported for group sessions.
+func TestObserverGroup(t *testing.T) {
+	serializer := newSerializer()
+	metrics := observer.NewExpvar(new(expvar.Map))
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.groupBuilder.SetObserver(metrics)
+	bob.groupBuilder.SetObserver(metrics)
+
+	senderKeyName := protocol.NewSenderKeyName("123", alice.address)
+	skdm, err := alice.groupBuilder.Create(senderKeyName)
+	if err != nil {
+		t.Fatal("Unable to create group session: ", err)
+	}
+	aliceCipher := groups.NewGroupCipher(alice.groupBuilder, senderKeyName, alice.senderKeyStore)
+	messageStrings, messages := sendGroupMessages(3, aliceCipher, serializer, t)
+
+	bobCipher := groups.NewGroupCipher(bob.groupBuilder, senderKeyName, bob.senderKeyStore)
+	if _, err := bobCipher.Decrypt(messages[0].(*protocol.SenderKeyMessage)); !errors.Is(err, groups.ErrNoSenderKey) {
+		t.Fatal("Expected decrypting without a sender key to fail, got: ", err)
+	}
+	bob.groupBuilder.Process(senderKeyName, skdm)
+	receiveGroupMessages(messages[2:], messageStrings[2:], bobCipher, t)
+
+	expected := map[string]int64{
+		"group_process.calls":                 1,
+		"group_encrypt.calls":                 3,
+		"encrypt.sender_key":                  3,
+		"group_decrypt.calls":                 2,
+		"decrypt.sender_key":                  1,
+		"skipped_keys.stored":                 2,
+		"failure.group_decrypt.no_sender_key": 1,
+	}
+	checkCounters(metrics, expected, t)
+}
+
+// TestObserverTracing checks that operations are traced, and that the shared
+// observer receives the key helpers' events.
+func TestObserverTracing(t *testing.T) {
+	serializer := newSerializer()
+	tracer := &testTracer{}
+	metrics := observer.NewExpvar(new(expvar.Map))
+	observer.Setup(observer.Multi(metrics, observer.NewTracing(tracer)))
+	defer observer.Setup(nil)
+
+	if _, err := keyhelper.GeneratePreKeys(1, 5, serializer.PreKeyRecord); err != nil {
+		t.Fatal("Unable to generate prekeys: ", err)
+	}
+	checkCounters(metrics, map[string]int64{"generated.prekey": 5}, t)
+
+	// Fail to build a session from a bundle with a bad signature.
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.signedPreKey = newUser("Carol", 3, serializer).signedPreKey
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); !errors.Is(err, session.ErrInvalidSignature) {
+		t.Fatal("Expected a bundle with a bad signature to fail, got: ", err)
+	}
+
+	checkCounters(metrics, map[string]int64{"failure.process_bundle.invalid_signature": 1}, t)
+	spans := tracer.finished()
+	if len(spans) != 1 || spans[0].name != "signal.process_bundle" {
+		t.Fatalf("Unexpected spans: %+v", spans)
+	}
+	if spans[0].err == nil || spans[0].attributes["failure"] != string(observer.ReasonInvalidSignature) {
+		t.Errorf("Expected a failed span with the failure reason, got: %+v", spans[0])
+	}
+}
+
+// checkCounters checks the given expvar counters.
+func checkCounters(metrics *observer.Expvar, expected map[string]int64, t *testing.T) {
+	for key, value := range expected {
+		if got := counter(metrics, key); got != value {
+			t.Errorf("Got %d for %s, want %d", got, key, value)
+		}
+	}
+}
+
+// counter returns the value of the given expvar counter.
+func counter(metrics *observer.Expvar, key string) int64 {
+	value, ok := metrics.Map().Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return value.Value()
+}
+
+// testTracer is a tracer that records its finished spans.
+type testTracer struct {
+	mutex sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(name string) observer.Span {
+	return &testSpan{tracer: t, name: name, attributes: make(map[string]string)}
+}
+
+// finished returns the spans that have ended.
+func (t *testTracer) finished() []*testSpan {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.spans
+}
+
+// testSpan is a span recorded by testTracer.
+type testSpan struct {
+	tracer     *testTracer
+	name       string
+	attributes map[string]string
+	err        error
+}
+
+func (s *testSpan) SetAttribute(key, value string) {
+	s.attributes[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.err = err
+	s.tracer.mutex.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mutex.Unlock()
+}
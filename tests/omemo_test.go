@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/omemo"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// TestOMEMOBundle checks that bundles survive their XML encoding and map to
+// prekey bundles.
+func TestOMEMOBundle(t *testing.T) {
+	serializer := newSerializer()
+	bob := newOMEMODevice("bob@example.com", 2001, serializer)
+
+	serialized, err := bob.bundle().XML()
+	if err != nil {
+		t.Fatal("Unable to encode bundle: ", err)
+	}
+	if !strings.Contains(string(serialized), `xmlns="`+omemo.Namespace+`"`) {
+		t.Error("Bundle is missing its namespace: ", string(serialized))
+	}
+	bundle, err := omemo.NewBundleFromXML(serialized)
+	if err != nil {
+		t.Fatal("Unable to decode bundle: ", err)
+	}
+	if len(bundle.PreKeys()) != len(bob.preKeys) || bundle.SignedPreKeyID() != bob.signedPreKey.ID() {
+		t.Error("Unexpected keys in decoded bundle.")
+	}
+
+	preKeyBundle, err := bundle.PreKeyBundle(bob.deviceID)
+	if err != nil {
+		t.Fatal("Unable to create prekey bundle: ", err)
+	}
+	if preKeyBundle.DeviceID() != bob.deviceID || preKeyBundle.RegistrationID() != bob.deviceID {
+		t.Errorf("Got device %d and registration %d, want %d", preKeyBundle.DeviceID(), preKeyBundle.RegistrationID(), bob.deviceID)
+	}
+	if preKeyBundle.PreKeyID().IsEmpty {
+		t.Error("Expected one of the bundle's prekeys, got: ", preKeyBundle.PreKeyID())
+	}
+	if _, err := bundle.PreKeyBundle(0); !errors.Is(err, omemo.ErrInvalidDeviceID) {
+		t.Errorf("Expected device ID 0 to fail, got: %v", err)
+	}
+
+	// A truncated identity key is rejected.
+	truncated := []byte(`<bundle xmlns="eu.siacs.conversations.axolotl"><identityKey>BQ==</identityKey></bundle>`)
+	var decodeErr *errorhelper.DecodeError
+	if _, err := omemo.NewBundleFromXML(truncated); !errors.As(err, &decodeErr) || decodeErr.Field != "IdentityKey" {
+		t.Errorf("Expected an identity key decode error, got: %v", err)
+	}
+}
+
+// TestOMEMOMessages exchanges OMEMO messages between two local clients.
+func TestOMEMOMessages(t *testing.T) {
+	serializer := newSerializer()
+	alice := newOMEMODevice("alice@example.com", 1001, serializer)
+	aliceLaptop := newOMEMODevice("alice@example.com", 1002, serializer)
+	bob := newOMEMODevice("bob@example.com", 2001, serializer)
+
+	// Alice builds sessions with Bob and her own laptop from their
+	// published bundles.
+	for _, device := range []*omemoDevice{bob, aliceLaptop} {
+		serialized, _ := device.bundle().XML()
+		bundle, err := omemo.NewBundleFromXML(serialized)
+		if err != nil {
+			t.Fatal("Unable to decode bundle: ", err)
+		}
+		if err := alice.cipher.ProcessBundle(device.name, device.deviceID, bundle); err != nil {
+			t.Fatal("Unable to process bundle: ", err)
+		}
+	}
+
+	message := exchangeOMEMO(alice, "Hello Bob!", t, bob, aliceLaptop)
+	if key := message.Key(bob.deviceID); key == nil || !key.PreKey {
+		t.Error("Expected the first message to Bob to carry a prekey message.")
+	}
+
+	// Bob answers over the session Alice built.
+	message = exchangeOMEMO(bob, "Hello Alice!", t, alice)
+	if message.Key(alice.deviceID).PreKey {
+		t.Error("Expected Bob's reply to use the existing session.")
+	}
+	exchangeOMEMO(alice, "", t, bob)
+
+	// Key transport elements advance the session without a payload.
+	keyTransport, err := bob.cipher.KeyTransport(alice.address)
+	if err != nil {
+		t.Fatal("Unable to create key transport element: ", err)
+	}
+	serialized, _ := keyTransport.XML()
+	if strings.Contains(string(serialized), "<payload>") {
+		t.Error("Key transport element has a payload: ", string(serialized))
+	}
+	received, err := omemo.NewMessageFromXML(serialized)
+	if err != nil {
+		t.Fatal("Unable to decode key transport element: ", err)
+	}
+	if !received.IsKeyTransport() {
+		t.Error("Expected a key transport element.")
+	}
+	if plaintext, err := alice.cipher.Decrypt(bob.name, received); err != nil || plaintext != nil {
+		t.Errorf("Unexpected result of key transport: %q, %v", plaintext, err)
+	}
+
+	// Messages for other devices and tampered payloads are rejected.
+	message, _ = alice.cipher.Encrypt([]byte("Only for Bob"), bob.address)
+	if _, err := aliceLaptop.cipher.Decrypt(alice.name, message); !errors.Is(err, omemo.ErrNoKeyForDevice) {
+		t.Errorf("Expected a message without a key for the device to fail, got: %v", err)
+	}
+	payload := message.Payload()
+	payload[0] ^= 1
+	tampered := omemo.NewMessage(message.SenderDeviceID(), message.Keys(), message.IV(), payload)
+	if _, err := bob.cipher.Decrypt(alice.name, tampered); err == nil {
+		t.Error("Expected a tampered payload to fail.")
+	}
+}
+
+// omemoDevice is a local OMEMO client for testing.
+type omemoDevice struct {
+	*user
+	cipher *omemo.Cipher
+}
+
+// newOMEMODevice returns a new OMEMO client for the given JID and device
+// ID. OMEMO device IDs double as registration IDs.
+func newOMEMODevice(jid string, deviceID uint32, serializer *serialize.Serializer) *omemoDevice {
+	device := newUser(jid, deviceID, serializer)
+	device.registrationID = deviceID
+	device.store.IdentityKey = memstore.NewIdentityKey(device.identityKeyPair, deviceID)
+	device.identityStore = device.store.IdentityKey
+
+	return &omemoDevice{
+		user:   device,
+		cipher: omemo.NewCipher(device.store, device.address, serializer),
+	}
+}
+
+// bundle returns the device's OMEMO bundle.
+func (d *omemoDevice) bundle() *omemo.Bundle {
+	return omemo.NewBundle(d.identityKeyPair.PublicKey(), d.signedPreKey, d.preKeys)
+}
+
+// exchangeOMEMO encrypts the given message from the sender to the given
+// recipients over XML, and checks that each of them decrypts it.
+func exchangeOMEMO(sender *omemoDevice, plaintext string, t *testing.T, recipients ...*omemoDevice) *omemo.Message {
+	addresses := make([]*protocol.SignalAddress, len(recipients))
+	for i, recipient := range recipients {
+		addresses[i] = recipient.address
+	}
+	message, err := sender.cipher.Encrypt([]byte(plaintext), addresses...)
+	if err != nil {
+		t.Fatal("Unable to encrypt OMEMO message: ", err)
+	}
+	serialized, err := message.XML()
+	if err != nil {
+		t.Fatal("Unable to encode OMEMO message: ", err)
+	}
+
+	for _, recipient := range recipients {
+		received, err := omemo.NewMessageFromXML(serialized)
+		if err != nil {
+			t.Fatal("Unable to decode OMEMO message: ", err)
+		}
+		if received.IsKeyTransport() {
+			t.Error("Expected a message with a payload.")
+		}
+		decrypted, err := recipient.cipher.Decrypt(sender.name, received)
+		if err != nil {
+			t.Fatalf("Unable to decrypt OMEMO message on device %d: %v", recipient.deviceID, err)
+		}
+		if !bytes.Equal(decrypted, []byte(plaintext)) {
+			t.Errorf("Got %q, want %q", decrypted, plaintext)
+		}
+	}
+
+	return message
+}
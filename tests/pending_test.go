@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/groups"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/pending"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+)
+
+// pendingResult is a result passed to a pending buffer's handler.
+type pendingResult struct {
+	plaintext string
+	err       error
+}
+
+// newPendingBuffer returns a pending buffer that records the results passed
+// to its handler.
+func newPendingBuffer(ttl time.Duration, maxSize int) (*pending.Buffer, *[]pendingResult) {
+	results := &[]pendingResult{}
+	buffer := pending.NewBuffer(ttl, maxSize, func(message *pending.Message, plaintext []byte, err error) {
+		*results = append(*results, pendingResult{plaintext: string(plaintext), err: err})
+	})
+	return buffer, results
+}
+
+// TestPendingSessionMessage checks that a message that arrives before the
+// prekey message that starts its session is decrypted once the session is
+// built.
+func TestPendingSessionMessage(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	buffer, results := newPendingBuffer(pending.DefaultTTL, pending.DefaultMaxSize)
+	bob.sessionBuilder.SetPendingBuffer(buffer)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+	messageStrings, messages := sendMessages(2, aliceCipher, serializer, t)
+
+	// The second message overtakes the first one.
+	late := messages[1].(*protocol.PreKeySignalMessage).WhisperMessage()
+	if _, err := bobCipher.Decrypt(late); !errors.Is(err, pending.ErrBuffered) {
+		t.Fatal("Expected the message to be buffered, got: ", err)
+	}
+	if buffer.Len() != 1 {
+		t.Fatalf("Got %d buffered messages, want 1", buffer.Len())
+	}
+
+	// Building the session decrypts the buffered message.
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Got %d buffered messages after processing, want 0", buffer.Len())
+	}
+	if len(*results) != 1 || (*results)[0].err != nil || (*results)[0].plaintext != messageStrings[1] {
+		t.Fatalf("Unexpected buffered message results: %+v", *results)
+	}
+	receiveMessages(messages[:1], messageStrings[:1], bobCipher, t)
+}
+
+// TestPendingGroupMessage checks that a group message that arrives before
+// its sender key distribution message is decrypted once the sender key is
+// added.
+func TestPendingGroupMessage(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+
+	buffer, results := newPendingBuffer(pending.DefaultTTL, pending.DefaultMaxSize)
+	bob.groupBuilder.SetPendingBuffer(buffer)
+
+	senderKeyName := protocol.NewSenderKeyName("123", alice.address)
+	skdm, err := alice.groupBuilder.Create(senderKeyName)
+	if err != nil {
+		t.Fatal("Unable to create group session: ", err)
+	}
+	aliceCipher := groups.NewGroupCipher(alice.groupBuilder, senderKeyName, alice.senderKeyStore)
+	messageStrings, messages := sendGroupMessages(3, aliceCipher, serializer, t)
+
+	bobCipher := groups.NewGroupCipher(bob.groupBuilder, senderKeyName, bob.senderKeyStore)
+	for _, message := range messages[:2] {
+		if _, err := bobCipher.Decrypt(message.(*protocol.SenderKeyMessage)); !errors.Is(err, pending.ErrBuffered) {
+			t.Fatal("Expected the group message to be buffered, got: ", err)
+		}
+	}
+
+	bob.groupBuilder.Process(senderKeyName, skdm)
+	if len(*results) != 2 {
+		t.Fatalf("Got %d buffered group message results, want 2", len(*results))
+	}
+	for i, result := range *results {
+		if result.err != nil || result.plaintext != messageStrings[i] {
+			t.Errorf("Unexpected result for buffered group message %d: %+v", i, result)
+		}
+	}
+	receiveGroupMessages(messages[2:], messageStrings[2:], bobCipher, t)
+}
+
+// TestPendingBufferLimits checks that buffered messages expire and that the
+// oldest messages are dropped when the buffer is full.
+func TestPendingBufferLimits(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	_, messages := sendMessages(3, session.NewCipher(alice.sessionBuilder, bob.address), serializer, t)
+
+	// The oldest message is dropped to make room for a third one.
+	buffer, results := newPendingBuffer(pending.DefaultTTL, 2)
+	for _, message := range messages {
+		buffer.AddSessionMessage(alice.address, message)
+	}
+	if buffer.Len() != 2 {
+		t.Errorf("Got %d buffered messages, want 2", buffer.Len())
+	}
+	if len(*results) != 1 || !errors.Is((*results)[0].err, pending.ErrBufferFull) {
+		t.Errorf("Expected one message dropped from a full buffer, got: %+v", *results)
+	}
+
+	// Expired messages are reported when pruned and are never retried.
+	buffer, results = newPendingBuffer(time.Millisecond, pending.DefaultMaxSize)
+	buffer.AddSessionMessage(alice.address, messages[0])
+	time.Sleep(5 * time.Millisecond)
+	buffer.Prune()
+	if buffer.Len() != 0 {
+		t.Errorf("Got %d buffered messages after pruning, want 0", buffer.Len())
+	}
+	if len(*results) != 1 || !errors.Is((*results)[0].err, pending.ErrExpired) {
+		t.Errorf("Expected one expired message, got: %+v", *results)
+	}
+	if taken := buffer.TakeSessionMessages(alice.address); len(taken) != 0 {
+		t.Errorf("Got %d messages after expiry, want 0", len(taken))
+	}
+}
+
+// TestPendingBufferDefaults checks that a buffer created with a time to live
+// or size that isn't positive uses the defaults instead of dropping every
+// message.
+func TestPendingBufferDefaults(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	_, messages := sendMessages(2, session.NewCipher(alice.sessionBuilder, bob.address), serializer, t)
+
+	for _, limit := range []int{0, -1} {
+		buffer, results := newPendingBuffer(time.Duration(limit), limit)
+		for _, message := range messages {
+			buffer.AddSessionMessage(alice.address, message)
+		}
+		buffer.Prune()
+		if buffer.Len() != len(messages) {
+			t.Errorf("Limit %d: got %d buffered messages, want %d", limit, buffer.Len(), len(messages))
+		}
+		if len(*results) != 0 {
+			t.Errorf("Limit %d: expected no dropped messages, got: %+v", limit, *results)
+		}
+	}
+}
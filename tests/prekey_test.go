@@ -4,6 +4,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/medium"
 	"testing"
 )
 
@@ -30,3 +31,31 @@ func TestPreKeys(t *testing.T) {
 	signedPreKey, _ := keyhelper.GenerateSignedPreKey(identityKeyPair, 1, serializer.SignedPreKeyRecord)
 	logger.Info("Signed PreKey: ", signedPreKey)
 }
+
+// TestPreKeyIDs checks that generated prekey IDs start at the given ID and
+// wrap around before the reserved last resort ID.
+func TestPreKeyIDs(t *testing.T) {
+	serializer := newSerializer()
+
+	tests := []struct {
+		start    int
+		count    int
+		expected []uint32
+	}{
+		{1, 3, []uint32{1, 2, 3}},
+		{0, 3, []uint32{medium.MaxValue - 1, 1, 2}},
+		{int(medium.MaxValue) - 2, 4, []uint32{medium.MaxValue - 2, medium.MaxValue - 1, 1, 2}},
+		{int(medium.MaxValue), 2, []uint32{1, 2}},
+	}
+	for _, test := range tests {
+		preKeys, err := keyhelper.GeneratePreKeys(test.start, test.count, serializer.PreKeyRecord)
+		if err != nil {
+			t.Fatal("Unable to generate prekeys: ", err)
+		}
+		for i, preKey := range preKeys {
+			if preKey.ID().Value != test.expected[i] {
+				t.Error("Start ", test.start, ": expected prekey ID ", test.expected[i], ", got ", preKey.ID().Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/provisioning"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/bytehelper"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
+)
+
+// TestProvisioning links a new device to Alice's account and checks that it
+// can build sessions with the imported identity.
+func TestProvisioning(t *testing.T) {
+	serializer := newSerializer()
+	aci := protocol.NewACI(testUUIDBytes)
+	pni := protocol.NewPNI([16]byte{1, 2, 3, 4})
+	alice := newUser(aci.String(), 1, serializer)
+	pniIdentityKeyPair, err := keyhelper.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal("Unable to generate PNI identity: ", err)
+	}
+
+	// The new device shows its ephemeral public key to the primary.
+	ephemeral, err := ecc.GenerateKeyPair()
+	if err != nil {
+		t.Fatal("Unable to generate ephemeral key pair: ", err)
+	}
+
+	// The primary sends the account's identities and data.
+	message := provisioning.NewMessage(alice.identityKeyPair, aci, "+15555550123", "123456")
+	message.SetPNI(pni, pniIdentityKeyPair)
+	message.SetProfileKey([]byte("profile key"))
+	message.SetUserAgent("Go")
+	message.SetReadReceipts(true)
+	envelope, err := provisioning.EncryptMessage(ephemeral.PublicKey(), message, serializer.ProvisionMessage)
+	if err != nil {
+		t.Fatal("Unable to encrypt provisioning message: ", err)
+	}
+	received, err := provisioning.NewEnvelopeFromBytes(envelope.Serialize(serializer.ProvisionEnvelope),
+		serializer.ProvisionEnvelope)
+	if err != nil {
+		t.Fatal("Unable to read provisioning envelope: ", err)
+	}
+
+	// The new device decrypts the message.
+	provisioned, err := provisioning.DecryptMessage(ephemeral, received, serializer.ProvisionMessage)
+	if err != nil {
+		t.Fatal("Unable to decrypt provisioning message: ", err)
+	}
+	if provisioned.ACI() != aci || provisioned.PNI() != pni || provisioned.Number() != "+15555550123" ||
+		provisioned.ProvisioningCode() != "123456" || !bytes.Equal(provisioned.ProfileKey(), []byte("profile key")) ||
+		provisioned.UserAgent() != "Go" || !provisioned.ReadReceipts() {
+		t.Errorf("Provisioned account data does not match: %+v", provisioned)
+	}
+	if provisioned.ACIIdentityKeyPair().PublicKey().Fingerprint() != alice.identityKeyPair.PublicKey().Fingerprint() ||
+		provisioned.ACIIdentityKeyPair().PrivateKey().Serialize() != alice.identityKeyPair.PrivateKey().Serialize() ||
+		provisioned.PNIIdentityKeyPair().PublicKey().Fingerprint() != pniIdentityKeyPair.PublicKey().Fingerprint() {
+		t.Error("Provisioned identities do not match the account's.")
+	}
+
+	// The new device imports the identity with its own registration ID and
+	// prekeys, and Bob builds a session with it.
+	linked := newUser(aci.String(), 2, serializer)
+	linked.identityKeyPair = provisioned.ACIIdentityKeyPair()
+	linked.signedPreKey, err = keyhelper.GenerateSignedPreKey(linked.identityKeyPair, 0, serializer.SignedPreKeyRecord)
+	if err != nil {
+		t.Fatal("Unable to generate signed prekey: ", err)
+	}
+	linkedStore := memstore.NewSignalProtocol(linked.identityKeyPair, linked.registrationID, serializer)
+	storeUserKeys(linked, linkedStore, serializer)
+
+	bob := newUser("Bob", 1, serializer)
+	bob.buildSession(linked.address, serializer)
+	if err := bob.sessionBuilder.ProcessBundle(newBundle(linked, 0)); err != nil {
+		t.Fatal("Unable to process the linked device's bundle: ", err)
+	}
+	messageStrings, messages := sendMessages(1, session.NewCipher(bob.sessionBuilder, linked.address), serializer, t)
+	linkedBuilder := session.NewBuilderFromSignal(linkedStore, bob.address, serializer)
+	if _, err := linkedBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	receiveMessages(messages, messageStrings, session.NewCipher(linkedBuilder, bob.address), t)
+}
+
+// TestProvisioningFailures checks that provisioning envelopes can only be
+// decrypted by the new device, and are checked for tampering.
+func TestProvisioningFailures(t *testing.T) {
+	serializer := newSerializer()
+	ephemeral, _ := ecc.GenerateKeyPair()
+	other, _ := ecc.GenerateKeyPair()
+	envelope, err := provisioning.Encrypt(ephemeral.PublicKey(), []byte("account data"))
+	if err != nil {
+		t.Fatal("Unable to encrypt provisioning body: ", err)
+	}
+
+	if _, err := provisioning.Decrypt(other, envelope); !errors.Is(err, provisioning.ErrBadMac) {
+		t.Errorf("Expected decrypting with another key to fail with a bad MAC, got: %v", err)
+	}
+
+	tampered := append([]byte{}, envelope.Body()...)
+	tampered[20] ^= 0x01
+	if _, err := provisioning.Decrypt(ephemeral, provisioning.NewEnvelope(envelope.PublicKey(), tampered)); !errors.Is(err, provisioning.ErrBadMac) {
+		t.Errorf("Expected a tampered body to fail with a bad MAC, got: %v", err)
+	}
+
+	wrongVersion := append([]byte{}, envelope.Body()...)
+	wrongVersion[0] = provisioning.Version + 1
+	if _, err := provisioning.Decrypt(ephemeral, provisioning.NewEnvelope(envelope.PublicKey(), wrongVersion)); err == nil {
+		t.Error("Expected an unknown version to fail.")
+	}
+	if _, err := provisioning.Decrypt(ephemeral, provisioning.NewEnvelope(envelope.PublicKey(), envelope.Body()[:40])); err == nil {
+		t.Error("Expected a truncated body to fail.")
+	}
+
+	// A private key that doesn't belong to its public key is rejected.
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 1, serializer)
+	structure := &provisioning.MessageStructure{
+		ACIIdentityKeyPublic:  alice.identityKeyPair.PublicKey().Serialize(),
+		ACIIdentityKeyPrivate: bytehelper.ArrayToSlice(bob.identityKeyPair.PrivateKey().Serialize()),
+		ACI:                   protocol.NewACI(testUUIDBytes).String(),
+	}
+	if _, err := provisioning.NewMessageFromStruct(structure); err == nil {
+		t.Error("Expected a mismatched identity key pair to fail.")
+	}
+
+	// The ACI must be an ACI.
+	structure.ACIIdentityKeyPrivate = bytehelper.ArrayToSlice(alice.identityKeyPair.PrivateKey().Serialize())
+	structure.ACI = protocol.NewPNI(testUUIDBytes).String()
+	if _, err := provisioning.NewMessageFromStruct(structure); err == nil {
+		t.Error("Expected a PNI in the ACI field to fail.")
+	}
+}
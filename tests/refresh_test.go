@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/root"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+)
+
+// TestSessionRefresh checks that a one-directional sender can force new
+// ratchet keys and that the receiver follows them.
+func TestSessionRefresh(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, aliceCipher, bobCipher := buildRefreshSessions(serializer, t)
+
+	// A refresh is delayed until the session has been acknowledged.
+	unacked := newUser("Carol", 3, serializer)
+	unacked.buildSession(bob.address, serializer)
+	if err := unacked.sessionBuilder.ProcessBundle(newBundle(bob, 1)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	unackedCipher := session.NewCipher(unacked.sessionBuilder, bob.address)
+	first := senderRatchetKey(encryptMessage("Hello", unackedCipher, serializer, t))
+	if err := unackedCipher.Refresh(); err != nil {
+		t.Fatal("Unable to refresh session: ", err)
+	}
+	if senderRatchetKey(encryptMessage("Hello", unackedCipher, serializer, t)) != first {
+		t.Error("An unacknowledged session should not be refreshed.")
+	}
+
+	// Refresh several times without Bob ever replying.
+	for i := 0; i < 3; i++ {
+		before := alice.sessionStore.LoadSession(bob.address).SessionState().SenderChainRatchetKey().PublicKey()
+		if err := aliceCipher.Refresh(); err != nil {
+			t.Fatal("Unable to refresh session: ", err)
+		}
+		messageStrings, messages := sendRefreshMessages(3, alice, bob, aliceCipher, serializer, t)
+		if senderRatchetKey(messages[0]) == before {
+			t.Fatal("Refresh did not generate a new sender ratchet key.")
+		}
+		receiveMessages(messages, messageStrings, bobCipher, t)
+	}
+
+	// The session keeps working in both directions afterwards.
+	messageStrings, messages := sendMessages(3, bobCipher, serializer, t)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	messageStrings, messages = sendMessages(3, aliceCipher, serializer, t)
+	receiveMessages(messages, messageStrings, bobCipher, t)
+}
+
+// TestSessionRefreshPolicy checks that a refresh policy forces new ratchet
+// keys after a number of messages or an amount of time.
+func TestSessionRefreshPolicy(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, aliceCipher, bobCipher := buildRefreshSessions(serializer, t)
+
+	aliceCipher.SetRefreshPolicy(session.RefreshPolicy{MaxMessages: 2})
+	messageStrings, messages := sendRefreshMessages(7, alice, bob, aliceCipher, serializer, t)
+	if keys := countRatchetKeys(messages); keys != 4 {
+		t.Errorf("Got %d sender ratchet keys for 7 messages, want 4", keys)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	aliceCipher.SetRefreshPolicy(session.RefreshPolicy{MaxAge: time.Hour})
+	messageStrings, messages = sendRefreshMessages(3, alice, bob, aliceCipher, serializer, t)
+	if keys := countRatchetKeys(messages); keys != 1 {
+		t.Errorf("Got %d sender ratchet keys within the maximum age, want 1", keys)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	aliceCipher.SetRefreshPolicy(session.RefreshPolicy{MaxAge: time.Nanosecond})
+	messageStrings, messages = sendRefreshMessages(3, alice, bob, aliceCipher, serializer, t)
+	if keys := countRatchetKeys(messages); keys != 3 {
+		t.Errorf("Got %d sender ratchet keys past the maximum age, want 3", keys)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+}
+
+// TestSessionRefreshCrossing checks a refresh that crosses a reply the
+// sender has not received yet.
+func TestSessionRefreshCrossing(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, aliceCipher, bobCipher := buildRefreshSessions(serializer, t)
+
+	// Bob replies, but Alice refreshes before the reply arrives.
+	bobMessageStrings, bobMessages := sendMessages(2, bobCipher, serializer, t)
+	if err := aliceCipher.Refresh(); err != nil {
+		t.Fatal("Unable to refresh session: ", err)
+	}
+	aliceMessageStrings, aliceMessages := sendRefreshMessages(2, alice, bob, aliceCipher, serializer, t)
+
+	receiveMessages(aliceMessages, aliceMessageStrings, bobCipher, t)
+	receiveMessages(bobMessages, bobMessageStrings, aliceCipher, t)
+
+	for i := 0; i < 2; i++ {
+		messageStrings, messages := sendMessages(2, aliceCipher, serializer, t)
+		receiveMessages(messages, messageStrings, bobCipher, t)
+		messageStrings, messages = sendMessages(2, bobCipher, serializer, t)
+		receiveMessages(messages, messageStrings, aliceCipher, t)
+	}
+}
+
+// TestSessionRefreshReordered checks a refreshed chain that arrives before
+// the chain it replaced, which was started by a DH ratchet step.
+func TestSessionRefreshReordered(t *testing.T) {
+	serializer := newSerializer()
+	alice, bob, aliceCipher, bobCipher := buildRefreshSessions(serializer, t)
+
+	// Alice answers Bob with a new ratchet key, then refreshes it.
+	messageStrings, messages := sendMessages(1, bobCipher, serializer, t)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	delayedStrings, delayed := sendMessages(1, aliceCipher, serializer, t)
+	if err := aliceCipher.Refresh(); err != nil {
+		t.Fatal("Unable to refresh session: ", err)
+	}
+	messageStrings, messages = sendRefreshMessages(2, alice, bob, aliceCipher, serializer, t)
+
+	receiveMessages(messages, messageStrings, bobCipher, t)
+	receiveMessages(delayed, delayedStrings, bobCipher, t)
+
+	// A refreshed chain can't be followed without our identity key.
+	if err := aliceCipher.Refresh(); err != nil {
+		t.Fatal("Unable to refresh session: ", err)
+	}
+	_, messages = sendRefreshMessages(1, alice, bob, aliceCipher, serializer, t)
+	cipher := session.NewCipherWithSerializer(alice.address, bob.sessionStore, bob.preKeyStore, serializer)
+	if _, err := cipher.Decrypt(messages[0].(*protocol.SignalMessage)); err == nil {
+		t.Error("Expected a refreshed chain to fail without an identity key store.")
+	}
+	cipher.SetIdentityKeyStore(bob.store.IdentityKey)
+	if _, err := cipher.Decrypt(messages[0].(*protocol.SignalMessage)); err != nil {
+		t.Error("Unable to decrypt refreshed chain: ", err)
+	}
+}
+
+// buildRefreshSessions builds an acknowledged session between Alice and Bob,
+// with one message sent on Alice's current sender chain.
+func buildRefreshSessions(serializer *serialize.Serializer, t *testing.T) (*user, *user, *session.Cipher, *session.Cipher) {
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+
+	messageStrings, messages := sendMessages(1, aliceCipher, serializer, t)
+	if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	receiveMessages(messages, messageStrings, bobCipher, t)
+	messageStrings, messages = sendMessages(1, bobCipher, serializer, t)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	messageStrings, messages = sendMessages(1, aliceCipher, serializer, t)
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	return alice, bob, aliceCipher, bobCipher
+}
+
+// sendRefreshMessages sends messages like sendMessages, and checks every
+// sender chain that a refresh starts with checkRefreshedChain.
+func sendRefreshMessages(count int, sender, receiver *user, cipher *session.Cipher,
+	serializer *serialize.Serializer, t *testing.T) ([]string, []protocol.CiphertextMessage) {
+
+	messageStrings := make([]string, count)
+	messages := make([]protocol.CiphertextMessage, count)
+	for i := range messages {
+		before := sender.sessionStore.LoadSession(receiver.address).SessionState()
+		messageStrings[i] = "Message " + strconv.Itoa(i)
+		messages[i] = encryptMessage(messageStrings[i], cipher, serializer, t)
+		if senderRatchetKey(messages[i]) != before.SenderChainRatchetKey().PublicKey() {
+			after := sender.sessionStore.LoadSession(receiver.address).SessionState()
+			checkRefreshedChain(before, after, receiver.identityKeyPair, t)
+		}
+	}
+
+	return messageStrings, messages
+}
+
+// checkRefreshedChain checks that a refresh derived the new sender chain
+// from the previous sender chain key and the Diffie-Hellman output of the
+// refresh key and the receiver's identity key, and that it left the root key
+// and ratchet key pair alone. The state after the refresh has sent one
+// message.
+func checkRefreshedChain(before, after *record.State, receiverIdentity *identity.KeyPair, t *testing.T) {
+	params, err := before.VersionParameters()
+	if err != nil {
+		t.Fatal("Unable to get version parameters: ", err)
+	}
+	if !bytes.Equal(after.RootKey().Bytes(), before.RootKey().Bytes()) ||
+		after.SenderRatchetKey().PublicKey() != before.SenderRatchetKey().PublicKey() {
+		t.Fatal("The refresh changed the DH ratchet.")
+	}
+	if after.SenderRefreshParentKey().PublicKey() != before.SenderChainRatchetKey().PublicKey() {
+		t.Fatal("The refreshed chain doesn't name the chain it replaced.")
+	}
+
+	// The receiver derives the chain with its identity key.
+	identityKeyPair := ecc.NewECKeyPair(receiverIdentity.PublicKey().PublicKey(), receiverIdentity.PrivateKey())
+	parentKey := root.NewKey(kdf.DeriveSecrets, before.SenderChainKey().Key())
+	expected, err := parentKey.CreateChainWithParameters(after.SenderChainRatchetKey(), identityKeyPair, params)
+	if err != nil {
+		t.Fatal("Unable to create chain: ", err)
+	}
+	if !bytes.Equal(after.SenderChainKey().Key(), expected.ChainKey.NextKey().Key()) {
+		t.Fatal("The refreshed chain is not derived from the refresh key.")
+	}
+
+	// The same chain key without the refresh key gives other keys.
+	stale, err := parentKey.CreateChainWithParameters(before.SenderChainRatchetKey(), identityKeyPair, params)
+	if err != nil {
+		t.Fatal("Unable to create chain: ", err)
+	}
+	if bytes.Equal(stale.ChainKey.Key(), expected.ChainKey.Key()) {
+		t.Fatal("The refreshed chain doesn't depend on the new Diffie-Hellman output.")
+	}
+}
+
+// senderRatchetKey returns the sender ratchet key of the given message.
+func senderRatchetKey(message protocol.CiphertextMessage) [32]byte {
+	if preKeyMessage, ok := message.(*protocol.PreKeySignalMessage); ok {
+		return preKeyMessage.WhisperMessage().SenderRatchetKey().PublicKey()
+	}
+	return message.(*protocol.SignalMessage).SenderRatchetKey().PublicKey()
+}
+
+// countRatchetKeys returns the number of distinct sender ratchet keys used
+// by the given messages.
+func countRatchetKeys(messages []protocol.CiphertextMessage) int {
+	keys := make(map[[32]byte]bool)
+	for _, message := range messages {
+		keys[senderRatchetKey(message)] = true
+	}
+	return len(keys)
+}
@@ -1,12 +1,136 @@
 package tests
 
 import (
-	"fmt"
-	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
 	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/logger"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
 )
 
+// TestRegistrationID checks that generated registration IDs are within range.
 func TestRegistrationID(t *testing.T) {
-	regID := keyhelper.GenerateRegistrationID()
-	fmt.Println(regID)
+	for i := 0; i < 10000; i++ {
+		regID := keyhelper.GenerateRegistrationID()
+		if !keyhelper.IsValidRegistrationID(regID, false) {
+			t.Fatal("Registration ID out of range: ", regID)
+		}
+		extendedID := keyhelper.GenerateExtendedRegistrationID()
+		if !keyhelper.IsValidRegistrationID(extendedID, true) {
+			t.Fatal("Extended registration ID out of range: ", extendedID)
+		}
+	}
+	logger.Info("Generated registration ID: ", keyhelper.GenerateRegistrationID())
+
+	for _, regID := range []uint32{0, keyhelper.MaxRegistrationID + 1} {
+		if keyhelper.IsValidRegistrationID(regID, false) {
+			t.Error("Registration ID ", regID, " should not be valid.")
+		}
+	}
+	if !keyhelper.IsValidRegistrationID(keyhelper.MaxRegistrationID+1, true) {
+		t.Error("Registration ID above the standard range should be valid in the extended range.")
+	}
+	if keyhelper.IsValidRegistrationID(keyhelper.MaxExtendedRegistrationID+1, true) {
+		t.Error("Registration ID above the extended range should not be valid.")
+	}
+}
+
+// TestInvalidRegistrationID checks that bundles and messages with an invalid
+// registration ID are rejected.
+func TestInvalidRegistrationID(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+
+	bundle := newBundle(bob, 0)
+	invalidBundle := prekey.NewBundle(0, bob.deviceID, bob.preKeys[0].ID(), bob.signedPreKey.ID(),
+		bob.preKeys[0].KeyPair().PublicKey(), bob.signedPreKey.KeyPair().PublicKey(),
+		bob.signedPreKey.Signature(), bob.identityKeyPair.PublicKey())
+	if err := alice.sessionBuilder.ProcessBundle(invalidBundle); err == nil {
+		t.Error("A bundle with registration ID 0 should be rejected.")
+	}
+
+	// Build a sender whose store reports an invalid registration ID.
+	mallory := newUser("Mallory", 3, serializer)
+	mallory.store = memstore.NewSignalProtocol(mallory.identityKeyPair, 0, serializer)
+	builder := session.NewBuilderFromSignal(mallory.store, bob.address, serializer)
+	if err := builder.ProcessBundle(bundle); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	message, err := session.NewCipher(builder, bob.address).Encrypt([]byte("Hello"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	bob.buildSession(mallory.address, serializer)
+	if _, err := bob.sessionBuilder.Process(message.(*protocol.PreKeySignalMessage)); err == nil {
+		t.Error("A message with registration ID 0 should be rejected.")
+	}
+}
+
+// TestRegistrationIDChange checks that a remote registration ID change is
+// detected and the session is rebuilt.
+func TestRegistrationIDChange(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	buildBackupSessions(alice, bob, serializer, t)
+
+	// Bob reinstalls with a new identity and registration ID.
+	reinstalled := newUser("Bob", 2, serializer)
+	for reinstalled.registrationID == bob.registrationID {
+		reinstalled.registrationID = keyhelper.GenerateRegistrationID()
+	}
+
+	var changed []uint32
+	builder := session.NewBuilderFromSignal(alice.store, reinstalled.address, serializer)
+	builder.SetRegistrationIDChangeHandler(func(address *protocol.SignalAddress, oldRegistrationID, newRegistrationID uint32) {
+		if !address.Equal(reinstalled.address) {
+			t.Error("Registration ID change reported for the wrong address: ", address)
+		}
+		changed = append(changed, oldRegistrationID, newRegistrationID)
+	})
+
+	// Alice trusts the new identity, as a user would after verifying it.
+	alice.store.SaveIdentity(reinstalled.address, reinstalled.identityKeyPair.PublicKey())
+	if err := builder.ProcessBundle(newBundle(reinstalled, 1)); err != nil {
+		t.Fatal("Unable to process reinstalled bundle: ", err)
+	}
+	if len(changed) != 2 || changed[0] != bob.registrationID || changed[1] != reinstalled.registrationID {
+		t.Fatal("Expected registration ID change from ", bob.registrationID, " to ", reinstalled.registrationID, ", got: ", changed)
+	}
+
+	sessionRecord := alice.store.LoadSession(reinstalled.address)
+	if sessionRecord.SessionState().RemoteRegistrationID() != reinstalled.registrationID {
+		t.Error("Session was not rebuilt with the new registration ID.")
+	}
+	if len(sessionRecord.PreviousSessionStates()) == 0 {
+		t.Error("The old session should have been archived.")
+	}
+
+	// Processing the same registration ID again is not a change.
+	if err := builder.ProcessBundle(newBundle(reinstalled, 2)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	if len(changed) != 2 {
+		t.Error("An unchanged registration ID should not be reported.")
+	}
+}
+
+// newBundle returns a prekey bundle for the given user with the prekey at
+// the given index.
+func newBundle(u *user, preKeyIndex int) *prekey.Bundle {
+	return prekey.NewBundle(
+		u.registrationID,
+		u.deviceID,
+		u.preKeys[preKeyIndex].ID(),
+		u.signedPreKey.ID(),
+		u.preKeys[preKeyIndex].KeyPair().PublicKey(),
+		u.signedPreKey.KeyPair().PublicKey(),
+		u.signedPreKey.Signature(),
+		u.identityKeyPair.PublicKey(),
+	)
 }
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+const testUUID = "9d0652a3-dcc3-4d11-975f-74d61598733f"
+
+var testUUIDBytes = [16]byte{
+	0x9d, 0x06, 0x52, 0xa3, 0xdc, 0xc3, 0x4d, 0x11,
+	0x97, 0x5f, 0x74, 0xd6, 0x15, 0x98, 0x73, 0x3f,
+}
+
+// TestServiceID checks the string and binary forms of ACIs and PNIs.
+func TestServiceID(t *testing.T) {
+	tests := []struct {
+		serviceID       protocol.ServiceID
+		kind            protocol.ServiceIDKind
+		str             string
+		binaryLength    int
+		fixedWidthFirst byte
+	}{
+		{protocol.NewACI(testUUIDBytes), protocol.ACI, testUUID, 16, 0x00},
+		{protocol.NewPNI(testUUIDBytes), protocol.PNI, "PNI:" + testUUID, 17, 0x01},
+	}
+
+	for _, test := range tests {
+		if test.serviceID.Kind() != test.kind || test.serviceID.String() != test.str {
+			t.Errorf("Got %s %s, want %s %s", test.serviceID.Kind(), test.serviceID, test.kind, test.str)
+		}
+		parsed, err := protocol.ParseServiceID(test.str)
+		if err != nil || parsed != test.serviceID {
+			t.Errorf("Unable to parse %s: %v", test.str, err)
+		}
+
+		binary := test.serviceID.Bytes()
+		fixedWidth := test.serviceID.FixedWidthBytes()
+		if len(binary) != test.binaryLength || len(fixedWidth) != 17 || fixedWidth[0] != test.fixedWidthFirst ||
+			!bytes.Equal(fixedWidth[1:], testUUIDBytes[:]) {
+			t.Errorf("Unexpected binary forms of %s: %x, %x", test.str, binary, fixedWidth)
+		}
+		for _, serialized := range [][]byte{binary, fixedWidth} {
+			if fromBytes, err := protocol.ServiceIDFromBytes(serialized); err != nil || fromBytes != test.serviceID {
+				t.Errorf("Unable to read %s from %x: %v", test.str, serialized, err)
+			}
+		}
+
+		address := test.serviceID.Address(2)
+		if fromAddress, err := protocol.ServiceIDFromAddress(address); err != nil || fromAddress != test.serviceID ||
+			address.DeviceID() != 2 {
+			t.Errorf("Unexpected address for %s: %v", test.str, address)
+		}
+	}
+
+	// Upper case UUIDs are accepted, and formatted in lower case.
+	if parsed, err := protocol.ParseServiceID("PNI:9D0652A3-DCC3-4D11-975F-74D61598733F"); err != nil ||
+		parsed.String() != "PNI:"+testUUID {
+		t.Errorf("Unable to parse an upper case PNI: %v %v", parsed, err)
+	}
+
+	for _, invalid := range []string{"", "PNI:", "pni:" + testUUID, "9d0652a3dcc34d11975f74d61598733f", testUUID + "0",
+		"9d0652a3-dcc3-4d11-975f-74d61598733g"} {
+		if _, err := protocol.ParseServiceID(invalid); err == nil {
+			t.Errorf("Expected %q to be an invalid service ID.", invalid)
+		}
+	}
+	for _, invalid := range [][]byte{nil, testUUIDBytes[:15], append([]byte{0x02}, testUUIDBytes[:]...)} {
+		if _, err := protocol.ServiceIDFromBytes(invalid); err == nil {
+			t.Errorf("Expected %x to be an invalid service ID.", invalid)
+		}
+	}
+}
+
+// TestServiceIdentities checks that a session with our PNI is built with the
+// PNI's identity, and kept apart from our ACI's sessions.
+func TestServiceIdentities(t *testing.T) {
+	serializer := newSerializer()
+	aci := protocol.NewACI(testUUIDBytes)
+	pni := protocol.NewPNI([16]byte{1, 2, 3, 4})
+
+	// Alice's ACI and PNI each have their own identity and prekeys.
+	aliceACI := newUser(aci.String(), 1, serializer)
+	alicePNI := newUser(pni.String(), 1, serializer)
+	identities := memstore.NewLocalIdentities(serializer)
+	storeUserKeys(aliceACI, identities.AddIdentity(aci, aliceACI.identityKeyPair, aliceACI.registrationID), serializer)
+	storeUserKeys(alicePNI, identities.AddIdentity(pni, alicePNI.identityKeyPair, alicePNI.registrationID), serializer)
+	if serviceIDs := identities.LocalServiceIDs(); len(serviceIDs) != 2 || serviceIDs[0] != aci || serviceIDs[1] != pni {
+		t.Errorf("Unexpected local service IDs: %v", serviceIDs)
+	}
+
+	// Bob only knows Alice's phone number, and starts a session with her PNI.
+	bob := newUser("Bob", 1, serializer)
+	bob.buildSession(pni.Address(1), serializer)
+	if err := bob.sessionBuilder.ProcessBundle(newBundle(alicePNI, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	bobCipher := session.NewCipher(bob.sessionBuilder, pni.Address(1))
+	messageStrings, messages := sendMessages(1, bobCipher, serializer, t)
+
+	// The destination of Bob's message is Alice's PNI.
+	destination, err := protocol.ServiceIDFromAddress(pni.Address(1))
+	if err != nil {
+		t.Fatal("Unable to read destination service ID: ", err)
+	}
+	aliceBuilder, err := session.NewBuilderForService(identities, destination, bob.address, serializer)
+	if err != nil {
+		t.Fatal("Unable to build session builder: ", err)
+	}
+	if _, err := aliceBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+		t.Fatal("Unable to process prekey message: ", err)
+	}
+	aliceCipher := session.NewCipher(aliceBuilder, bob.address)
+	receiveMessages(messages, messageStrings, aliceCipher, t)
+	messageStrings, messages = sendMessages(2, aliceCipher, serializer, t)
+	receiveMessages(messages, messageStrings, bobCipher, t)
+
+	// The session belongs to the PNI only.
+	if !identities.IdentityStore(pni).ContainsSession(bob.address) {
+		t.Error("Expected the PNI to have a session with Bob.")
+	}
+	if identities.IdentityStore(aci).ContainsSession(bob.address) {
+		t.Error("Expected the ACI to have no session with Bob.")
+	}
+
+	// Service IDs that aren't ours have no identity.
+	if _, err := session.NewBuilderForService(identities, protocol.NewACI([16]byte{9}), bob.address, serializer); err == nil {
+		t.Error("Expected a builder for an unknown service ID to fail.")
+	}
+	identities.RemoveIdentity(pni)
+	if identities.IdentityStore(pni) != nil {
+		t.Error("Expected a removed identity to have no store.")
+	}
+}
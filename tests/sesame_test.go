@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/prekey"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/sesame"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+)
+
+// TestSesameDeviceChanges checks that a sender follows the recipient's
+// devices as they are added, removed and reinstalled.
+func TestSesameDeviceChanges(t *testing.T) {
+	serializer := newSerializer()
+	server := newSesameServer(serializer)
+	alice := server.register(newUser("Alice", 1, serializer))
+	bob1 := server.register(newUser("Bob", 1, serializer))
+	bob2 := server.register(newUser("Bob", 2, serializer))
+	aliceManager := server.newManager(alice)
+
+	// Alice has no sessions yet, so she fetches bundles for all of Bob's devices.
+	sendSesame(aliceManager, "Bob", "Hello", t)
+	server.receive(bob1, "Hello", t)
+	server.receive(bob2, "Hello", t)
+
+	// Bob adds a device. The server rejects the message and Alice retries.
+	bob3 := server.register(newUser("Bob", 3, serializer))
+	sendSesame(aliceManager, "Bob", "Three devices", t)
+	server.receive(bob1, "Three devices", t)
+	server.receive(bob2, "Three devices", t)
+	server.receive(bob3, "Three devices", t)
+
+	// Bob's second device sends a message and is then removed.
+	delayed, err := server.newManager(bob2).Encrypt("Alice", []byte("Delayed"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	server.unregister(bob2)
+	sendSesame(aliceManager, "Bob", "Removed", t)
+	if !aliceManager.IsStale(bob2.address) {
+		t.Error("A removed device should be stale.")
+	}
+	if len(aliceManager.Devices("Bob")) != 2 {
+		t.Errorf("Got %d active devices, want 2", len(aliceManager.Devices("Bob")))
+	}
+	server.receive(bob1, "Removed", t)
+	server.receive(bob3, "Removed", t)
+
+	// A delayed message from the stale device can still be decrypted.
+	plaintext, err := aliceManager.Decrypt(bob2.address, server.roundTrip(delayed[0].Message, t))
+	if err != nil || string(plaintext) != "Delayed" {
+		t.Error("Unable to decrypt delayed message from stale device: ", err)
+	}
+
+	// Bob reinstalls his first device, and Alice accepts his new identity.
+	// Her old session is stale.
+	reinstalled := server.register(newUser("Bob", 1, serializer))
+	alice.identityStore.SaveIdentity(reinstalled.address, reinstalled.identityKeyPair.PublicKey())
+	sendSesame(aliceManager, "Bob", "Reinstalled", t)
+	server.receive(reinstalled, "Reinstalled", t)
+	server.receive(bob3, "Reinstalled", t)
+	sessionRecord := alice.sessionStore.LoadSession(bob1.address)
+	if len(sessionRecord.PreviousSessionStates()) == 0 {
+		t.Error("The session of the reinstalled device should be kept as an inactive session.")
+	}
+
+	// Stale devices are pruned after the timeout.
+	aliceManager.SetStaleTimeout(0)
+	aliceManager.PruneStaleDevices()
+	if alice.sessionStore.ContainsSession(bob2.address) {
+		t.Error("The sessions of a stale device should be deleted.")
+	}
+}
+
+// TestSesameStaleDevicesRebuild checks that devices marked stale stay stale
+// when the manager is rebuilt from the same stores.
+func TestSesameStaleDevicesRebuild(t *testing.T) {
+	serializer := newSerializer()
+	server := newSesameServer(serializer)
+	alice := server.register(newUser("Alice", 1, serializer))
+	bob1 := server.register(newUser("Bob", 1, serializer))
+	bob2 := server.register(newUser("Bob", 2, serializer))
+	staleDevices := memstore.NewStaleDevice()
+	aliceManager := server.newManager(alice)
+	aliceManager.SetStaleDevices(staleDevices)
+
+	sendSesame(aliceManager, "Bob", "Hello", t)
+	server.receive(bob1, "Hello", t)
+	server.receive(bob2, "Hello", t)
+	server.unregister(bob2)
+	sendSesame(aliceManager, "Bob", "Removed", t)
+	server.receive(bob1, "Removed", t)
+
+	// A new manager with the same stores still skips the removed device.
+	rebuilt := sesame.NewManager(alice.store, serializer, server.fetchBundles, server.deliverer(alice))
+	rebuilt.SetStaleDevices(staleDevices)
+	if !rebuilt.IsStale(bob2.address) {
+		t.Error("A removed device should still be stale after rebuilding the manager.")
+	}
+	messages, err := rebuilt.Encrypt("Bob", []byte("Rebuilt"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	if len(messages) != 1 || messages[0].DeviceID != bob1.deviceID {
+		t.Errorf("Got %d messages, want one for device %d", len(messages), bob1.deviceID)
+	}
+
+	rebuilt.SetStaleTimeout(0)
+	rebuilt.PruneStaleDevices()
+	if alice.sessionStore.ContainsSession(bob2.address) {
+		t.Error("The sessions of a stale device should be deleted.")
+	}
+	if len(staleDevices.LoadStaleDeviceAddresses()) != 0 {
+		t.Error("A pruned device should be removed from the stale device store.")
+	}
+}
+
+// TestSesameSimultaneousInitiation checks that two devices that build
+// sessions with each other at the same time converge on one session.
+func TestSesameSimultaneousInitiation(t *testing.T) {
+	serializer := newSerializer()
+	server := newSesameServer(serializer)
+	alice := server.register(newUser("Alice", 1, serializer))
+	bob := server.register(newUser("Bob", 1, serializer))
+	aliceManager := server.newManager(alice)
+	bobManager := server.newManager(bob)
+
+	// Both send their first message before receiving the other's.
+	sendSesame(aliceManager, "Bob", "Hello Bob", t)
+	sendSesame(bobManager, "Alice", "Hello Alice", t)
+	server.receiveWith(bobManager, bob, "Hello Bob", t)
+	server.receiveWith(aliceManager, alice, "Hello Alice", t)
+
+	// Once one side replies, both use the same session.
+	sendSesame(aliceManager, "Bob", "Reply", t)
+	server.receiveWith(bobManager, bob, "Reply", t)
+	sendSesame(bobManager, "Alice", "Reply", t)
+	server.receiveWith(aliceManager, alice, "Reply", t)
+
+	aliceState := aliceManager.ActiveSession(bob.address)
+	bobState := bobManager.ActiveSession(alice.address)
+	if !bytes.Equal(aliceState.SenderBaseKey(), bobState.SenderBaseKey()) {
+		t.Error("Alice and Bob did not converge on the same session.")
+	}
+
+	// Several messages in a row keep working in both directions.
+	for i := 0; i < 3; i++ {
+		sendSesame(aliceManager, "Bob", "Again", t)
+		sendSesame(bobManager, "Alice", "Again", t)
+	}
+	for i := 0; i < 3; i++ {
+		server.receiveWith(bobManager, bob, "Again", t)
+		server.receiveWith(aliceManager, alice, "Again", t)
+	}
+}
+
+// sesameServer is a simulated server that keeps the device list of every
+// user and their inbox.
+type sesameServer struct {
+	serializer  *serialize.Serializer
+	devices     map[string]map[uint32]*user
+	preKeyIndex map[*user]int
+	inbox       map[protocol.SignalAddress][]*sesameEnvelope
+	managers    map[*user]*sesame.Manager
+}
+
+// sesameEnvelope is a message waiting in a device's inbox.
+type sesameEnvelope struct {
+	sender  *protocol.SignalAddress
+	message protocol.CiphertextMessage
+}
+
+func newSesameServer(serializer *serialize.Serializer) *sesameServer {
+	return &sesameServer{
+		serializer:  serializer,
+		devices:     make(map[string]map[uint32]*user),
+		preKeyIndex: make(map[*user]int),
+		inbox:       make(map[protocol.SignalAddress][]*sesameEnvelope),
+		managers:    make(map[*user]*sesame.Manager),
+	}
+}
+
+// register adds or replaces the given device of a user.
+func (s *sesameServer) register(u *user) *user {
+	if s.devices[u.name] == nil {
+		s.devices[u.name] = make(map[uint32]*user)
+	}
+	s.devices[u.name][u.deviceID] = u
+
+	return u
+}
+
+// unregister removes the given device of a user.
+func (s *sesameServer) unregister(u *user) {
+	delete(s.devices[u.name], u.deviceID)
+}
+
+// newManager returns the Sesame manager of the given device.
+func (s *sesameServer) newManager(u *user) *sesame.Manager {
+	if s.managers[u] == nil {
+		s.managers[u] = sesame.NewManager(u.store, s.serializer, s.fetchBundles, s.deliverer(u))
+	}
+	return s.managers[u]
+}
+
+// fetchBundles returns a bundle for each of the given devices of a user.
+func (s *sesameServer) fetchBundles(name string, deviceIDs []uint32) ([]*prekey.Bundle, error) {
+	if len(deviceIDs) == 0 {
+		for deviceID := range s.devices[name] {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+
+	bundles := make([]*prekey.Bundle, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		device := s.devices[name][deviceID]
+		bundles = append(bundles, newBundle(device, s.preKeyIndex[device]))
+		s.preKeyIndex[device]++
+	}
+
+	return bundles, nil
+}
+
+// deliverer returns a Deliverer for messages sent by the given device. It
+// rejects messages that don't match the recipient's device list.
+func (s *sesameServer) deliverer(sender *user) sesame.Deliverer {
+	return func(name string, messages []*sesame.DeviceMessage) error {
+		mismatch := &sesame.DeviceMismatchError{}
+		sent := make(map[uint32]bool)
+		for _, message := range messages {
+			sent[message.DeviceID] = true
+			device, ok := s.devices[name][message.DeviceID]
+			switch {
+			case !ok:
+				mismatch.ExtraDevices = append(mismatch.ExtraDevices, message.DeviceID)
+			case device.registrationID != message.RegistrationID:
+				mismatch.StaleDevices = append(mismatch.StaleDevices, message.DeviceID)
+			}
+		}
+		for deviceID := range s.devices[name] {
+			if !sent[deviceID] {
+				mismatch.MissingDevices = append(mismatch.MissingDevices, deviceID)
+			}
+		}
+		if len(mismatch.MissingDevices)+len(mismatch.ExtraDevices)+len(mismatch.StaleDevices) > 0 {
+			return mismatch
+		}
+
+		for _, message := range messages {
+			address := *protocol.NewSignalAddress(name, message.DeviceID)
+			s.inbox[address] = append(s.inbox[address], &sesameEnvelope{
+				sender:  sender.address,
+				message: message.Message,
+			})
+		}
+		return nil
+	}
+}
+
+// roundTrip emulates sending the given message over the network.
+func (s *sesameServer) roundTrip(message protocol.CiphertextMessage, t *testing.T) protocol.CiphertextMessage {
+	var received protocol.CiphertextMessage
+	var err error
+	switch message.(type) {
+	case *protocol.PreKeySignalMessage:
+		received, err = protocol.NewPreKeySignalMessageFromBytes(message.Serialize(), s.serializer.PreKeySignalMessage, s.serializer.SignalMessage)
+	case *protocol.SignalMessage:
+		received, err = protocol.NewSignalMessageFromBytes(message.Serialize(), s.serializer.SignalMessage)
+	}
+	if err != nil {
+		t.Fatal("Unable to decode message: ", err)
+	}
+
+	return received
+}
+
+// receive decrypts the next message in the given device's inbox with the
+// device's manager and checks its plaintext.
+func (s *sesameServer) receive(u *user, want string, t *testing.T) {
+	s.receiveWith(s.newManager(u), u, want, t)
+}
+
+// receiveWith decrypts the next message in the given device's inbox with
+// the given manager and checks its plaintext.
+func (s *sesameServer) receiveWith(manager *sesame.Manager, u *user, want string, t *testing.T) {
+	t.Helper()
+	inbox := s.inbox[*u.address]
+	if len(inbox) == 0 {
+		t.Fatal("No message for: ", u.address)
+	}
+	envelope := inbox[0]
+	s.inbox[*u.address] = inbox[1:]
+
+	plaintext, err := manager.Decrypt(envelope.sender, s.roundTrip(envelope.message, t))
+	if err != nil {
+		t.Fatal("Unable to decrypt message: ", err)
+	}
+	if string(plaintext) != want {
+		t.Errorf("Got %q, want %q", plaintext, want)
+	}
+}
+
+// sendSesame sends the given message to every device of a user.
+func sendSesame(manager *sesame.Manager, name, message string, t *testing.T) {
+	t.Helper()
+	if err := manager.Send(name, []byte(message)); err != nil {
+		t.Fatal("Unable to send message: ", err)
+	}
+}
@@ -311,6 +311,8 @@ func encryptMessage(message string, cipher *session.Cipher, serializer *serializ
 		encryptedMessage, err = protocol.NewPreKeySignalMessageFromBytes(encrypted.Serialize(), serializer.PreKeySignalMessage, serializer.SignalMessage)
 	case *protocol.SignalMessage:
 		encryptedMessage, err = protocol.NewSignalMessageFromBytes(encrypted.Serialize(), serializer.SignalMessage)
+	case *protocol.HeaderEncryptedMessage:
+		encryptedMessage, err = protocol.NewHeaderEncryptedMessageFromBytes(encrypted.Serialize(), serializer.HeaderEncryptedMessage)
 	}
 
 	if err != nil {
@@ -323,12 +325,16 @@ func encryptMessage(message string, cipher *session.Cipher, serializer *serializ
 
 // decryptMessage is a helper function to decrypt messages of a session.
 func decryptMessage(message protocol.CiphertextMessage, cipher *session.Cipher, t *testing.T) string {
+	var msg []byte
+	var err error
 	switch message.(type) {
 	case *protocol.PreKeySignalMessage:
 		return decryptMessage(message.(*protocol.PreKeySignalMessage).WhisperMessage(), cipher, t)
+	case *protocol.HeaderEncryptedMessage:
+		msg, err = cipher.DecryptHeaderEncrypted(message.(*protocol.HeaderEncryptedMessage))
+	default:
+		msg, err = cipher.Decrypt(message.(*protocol.SignalMessage))
 	}
-
-	msg, err := cipher.Decrypt(message.(*protocol.SignalMessage))
 	if err != nil {
 		logger.Error("Unable to decrypt message: ", err)
 		t.FailNow()
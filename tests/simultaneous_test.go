@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+)
+
+// TestSimultaneousInitiation checks that two users who build sessions with
+// each other at once keep the session with the lower base key, and that
+// they don't switch states when they keep sending at the same time.
+func TestSimultaneousInitiation(t *testing.T) {
+	serializer := newSerializer()
+	conversation := newSimultaneousConversation(serializer, t)
+	alice, bob := conversation.alice, conversation.bob
+
+	// Both send before receiving anything.
+	conversation.send(alice, 2)
+	conversation.send(bob, 2)
+	conversation.deliverAll()
+	kept := conversation.assertConverged()
+
+	// Sending at the same time no longer makes the states alternate.
+	for i := 0; i < 5; i++ {
+		conversation.send(alice, 1)
+		conversation.send(bob, 1)
+		conversation.deliverAll()
+		if !bytes.Equal(conversation.assertConverged(), kept) {
+			t.Fatal("The kept session changed.")
+		}
+	}
+}
+
+// TestSimultaneousInitiationSimulation runs random interleavings of two
+// users initiating sessions at once and checks that every message is
+// decrypted and that both users end up on the same session.
+func TestSimultaneousInitiationSimulation(t *testing.T) {
+	serializer := newSerializer()
+	for seed := int64(0); seed < 20; seed++ {
+		random := rand.New(rand.NewSource(seed))
+		conversation := newSimultaneousConversation(serializer, t)
+		alice, bob := conversation.alice, conversation.bob
+		conversation.send(alice, 1)
+		conversation.send(bob, 1)
+
+		for step := 0; step < 30; step++ {
+			switch random.Intn(4) {
+			case 0:
+				conversation.send(alice, 1)
+			case 1:
+				conversation.send(bob, 1)
+			case 2:
+				conversation.deliver(alice)
+			case 3:
+				conversation.deliver(bob)
+			}
+		}
+		conversation.deliverAll()
+
+		// One round trip after the messages have settled.
+		conversation.send(alice, 1)
+		conversation.deliverAll()
+		conversation.send(bob, 1)
+		conversation.deliverAll()
+		conversation.assertConverged()
+	}
+}
+
+// simultaneousUser is one side of a simultaneous conversation.
+type simultaneousUser struct {
+	*user
+	remote *protocol.SignalAddress
+	cipher *session.Cipher
+	inbox  []protocol.CiphertextMessage
+}
+
+// simultaneousConversation holds two users that both processed a bundle of
+// the other before sending anything.
+type simultaneousConversation struct {
+	alice      *simultaneousUser
+	bob        *simultaneousUser
+	serializer *serialize.Serializer
+	t          *testing.T
+}
+
+func newSimultaneousConversation(serializer *serialize.Serializer, t *testing.T) *simultaneousConversation {
+	alice := &simultaneousUser{user: newUser("Alice", 1, serializer)}
+	bob := &simultaneousUser{user: newUser("Bob", 1, serializer)}
+	alice.remote, bob.remote = bob.address, alice.address
+
+	for _, u := range []*simultaneousUser{alice, bob} {
+		u.buildSession(u.remote, serializer)
+		u.cipher = session.NewCipher(u.sessionBuilder, u.remote)
+	}
+	if err := alice.sessionBuilder.ProcessBundle(newBundle(bob.user, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	if err := bob.sessionBuilder.ProcessBundle(newBundle(alice.user, 0)); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+
+	return &simultaneousConversation{alice: alice, bob: bob, serializer: serializer, t: t}
+}
+
+// peer returns the other side of the conversation.
+func (c *simultaneousConversation) peer(u *simultaneousUser) *simultaneousUser {
+	if u == c.alice {
+		return c.bob
+	}
+	return c.alice
+}
+
+// send encrypts the given number of messages from the given user.
+func (c *simultaneousConversation) send(from *simultaneousUser, count int) {
+	to := c.peer(from)
+	for i := 0; i < count; i++ {
+		to.inbox = append(to.inbox, encryptMessage(from.name, from.cipher, c.serializer, c.t))
+	}
+}
+
+// deliver decrypts the oldest message in the given user's inbox.
+func (c *simultaneousConversation) deliver(to *simultaneousUser) {
+	if len(to.inbox) == 0 {
+		return
+	}
+	message := to.inbox[0]
+	to.inbox = to.inbox[1:]
+
+	if preKeyMessage, ok := message.(*protocol.PreKeySignalMessage); ok {
+		if _, err := to.sessionBuilder.Process(preKeyMessage); err != nil {
+			c.t.Fatal("Unable to process prekey message: ", err)
+		}
+	}
+	if plaintext := decryptMessage(message, to.cipher, c.t); plaintext != c.peer(to).name {
+		c.t.Fatalf("Got %q, want %q", plaintext, c.peer(to).name)
+	}
+}
+
+// deliverAll decrypts every message in both inboxes.
+func (c *simultaneousConversation) deliverAll() {
+	for len(c.alice.inbox) > 0 || len(c.bob.inbox) > 0 {
+		c.deliver(c.alice)
+		c.deliver(c.bob)
+	}
+}
+
+// assertConverged checks that both users use the state with the lower base
+// key, and returns that base key.
+func (c *simultaneousConversation) assertConverged() []byte {
+	c.t.Helper()
+	aliceState := c.alice.sessionStore.LoadSession(c.alice.remote).SessionState()
+	bobState := c.bob.sessionStore.LoadSession(c.bob.remote).SessionState()
+	if !bytes.Equal(aliceState.SenderBaseKey(), bobState.SenderBaseKey()) {
+		c.t.Fatal("Alice and Bob use different sessions.")
+	}
+
+	// The other state must have a greater base key.
+	for _, state := range c.alice.sessionStore.LoadSession(c.alice.remote).PreviousSessionStates() {
+		if bytes.Compare(state.SenderBaseKey(), aliceState.SenderBaseKey()) < 0 {
+			c.t.Fatal("The session with the greater base key was kept.")
+		}
+	}
+
+	return aliceState.SenderBaseKey()
+}
@@ -0,0 +1,21 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/storetest"
+)
+
+// TestMemStoreConformance runs the store conformance suite against the
+// in-memory stores.
+func TestMemStoreConformance(t *testing.T) {
+	storetest.RunSignalProtocolStoreTests(t, func(identityKeyPair *identity.KeyPair, registrationID uint32,
+		serializer *serialize.Serializer) store.SignalProtocol {
+
+		return memstore.NewSignalProtocol(identityKeyPair, registrationID, serializer)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store/memstore"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/keyhelper"
 )
 
@@ -22,11 +23,12 @@ type user struct {
 	preKeys      []*record.PreKey
 	signedPreKey *record.SignedPreKey
 
-	sessionStore      *InMemorySession
-	preKeyStore       *InMemoryPreKey
-	signedPreKeyStore *InMemorySignedPreKey
-	identityStore     *InMemoryIdentityKey
-	senderKeyStore    *InMemorySenderKey
+	store             *memstore.SignalProtocol
+	sessionStore      *memstore.Session
+	preKeyStore       *memstore.PreKey
+	signedPreKeyStore *memstore.SignedPreKey
+	identityStore     *memstore.IdentityKey
+	senderKeyStore    *memstore.SenderKey
 
 	sessionBuilder *session.Builder
 	groupBuilder   *groups.SessionBuilder
@@ -66,11 +68,12 @@ func newUser(name string, deviceID uint32, serializer *serialize.Serializer) *us
 	signalUser.signedPreKey, _ = keyhelper.GenerateSignedPreKey(signalUser.identityKeyPair, 0, serializer.SignedPreKeyRecord)
 
 	// Create all our record stores using an in-memory implementation.
-	signalUser.sessionStore = NewInMemorySession(serializer)
-	signalUser.preKeyStore = NewInMemoryPreKey()
-	signalUser.signedPreKeyStore = NewInMemorySignedPreKey()
-	signalUser.identityStore = NewInMemoryIdentityKey(signalUser.identityKeyPair, signalUser.registrationID)
-	signalUser.senderKeyStore = NewInMemorySenderKey()
+	signalUser.store = memstore.NewSignalProtocol(signalUser.identityKeyPair, signalUser.registrationID, serializer)
+	signalUser.sessionStore = signalUser.store.Session
+	signalUser.preKeyStore = signalUser.store.PreKey
+	signalUser.signedPreKeyStore = signalUser.store.SignedPreKey
+	signalUser.identityStore = signalUser.store.IdentityKey
+	signalUser.senderKeyStore = signalUser.store.SenderKey
 
 	// Put all our pre keys in our local stores.
 	for i := range signalUser.preKeys {
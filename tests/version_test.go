@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/root"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/protocol"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/serialize"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/session"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/version"
+)
+
+// TestVersionNegotiate checks the version selection rules.
+func TestVersionNegotiate(t *testing.T) {
+	tests := []struct {
+		ours, theirs []int
+		want         int
+		err          error
+	}{
+		{[]int{3, 4}, []int{3, 4}, 4, nil},
+		{[]int{3, 4}, []int{3}, 3, nil},
+		{[]int{3}, []int{4, 3}, 3, nil},
+		{[]int{3, 4}, nil, version.Default, nil},
+		{[]int{4}, nil, 0, version.ErrNoCommonVersion},
+		{[]int{3, 4}, []int{5}, 0, version.ErrNoCommonVersion},
+	}
+	for _, test := range tests {
+		got, err := version.Negotiate(test.ours, test.theirs)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Negotiate(%v, %v): got error %v, want %v", test.ours, test.theirs, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Negotiate(%v, %v): got version %d, want %d", test.ours, test.theirs, got, test.want)
+		}
+	}
+}
+
+// TestRootKeyRatchetStep checks that every version mixes the ratchet's
+// Diffie-Hellman output into the next root and chain keys.
+func TestRootKeyRatchetStep(t *testing.T) {
+	rootKeyBytes := make([]byte, 32)
+	if _, err := rand.Read(rootKeyBytes); err != nil {
+		t.Fatal("Unable to generate root key: ", err)
+	}
+	rootKey := root.NewKey(kdf.DeriveSecrets, rootKeyBytes)
+	theirs, _ := ecc.GenerateKeyPair()
+	first, _ := ecc.GenerateKeyPair()
+	second, _ := ecc.GenerateKeyPair()
+
+	for _, params := range []*version.Parameters{version.V2, version.V3, version.V4} {
+		a, err := rootKey.CreateChainWithParameters(theirs.PublicKey(), first, params)
+		if err != nil {
+			t.Fatal("Unable to create chain: ", err)
+		}
+		b, err := rootKey.CreateChainWithParameters(theirs.PublicKey(), second, params)
+		if err != nil {
+			t.Fatal("Unable to create chain: ", err)
+		}
+		if bytes.Equal(a.RootKey.Bytes(), b.RootKey.Bytes()) {
+			t.Errorf("Version %d: different ratchet keys gave the same root key", params.Version)
+		}
+		if bytes.Equal(a.ChainKey.Key(), b.ChainKey.Key()) {
+			t.Errorf("Version %d: different ratchet keys gave the same chain key", params.Version)
+		}
+
+		// The remote side derives the same keys from its half of the exchange.
+		remote, err := rootKey.CreateChainWithParameters(first.PublicKey(), theirs, params)
+		if err != nil {
+			t.Fatal("Unable to create chain: ", err)
+		}
+		if !bytes.Equal(a.RootKey.Bytes(), remote.RootKey.Bytes()) || !bytes.Equal(a.ChainKey.Key(), remote.ChainKey.Key()) {
+			t.Errorf("Version %d: the two sides of a ratchet step derived different keys", params.Version)
+		}
+	}
+}
+
+// TestSessionVersionNegotiation checks that a session uses the highest
+// version both sides advertise, and falls back to the default version for
+// bundles that do not advertise any.
+func TestSessionVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name      string
+		versions  []int
+		want      int
+		bobLimits []int
+	}{
+		{"latest", version.Supported(), version.Latest, nil},
+		{"unadvertised", nil, version.Default, nil},
+		{"v3 only", []int{3}, 3, []int{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serializer := newSerializer()
+			alice := newUser("Alice", 1, serializer)
+			bob := newUser("Bob", 2, serializer)
+			alice.buildSession(bob.address, serializer)
+			bob.buildSession(alice.address, serializer)
+			if test.bobLimits != nil {
+				bob.sessionBuilder.SetSupportedVersions(test.bobLimits...)
+			}
+
+			bundle := newBundle(bob, 0)
+			bundle.SetSupportedVersions(test.versions)
+			if err := alice.sessionBuilder.ProcessBundle(bundle); err != nil {
+				t.Fatal("Unable to process bundle: ", err)
+			}
+			assertSessionVersion(alice.sessionStore.LoadSession(bob.address).SessionState().Version(), test.want, t)
+
+			runVersionedConversation(alice, bob, serializer, t)
+			assertSessionVersion(bob.sessionStore.LoadSession(alice.address).SessionState().Version(), test.want, t)
+		})
+	}
+}
+
+// TestUnsupportedVersionRejected checks that a receiver limited to older
+// versions rejects messages of a newer version.
+func TestUnsupportedVersionRejected(t *testing.T) {
+	serializer := newSerializer()
+	alice := newUser("Alice", 1, serializer)
+	bob := newUser("Bob", 2, serializer)
+	alice.buildSession(bob.address, serializer)
+	bob.buildSession(alice.address, serializer)
+	bob.sessionBuilder.SetSupportedVersions(version.Default)
+
+	// Alice negotiates against a bundle that advertises more than Bob
+	// actually accepts.
+	bundle := newBundle(bob, 0)
+	bundle.SetSupportedVersions([]int{version.Default, version.Latest})
+	if err := alice.sessionBuilder.ProcessBundle(bundle); err != nil {
+		t.Fatal("Unable to process bundle: ", err)
+	}
+	message, err := session.NewCipher(alice.sessionBuilder, bob.address).Encrypt([]byte("Hello"))
+	if err != nil {
+		t.Fatal("Unable to encrypt message: ", err)
+	}
+	if _, err := bob.sessionBuilder.Process(message.(*protocol.PreKeySignalMessage)); err == nil {
+		t.Error("A message with an unsupported version should be rejected.")
+	}
+
+	// A sender with no version in common with the bundle must fail.
+	carol := newUser("Carol", 3, serializer)
+	carol.buildSession(bob.address, serializer)
+	carol.sessionBuilder.SetSupportedVersions(version.Latest)
+	bundle = newBundle(bob, 1)
+	bundle.SetSupportedVersions([]int{version.Default})
+	if err := carol.sessionBuilder.ProcessBundle(bundle); !errors.Is(err, version.ErrNoCommonVersion) {
+		t.Error("Expected no common version error, got: ", err)
+	}
+}
+
+// runVersionedConversation exchanges several rounds of messages between
+// Alice and Bob so both sides step through the DH ratchet.
+func runVersionedConversation(alice, bob *user, serializer *serialize.Serializer, t *testing.T) {
+	aliceCipher := session.NewCipher(alice.sessionBuilder, bob.address)
+	bobCipher := session.NewCipher(bob.sessionBuilder, alice.address)
+
+	for i := 0; i < 3; i++ {
+		messageStrings, messages := sendMessages(3, aliceCipher, serializer, t)
+		if i == 0 {
+			if _, err := bob.sessionBuilder.Process(messages[0].(*protocol.PreKeySignalMessage)); err != nil {
+				t.Fatal("Unable to process prekey message: ", err)
+			}
+		}
+		receiveMessages(messages, messageStrings, bobCipher, t)
+
+		messageStrings, messages = sendMessages(3, bobCipher, serializer, t)
+		receiveMessages(messages, messageStrings, aliceCipher, t)
+	}
+}
+
+// assertSessionVersion fails the test if the session version is not the
+// expected one.
+func assertSessionVersion(got, want int, t *testing.T) {
+	if got != want {
+		t.Fatalf("Session version is %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package errorhelper
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Sentinel errors describing why a serialized structure was rejected. Decode
+// failures wrap one of these in a DecodeError, so callers can check the
+// cause with errors.Is.
+var (
+	ErrMissingField    = errors.New("Missing required field.")
+	ErrInvalidLength   = errors.New("Invalid field length.")
+	ErrInvalidKeyType  = errors.New("Invalid key type.")
+	ErrLegacyVersion   = errors.New("Legacy message version.")
+	ErrUnknownVersion  = errors.New("Unknown message version.")
+	ErrInvalidCounter  = errors.New("Invalid counter.")
+	ErrUnexpectedField = errors.New("Unexpected field.")
+)
+
+// NewDecodeError returns a new DecodeError for the given structure type and
+// field, wrapping the given cause.
+func NewDecodeError(structType, field string, err error) *DecodeError {
+	return &DecodeError{
+		Type:  structType,
+		Field: field,
+		Err:   err,
+	}
+}
+
+// DecodeError is returned when a FromBytes or FromStruct constructor
+// rejects its input. Type and Field name the offending structure and field.
+type DecodeError struct {
+	Type  string
+	Field string
+	Err   error
+}
+
+// Error returns a description of the rejected field.
+func (e *DecodeError) Error() string {
+	return e.Type + "." + e.Field + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause of the decode error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// WithDetail returns an error that adds the given detail to err's message
+// while still matching err with errors.Is.
+func WithDetail(err error, detail string) error {
+	return &detailError{detail: detail, err: err}
+}
+
+// CheckLength returns a DecodeError if the given bytes are not exactly the
+// given length.
+func CheckLength(structType, field string, bytes []byte, length int) error {
+	if bytes == nil {
+		return NewDecodeError(structType, field, ErrMissingField)
+	}
+	if len(bytes) != length {
+		detail := "got " + strconv.Itoa(len(bytes)) + " bytes, want " + strconv.Itoa(length)
+		return NewDecodeError(structType, field, WithDetail(ErrInvalidLength, detail))
+	}
+	return nil
+}
+
+// CheckMaxCount returns a DecodeError if count is larger than max.
+func CheckMaxCount(structType, field string, count, max int) error {
+	if count > max {
+		detail := strconv.Itoa(count) + " entries, at most " + strconv.Itoa(max) + " allowed"
+		return NewDecodeError(structType, field, WithDetail(ErrInvalidCounter, detail))
+	}
+	return nil
+}
+
+// detailError is a sentinel error with extra detail attached.
+type detailError struct {
+	detail string
+	err    error
+}
+
+func (d *detailError) Error() string {
+	return d.err.Error() + " (" + d.detail + ")"
+}
+
+func (d *detailError) Unwrap() error {
+	return d.err
+}
@@ -38,3 +38,9 @@ func (m *MultiError) Error() string {
 
 	return m.errors[0].Error()
 }
+
+// Unwrap returns all of the errors that have been added, so errors.Is
+// and errors.As can match any of them.
+func (m *MultiError) Unwrap() []error {
+	return m.errors
+}
@@ -3,11 +3,17 @@ package keyhelper
 
 import (
 	"crypto/rand"
-	"encoding/binary"
+	"errors"
 	"github.com/RadicalApp/complete"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/ecc"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/keys/identity"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/observer"
 	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/record"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/state/store"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/medium"
+	"math"
+	"math/big"
+	"strconv"
 	"time"
 )
 
@@ -19,6 +25,7 @@ func GenerateIdentityKeyPair() (*identity.KeyPair, error) {
 		return nil, err
 	}
 
+	observer.Get().KeysGenerated(observer.KeyIdentity, 1)
 	publicKey := identity.NewKey(keyPair.PublicKey())
 	return identity.NewKeyPair(publicKey, keyPair.PrivateKey()), nil
 }
@@ -40,34 +47,68 @@ func GenerateIdentityKeyPairAsync(completion complete.Completionable) {
 // install time, and subsequently any time the list of PreKeys stored on
 // the server runs low.
 //
-// PreKeys IDs are shorts, so they will eventually be repeated. Clients
-// should store PreKeys in a circular buffer, so that they are repeated
-// as infrequently as possible.
+// PreKey IDs are between 1 and medium.MaxValue - 1, as medium.MaxValue is
+// reserved for the last resort key. The keys get the IDs start, start+1, and
+// so on, wrapped into that range: the ID after medium.MaxValue - 1 is 1, and
+// a start of 0 is the ID before 1, medium.MaxValue - 1. IDs will eventually be
+// repeated, so clients should store PreKeys in a circular buffer, so that
+// they are repeated as infrequently as possible.
 func GeneratePreKeys(start int, count int, serializer record.PreKeySerializer) ([]*record.PreKey, error) {
 	var preKeys []*record.PreKey
 
-	start--
-
 	for i := 0; i < count; i++ {
 		key, err := ecc.GenerateKeyPair()
 		if err != nil {
 			return nil, err
 		}
-		preKeys = append(preKeys, record.NewPreKey(uint32(i), key, serializer))
+		preKeys = append(preKeys, record.NewPreKey(preKeyID(start+i), key, serializer))
 	}
+	observer.Get().KeysGenerated(observer.KeyPreKey, count)
 
 	return preKeys, nil
 }
 
+// preKeyID wraps the given ID into the range 1 to medium.MaxValue - 1.
+func preKeyID(id int) uint32 {
+	size := int(medium.MaxValue) - 1
+	return uint32(((id-1)%size+size)%size) + 1
+}
+
 // GenerateLastResortKey will generate the last resort PreKey. Clients should
 // do this only once, at install time, and durably store it for the length
-// of the install.
+// of the install. The key uses the reserved record.LastResortPreKeyID.
 func GenerateLastResortKey(serializer record.PreKeySerializer) (*record.PreKey, error) {
 	keyPair, err := ecc.GenerateKeyPair()
 	if err != nil {
 		return nil, err
 	}
-	return record.NewPreKey(0, keyPair, serializer), nil
+	observer.Get().KeysGenerated(observer.KeyLastResort, 1)
+	return record.NewLastResortPreKey(record.LastResortPreKeyID, keyPair, serializer), nil
+}
+
+// MigrateLastResortKey fixes a store holding a last resort prekey that was
+// generated under the given legacy ID, as older versions used ID 0. The legacy
+// record is flagged as last resort, so it keeps working for bundles that were
+// already published, and a copy is stored under record.LastResortPreKeyID to
+// publish from now on. The new last resort record is returned.
+func MigrateLastResortKey(preKeyStore store.PreKey, legacyID uint32,
+	serializer record.PreKeySerializer) (*record.PreKey, error) {
+
+	legacyKey := preKeyStore.LoadPreKey(legacyID)
+	if legacyKey == nil {
+		return nil, errors.New("No last resort prekey to migrate with ID " + strconv.FormatUint(uint64(legacyID), 10))
+	}
+
+	// Flag the legacy record so it is never removed.
+	if !legacyKey.IsLastResort() {
+		preKeyStore.StorePreKey(legacyID, record.NewLastResortPreKey(legacyID, legacyKey.KeyPair(), serializer))
+	}
+
+	// Store the same key under the reserved ID.
+	lastResortKey := record.NewLastResortPreKey(record.LastResortPreKeyID, legacyKey.KeyPair(), serializer)
+	preKeyStore.StorePreKey(record.LastResortPreKeyID, lastResortKey)
+
+	return lastResortKey, nil
 }
 
 // GenerateSignedPreKey generates a signed PreKey.
@@ -78,17 +119,44 @@ func GenerateSignedPreKey(identityKeyPair *identity.KeyPair, signedPreKeyID uint
 	}
 	signature := ecc.CalculateSignature(identityKeyPair.PrivateKey(), keyPair.PublicKey().Serialize())
 	timestamp := time.Now().Unix()
+	observer.Get().KeysGenerated(observer.KeySignedPreKey, 1)
 
 	return record.NewSignedPreKey(signedPreKeyID, timestamp, keyPair, signature, serializer), nil
 }
 
-// GenerateRegistrationID generates a registration ID. Clients should only do
-// this once, at install time.
+// MaxRegistrationID is the largest registration ID in the standard range.
+// Registration IDs are between 1 and MaxRegistrationID.
+const MaxRegistrationID uint32 = 16380
+
+// MaxExtendedRegistrationID is the largest registration ID in the extended
+// range, used by clients that need more than the standard 14-bit range.
+const MaxExtendedRegistrationID uint32 = math.MaxInt32 - 1
+
+// GenerateRegistrationID generates a registration ID between 1 and
+// MaxRegistrationID. Clients should only do this once, at install time.
 func GenerateRegistrationID() uint32 {
-	var n uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &n)
+	return randomUint32(MaxRegistrationID) + 1
+}
+
+// GenerateExtendedRegistrationID generates a registration ID between 1 and
+// MaxExtendedRegistrationID. Clients should only do this once, at install time.
+func GenerateExtendedRegistrationID() uint32 {
+	return randomUint32(MaxExtendedRegistrationID) + 1
+}
+
+// IsValidRegistrationID returns true if the given registration ID is within
+// the standard range, or within the extended range if extendedRange is set.
+func IsValidRegistrationID(registrationID uint32, extendedRange bool) bool {
+	if extendedRange {
+		return registrationID >= 1 && registrationID <= MaxExtendedRegistrationID
+	}
+	return registrationID >= 1 && registrationID <= MaxRegistrationID
+}
 
-	return n
+// randomUint32 returns a uniformly random number between 0 and max - 1.
+func randomUint32(max uint32) uint32 {
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	return uint32(n.Uint64())
 }
 
 //---------- Group Stuff ----------------
@@ -100,11 +168,12 @@ func GenerateSenderSigningKey() (*ecc.ECKeyPair, error) {
 func GenerateSenderKey() []byte {
 	randBytes := make([]byte, 32)
 	rand.Read(randBytes)
+	observer.Get().KeysGenerated(observer.KeySenderKey, 1)
 	return randBytes
 }
 
 func GenerateSenderKeyID() uint32 {
-	return GenerateRegistrationID()
+	return randomUint32(math.MaxInt32)
 }
 
 //---------- End Group Stuff --------------
@@ -0,0 +1,3 @@
+// Package version provides the parameter sets for each supported session
+// protocol version, and negotiation of a common version between two clients.
+package version
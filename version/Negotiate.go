@@ -0,0 +1,37 @@
+package version
+
+import "errors"
+
+// ErrNoCommonVersion is returned when two clients do not support any of
+// the same versions.
+var ErrNoCommonVersion = errors.New("No common protocol version.")
+
+// Negotiate returns the newest version that is in both ours and theirs and
+// that this library supports. If theirs is empty the remote client is
+// assumed to only support the Default version.
+func Negotiate(ours, theirs []int) (int, error) {
+	if len(theirs) == 0 {
+		theirs = []int{Default}
+	}
+
+	chosen := 0
+	for _, v := range ours {
+		if v > chosen && contains(theirs, v) && IsSupported(v) {
+			chosen = v
+		}
+	}
+	if chosen == 0 {
+		return 0, ErrNoCommonVersion
+	}
+	return chosen, nil
+}
+
+// contains returns true if the given version is in versions.
+func contains(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package version
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/cipher"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/kdf"
+	"github.com/kabuke/fix-forside-libsignal-protocol-go/util/errorhelper"
+)
+
+// Default is the version assumed for a remote client that does not
+// advertise the versions it supports.
+const Default = 3
+
+// Latest is the newest version this library supports.
+const Latest = 4
+
+// ErrUnsupportedVersion is returned when there is no parameter set for a
+// version.
+var ErrUnsupportedVersion = errors.New("Unsupported protocol version.")
+
+// Cipher encrypts and decrypts message bodies with a message key.
+type Cipher interface {
+	Encrypt(iv, key, plaintext []byte) ([]byte, error)
+	Decrypt(iv, key, ciphertext []byte) ([]byte, error)
+}
+
+// Parameters is the set of cryptographic parameters used by sessions of a
+// single protocol version. Parameter sets are shared and must not be modified.
+type Parameters struct {
+	// Version is the protocol version these parameters belong to.
+	Version int
+
+	// ReadOnly is true for legacy versions that may only be used to decrypt
+	// old messages. New sessions and messages are never created with them.
+	ReadOnly bool
+
+	// KDF is the HKDF variant used to derive root, chain and message keys.
+	KDF kdf.HKDF
+
+	// RootKdfInfo is the HKDF info used to derive root and chain keys.
+	RootKdfInfo []byte
+
+	// MessageKdfInfo is the HKDF info used to derive message keys from a
+	// chain key.
+	MessageKdfInfo []byte
+
+	// MacLength is the number of bytes of the HMAC-SHA256 that are sent
+	// with each message.
+	MacLength int
+
+	// MacIdentityKeys is true if the sender and receiver identity keys are
+	// included in the MAC.
+	MacIdentityKeys bool
+
+	// CounterIV is true if message bodies are encrypted with an IV built from
+	// the message counter instead of the IV derived with the message keys.
+	CounterIV bool
+
+	// Cipher encrypts and decrypts message bodies.
+	Cipher Cipher
+}
+
+// V2 is the read-only parameter set for legacy version 2 sessions. Version
+// 2 used an HKDF that counts from 0, left the identity keys out of the MAC
+// and encrypted message bodies with AES-CTR.
+var V2 = &Parameters{
+	Version:         2,
+	ReadOnly:        true,
+	KDF:             kdf.DeriveSecretsV2,
+	RootKdfInfo:     []byte("WhisperRatchet"),
+	MessageKdfInfo:  []byte("WhisperMessageKeys"),
+	MacLength:       8,
+	MacIdentityKeys: false,
+	CounterIV:       true,
+	Cipher:          aesCTR{},
+}
+
+// V3 is the parameter set for version 3 sessions.
+var V3 = &Parameters{
+	Version:         3,
+	KDF:             kdf.DeriveSecrets,
+	RootKdfInfo:     []byte("WhisperRatchet"),
+	MessageKdfInfo:  []byte("WhisperMessageKeys"),
+	MacLength:       8,
+	MacIdentityKeys: true,
+	Cipher:          aesCBC{},
+}
+
+// V4 is the parameter set for version 4 sessions. It uses its own KDF info
+// strings and a longer MAC.
+var V4 = &Parameters{
+	Version:         4,
+	KDF:             kdf.DeriveSecrets,
+	RootKdfInfo:     []byte("SignalRatchet_v4"),
+	MessageKdfInfo:  []byte("SignalMessageKeys_v4"),
+	MacLength:       16,
+	MacIdentityKeys: true,
+	Cipher:          aesCBC{},
+}
+
+// parameters holds every supported parameter set, oldest first.
+var parameters = []*Parameters{V3, V4}
+
+// Get returns the parameter set for the given version.
+func Get(version int) (*Parameters, error) {
+	for _, p := range parameters {
+		if p.Version == version {
+			return p, nil
+		}
+	}
+	return nil, errorhelper.WithDetail(ErrUnsupportedVersion, "version "+strconv.Itoa(version))
+}
+
+// legacyParameters holds the read-only parameter sets of legacy versions.
+var legacyParameters = []*Parameters{V2}
+
+// Lookup returns the parameter set for the given version, including the
+// read-only parameter sets of legacy versions. Callers must check ReadOnly
+// before using the result to create sessions or messages.
+func Lookup(version int) (*Parameters, error) {
+	for _, p := range legacyParameters {
+		if p.Version == version {
+			return p, nil
+		}
+	}
+	return Get(version)
+}
+
+// IsLegacy returns true if the given version is a legacy version that can
+// only be decrypted.
+func IsLegacy(version int) bool {
+	for _, p := range legacyParameters {
+		if p.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Supported returns every version this library supports, oldest first.
+func Supported() []int {
+	versions := make([]int, len(parameters))
+	for i, p := range parameters {
+		versions[i] = p.Version
+	}
+	return versions
+}
+
+// IsSupported returns true if there is a parameter set for the given version.
+func IsSupported(version int) bool {
+	_, err := Get(version)
+	return err == nil
+}
+
+// aesCBC encrypts message bodies with AES-256 in CBC mode with PKCS#7
+// padding.
+type aesCBC struct{}
+
+func (aesCBC) Encrypt(iv, key, plaintext []byte) ([]byte, error) {
+	return cipher.Encrypt(iv, key, plaintext)
+}
+
+func (aesCBC) Decrypt(iv, key, ciphertext []byte) ([]byte, error) {
+	return cipher.Decrypt(iv, key, ciphertext)
+}
+
+// aesCTR encrypts message bodies with AES-256 in counter mode.
+type aesCTR struct{}
+
+func (aesCTR) Encrypt(iv, key, plaintext []byte) ([]byte, error) {
+	return cipher.EncryptCTR(iv, key, plaintext)
+}
+
+func (aesCTR) Decrypt(iv, key, ciphertext []byte) ([]byte, error) {
+	return cipher.DecryptCTR(iv, key, ciphertext)
+}